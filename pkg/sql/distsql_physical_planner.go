@@ -605,6 +605,12 @@ func (dsp *distSQLPlanner) convertOrdering(
 		if col.Direction == encoding.Descending {
 			oc.Direction = distsqlrun.Ordering_Column_DESC
 		}
+		switch col.NullsOrder {
+		case sqlbase.NullsFirst:
+			oc.NullsOrder = distsqlrun.Ordering_Column_NULLS_FIRST
+		case sqlbase.NullsLast:
+			oc.NullsOrder = distsqlrun.Ordering_Column_NULLS_LAST
+		}
 		ordering.Columns = append(ordering.Columns, oc)
 	}
 	return ordering
@@ -232,6 +232,11 @@ type distSQLReceiver struct {
 	// Once set, no more rows are accepted.
 	err error
 
+	// partialResults is set if a sorter stopped reading its input because its
+	// time budget ran out, in which case the rows are only a best-effort result
+	// (see distsqlrun.SorterSpec.PartialResultsAfterNanos).
+	partialResults bool
+
 	row    parser.Datums
 	status distsqlrun.ConsumerStatus
 	alloc  sqlbase.DatumAlloc
@@ -318,6 +323,11 @@ func (r *distSQLReceiver) Push(
 				r.err = errors.Errorf("error ingesting remote spans: %s", err)
 			}
 		}
+		if meta.SorterPartialResult != nil {
+			log.Eventf(r.ctx, "partial results: a sorter stopped after %d input rows",
+				meta.SorterPartialResult.InputRows)
+			r.partialResults = true
+		}
 		return r.status
 	}
 	if r.err != nil {
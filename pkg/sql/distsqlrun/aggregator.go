@@ -77,6 +77,46 @@ func GetAggregateInfo(
 	)
 }
 
+// makeAggregateConstructors checks the aggregations of the spec against the
+// types of the input columns, and returns the constructor and the return type
+// of each of them.
+func makeAggregateConstructors(
+	spec *AggregatorSpec, inputTypes []sqlbase.ColumnType,
+) (
+	constructors []func(*parser.EvalContext) parser.AggregateFunc,
+	outputTypes []sqlbase.ColumnType,
+	err error,
+) {
+	constructors = make([]func(*parser.EvalContext) parser.AggregateFunc, len(spec.Aggregations))
+	outputTypes = make([]sqlbase.ColumnType, len(spec.Aggregations))
+	for i, aggInfo := range spec.Aggregations {
+		if aggInfo.FilterColIdx != nil {
+			col := *aggInfo.FilterColIdx
+			if col >= uint32(len(inputTypes)) {
+				return nil, nil, errors.Errorf("FilterColIdx out of range (%d)", col)
+			}
+			t := inputTypes[col].SemanticType
+			if t != sqlbase.ColumnType_BOOL && t != sqlbase.ColumnType_NULL {
+				return nil, nil, errors.Errorf(
+					"filter column %d must be of boolean type, not %s", *aggInfo.FilterColIdx, t,
+				)
+			}
+		}
+		argTypes := make([]sqlbase.ColumnType, len(aggInfo.ColIdx))
+		for j, c := range aggInfo.ColIdx {
+			if c >= uint32(len(inputTypes)) {
+				return nil, nil, errors.Errorf("ColIdx out of range (%d)", aggInfo.ColIdx)
+			}
+			argTypes[j] = inputTypes[c]
+		}
+		constructors[i], outputTypes[i], err = GetAggregateInfo(aggInfo.Func, argTypes...)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return constructors, outputTypes, nil
+}
+
 // aggregator is the processor core type that does "aggregation" in the SQL
 // sense. It groups rows and computes an aggregate for each group. The group is
 // configured using the group key and the aggregator can be configured with one
@@ -117,7 +157,6 @@ func newAggregator(
 		aggregations: spec.Aggregations,
 		buckets:      make(map[string]struct{}),
 		funcs:        make([]*aggregateFuncHolder, len(spec.Aggregations)),
-		outputTypes:  make([]sqlbase.ColumnType, len(spec.Aggregations)),
 		bucketsAcc:   flowCtx.evalCtx.Mon.MakeBoundAccount(),
 	}
 
@@ -126,39 +165,17 @@ func newAggregator(
 	// (which just returns the last value added to them for a bucket) to provide
 	// grouped-by values for each bucket.  ag.funcs is updated to contain all
 	// the functions which need to be fed values.
-	inputTypes := input.Types()
+	constructors, outputTypes, err := makeAggregateConstructors(spec, input.Types())
+	if err != nil {
+		return nil, err
+	}
 	for i, aggInfo := range spec.Aggregations {
-		if aggInfo.FilterColIdx != nil {
-			col := *aggInfo.FilterColIdx
-			if col >= uint32(len(inputTypes)) {
-				return nil, errors.Errorf("FilterColIdx out of range (%d)", col)
-			}
-			t := inputTypes[col].SemanticType
-			if t != sqlbase.ColumnType_BOOL && t != sqlbase.ColumnType_NULL {
-				return nil, errors.Errorf(
-					"filter column %d must be of boolean type, not %s", *aggInfo.FilterColIdx, t,
-				)
-			}
-		}
-		argTypes := make([]sqlbase.ColumnType, len(aggInfo.ColIdx))
-		for i, c := range aggInfo.ColIdx {
-			if c >= uint32(len(inputTypes)) {
-				return nil, errors.Errorf("ColIdx out of range (%d)", aggInfo.ColIdx)
-			}
-			argTypes[i] = inputTypes[c]
-		}
-		aggConstructor, retType, err := GetAggregateInfo(aggInfo.Func, argTypes...)
-		if err != nil {
-			return nil, err
-		}
-
-		ag.funcs[i] = ag.newAggregateFuncHolder(aggConstructor)
+		ag.funcs[i] = ag.newAggregateFuncHolder(constructors[i])
 		if aggInfo.Distinct {
 			ag.funcs[i].seen = make(map[string]struct{})
 		}
-
-		ag.outputTypes[i] = retType
 	}
+	ag.outputTypes = outputTypes
 	if err := ag.out.init(post, ag.outputTypes, &flowCtx.evalCtx, output); err != nil {
 		return nil, err
 	}
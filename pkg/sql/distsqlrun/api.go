@@ -29,5 +29,6 @@ func MakeEvalContext(evalCtx parser.EvalContext) EvalContext {
 		ClusterTimestamp:   evalCtx.GetClusterTimestampRaw(),
 		Location:           evalCtx.GetLocation().String(),
 		Database:           evalCtx.Database,
+		ReverseSortColumns: evalCtx.ReverseSortColumns,
 	}
 }
@@ -139,6 +139,16 @@ type RowSource interface {
 	ConsumerClosed()
 }
 
+// orderedRowSource is implemented by the RowSources that guarantee the
+// ordering of their rows, e.g. the orderedSynchronizer. Consumers that need
+// their input to be ordered can use it to avoid ordering the rows again.
+type orderedRowSource interface {
+	RowSource
+
+	// outputOrdering returns the ordering of the rows returned by Next.
+	outputOrdering() sqlbase.ColumnOrdering
+}
+
 // DrainAndForwardMetadata calls src.ConsumerDone() (thus asking src for
 // draining metadata) and then forwards all the metadata to dst.
 //
@@ -276,11 +286,22 @@ type ProducerMetadata struct {
 	Err error
 	// TraceData is sent if snowball tracing is enabled.
 	TraceData []tracing.RecordedSpan
+	// SorterStats are sent by the sorters of flows that ask for them (see
+	// FlowSpec.SendSorterStats).
+	SorterStats *RemoteProducerMetadata_SorterStats
+	// SorterProgress is sent periodically by the running sorters of flows that
+	// ask for it (see FlowSpec.SendSorterProgress).
+	SorterProgress *RemoteProducerMetadata_SorterProgress
+	// SorterPartialResult is sent by the sorters that stopped reading their
+	// input because their time budget ran out (see
+	// SorterSpec.PartialResultsAfterNanos).
+	SorterPartialResult *RemoteProducerMetadata_SorterPartialResult
 }
 
 // Empty returns true if none of the fields in metadata are populated.
 func (meta ProducerMetadata) Empty() bool {
-	return meta.Ranges == nil && meta.Err == nil && meta.TraceData == nil
+	return meta.Ranges == nil && meta.Err == nil && meta.TraceData == nil &&
+		meta.SorterStats == nil && meta.SorterProgress == nil && meta.SorterPartialResult == nil
 }
 
 // RowChannel is a thin layer over a RowChannelMsg channel, which can be used to
@@ -559,6 +580,25 @@ func (rb *RowBuffer) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) Consum
 	return status
 }
 
+// PushBatch is part of the batchRowReceiver interface. The rows are stored
+// while holding the lock once.
+func (rb *RowBuffer) PushBatch(rows sqlbase.EncDatumRows) ConsumerStatus {
+	if rb.ProducerClosed {
+		panic("PushBatch called after ProducerDone")
+	}
+	status := ConsumerStatus(atomic.LoadUint32((*uint32)(&rb.ConsumerStatus)))
+	if status != NeedMoreRows && !rb.args.AccumulateRowsWhileDraining {
+		return status
+	}
+	rb.mu.Lock()
+	for _, row := range rows {
+		rowCopy := append(sqlbase.EncDatumRow(nil), row...)
+		rb.mu.records = append(rb.mu.records, BufferedRecord{Row: rowCopy})
+	}
+	rb.mu.Unlock()
+	return status
+}
+
 // ProducerDone is part of the interface.
 func (rb *RowBuffer) ProducerDone() {
 	if rb.ProducerClosed {
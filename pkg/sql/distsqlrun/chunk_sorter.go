@@ -0,0 +1,253 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+// chunkInput is the input of a chunkSorter. nextRow returns nil once the input
+// is exhausted.
+type chunkInput interface {
+	nextRow(ctx context.Context) (sqlbase.EncDatumRow, error)
+}
+
+var _ chunkInput = &sorter{}
+var _ chunkInput = &rowSourceChunkInput{}
+
+// rowSourceChunkInput is the chunkInput of a RowSource, whose metadata is
+// forwarded to a RowReceiver (see NoMetadataRowSource). No more rows are read
+// once the context is canceled.
+type rowSourceChunkInput struct {
+	src NoMetadataRowSource
+}
+
+func makeRowSourceChunkInput(src RowSource, metadataSink RowReceiver) rowSourceChunkInput {
+	return rowSourceChunkInput{src: MakeNoMetadataRowSource(src, metadataSink)}
+}
+
+func (in *rowSourceChunkInput) nextRow(ctx context.Context) (sqlbase.EncDatumRow, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	return in.src.NextRow()
+}
+
+// chunkFunc is called by a chunkSorter with each sorted chunk. It consumes
+// (pops) all the rows of the chunk, unless it returns an error or a
+// ConsumerStatus other than NeedMoreRows, in which case the chunkSorter stops.
+type chunkFunc func(ctx context.Context, chunk *memRowContainer) (ConsumerStatus, error)
+
+// chunkSorter sorts the rows of an input that is already ordered on a prefix
+// of an ordering, of length matchLen: the rows are accumulated in chunks of
+// rows that share the values of the prefix, and each chunk is sorted and handed
+// to a chunkFunc as soon as it is complete, which is known once the first row
+// of the next chunk is read. No more input is read before the chunkFunc
+// returns. Rows can't be output before their chunk is complete, since any of
+// its remaining rows could sort before them. An error is returned if the input
+// turns out not to be ordered on the prefix.
+//
+// If k is specified (i.e. only the first k rows are needed), the chunkSorter
+// stops consuming the input as soon as k rows have been handed out.
+// Additionally, once a chunk accumulates more rows than are still needed, the
+// rows in the chunk are arranged in a max-heap that only keeps the smallest
+// ones (similar to the sortTopKStrategy). Note that even in this case the last
+// chunk needs to be fully read, as any of its remaining rows could sort before
+// the ones accumulated so far.
+//
+// Chunks are sorted with the rows' container, so they are sorted with
+// sort.Stable if the container is stable. When k is specified, the heap
+// doesn't preserve the input order of equal rows; the container's ordering
+// needs to break the ties then (see sorter.seqNums).
+//
+// If skip is specified, the first skip rows of the sorted output are
+// discarded instead of being handed out (k includes them). The chunks that
+// only hold such rows are discarded without being sorted: all their rows sort
+// before those of the following chunks, so they are the first rows of the
+// output whatever their order. The chunk in which the skipped rows end is
+// sorted, and only its rows after them are handed out.
+//
+// Chunks that take up less than minChunkSize bytes are not sorted right away;
+// the following chunks are accumulated with them until the threshold is
+// reached, and they are all sorted together. This is correct because all the
+// rows of a chunk sort before those of the following chunks, and it saves the
+// overhead of sorting (and handing out) many tiny chunks when the ordering
+// prefix changes often.
+//
+// If lowCardinality is set, the ordering columns after the prefix are expected
+// to have few distinct values, and each chunk is sorted by bucketing its rows
+// on them (see memRowContainer.sortBuckets), unless it turns out to have too
+// many. The buckets are stable, like sort.Stable.
+type chunkSorter struct {
+	// rows is the container in which the chunks are accumulated and sorted. Its
+	// ordering must start with ordering.
+	rows         *memRowContainer
+	ordering     sqlbase.ColumnOrdering
+	matchLen     uint32
+	k            int64
+	skip         int64
+	minChunkSize int64
+	// lowCardinality is set if the chunks are bucketed rather than sorted
+	// whenever possible.
+	lowCardinality bool
+	// checkMaxRows, if set, is called with the number of rows that a chunk will
+	// hold before every row is added to it, and the error it returns, if any,
+	// is returned by run.
+	checkMaxRows func(numRows int64) error
+
+	alloc sqlbase.DatumAlloc
+}
+
+// run reads the whole input (or until k rows have been handed out) and hands
+// each sorted chunk to fn.
+func (c *chunkSorter) run(ctx context.Context, input chunkInput, fn chunkFunc) error {
+	// pivoted is a helper function that determines if the given row shares the same values for the
+	// first c.matchLen ordering columns with the given pivot.
+	pivoted := func(row, pivot sqlbase.EncDatumRow) (bool, error) {
+		for _, ord := range c.ordering[:c.matchLen] {
+			cmp, err := row[ord.ColIdx].Compare(&c.alloc, c.rows.evalCtx, &pivot[ord.ColIdx])
+			if err != nil || cmp != 0 {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	nextRow, err := input.nextRow(ctx)
+	if err != nil || nextRow == nil {
+		return err
+	}
+
+	// emitted is the number of rows that were handed out (or skipped) so far.
+	// It is only used if c.k is specified.
+	emitted := int64(0)
+	for {
+		pivot := nextRow
+		heapCreated := false
+		// merged is set if the rows buffered are those of several chunks.
+		merged := false
+
+		// We will accumulate rows to form a chunk such that they all share the same values
+		// for the first c.matchLen ordering columns.
+		for {
+			if log.V(3) {
+				log.Infof(ctx, "pushing row %s", nextRow)
+			}
+			if c.k == 0 || int64(c.rows.Len()) < c.k-emitted {
+				if c.checkMaxRows != nil {
+					if err := c.checkMaxRows(int64(c.rows.Len()) + 1); err != nil {
+						return err
+					}
+				}
+				if err := c.rows.AddRow(ctx, nextRow); err != nil {
+					return err
+				}
+			} else {
+				// We already have as many rows as are still needed; only keep the
+				// smallest ones.
+				if !heapCreated {
+					c.rows.InitMaxHeap()
+					heapCreated = true
+				}
+				if err := c.rows.MaybeReplaceMax(ctx, nextRow); err != nil {
+					return err
+				}
+			}
+
+			nextRow, err = input.nextRow(ctx)
+			if err != nil {
+				return err
+			}
+			if nextRow == nil {
+				break
+			}
+
+			p, err := pivoted(nextRow, pivot)
+			if err != nil {
+				return err
+			}
+			if p {
+				continue
+			}
+
+			// We verify if the nextRow here is infact 'greater' than pivot.
+			if cmp, err := nextRow.Compare(&c.alloc, c.ordering, c.rows.evalCtx, pivot); err != nil {
+				return err
+			} else if cmp < 0 {
+				return errors.Errorf("incorrectly ordered row %s before %s", pivot, nextRow)
+			}
+			// Keep accumulating the next chunk if the rows buffered so far are
+			// too few to be worth sorting on their own. Once the heap is in use
+			// enough rows have been buffered, and none of the next chunk's rows
+			// can be among the smallest ones.
+			if !heapCreated && c.rows.MemUsage() < c.minChunkSize {
+				pivot = nextRow
+				merged = true
+				continue
+			}
+			break
+		}
+
+		numRows := int64(c.rows.Len())
+		if c.skip >= numRows {
+			// All the rows of the chunk are skipped; there is no need to sort
+			// them.
+			c.skip -= numRows
+		} else {
+			// Sort the rows that have been pushed onto the buffer, and hand out
+			// the ones after the skipped rows.
+			c.sortRows(ctx, merged)
+			for ; c.skip > 0; c.skip-- {
+				c.rows.PopFirst()
+			}
+			if consumerStatus, err := fn(ctx, c.rows); err != nil || consumerStatus != NeedMoreRows {
+				return err
+			}
+		}
+		emitted += numRows
+		c.rows.Clear(ctx)
+
+		if nextRow == nil {
+			// We've reached the end of the input.
+			break
+		}
+		if c.k != 0 && emitted >= c.k {
+			// We've handed out all the rows that were needed; there is no need
+			// to consume the rest of the input.
+			break
+		}
+	}
+
+	return nil
+}
+
+// sortRows sorts the buffered rows, which are those of several chunks if
+// merged is set. The rows of a single chunk are equal on the ordering prefix,
+// so their buckets are only told apart by the following columns.
+func (c *chunkSorter) sortRows(ctx context.Context, merged bool) {
+	start := int(c.matchLen)
+	if merged {
+		start = 0
+	}
+	if !c.lowCardinality || !c.rows.sortBuckets(ctx, start, maxSortBuckets) {
+		c.rows.Sort()
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// countingChunkInput is a chunkInput that counts the rows read from it.
+type countingChunkInput struct {
+	rowSourceChunkInput
+	numRows int
+}
+
+func (in *countingChunkInput) nextRow(ctx context.Context) (sqlbase.EncDatumRow, error) {
+	row, err := in.rowSourceChunkInput.nextRow(ctx)
+	if row != nil {
+		in.numRows++
+	}
+	return row, err
+}
+
+// TestChunkSorter verifies that a chunkSorter reading from a RowSource hands
+// out each chunk of rows sharing the ordering prefix once sorted, that it
+// stops reading the input once k rows have been handed out, and that it
+// discards the first rows of the output when asked to skip them.
+func TestChunkSorter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	// The rows are ordered on the first column, and each chunk of 4 rows is in
+	// the reverse order of the second column.
+	const numRows = 20
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/4))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(-i))),
+		}
+	}
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+
+	testCases := []struct {
+		name         string
+		k            int64
+		skip         int64
+		minChunkSize int64
+		// lowCardinality is set if the chunks are bucketed.
+		lowCardinality bool
+		// expChunks are the sizes of the chunks handed out.
+		expChunks []int
+		// expRead is the number of rows read from the input.
+		expRead int
+	}{
+		{name: "All", expChunks: []int{4, 4, 4, 4, 4}, expRead: numRows},
+		// The second chunk is read entirely, but only its smallest rows are
+		// kept.
+		{name: "K", k: 6, expChunks: []int{4, 2}, expRead: 9},
+		// The chunks are accumulated until they take up the minimum size.
+		{name: "MinChunkSize", minChunkSize: 1 << 30, expChunks: []int{20}, expRead: numRows},
+		// The chunks are bucketed on the second column, or on both columns
+		// once accumulated.
+		{name: "LowCardinality", lowCardinality: true, expChunks: []int{4, 4, 4, 4, 4}, expRead: numRows},
+		{
+			name: "LowCardinalityMinChunkSize", minChunkSize: 1 << 30, lowCardinality: true,
+			expChunks: []int{20}, expRead: numRows,
+		},
+		// The first chunk is skipped entirely, and the first rows of the second
+		// one.
+		{name: "Skip", skip: 6, expChunks: []int{2, 4, 4, 4}, expRead: numRows},
+		// The skipped rows count towards k.
+		{name: "SkipK", k: 10, skip: 4, expChunks: []int{4, 2}, expRead: 13},
+		{name: "SkipAll", skip: numRows, expRead: numRows},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &RowBuffer{}
+			in := countingChunkInput{
+				rowSourceChunkInput: makeRowSourceChunkInput(
+					NewRowBuffer(types, rows, RowBufferArgs{}), out,
+				),
+			}
+			sv := makeRowContainer(ordering, types, &evalCtx)
+			defer sv.Close(ctx)
+			c := chunkSorter{
+				rows: &sv, ordering: ordering, matchLen: 1, k: tc.k, skip: tc.skip,
+				minChunkSize: tc.minChunkSize, lowCardinality: tc.lowCardinality,
+			}
+
+			var chunks []int
+			var sorted sqlbase.EncDatumRows
+			if err := c.run(ctx, &in, func(
+				ctx context.Context, chunk *memRowContainer,
+			) (ConsumerStatus, error) {
+				chunks = append(chunks, chunk.Len())
+				for chunk.Len() > 0 {
+					sorted = append(sorted, append(sqlbase.EncDatumRow(nil), chunk.EncRow(0)...))
+					chunk.PopFirst()
+				}
+				return NeedMoreRows, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(chunks) != len(tc.expChunks) {
+				t.Fatalf("expected chunks of %v rows, got %v", tc.expChunks, chunks)
+			}
+			for i := range chunks {
+				if chunks[i] != tc.expChunks[i] {
+					t.Fatalf("expected chunks of %v rows, got %v", tc.expChunks, chunks)
+				}
+			}
+			if in.numRows != tc.expRead {
+				t.Fatalf("expected %d rows to be read, got %d", tc.expRead, in.numRows)
+			}
+			var expected sqlbase.EncDatumRows
+			for i := 0; i < numRows; i += 4 {
+				for j := i + 3; j >= i; j-- {
+					expected = append(expected, rows[j])
+				}
+			}
+			expected = expected[tc.skip:][:len(sorted)]
+			if expStr, retStr := expected.String(), sorted.String(); expStr != retStr {
+				t.Fatalf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+			}
+		})
+	}
+
+	// The chunks made only of skipped rows are not sorted: the comparisons are
+	// those of sorting the other chunks, which all take as many comparisons as
+	// they hold the same values in the same order.
+	t.Run("SkipUnsorted", func(t *testing.T) {
+		var chunkComparisons int64
+		one := makeRowContainer(ordering, types, &evalCtx)
+		defer one.Close(ctx)
+		one.comparisons = &chunkComparisons
+		for _, row := range rows[:4] {
+			if err := one.AddRow(ctx, row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		one.Sort()
+
+		var comparisons int64
+		in := makeRowSourceChunkInput(NewRowBuffer(types, rows, RowBufferArgs{}), &RowBuffer{})
+		sv := makeRowContainer(ordering, types, &evalCtx)
+		defer sv.Close(ctx)
+		sv.comparisons = &comparisons
+		c := chunkSorter{rows: &sv, ordering: ordering, matchLen: 1, skip: 8}
+		if err := c.run(ctx, &in, func(
+			ctx context.Context, chunk *memRowContainer,
+		) (ConsumerStatus, error) {
+			chunk.Clear(ctx)
+			return NeedMoreRows, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if exp := 3 * chunkComparisons; comparisons != exp {
+			t.Fatalf("expected %d comparisons (3 chunks sorted), got %d", exp, comparisons)
+		}
+	})
+
+	t.Run("Unordered", func(t *testing.T) {
+		unordered := sqlbase.EncDatumRows{rows[4], rows[0]}
+		in := makeRowSourceChunkInput(NewRowBuffer(types, unordered, RowBufferArgs{}), &RowBuffer{})
+		sv := makeRowContainer(ordering, types, &evalCtx)
+		defer sv.Close(ctx)
+		c := chunkSorter{rows: &sv, ordering: ordering, matchLen: 1}
+		err := c.run(ctx, &in, func(
+			ctx context.Context, chunk *memRowContainer,
+		) (ConsumerStatus, error) {
+			t.Fatalf("unexpected chunk of %d rows", chunk.Len())
+			return NeedMoreRows, nil
+		})
+		if !testutils.IsError(err, "incorrectly ordered row") {
+			t.Fatalf("expected an ordering error, got %v", err)
+		}
+	})
+}
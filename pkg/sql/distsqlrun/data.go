@@ -32,6 +32,12 @@ func convertToColumnOrdering(specOrdering Ordering) sqlbase.ColumnOrdering {
 		} else {
 			ordering[i].Direction = encoding.Descending
 		}
+		switch c.NullsOrder {
+		case Ordering_Column_NULLS_FIRST:
+			ordering[i].NullsOrder = sqlbase.NullsFirst
+		case Ordering_Column_NULLS_LAST:
+			ordering[i].NullsOrder = sqlbase.NullsLast
+		}
 	}
 	return ordering
 }
@@ -48,6 +54,19 @@ func convertToSpecOrdering(columnOrdering sqlbase.ColumnOrdering) Ordering {
 		} else {
 			specOrdering.Columns[i].Direction = Ordering_Column_DESC
 		}
+		specOrdering.Columns[i].NullsOrder = convertToSpecNullsOrder(c.NullsOrder)
 	}
 	return specOrdering
 }
+
+// convertToSpecNullsOrder converts a sqlbase.NullsOrder to an
+// Ordering_Column_NullsOrder (as defined in data.proto).
+func convertToSpecNullsOrder(nullsOrder sqlbase.NullsOrder) Ordering_Column_NullsOrder {
+	switch nullsOrder {
+	case sqlbase.NullsFirst:
+		return Ordering_Column_NULLS_FIRST
+	case sqlbase.NullsLast:
+		return Ordering_Column_NULLS_LAST
+	}
+	return Ordering_Column_NULLS_DEFAULT
+}
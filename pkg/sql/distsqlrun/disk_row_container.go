@@ -17,13 +17,20 @@
 package distsqlrun
 
 import (
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
 )
 
 // diskRowContainer is a sortableRowContainer that stores rows on disk according
@@ -53,6 +60,33 @@ type diskRowContainer struct {
 	// columns described by ordering will be encoded as keys. See
 	// makeDiskRowContainer() for more encoding specifics.
 	valueIdxs []int
+	// orderingValueIdxs holds, for each of the columns in ordering, its index
+	// in valueIdxs if the column is also encoded as a value, or -1 otherwise.
+	orderingValueIdxs []int
+	// valueEncodings holds the DatumEncoding of each of the columns at
+	// valueIdxs (see diskColumnEncoding).
+	valueEncodings []sqlbase.DatumEncoding
+	// encoder lays out the columns at valueIdxs in the values.
+	encoder diskRowEncoder
+	// compressValues is set if the encoded values are compressed with snappy
+	// before being written to disk. The keys can't be compressed since they
+	// determine the order of the rows.
+	compressValues bool
+	// scratchCompressed and scratchDecompressed are used to compress values in
+	// AddRow and decompress them in keyValToRow, respectively.
+	scratchCompressed   []byte
+	scratchDecompressed []byte
+	// scratchArrayKey is used to encode the keys of ARRAY ordering columns in
+	// AddRow (see encodeArrayKey).
+	scratchArrayKey []byte
+
+	// bytesWritten is the number of bytes of keys and values written to the
+	// diskMap.
+	bytesWritten int64
+	// metrics, if set, are updated with the bytes written to the diskMap.
+	metrics *DistSQLMetrics
+	// dumper, if set, dumps the rows for debugging (see sortDumpDir).
+	dumper *diskRowDumper
 
 	datumAlloc sqlbase.DatumAlloc
 }
@@ -69,21 +103,40 @@ var _ sortableRowContainer = &diskRowContainer{}
 // 	- rowContainer contains the initial set of rows that this diskRowContainer
 // 	  is created with.
 // 	- e is the underlying store that rows are stored on.
+// 	- compressValues specifies whether the values should be compressed, which
+// 	  trades CPU for disk bandwidth and space.
+// 	- rowEncoding is the layout of the columns in the values.
+// 	- columnEncoding selects the encoding of each of the columns in the
+// 	  values.
+// 	- batchSize is the number of bytes of rows buffered before they are
+// 	  written to the store, or zero for the store's default.
+// 	- metrics are updated with the bytes stored on disk, if not nil.
 func makeDiskRowContainer(
 	ctx context.Context,
 	types []sqlbase.ColumnType,
 	ordering sqlbase.ColumnOrdering,
 	rowContainer memRowContainer,
 	e engine.Engine,
+	compressValues bool,
+	rowEncoding diskRowEncoding,
+	columnEncoding diskColumnEncoding,
+	batchSize int,
+	metrics *DistSQLMetrics,
 ) (diskRowContainer, error) {
 	diskMap := engine.NewRocksDBMap(e)
 	d := diskRowContainer{
-		diskMap:       diskMap,
-		types:         types,
-		ordering:      ordering,
-		scratchEncRow: make(sqlbase.EncDatumRow, len(types)),
+		diskMap:        diskMap,
+		types:          types,
+		ordering:       ordering,
+		scratchEncRow:  make(sqlbase.EncDatumRow, len(types)),
+		compressValues: compressValues,
+		metrics:        metrics,
+	}
+	if batchSize > 0 {
+		d.bufferedRows = d.diskMap.NewBatchWriterCapacity(batchSize)
+	} else {
+		d.bufferedRows = d.diskMap.NewBatchWriter()
 	}
-	d.bufferedRows = d.diskMap.NewBatchWriter()
 
 	// The ordering is specified for a subset of the columns. These will be
 	// encoded as a key in the given order according to the given direction so
@@ -104,17 +157,41 @@ func makeDiskRowContainer(
 		// returns true may not necessarily need to be encoded in the value, so
 		// make this more fine-grained. See IsComposite() methods in
 		// pkg/sql/parser/datum.go.
-		if _, ok := orderingIdxs[i]; !ok || sqlbase.HasCompositeKeyEncoding(d.types[i].SemanticType) {
+		if _, ok := orderingIdxs[i]; !ok || decodedFromValue(d.types[i]) {
 			d.valueIdxs = append(d.valueIdxs, i)
 		}
 	}
 
 	d.encodings = make([]sqlbase.DatumEncoding, len(d.ordering))
+	d.orderingValueIdxs = make([]int, len(d.ordering))
 	for i, orderInfo := range ordering {
 		d.encodings[i] = sqlbase.EncodingDirToDatumEncoding(orderInfo.Direction)
+		d.orderingValueIdxs[i] = -1
+		for j, idx := range d.valueIdxs {
+			if idx == orderInfo.ColIdx {
+				d.orderingValueIdxs[i] = j
+				break
+			}
+		}
 	}
+	d.valueEncodings = makeColumnEncodings(columnEncoding, d.types, d.valueIdxs)
+	d.encoder = makeDiskRowEncoder(rowEncoding, d.types, d.valueIdxs, d.valueEncodings)
+	d.dumper = newDiskRowDumper(ctx, &d, rowEncoding)
+
+	// The rows written so far are removed if the container can't be returned,
+	// including if something panics while the rows are written: the caller
+	// can't close a container it doesn't have.
+	success := false
+	defer func() {
+		if !success {
+			d.Close(ctx)
+		}
+	}()
 
-	i := rowContainer.NewIterator(ctx)
+	i, err := rowContainer.NewIterator(ctx)
+	if err != nil {
+		return diskRowContainer{}, err
+	}
 	defer i.Close()
 
 	for i.Rewind(); ; i.Next() {
@@ -131,6 +208,7 @@ func makeDiskRowContainer(
 			return diskRowContainer{}, errors.Wrap(err, "could not add row")
 		}
 	}
+	success = true
 	return d, nil
 }
 
@@ -140,34 +218,246 @@ func (d *diskRowContainer) AddRow(ctx context.Context, row sqlbase.EncDatumRow)
 	}
 
 	for i, orderInfo := range d.ordering {
-		var err error
-		d.scratchKey, err = row[orderInfo.ColIdx].Encode(&d.datumAlloc, d.encodings[i], d.scratchKey)
-		if err != nil {
-			return err
+		if orderInfo.HasExplicitNullsOrder() {
+			// The key encoding of NULL sorts before any other value when
+			// ascending and after any other value when descending. Prefix the
+			// key with a marker to place NULLs as requested instead.
+			d.scratchKey = append(d.scratchKey, nullsOrderMarker(orderInfo, row[orderInfo.ColIdx].IsNull()))
 		}
-	}
-	for _, i := range d.valueIdxs {
 		var err error
-		d.scratchVal, err = row[i].Encode(&d.datumAlloc, sqlbase.DatumEncoding_VALUE, d.scratchVal)
+		if d.types[orderInfo.ColIdx].SemanticType == sqlbase.ColumnType_ARRAY {
+			d.scratchKey, err = d.encodeArrayKey(d.scratchKey, row[orderInfo.ColIdx], orderInfo.Direction)
+		} else {
+			d.scratchKey, err = row[orderInfo.ColIdx].Encode(&d.datumAlloc, d.encodings[i], d.scratchKey)
+		}
 		if err != nil {
 			return err
 		}
 	}
+	var err error
+	d.scratchVal, err = d.encoder.encodeValues(d.scratchVal, row, &d.datumAlloc)
+	if err != nil {
+		return err
+	}
+
+	val := d.scratchVal
+	if d.compressValues {
+		d.scratchCompressed = snappy.Encode(d.scratchCompressed[:cap(d.scratchCompressed)], val)
+		val = d.scratchCompressed
+	}
 
 	// Put a unique row to keep track of duplicates. Note that this will not
 	// mess with key decoding.
-	if err := d.bufferedRows.Put(
-		encoding.EncodeUvarintAscending(d.scratchKey, d.rowID),
-		d.scratchVal,
-	); err != nil {
+	key := encoding.EncodeUvarintAscending(d.scratchKey, d.rowID)
+	// Putting the same key again after a failed flush is harmless: the key is
+	// unique to this row.
+	if err := retryTempStorage(ctx, "write", func() error {
+		return d.bufferedRows.Put(key, val)
+	}); err != nil {
 		return err
 	}
+	if d.dumper != nil {
+		d.dumper.addRow(ctx, key, val)
+	}
+	written := int64(len(key) + len(val))
+	d.bytesWritten += written
+	if d.metrics != nil {
+		d.metrics.SortSpilledBytes.Inc(written)
+		d.metrics.SortDiskCurBytes.Inc(written)
+	}
 	d.scratchKey = d.scratchKey[:0]
 	d.scratchVal = d.scratchVal[:0]
 	d.rowID++
 	return nil
 }
 
+// tempStorageRetryOptions are the options used to retry writes to temporary
+// storage that fail with a transient error.
+var tempStorageRetryOptions = retry.Options{
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	MaxRetries:     5,
+}
+
+// transientTempStorageErrors are the messages of the RocksDB statuses that
+// indicate that an operation could succeed if it were retried. The engine only
+// exposes the statuses through their messages.
+var transientTempStorageErrors = []string{
+	"Resource busy",
+	"Operation timed out",
+	"Try again",
+}
+
+// isTransientTempStorageError returns whether err, returned by an operation on
+// temporary storage, could go away if the operation were retried.
+func isTransientTempStorageError(err error) bool {
+	msg := err.Error()
+	for _, s := range transientTempStorageErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// tempStorageFullErrors are the messages of the RocksDB statuses that indicate
+// that temporary storage ran out of space.
+var tempStorageFullErrors = []string{
+	"No space left on device",
+	"Disk quota exceeded",
+}
+
+// isTempStorageFullError returns whether err, returned by an operation on
+// temporary storage, indicates that temporary storage is full.
+func isTempStorageFullError(err error) bool {
+	msg := err.Error()
+	for _, s := range tempStorageFullErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// newTempStorageFullError returns the error returned when the given operation
+// on temporary storage failed with err because temporary storage is full. It
+// is a disk full error, which is preserved when the error is sent to the
+// gateway as metadata, so that clients can tell it apart from other storage
+// errors: retrying the query right away is unlikely to help.
+func newTempStorageFullError(op string, err error) error {
+	return pgerror.NewErrorf(pgerror.CodeDiskFullError,
+		"temporary storage exceeded its capacity: %s failed: %s", op, err)
+}
+
+// retryTempStorage runs fn, which performs the given operation on temporary
+// storage, and retries it with backoff for as long as it fails with transient
+// errors (see tempStorageRetryOptions). If the retries are exhausted, the
+// first error returned by fn is returned. Errors that are not transient are
+// returned right away, as a disk full error if temporary storage is full (see
+// newTempStorageFullError).
+//
+// Reads are not retried: an iterator that failed would have to be positioned
+// again on the row it was reading.
+func retryTempStorage(ctx context.Context, op string, fn func() error) error {
+	var firstErr error
+	for r := retry.StartWithCtx(ctx, tempStorageRetryOptions); r.Next(); {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !isTransientTempStorageError(err) {
+			if isTempStorageFullError(err) {
+				return newTempStorageFullError(op, err)
+			}
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if log.V(1) {
+			log.Infof(ctx, "temporary storage %s failed, retrying: %s", op, err)
+		}
+	}
+	return firstErr
+}
+
+// Markers used as a key prefix for ordering columns with an explicit NULL
+// ordering (see sqlbase.ColumnOrderInfo.HasExplicitNullsOrder).
+const (
+	nullsFirstMarker byte = iota
+	notNullMarker
+	nullsLastMarker
+)
+
+// nullsOrderMarker returns the key prefix of a value of the given ordering
+// column, which must have an explicit NULL ordering.
+func nullsOrderMarker(orderInfo sqlbase.ColumnOrderInfo, isNull bool) byte {
+	if !isNull {
+		return notNullMarker
+	}
+	if orderInfo.NullsOrder == sqlbase.NullsFirst {
+		return nullsFirstMarker
+	}
+	return nullsLastMarker
+}
+
+// decodedFromValue returns whether an ordering column of the given type is
+// also encoded in the value, to be decoded from there instead of from the key.
+// This is the case of the types with composite key encodings, whose keys lose
+// information, and of the arrays of such types.
+func decodedFromValue(typ sqlbase.ColumnType) bool {
+	if typ.SemanticType == sqlbase.ColumnType_ARRAY {
+		return sqlbase.HasCompositeKeyEncoding(*typ.ArrayContents)
+	}
+	return sqlbase.HasCompositeKeyEncoding(typ.SemanticType)
+}
+
+// encodeArrayKey appends the key of an ARRAY ordering column to buf. The key
+// encoding of an array (see sqlbase.EncodeTableKey) is the concatenation of
+// the keys of its elements, which is ordered like the arrays (element by
+// element, with NULL elements first, and a prefix of an array before the
+// array) on its own, but not once other keys follow it, since its end isn't
+// marked. It also can't be decoded. The key of the column is therefore that
+// encoding, in ascending order, wrapped in a bytes encoding in the direction of
+// the column: the bytes encoding is terminated and ordered like the byte
+// strings, in either direction.
+func (d *diskRowContainer) encodeArrayKey(
+	buf []byte, datum sqlbase.EncDatum, dir encoding.Direction,
+) ([]byte, error) {
+	if err := datum.EnsureDecoded(&d.datumAlloc); err != nil {
+		return nil, err
+	}
+	if datum.IsNull() {
+		if dir == encoding.Ascending {
+			return encoding.EncodeNullAscending(buf), nil
+		}
+		return encoding.EncodeNullDescending(buf), nil
+	}
+	var err error
+	d.scratchArrayKey, err = sqlbase.EncodeTableKey(d.scratchArrayKey[:0], datum.Datum, encoding.Ascending)
+	if err != nil {
+		return nil, err
+	}
+	if dir == encoding.Ascending {
+		return encoding.EncodeBytesAscending(buf, d.scratchArrayKey), nil
+	}
+	return encoding.EncodeBytesDescending(buf, d.scratchArrayKey), nil
+}
+
+// decodeArrayKey decodes the key of an ARRAY ordering column of the given type
+// encoded by encodeArrayKey, and returns the rest of the key.
+func (d *diskRowContainer) decodeArrayKey(
+	typ sqlbase.ColumnType, key []byte, dir encoding.Direction,
+) (parser.Datum, []byte, error) {
+	if key, isNull := encoding.DecodeIfNull(key); isNull {
+		return parser.DNull, key, nil
+	}
+	var elems []byte
+	var err error
+	if dir == encoding.Ascending {
+		key, elems, err = encoding.DecodeBytesAscending(key, nil)
+	} else {
+		key, elems, err = encoding.DecodeBytesDescending(key, nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	elemTyp := typ.ToDatumType().(parser.TArray).Typ
+	array := parser.NewDArray(elemTyp)
+	for len(elems) > 0 {
+		var elem parser.Datum
+		elem, elems, err = sqlbase.DecodeTableKey(&d.datumAlloc, elemTyp, elems, encoding.Ascending)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := array.Append(elem); err != nil {
+			return nil, nil, err
+		}
+	}
+	return array, key, nil
+}
+
 // Sort is a noop because the use of a SortedDiskMap as the underlying store
 // keeps the rows in sorted order.
 func (d *diskRowContainer) Sort() {}
@@ -177,37 +467,112 @@ func (d *diskRowContainer) Close(ctx context.Context) {
 	// in the following Close.
 	_ = d.bufferedRows.Close(ctx)
 	d.diskMap.Close(ctx)
+	if d.dumper != nil {
+		d.dumper.close(ctx)
+		d.dumper = nil
+	}
+	if d.metrics != nil {
+		d.metrics.SortDiskCurBytes.Dec(d.bytesWritten)
+	}
+	d.bytesWritten = 0
 }
 
 // keyValToRow decodes a key and a value byte slice stored with AddRow() into
 // a sqlbase.EncDatumRow. The returned EncDatumRow is only valid until the next
-// call to keyValToRow().
+// call to keyValToRow() or keyValToOrderingRow().
 func (d *diskRowContainer) keyValToRow(k []byte, v []byte) (sqlbase.EncDatumRow, error) {
+	if err := d.decodeKey(k); err != nil {
+		return nil, err
+	}
+	v, err := d.decompressValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.encoder.decodeValues(v, d.scratchEncRow); err != nil {
+		return nil, err
+	}
+	return d.scratchEncRow, nil
+}
+
+// keyValToOrderingRow is like keyValToRow but only decodes the ordering
+// columns, which is all that comparing rows requires. The other columns of the
+// returned EncDatumRow are left unset.
+func (d *diskRowContainer) keyValToOrderingRow(k []byte, v []byte) (sqlbase.EncDatumRow, error) {
+	for i := range d.scratchEncRow {
+		d.scratchEncRow[i] = sqlbase.EncDatum{}
+	}
+	if err := d.decodeKey(k); err != nil {
+		return nil, err
+	}
+	decompressed := false
+	for _, valueIdx := range d.orderingValueIdxs {
+		if valueIdx == -1 {
+			continue
+		}
+		if !decompressed {
+			var err error
+			if v, err = d.decompressValue(v); err != nil {
+				return nil, err
+			}
+			decompressed = true
+		}
+		if err := d.encoder.decodeValue(v, valueIdx, d.scratchEncRow); err != nil {
+			return nil, err
+		}
+	}
+	return d.scratchEncRow, nil
+}
+
+// decodeKey decodes the ordering columns of a key stored with AddRow() into
+// d.scratchEncRow, except for the columns that are decoded from the value (see
+// decodedFromValue).
+func (d *diskRowContainer) decodeKey(k []byte) error {
 	for i, orderInfo := range d.ordering {
-		// Types with composite key encodings are decoded from the value.
-		if sqlbase.HasCompositeKeyEncoding(d.types[orderInfo.ColIdx].SemanticType) {
+		if orderInfo.HasExplicitNullsOrder() {
+			// Skip over the NULL ordering marker.
+			k = k[1:]
+		}
+		typ := d.types[orderInfo.ColIdx]
+		if decodedFromValue(typ) {
 			// Skip over the encoded key.
 			encLen, err := encoding.PeekLength(k)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			k = k[encLen:]
 			continue
 		}
+		if typ.SemanticType == sqlbase.ColumnType_ARRAY {
+			datum, rest, err := d.decodeArrayKey(typ, k, orderInfo.Direction)
+			if err != nil {
+				return errors.Wrap(err, "unable to decode row")
+			}
+			d.scratchEncRow[orderInfo.ColIdx] = sqlbase.DatumToEncDatum(typ, datum)
+			k = rest
+			continue
+		}
 		var err error
 		d.scratchEncRow[orderInfo.ColIdx], k, err = sqlbase.EncDatumFromBuffer(d.types[orderInfo.ColIdx], d.encodings[i], k)
 		if err != nil {
-			return nil, errors.Wrap(err, "unable to decode row")
+			return errors.Wrap(err, "unable to decode row")
 		}
 	}
-	for _, i := range d.valueIdxs {
-		var err error
-		d.scratchEncRow[i], v, err = sqlbase.EncDatumFromBuffer(d.types[i], sqlbase.DatumEncoding_VALUE, v)
-		if err != nil {
-			return nil, errors.Wrap(err, "unable to decode row")
-		}
+	return nil
+}
+
+// decompressValue returns the given value stored with AddRow() decompressed,
+// if values are compressed. The returned slice is only valid until the next
+// call to decompressValue().
+func (d *diskRowContainer) decompressValue(v []byte) ([]byte, error) {
+	if !d.compressValues {
+		return v, nil
 	}
-	return d.scratchEncRow, nil
+	var err error
+	d.scratchDecompressed, err = snappy.Decode(d.scratchDecompressed[:cap(d.scratchDecompressed)], v)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decompress row")
+	}
+	return d.scratchDecompressed, nil
 }
 
 // diskRowIterator iterates over the rows in a diskRowContainer.
@@ -218,11 +583,17 @@ type diskRowIterator struct {
 
 var _ rowIterator = diskRowIterator{}
 
-func (d *diskRowContainer) NewIterator(ctx context.Context) rowIterator {
-	if err := d.bufferedRows.Flush(); err != nil {
-		log.Fatal(ctx, err)
+// NewIterator is part of the sortableRowContainer interface. The rows that are
+// still buffered are first written to temporary storage, which can fail like
+// AddRow does.
+func (d *diskRowContainer) NewIterator(ctx context.Context) (rowIterator, error) {
+	if err := retryTempStorage(ctx, "flush", d.bufferedRows.Flush); err != nil {
+		return nil, err
+	}
+	if d.dumper != nil {
+		d.dumper.dumpSorted(ctx, d.diskMap)
 	}
-	return diskRowIterator{rowContainer: d, SortedDiskMapIterator: d.diskMap.NewIterator()}
+	return diskRowIterator{rowContainer: d, SortedDiskMapIterator: d.diskMap.NewIterator()}, nil
 }
 
 // Row returns the current row. The returned sqlbase.EncDatumRow is only valid
@@ -236,3 +607,15 @@ func (r diskRowIterator) Row() (sqlbase.EncDatumRow, error) {
 
 	return r.rowContainer.keyValToRow(r.Key(), r.Value())
 }
+
+// orderingRow is like Row but only decodes the ordering columns of the current
+// row; see keyValToOrderingRow.
+func (r diskRowIterator) orderingRow() (sqlbase.EncDatumRow, error) {
+	if ok, err := r.Valid(); err != nil {
+		return nil, errors.Wrap(err, "unable to check row validity")
+	} else if !ok {
+		return nil, errors.New("invalid row")
+	}
+
+	return r.rowContainer.keyValToOrderingRow(r.Key(), r.Value())
+}
@@ -17,17 +17,25 @@
 package distsqlrun
 
 import (
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 )
 
@@ -41,19 +49,32 @@ func compareRows(
 	d *sqlbase.DatumAlloc,
 	ordering sqlbase.ColumnOrdering,
 ) (int, error) {
-	for _, orderInfo := range ordering {
-		cmp, err := l[orderInfo.ColIdx].Compare(d, e, &r[orderInfo.ColIdx])
-		if err != nil {
-			return 0, err
-		}
-		if cmp != 0 {
-			if orderInfo.Direction == encoding.Descending {
-				cmp = -cmp
-			}
-			return cmp, nil
-		}
+	return l.Compare(d, ordering, e, r)
+}
+
+// flakyBatchWriter is a SortedDiskMapBatchWriter whose Puts, or Flushes if
+// flush is set, fail with err the first failures times.
+type flakyBatchWriter struct {
+	engine.SortedDiskMapBatchWriter
+	err      error
+	failures int
+	flush    bool
+}
+
+func (w *flakyBatchWriter) Put(k []byte, v []byte) error {
+	if !w.flush && w.failures > 0 {
+		w.failures--
+		return w.err
+	}
+	return w.SortedDiskMapBatchWriter.Put(k, v)
+}
+
+func (w *flakyBatchWriter) Flush() error {
+	if w.flush && w.failures > 0 {
+		w.failures--
+		return w.err
 	}
-	return 0, nil
+	return w.SortedDiskMapBatchWriter.Flush()
 }
 
 func TestDiskRowContainer(t *testing.T) {
@@ -95,6 +116,18 @@ func TestDiskRowContainer(t *testing.T) {
 				Direction: encoding.Ascending,
 			},
 		},
+		{
+			sqlbase.ColumnOrderInfo{
+				ColIdx:     1,
+				Direction:  encoding.Ascending,
+				NullsOrder: sqlbase.NullsLast,
+			},
+			sqlbase.ColumnOrderInfo{
+				ColIdx:     0,
+				Direction:  encoding.Descending,
+				NullsOrder: sqlbase.NullsFirst,
+			},
+		},
 	}
 
 	rng := rand.New(rand.NewSource(int64(timeutil.Now().UnixNano())))
@@ -111,8 +144,14 @@ func TestDiskRowContainer(t *testing.T) {
 				}
 				row := sqlbase.EncDatumRow(sqlbase.RandEncDatumSliceOfTypes(rng, types))
 				func() {
+					// Alternate between compressed and uncompressed values, and
+					// between row and column encodings.
+					compress := i%2 == 0
+					rowEncoding := diskRowEncoding((i / 2) % 2)
+					columnEncoding := diskColumnEncoding((i / 4) % 3)
 					d, err := makeDiskRowContainer(
-						ctx, types, ordering, memRowContainer{}, tempEngine,
+						ctx, types, ordering, memRowContainer{}, tempEngine, compress, rowEncoding,
+						columnEncoding, 0 /* batchSize */, nil, /* metrics */
 					)
 					if err != nil {
 						t.Fatal(err)
@@ -122,7 +161,10 @@ func TestDiskRowContainer(t *testing.T) {
 						t.Fatal(err)
 					}
 
-					i := d.NewIterator(ctx)
+					i, err := d.NewIterator(ctx)
+					if err != nil {
+						t.Fatal(err)
+					}
 					defer i.Close()
 					i.Rewind()
 					if ok, err := i.Valid(); err != nil {
@@ -154,6 +196,29 @@ func TestDiskRowContainer(t *testing.T) {
 							t.Fatalf("encoded %s but decoded %s", row, readRow)
 						}
 					}
+
+					// Only the ordering columns are decoded by orderingRow.
+					orderingRow, err := i.(diskRowIterator).orderingRow()
+					if err != nil {
+						t.Fatal(err)
+					}
+					isOrderingCol := make([]bool, len(row))
+					for _, orderInfo := range ordering {
+						isOrderingCol[orderInfo.ColIdx] = true
+					}
+					for i := range row {
+						if !isOrderingCol[i] {
+							if !orderingRow[i].IsUnset() {
+								t.Fatalf("expected column %d to be unset, got %s", i, orderingRow[i])
+							}
+							continue
+						}
+						if cmp, err := orderingRow[i].Compare(&d.datumAlloc, &evalCtx, &row[i]); err != nil {
+							t.Fatal(err)
+						} else if cmp != 0 {
+							t.Fatalf("encoded %s but decoded ordering columns %s", row, orderingRow)
+						}
+					}
 				}()
 			}
 		}
@@ -161,7 +226,7 @@ func TestDiskRowContainer(t *testing.T) {
 
 	t.Run("SortedOrder", func(t *testing.T) {
 		numRows := 1024
-		for _, ordering := range orderings {
+		for orderingIdx, ordering := range orderings {
 			// numRows rows with numCols columns of the same random type.
 			rows := sqlbase.RandEncDatumRows(rng, numRows, numCols)
 			types := make([]sqlbase.ColumnType, len(rows[0]))
@@ -186,6 +251,11 @@ func TestDiskRowContainer(t *testing.T) {
 					ordering,
 					memoryContainer,
 					tempEngine,
+					orderingIdx%2 == 0,                 /* compressValues */
+					diskRowEncoding((orderingIdx/2)%2), /* rowEncoding */
+					diskColumnEncoding(orderingIdx%3),  /* columnEncoding */
+					0,                                  /* batchSize */
+					nil,                                /* metrics */
 				)
 				if err != nil {
 					t.Fatal(err)
@@ -208,7 +278,10 @@ func TestDiskRowContainer(t *testing.T) {
 				}
 				sortedRows.Sort()
 
-				i := d.NewIterator(ctx)
+				i, err := d.NewIterator(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
 				defer i.Close()
 
 				numKeysRead := 0
@@ -251,4 +324,508 @@ func TestDiskRowContainer(t *testing.T) {
 			}()
 		}
 	})
+
+	t.Run("Retries", func(t *testing.T) {
+		transientErr := errors.New("Resource busy: file is locked")
+		permanentErr := errors.New("IO error: Input/output error")
+		fullErr := errors.New("IO error: No space left on device")
+		testCases := []struct {
+			err      error
+			failures int
+			// flush is set if the flush of the rows by NewIterator fails, rather
+			// than the write of the row by AddRow.
+			flush       bool
+			expErr      error
+			expCode     string
+			expFailures int
+		}{
+			{err: transientErr, failures: 2, expErr: nil, expFailures: 0},
+			// The retries are exhausted and the original error is returned.
+			{err: transientErr, failures: 100, expErr: transientErr, expFailures: 100 - 6},
+			{err: permanentErr, failures: 3, expErr: permanentErr, expFailures: 2},
+			// Running out of space is not retried, and is reported as a disk
+			// full error.
+			{err: fullErr, failures: 3, expCode: pgerror.CodeDiskFullError, expFailures: 2},
+			{err: transientErr, failures: 2, flush: true, expErr: nil, expFailures: 0},
+			{err: transientErr, failures: 100, flush: true, expErr: transientErr, expFailures: 100 - 6},
+			{err: permanentErr, failures: 3, flush: true, expErr: permanentErr, expFailures: 2},
+			{err: fullErr, failures: 3, flush: true, expCode: pgerror.CodeDiskFullError, expFailures: 2},
+		}
+		types := []sqlbase.ColumnType{{SemanticType: sqlbase.ColumnType_INT}}
+		row := sqlbase.EncDatumRow{sqlbase.DatumToEncDatum(types[0], parser.NewDInt(1))}
+		for _, tc := range testCases {
+			t.Run(fmt.Sprintf("%s/%d/flush=%t", tc.err, tc.failures, tc.flush), func(t *testing.T) {
+				d, err := makeDiskRowContainer(
+					ctx, types, orderings[0], memRowContainer{}, tempEngine, false, /* compressValues */
+					diskRowEncodingRow, diskColumnEncodingValue, 0 /* batchSize */, nil, /* metrics */
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer d.Close(ctx)
+				w := &flakyBatchWriter{
+					SortedDiskMapBatchWriter: d.bufferedRows, err: tc.err, failures: tc.failures,
+					flush: tc.flush,
+				}
+				d.bufferedRows = w
+
+				var i rowIterator
+				if err = d.AddRow(ctx, row); err == nil {
+					i, err = d.NewIterator(ctx)
+				}
+				if tc.expCode != "" {
+					if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != tc.expCode {
+						t.Fatalf("expected error with code %s, got %v", tc.expCode, err)
+					}
+					// The code is preserved when the error is sent as metadata.
+					remoteErr := NewError(err).ErrorDetail()
+					if pgErr, ok := remoteErr.(*pgerror.Error); !ok || pgErr.Code != tc.expCode {
+						t.Fatalf("expected remote error with code %s, got %v", tc.expCode, remoteErr)
+					}
+				} else if err != tc.expErr {
+					t.Fatalf("expected error %v, got %v", tc.expErr, err)
+				}
+				if w.failures != tc.expFailures {
+					t.Fatalf("expected %d remaining failures, got %d", tc.expFailures, w.failures)
+				}
+				if err != nil {
+					return
+				}
+				defer i.Close()
+				i.Rewind()
+				if ok, err := i.Valid(); err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					t.Fatal("expected the row to have been written")
+				}
+			})
+		}
+	})
+
+	t.Run("Dump", func(t *testing.T) {
+		types := []sqlbase.ColumnType{
+			{SemanticType: sqlbase.ColumnType_INT}, {SemanticType: sqlbase.ColumnType_STRING},
+		}
+		ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Descending}}
+		var rows sqlbase.EncDatumRows
+		for i, n := range []int{2, 3, 1, 3} {
+			rows = append(rows, sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(types[0], parser.NewDInt(parser.DInt(n))),
+				sqlbase.DatumToEncDatum(types[1], parser.NewDString(fmt.Sprintf("r%d", i))),
+			})
+		}
+
+		// Nothing is dumped unless a directory is set.
+		d, err := makeDiskRowContainer(
+			ctx, types, ordering, memRowContainer{}, tempEngine, false, /* compressValues */
+			diskRowEncodingRow, diskColumnEncodingValue, 0 /* batchSize */, nil, /* metrics */
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.dumper != nil {
+			t.Fatal("expected no dumper without a dump directory")
+		}
+		d.Close(ctx)
+
+		dir, cleanup := testutils.TempDir(t)
+		defer cleanup()
+		defer func(old string) { sortDumpDir = old }(sortDumpDir)
+		sortDumpDir = dir
+
+		d, err = makeDiskRowContainer(
+			ctx, types, ordering, memRowContainer{}, tempEngine, true, /* compressValues */
+			diskRowEncodingColumnar, diskColumnEncodingValue, 0 /* batchSize */, nil, /* metrics */
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			if err := d.AddRow(ctx, row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var sorted []string
+		i, err := d.NewIterator(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i.Rewind(); ; i.Next() {
+			if ok, err := i.Valid(); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				break
+			}
+			row, err := i.Row()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sorted = append(sorted, row.String())
+		}
+		i.Close()
+		prefix := d.dumper.prefix
+		d.Close(ctx)
+
+		// readDump returns the decoded rows of a dump file after checking its
+		// header.
+		readDump := func(path string) []string {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+			const header = `# types: @1 INT @2 STRING
+# key columns: @1 DESC, followed by a unique uvarint
+# value columns: @2
+# value encoding: columnar, compressed: true`
+			if h := strings.Join(lines[:4], "\n"); h != header {
+				t.Fatalf("expected header:\n%s\ngot:\n%s", header, h)
+			}
+			var decoded []string
+			for _, line := range lines[4:] {
+				idx := strings.Index(line, " row=")
+				if !strings.HasPrefix(line, "key=") || idx == -1 {
+					t.Fatalf("unexpected line %q", line)
+				}
+				decoded = append(decoded, line[idx+len(" row="):])
+			}
+			return decoded
+		}
+		var added []string
+		for _, row := range rows {
+			added = append(added, row.String())
+		}
+		if spilled := readDump(prefix + "-spilled.txt"); !reflect.DeepEqual(spilled, added) {
+			t.Errorf("expected spilled rows %v, got %v", added, spilled)
+		}
+		if dumped := readDump(prefix + "-sorted-1.txt"); !reflect.DeepEqual(dumped, sorted) {
+			t.Errorf("expected sorted rows %v, got %v", sorted, dumped)
+		}
+	})
+
+	// The value columns are key-encoded as selected by the column encoding,
+	// and decoded back whatever their encodings.
+	t.Run("ColumnEncoding", func(t *testing.T) {
+		types := []sqlbase.ColumnType{
+			{SemanticType: sqlbase.ColumnType_INT},
+			{SemanticType: sqlbase.ColumnType_INT},
+			{SemanticType: sqlbase.ColumnType_STRING},
+			{SemanticType: sqlbase.ColumnType_DECIMAL},
+		}
+		ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Descending}}
+		row := sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(types[0], parser.NewDInt(7)),
+			sqlbase.DatumToEncDatum(types[1], parser.DNull),
+			sqlbase.DatumToEncDatum(types[2], parser.NewDString("a\x00b")),
+			sqlbase.DatumToEncDatum(types[3], &parser.DDecimal{}),
+		}
+		const v, k = sqlbase.DatumEncoding_VALUE, sqlbase.DatumEncoding_ASCENDING_KEY
+		for _, tc := range []struct {
+			enc diskColumnEncoding
+			// expected are the encodings of the value columns: the decimal can't
+			// be decoded from its key encoding, and the string is smaller when
+			// value-encoded.
+			expected []sqlbase.DatumEncoding
+		}{
+			{enc: diskColumnEncodingValue, expected: []sqlbase.DatumEncoding{v, v, v}},
+			{enc: diskColumnEncodingKey, expected: []sqlbase.DatumEncoding{k, k, v}},
+			{enc: diskColumnEncodingAuto, expected: []sqlbase.DatumEncoding{k, v, v}},
+		} {
+			t.Run(tc.enc.String(), func(t *testing.T) {
+				d, err := makeDiskRowContainer(
+					ctx, types, ordering, memRowContainer{}, tempEngine, false, /* compressValues */
+					diskRowEncodingRow, tc.enc, 0 /* batchSize */, nil, /* metrics */
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer d.Close(ctx)
+				if !reflect.DeepEqual(d.valueEncodings, tc.expected) {
+					t.Fatalf("expected encodings %v, got %v", tc.expected, d.valueEncodings)
+				}
+				if err := d.AddRow(ctx, row); err != nil {
+					t.Fatal(err)
+				}
+				i, err := d.NewIterator(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer i.Close()
+				i.Rewind()
+				if ok, err := i.Valid(); err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					t.Fatal("unexpectedly invalid")
+				}
+				readRow, err := i.Row()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected, actual := row.String(), readRow.String(); expected != actual {
+					t.Fatalf("encoded %s but decoded %s", expected, actual)
+				}
+			})
+		}
+	})
+
+	t.Run("BatchSize", func(t *testing.T) {
+		types := []sqlbase.ColumnType{
+			{SemanticType: sqlbase.ColumnType_INT}, {SemanticType: sqlbase.ColumnType_STRING},
+		}
+		ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+		// About 11 KiB of rows.
+		numRows := 100
+		value := parser.NewDString(strings.Repeat("a", 100))
+		for _, tc := range []struct {
+			batchSize int
+			// expFlushed is set if some rows are expected to be written to the
+			// store before the container is iterated over.
+			expFlushed bool
+		}{
+			{batchSize: minTempStorageWriteBatchSize, expFlushed: true},
+			{batchSize: 64 << 10, expFlushed: false},
+		} {
+			t.Run(fmt.Sprint(tc.batchSize), func(t *testing.T) {
+				d, err := makeDiskRowContainer(
+					ctx, types, ordering, memRowContainer{}, tempEngine, false, /* compressValues */
+					diskRowEncodingRow, diskColumnEncodingValue, tc.batchSize, nil, /* metrics */
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer d.Close(ctx)
+				for i := 0; i < numRows; i++ {
+					row := sqlbase.EncDatumRow{
+						sqlbase.DatumToEncDatum(types[0], parser.NewDInt(parser.DInt(i))),
+						sqlbase.DatumToEncDatum(types[1], value),
+					}
+					if err := d.AddRow(ctx, row); err != nil {
+						t.Fatal(err)
+					}
+				}
+				// Iterate over the store directly, without flushing the buffered
+				// rows.
+				numFlushed := 0
+				i := d.diskMap.NewIterator()
+				for i.Rewind(); ; i.Next() {
+					if ok, err := i.Valid(); err != nil {
+						t.Fatal(err)
+					} else if !ok {
+						break
+					}
+					numFlushed++
+				}
+				i.Close()
+				if flushed := numFlushed > 0; flushed != tc.expFlushed {
+					t.Fatalf(
+						"expected rows written before iterating: %t, got %d rows", tc.expFlushed, numFlushed,
+					)
+				}
+				if numFlushed == numRows {
+					t.Fatalf("expected some rows to still be buffered")
+				}
+			})
+		}
+
+		if err := distSQLTempStorageWriteBatchSize.Validate(1 << 10); !testutils.IsError(
+			err, "write batch size must be at least 4.0 KiB",
+		) {
+			t.Fatalf("expected the batch size to be rejected, got %v", err)
+		}
+		if err := distSQLTempStorageWriteBatchSize.Validate(8 << 20); !testutils.IsError(
+			err, "write batch size must be at most 4.0 MiB",
+		) {
+			t.Fatalf("expected the batch size to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		metrics := MakeDistSQLMetrics(metric.TestSampleInterval)
+		rows := sqlbase.RandEncDatumRows(rng, 100 /* numRows */, numCols)
+		types := make([]sqlbase.ColumnType, len(rows[0]))
+		for i := range types {
+			types[i] = rows[0][i].Type
+		}
+		d, err := makeDiskRowContainer(
+			ctx, types, orderings[0], memRowContainer{}, tempEngine, false, /* compressValues */
+			diskRowEncodingRow, diskColumnEncodingValue, 0 /* batchSize */, &metrics,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			if err := d.AddRow(ctx, row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		written := metrics.SortSpilledBytes.Count()
+		if written == 0 || written != d.bytesWritten {
+			t.Fatalf("expected %d spilled bytes, got %d", d.bytesWritten, written)
+		}
+		if cur := metrics.SortDiskCurBytes.Value(); cur != written {
+			t.Fatalf("expected %d bytes on disk, got %d", written, cur)
+		}
+		d.Close(ctx)
+		if cur := metrics.SortDiskCurBytes.Value(); cur != 0 {
+			t.Fatalf("expected no bytes on disk after Close, got %d", cur)
+		}
+		if n := metrics.SortSpilledBytes.Count(); n != written {
+			t.Fatalf("expected the spilled bytes to remain %d after Close, got %d", written, n)
+		}
+	})
+}
+
+// BenchmarkDiskRowContainer measures the cost of writing rows to a
+// diskRowContainer and reading them back in sorted order, with and without
+// compressing the values, and with each of the row encodings. Compression costs CPU time when rows are added and
+// read back in exchange for fewer bytes written to the temporary store, so it
+// is only worth it when disk bandwidth is the bottleneck and the values
+// compress well (like the repetitive strings used here). The temporary engine
+// used by this benchmark is unlikely to be IO bound, so it mostly measures
+// the CPU overhead of compression.
+func BenchmarkDiskRowContainer(b *testing.B) {
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	// Two column rows, sorted on an integer column, with a string value.
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeString}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+	rng := rand.New(rand.NewSource(int64(timeutil.Now().UnixNano())))
+
+	const numRows = 1 << 12
+	const valueLen = 256
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		value := make([]byte, valueLen)
+		for j := range value {
+			value[j] = 'a' + byte(rng.Intn(4))
+		}
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Int()))),
+			sqlbase.DatumToEncDatum(columnTypeString, parser.NewDString(string(value))),
+		}
+	}
+
+	for _, rowEncoding := range []diskRowEncoding{diskRowEncodingRow, diskRowEncodingColumnar} {
+		for _, compress := range []bool{false, true} {
+			b.Run(fmt.Sprintf("Encoding=%d/Compression=%t", rowEncoding, compress), func(b *testing.B) {
+				b.SetBytes(numRows * valueLen)
+				for n := 0; n < b.N; n++ {
+					d, err := makeDiskRowContainer(
+						ctx, types, ordering, memRowContainer{}, tempEngine, compress, rowEncoding,
+						diskColumnEncodingValue, 0 /* batchSize */, nil, /* metrics */
+					)
+					if err != nil {
+						b.Fatal(err)
+					}
+					for _, row := range rows {
+						if err := d.AddRow(ctx, row); err != nil {
+							b.Fatal(err)
+						}
+					}
+					i, err := d.NewIterator(ctx)
+					if err != nil {
+						b.Fatal(err)
+					}
+					for i.Rewind(); ; i.Next() {
+						if ok, err := i.Valid(); err != nil {
+							b.Fatal(err)
+						} else if !ok {
+							break
+						}
+						if _, err := i.Row(); err != nil {
+							b.Fatal(err)
+						}
+					}
+					i.Close()
+					d.Close(ctx)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkDiskRowContainerColumnEncoding measures the size of the rows spilled
+// to a diskRowContainer, and the cost of writing and reading them back, with
+// each choice of encoding of the value columns (see diskColumnEncoding). The
+// rows have a mix of integer and string value columns. The spilled size is
+// logged, per row.
+func BenchmarkDiskRowContainerColumnEncoding(b *testing.B) {
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	// The rows are sorted on the first column; the others are values.
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{
+		columnTypeInt, columnTypeInt, columnTypeInt, columnTypeString, columnTypeString,
+	}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+	rng := rand.New(rand.NewSource(int64(timeutil.Now().UnixNano())))
+	const numRows = 1 << 12
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		value := make([]byte, 32)
+		for j := range value {
+			value[j] = 'a' + byte(rng.Intn(26))
+		}
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Int()))),
+			// A small integer, and a large one.
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Intn(100)))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Int63()))),
+			sqlbase.DatumToEncDatum(columnTypeString, parser.NewDString(fmt.Sprint(rng.Intn(1000)))),
+			sqlbase.DatumToEncDatum(columnTypeString, parser.NewDString(string(value))),
+		}
+	}
+
+	for _, columnEncoding := range []diskColumnEncoding{
+		diskColumnEncodingValue, diskColumnEncodingKey, diskColumnEncodingAuto,
+	} {
+		b.Run(fmt.Sprintf("ColumnEncoding=%s", columnEncoding), func(b *testing.B) {
+			var written int64
+			for n := 0; n < b.N; n++ {
+				d, err := makeDiskRowContainer(
+					ctx, types, ordering, memRowContainer{}, tempEngine, false, /* compressValues */
+					diskRowEncodingRow, columnEncoding, 0 /* batchSize */, nil, /* metrics */
+				)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, row := range rows {
+					if err := d.AddRow(ctx, row); err != nil {
+						b.Fatal(err)
+					}
+				}
+				i, err := d.NewIterator(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for i.Rewind(); ; i.Next() {
+					if ok, err := i.Valid(); err != nil {
+						b.Fatal(err)
+					} else if !ok {
+						break
+					}
+					if _, err := i.Row(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				i.Close()
+				written = d.bytesWritten
+				d.Close(ctx)
+			}
+			b.Logf("%.1f bytes spilled per row", float64(written)/numRows)
+		})
+	}
 }
@@ -0,0 +1,225 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// sortDumpDir, if set, is a directory to which every diskRowContainer writes a
+// copy of the rows it spills and of the rows it reads back in sorted order (see
+// diskRowDumper). This is only meant for debugging disk sorts.
+var sortDumpDir = envutil.EnvOrDefaultString("COCKROACH_SORT_DUMP_DIR", "")
+
+// sortDumpSeq numbers the diskRowContainers that dump their rows, to give their
+// files unique names.
+var sortDumpSeq int64
+
+// diskRowDumper writes the rows of a diskRowContainer to files in sortDumpDir:
+//  - sort-<n>-spilled.txt gets the rows in the order in which they are added;
+//  - sort-<n>-sorted-<i>.txt gets the rows in sorted order, as read back by the
+//    i-th iterator over the container.
+// Each file starts with a header describing the types, the ordering and the
+// encoding of the rows. Each row is written as the key and value stored on
+// disk, followed by the row that they decode to. The rows are decoded by a
+// diskRowContainer of their own with the same encoding, so a row that doesn't
+// decode to the row that was added points at the encoding.
+//
+// Failing to write the files is logged and stops the dump; it never fails the
+// sort.
+type diskRowDumper struct {
+	// prefix is the path of the files, without the suffix.
+	prefix string
+	header string
+	// decoder decodes the rows of the container. It only shares the read-only
+	// fields of the container.
+	decoder diskRowContainer
+
+	spilledFile *os.File
+	spilled     *bufio.Writer
+	// numSorted is the number of sorted dumps written so far.
+	numSorted int
+}
+
+// newDiskRowDumper returns a diskRowDumper for d, or nil if the rows aren't to
+// be dumped. It must be called once d's encoding, which lays out the values
+// with enc, is set up.
+func newDiskRowDumper(
+	ctx context.Context, d *diskRowContainer, enc diskRowEncoding,
+) *diskRowDumper {
+	if sortDumpDir == "" {
+		return nil
+	}
+	dm := &diskRowDumper{
+		prefix: filepath.Join(sortDumpDir, fmt.Sprintf("sort-%d", atomic.AddInt64(&sortDumpSeq, 1))),
+		decoder: diskRowContainer{
+			types:             d.types,
+			ordering:          d.ordering,
+			encodings:         d.encodings,
+			valueIdxs:         d.valueIdxs,
+			orderingValueIdxs: d.orderingValueIdxs,
+			valueEncodings:    d.valueEncodings,
+			encoder:           makeDiskRowEncoder(enc, d.types, d.valueIdxs, d.valueEncodings),
+			compressValues:    d.compressValues,
+			scratchEncRow:     make(sqlbase.EncDatumRow, len(d.types)),
+		},
+	}
+	dm.header = dm.makeHeader(enc)
+	f, err := dm.create(ctx, dm.prefix+"-spilled.txt")
+	if err != nil {
+		return nil
+	}
+	dm.spilledFile = f
+	dm.spilled = bufio.NewWriter(f)
+	return dm
+}
+
+func (dm *diskRowDumper) makeHeader(enc diskRowEncoding) string {
+	var b bytes.Buffer
+	b.WriteString("# types:")
+	for i := range dm.decoder.types {
+		fmt.Fprintf(&b, " @%d %s", i+1, dm.decoder.types[i].SQLString())
+	}
+	b.WriteString("\n# key columns:")
+	for _, o := range dm.decoder.ordering {
+		dir := "ASC"
+		if o.Direction == encoding.Descending {
+			dir = "DESC"
+		}
+		fmt.Fprintf(&b, " @%d %s", o.ColIdx+1, dir)
+		switch o.NullsOrder {
+		case sqlbase.NullsFirst:
+			b.WriteString(" NULLS FIRST")
+		case sqlbase.NullsLast:
+			b.WriteString(" NULLS LAST")
+		}
+	}
+	b.WriteString(", followed by a unique uvarint\n# value columns:")
+	for i, idx := range dm.decoder.valueIdxs {
+		fmt.Fprintf(&b, " @%d", idx+1)
+		if dm.decoder.valueEncodings[i] != sqlbase.DatumEncoding_VALUE {
+			b.WriteString(" key-encoded")
+		}
+	}
+	fmt.Fprintf(&b, "\n# value encoding: %s, compressed: %t\n", enc, dm.decoder.compressValues)
+	return b.String()
+}
+
+// create creates a dump file and writes the header to it.
+func (dm *diskRowDumper) create(ctx context.Context, path string) (*os.File, error) {
+	f, err := os.Create(path)
+	if err == nil {
+		if _, err = f.WriteString(dm.header); err != nil {
+			_ = f.Close()
+		}
+	}
+	if err != nil {
+		log.Warningf(ctx, "unable to dump rows to %s: %s", path, err)
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeRow writes a row stored with the given key and value to w.
+func (dm *diskRowDumper) writeRow(w *bufio.Writer, k []byte, v []byte) error {
+	var decoded string
+	if row, err := dm.decoder.keyValToRow(k, v); err != nil {
+		decoded = fmt.Sprintf("<%s>", err)
+	} else {
+		decoded = row.String()
+	}
+	_, err := fmt.Fprintf(w, "key=%x value=%x row=%s\n", k, v, decoded)
+	return err
+}
+
+// addRow dumps a row added to the container with the given key and value.
+func (dm *diskRowDumper) addRow(ctx context.Context, k []byte, v []byte) {
+	if dm.spilled == nil {
+		return
+	}
+	if err := dm.writeRow(dm.spilled, k, v); err != nil {
+		log.Warningf(ctx, "unable to dump spilled rows: %s", err)
+		dm.closeSpilled(ctx)
+	}
+}
+
+// dumpSorted dumps all the rows of diskMap in sorted order. It has to be called
+// after the rows are flushed.
+func (dm *diskRowDumper) dumpSorted(ctx context.Context, diskMap engine.SortedDiskMap) {
+	if dm.spilled != nil {
+		// Make the spilled rows so far readable alongside the sorted ones.
+		if err := dm.spilled.Flush(); err != nil {
+			log.Warningf(ctx, "unable to dump spilled rows: %s", err)
+			dm.closeSpilled(ctx)
+		}
+	}
+	dm.numSorted++
+	f, err := dm.create(ctx, fmt.Sprintf("%s-sorted-%d.txt", dm.prefix, dm.numSorted))
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	i := diskMap.NewIterator()
+	defer i.Close()
+	for i.Rewind(); err == nil; i.Next() {
+		var ok bool
+		if ok, err = i.Valid(); err != nil || !ok {
+			break
+		}
+		err = dm.writeRow(w, i.Key(), i.Value())
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Warningf(ctx, "unable to dump sorted rows: %s", err)
+	}
+}
+
+func (dm *diskRowDumper) closeSpilled(ctx context.Context) {
+	if dm.spilled == nil {
+		return
+	}
+	err := dm.spilled.Flush()
+	if closeErr := dm.spilledFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Warningf(ctx, "unable to dump spilled rows: %s", err)
+	}
+	dm.spilled = nil
+	dm.spilledFile = nil
+}
+
+// close finishes the dump of the spilled rows.
+func (dm *diskRowDumper) close(ctx context.Context) {
+	dm.closeSpilled(ctx)
+}
@@ -0,0 +1,305 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+)
+
+// diskRowEncoding identifies the layout of the values that a diskRowContainer
+// writes to disk. The keys always hold the ordering columns, since they
+// determine the order of the rows.
+type diskRowEncoding int64
+
+const (
+	// diskRowEncodingRow encodes the value columns one after the other.
+	diskRowEncodingRow diskRowEncoding = iota
+	// diskRowEncodingColumnar prefixes the value columns with a table of their
+	// offsets, so that any one of them can be decoded without going over the
+	// ones before it.
+	diskRowEncodingColumnar
+)
+
+func (enc diskRowEncoding) String() string {
+	switch enc {
+	case diskRowEncodingRow:
+		return "row"
+	case diskRowEncodingColumnar:
+		return "columnar"
+	default:
+		return fmt.Sprintf("diskRowEncoding(%d)", int64(enc))
+	}
+}
+
+// diskColumnEncoding selects the encoding of each of the value columns of the
+// rows of a diskRowContainer, whatever their layout (see diskRowEncoding).
+// Depending on the type of a column, its key encoding can be smaller than its
+// value encoding, or the other way around.
+type diskColumnEncoding int64
+
+const (
+	// diskColumnEncodingValue value-encodes all the value columns.
+	diskColumnEncodingValue diskColumnEncoding = iota
+	// diskColumnEncodingKey key-encodes the value columns whose type can be
+	// decoded from its key encoding (see keyDecodableTypes), and value-encodes
+	// the others.
+	diskColumnEncodingKey
+	// diskColumnEncodingAuto picks the smaller of the two encodings for each
+	// value column based on its type (see smallerKeyEncodingTypes).
+	diskColumnEncodingAuto
+)
+
+func (enc diskColumnEncoding) String() string {
+	switch enc {
+	case diskColumnEncodingValue:
+		return "value"
+	case diskColumnEncodingKey:
+		return "key"
+	case diskColumnEncodingAuto:
+		return "auto"
+	default:
+		return fmt.Sprintf("diskColumnEncoding(%d)", int64(enc))
+	}
+}
+
+// keyDecodableTypes are the types of the value columns that can be
+// key-encoded: their datums can be decoded back from their key encoding,
+// unlike those of composite types (see decodedFromValue).
+var keyDecodableTypes = map[sqlbase.ColumnType_SemanticType]bool{
+	sqlbase.ColumnType_BOOL:        true,
+	sqlbase.ColumnType_INT:         true,
+	sqlbase.ColumnType_DATE:        true,
+	sqlbase.ColumnType_TIMESTAMP:   true,
+	sqlbase.ColumnType_TIMESTAMPTZ: true,
+	sqlbase.ColumnType_INTERVAL:    true,
+	sqlbase.ColumnType_STRING:      true,
+	sqlbase.ColumnType_BYTES:       true,
+}
+
+// smallerKeyEncodingTypes are the types whose key encoding is no larger than
+// their value encoding: both encode the numbers as varints, but the value
+// encoding starts with a tag. Strings and bytes are smaller when
+// value-encoded, since their key encoding escapes the zero bytes and ends with
+// a terminator.
+var smallerKeyEncodingTypes = map[sqlbase.ColumnType_SemanticType]bool{
+	sqlbase.ColumnType_INT:         true,
+	sqlbase.ColumnType_DATE:        true,
+	sqlbase.ColumnType_TIMESTAMP:   true,
+	sqlbase.ColumnType_TIMESTAMPTZ: true,
+	sqlbase.ColumnType_INTERVAL:    true,
+}
+
+// makeColumnEncodings returns the DatumEncoding of each of the columns of the
+// given types at valueIdxs, as selected by enc.
+func makeColumnEncodings(
+	enc diskColumnEncoding, types []sqlbase.ColumnType, valueIdxs []int,
+) []sqlbase.DatumEncoding {
+	encodings := make([]sqlbase.DatumEncoding, len(valueIdxs))
+	for i, idx := range valueIdxs {
+		encodings[i] = sqlbase.DatumEncoding_VALUE
+		typ := types[idx].SemanticType
+		if (enc == diskColumnEncodingKey && keyDecodableTypes[typ]) ||
+			(enc == diskColumnEncodingAuto && smallerKeyEncodingTypes[typ]) {
+			encodings[i] = sqlbase.DatumEncoding_ASCENDING_KEY
+		}
+	}
+	return encodings
+}
+
+// peekColumnLength returns the length of the column at the start of v, which
+// is encoded with enc.
+func peekColumnLength(enc sqlbase.DatumEncoding, v []byte) (int, error) {
+	if enc == sqlbase.DatumEncoding_VALUE {
+		_, encLen, err := encoding.PeekValueLength(v)
+		return encLen, err
+	}
+	return encoding.PeekLength(v)
+}
+
+// diskRowEncoder encodes the value columns of the rows of a diskRowContainer
+// (see diskRowContainer.valueIdxs) and decodes them back.
+type diskRowEncoder interface {
+	// encodeValues appends the encoding of the value columns of row to buf.
+	encodeValues(buf []byte, row sqlbase.EncDatumRow, a *sqlbase.DatumAlloc) ([]byte, error)
+	// decodeValues decodes all the value columns in v into row.
+	decodeValues(v []byte, row sqlbase.EncDatumRow) error
+	// decodeValue decodes only the i-th value column in v into row.
+	decodeValue(v []byte, i int, row sqlbase.EncDatumRow) error
+}
+
+// makeDiskRowEncoder returns a diskRowEncoder for the given layout of the
+// columns of the given types at valueIdxs, each of which is encoded with the
+// corresponding DatumEncoding in encodings.
+func makeDiskRowEncoder(
+	enc diskRowEncoding,
+	types []sqlbase.ColumnType,
+	valueIdxs []int,
+	encodings []sqlbase.DatumEncoding,
+) diskRowEncoder {
+	switch enc {
+	case diskRowEncodingRow:
+		return &rowDiskRowEncoder{types: types, valueIdxs: valueIdxs, encodings: encodings}
+	case diskRowEncodingColumnar:
+		return &columnarDiskRowEncoder{
+			types:     types,
+			valueIdxs: valueIdxs,
+			encodings: encodings,
+			ends:      make([]uint32, len(valueIdxs)),
+		}
+	default:
+		panic(fmt.Sprintf("unknown disk row encoding %d", enc))
+	}
+}
+
+// rowDiskRowEncoder is the diskRowEncoder for diskRowEncodingRow.
+type rowDiskRowEncoder struct {
+	types     []sqlbase.ColumnType
+	valueIdxs []int
+	encodings []sqlbase.DatumEncoding
+}
+
+var _ diskRowEncoder = &rowDiskRowEncoder{}
+
+func (e *rowDiskRowEncoder) encodeValues(
+	buf []byte, row sqlbase.EncDatumRow, a *sqlbase.DatumAlloc,
+) ([]byte, error) {
+	for i, idx := range e.valueIdxs {
+		var err error
+		buf, err = row[idx].Encode(a, e.encodings[i], buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (e *rowDiskRowEncoder) decodeValues(v []byte, row sqlbase.EncDatumRow) error {
+	for i, idx := range e.valueIdxs {
+		var err error
+		row[idx], v, err = sqlbase.EncDatumFromBuffer(e.types[idx], e.encodings[i], v)
+		if err != nil {
+			return errors.Wrap(err, "unable to decode row")
+		}
+	}
+	return nil
+}
+
+func (e *rowDiskRowEncoder) decodeValue(v []byte, i int, row sqlbase.EncDatumRow) error {
+	// Skip over the columns before the requested one.
+	for j := 0; j < i; j++ {
+		encLen, err := peekColumnLength(e.encodings[j], v)
+		if err != nil {
+			return errors.Wrap(err, "unable to decode row")
+		}
+		v = v[encLen:]
+	}
+	idx := e.valueIdxs[i]
+	var err error
+	row[idx], _, err = sqlbase.EncDatumFromBuffer(e.types[idx], e.encodings[i], v)
+	if err != nil {
+		return errors.Wrap(err, "unable to decode row")
+	}
+	return nil
+}
+
+// columnarDiskRowEncoder is the diskRowEncoder for diskRowEncodingColumnar. A
+// value starts with the end offset of each of the value columns, as fixed
+// width integers, followed by the encoded columns.
+// Note that the SortedDiskMap holds one row per key, so the columns of
+// different rows can't be stored together.
+type columnarDiskRowEncoder struct {
+	types     []sqlbase.ColumnType
+	valueIdxs []int
+	encodings []sqlbase.DatumEncoding
+
+	// ends and scratch are used to encode the columns in encodeValues before
+	// their offsets are known.
+	ends    []uint32
+	scratch []byte
+}
+
+var _ diskRowEncoder = &columnarDiskRowEncoder{}
+
+// columnarOffsetSize is the size of each entry of the offset table of the
+// values encoded by a columnarDiskRowEncoder.
+const columnarOffsetSize = 4
+
+func (e *columnarDiskRowEncoder) encodeValues(
+	buf []byte, row sqlbase.EncDatumRow, a *sqlbase.DatumAlloc,
+) ([]byte, error) {
+	e.scratch = e.scratch[:0]
+	for i, idx := range e.valueIdxs {
+		var err error
+		e.scratch, err = row[idx].Encode(a, e.encodings[i], e.scratch)
+		if err != nil {
+			return nil, err
+		}
+		e.ends[i] = uint32(len(e.scratch))
+	}
+	for _, end := range e.ends {
+		buf = encoding.EncodeUint32Ascending(buf, end)
+	}
+	return append(buf, e.scratch...), nil
+}
+
+func (e *columnarDiskRowEncoder) decodeValues(v []byte, row sqlbase.EncDatumRow) error {
+	headerLen := columnarOffsetSize * len(e.valueIdxs)
+	if len(v) < headerLen {
+		return errors.Errorf("unable to decode row: value too short")
+	}
+	v = v[headerLen:]
+	for i, idx := range e.valueIdxs {
+		var err error
+		row[idx], v, err = sqlbase.EncDatumFromBuffer(e.types[idx], e.encodings[i], v)
+		if err != nil {
+			return errors.Wrap(err, "unable to decode row")
+		}
+	}
+	return nil
+}
+
+func (e *columnarDiskRowEncoder) decodeValue(v []byte, i int, row sqlbase.EncDatumRow) error {
+	headerLen := columnarOffsetSize * len(e.valueIdxs)
+	if len(v) < headerLen {
+		return errors.Errorf("unable to decode row: value too short")
+	}
+	var start, end uint32
+	var err error
+	if i > 0 {
+		if _, start, err = encoding.DecodeUint32Ascending(v[columnarOffsetSize*(i-1):]); err != nil {
+			return errors.Wrap(err, "unable to decode row")
+		}
+	}
+	if _, end, err = encoding.DecodeUint32Ascending(v[columnarOffsetSize*i:]); err != nil {
+		return errors.Wrap(err, "unable to decode row")
+	}
+	data := v[headerLen:]
+	if start > end || int(end) > len(data) {
+		return errors.Errorf("unable to decode row: invalid offsets %d-%d", start, end)
+	}
+	idx := e.valueIdxs[i]
+	row[idx], _, err = sqlbase.EncDatumFromBuffer(
+		e.types[idx], e.encodings[i], data[start:end],
+	)
+	if err != nil {
+		return errors.Wrap(err, "unable to decode row")
+	}
+	return nil
+}
@@ -76,6 +76,31 @@ type FlowCtx struct {
 	// tempStorage is used by some DistSQL processors to store Rows when the
 	// working set is larger than can be stored in memory.
 	tempStorage engine.Engine
+
+	// metrics are the DistSQL server's metrics. Can be nil (e.g. in tests).
+	metrics *DistSQLMetrics
+
+	// sorterMem, if set, is the memory budget shared by the sorters of the flow
+	// that can fall back to disk. It is set up in Flow.setup.
+	sorterMem *sharedSorterMemory
+
+	// sorterSpills, if set, is where the sorters that can fall back to disk
+	// register to be asked to spill under memory pressure.
+	sorterSpills *sorterSpillRegistry
+
+	// sendSorterStats is set if the sorters of the flow send their statistics
+	// as metadata (see FlowSpec.SendSorterStats).
+	sendSorterStats bool
+
+	// deadlineAwareSorters is set if the sorters of the flow take the deadline
+	// of their context into account to choose their strategy (see
+	// FlowSpec.DeadlineAwareSorters).
+	deadlineAwareSorters bool
+
+	// sendSorterProgress is set if the sorters of the flow periodically send
+	// their progress as metadata while they run (see
+	// FlowSpec.SendSorterProgress).
+	sendSorterProgress bool
 }
 
 func (flowCtx *FlowCtx) setupTxn() *client.Txn {
@@ -282,7 +307,9 @@ func (f *Flow) setup(ctx context.Context, spec *FlowSpec) error {
 					streams[i] = rowChan
 				}
 				var err error
-				sync, err = makeOrderedSync(convertToColumnOrdering(is.Ordering), &f.evalCtx, streams)
+				sync, err = makeOrderedSync(
+					convertToColumnOrdering(is.Ordering), &f.evalCtx, streams, nil, /* compare */
+				)
 				if err != nil {
 					return err
 				}
@@ -294,6 +321,24 @@ func (f *Flow) setup(ctx context.Context, spec *FlowSpec) error {
 		}
 	}
 
+	if sorterSharedWorkMem.Get() {
+		numSorters := 0
+		for i := range spec.Processors {
+			if sorter := spec.Processors[i].Core.Sorter; sorter != nil {
+				// Only the sorters that can fall back to disk use the shared
+				// budget.
+				effort := sorter.sortEffort(&spec.Processors[i].Post, f.evalCtx.ReverseSortColumns)
+				if effort == SortEffortFull || effort == SortEffortTopK || effort == SortEffortMerge {
+					numSorters++
+				}
+			}
+		}
+		if numSorters > 1 {
+			f.sorterMem = &sharedSorterMemory{}
+			f.sorterMem.start(ctx, f.evalCtx.Mon, workMemLimit(f.evalCtx.Mon), numSorters)
+		}
+	}
+
 	f.processors = make([]processor, len(spec.Processors))
 
 	for i := range spec.Processors {
@@ -341,6 +386,9 @@ func (f *Flow) Cleanup(ctx context.Context) {
 	if f.status == FlowFinished {
 		panic("flow cleanup called twice")
 	}
+	if f.sorterMem != nil {
+		f.sorterMem.stop(ctx)
+	}
 	// This closes the account and monitor opened in ServerImpl.setupFlow.
 	f.evalCtx.ActiveMemAcc.Close(ctx)
 	f.evalCtx.Stop(ctx)
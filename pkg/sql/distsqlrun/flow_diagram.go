@@ -50,6 +50,12 @@ func (ord *Ordering) diagramString() string {
 		} else {
 			buf.WriteByte('+')
 		}
+		switch c.NullsOrder {
+		case Ordering_Column_NULLS_FIRST:
+			buf.WriteString(" nulls first")
+		case Ordering_Column_NULLS_LAST:
+			buf.WriteString(" nulls last")
+		}
 	}
 	return buf.String()
 }
@@ -155,9 +161,34 @@ func (s *SorterSpec) summary() (string, []string) {
 	if s.OrderingMatchLen != 0 {
 		details = append(details, fmt.Sprintf("match len: %d", s.OrderingMatchLen))
 	}
+	if s.Stable {
+		details = append(details, "stable")
+	}
+	if len(s.OrderingExprs) > 0 {
+		exprs := make([]string, len(s.OrderingExprs))
+		for i, expr := range s.OrderingExprs {
+			exprs[i] = expr.Expr
+		}
+		details = append(details, fmt.Sprintf("ordering exprs: %s", strings.Join(exprs, ", ")))
+	}
+	if s.Aggregation != nil {
+		_, aggDetails := s.Aggregation.summary()
+		details = append(details, aggDetails...)
+	}
+	if s.Distinct {
+		if len(s.DistinctColumns) > 0 {
+			details = append(details, fmt.Sprintf("distinct: %s", colListStr(s.DistinctColumns)))
+		} else {
+			details = append(details, "distinct")
+		}
+	}
 	return "Sorter", details
 }
 
+func (m *MergerSpec) summary() (string, []string) {
+	return "Merger", []string{m.Ordering.diagramString()}
+}
+
 func (bf *BackfillerSpec) summary() (string, []string) {
 	details := []string{
 		bf.Table.Name,
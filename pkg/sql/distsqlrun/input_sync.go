@@ -67,6 +67,9 @@ const (
 type orderedSynchronizer struct {
 	ordering sqlbase.ColumnOrdering
 	evalCtx  *parser.EvalContext
+	// compare, if set, compares the rows of the sources instead of
+	// EncDatumRow.Compare (see makeOrderedSync).
+	compare func(a, b sqlbase.EncDatumRow) (int, error)
 
 	sources []srcInfo
 
@@ -109,7 +112,7 @@ func (s *orderedSynchronizer) Len() int {
 func (s *orderedSynchronizer) Less(i, j int) bool {
 	si := &s.sources[s.heap[i]]
 	sj := &s.sources[s.heap[j]]
-	cmp, err := si.row.Compare(&s.alloc, s.ordering, s.evalCtx, sj.row)
+	cmp, err := s.compareRows(si.row, sj.row)
 	if err != nil {
 		s.err = err
 		return false
@@ -117,6 +120,14 @@ func (s *orderedSynchronizer) Less(i, j int) bool {
 	return cmp < 0
 }
 
+// compareRows compares two rows of the sources on the ordering.
+func (s *orderedSynchronizer) compareRows(a, b sqlbase.EncDatumRow) (int, error) {
+	if s.compare != nil {
+		return s.compare(a, b)
+	}
+	return a.Compare(&s.alloc, s.ordering, s.evalCtx, b)
+}
+
 // Swap is part of heap.Interface and is only meant to be used internally.
 func (s *orderedSynchronizer) Swap(i, j int) {
 	s.heap[i], s.heap[j] = s.heap[j], s.heap[i]
@@ -225,7 +236,7 @@ func (s *orderedSynchronizer) advanceRoot() error {
 	} else {
 		heap.Fix(s, 0)
 		// TODO(radu): this check may be costly, we could disable it in production
-		if cmp, err := oldRow.Compare(&s.alloc, s.ordering, s.evalCtx, src.row); err != nil {
+		if cmp, err := s.compareRows(oldRow, src.row); err != nil {
 			return err
 		} else if cmp > 0 {
 			return errors.Errorf("incorrectly ordered stream %s after %s", src.row, oldRow)
@@ -322,8 +333,21 @@ func (s *orderedSynchronizer) consumerStatusChanged(f func(RowSource)) {
 	}
 }
 
+var _ orderedRowSource = &orderedSynchronizer{}
+
+// outputOrdering is part of the orderedRowSource interface.
+func (s *orderedSynchronizer) outputOrdering() sqlbase.ColumnOrdering {
+	return s.ordering
+}
+
+// makeOrderedSync creates an orderedSynchronizer that merges the given sources
+// on the ordering. If compare is nil, the rows are compared with
+// EncDatumRow.Compare.
 func makeOrderedSync(
-	ordering sqlbase.ColumnOrdering, evalCtx *parser.EvalContext, sources []RowSource,
+	ordering sqlbase.ColumnOrdering,
+	evalCtx *parser.EvalContext,
+	sources []RowSource,
+	compare func(a, b sqlbase.EncDatumRow) (int, error),
 ) (RowSource, error) {
 	if len(sources) < 2 {
 		return nil, errors.Errorf("only %d sources for ordered synchronizer", len(sources))
@@ -334,6 +358,7 @@ func makeOrderedSync(
 		heap:     make([]srcIdx, 0, len(sources)),
 		ordering: ordering,
 		evalCtx:  evalCtx,
+		compare:  compare,
 	}
 	for i := range s.sources {
 		s.sources[i].src = sources[i]
@@ -117,7 +117,7 @@ func TestOrderedSync(t *testing.T) {
 		}
 		evalCtx := parser.NewTestingEvalContext()
 		defer evalCtx.Stop(context.Background())
-		src, err := makeOrderedSync(c.ordering, evalCtx, sources)
+		src, err := makeOrderedSync(c.ordering, evalCtx, sources, nil /* compare */)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -0,0 +1,126 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// merger is a processor that merges multiple input streams, each of them
+// already sorted according to the same ordering, into a single stream sorted
+// according to that ordering. Unlike the sorter, it doesn't buffer rows: the
+// merge is streaming and is performed with a heap of the heads of the input
+// streams (see orderedSynchronizer). The rows are compared like the sorter
+// compares them (see NewRowComparator), so that merging the outputs of sorters
+// gives the same order as sorting all the rows at once.
+//
+// Input streams that are empty or that finish early are simply removed from
+// the merge. The metadata received from any of the inputs is forwarded to the
+// output.
+type merger struct {
+	flowCtx *FlowCtx
+	// input is a row source without metadata; the metadata is directed straight
+	// to out.output.
+	input NoMetadataRowSource
+	// rawInput is the true input, not wrapped in a NoMetadataRowSource.
+	rawInput RowSource
+	out      procOutputHelper
+}
+
+var _ processor = &merger{}
+
+func newMerger(
+	flowCtx *FlowCtx,
+	spec *MergerSpec,
+	inputs []RowSource,
+	post *PostProcessSpec,
+	output RowReceiver,
+) (*merger, error) {
+	if len(inputs) == 0 {
+		return nil, errors.Errorf("merger needs at least one input")
+	}
+	types := inputs[0].Types()
+	for i, in := range inputs[1:] {
+		if len(in.Types()) != len(types) {
+			return nil, errors.Errorf(
+				"input %d has %d columns, expected %d", i+1, len(in.Types()), len(types),
+			)
+		}
+	}
+	input := inputs[0]
+	if len(inputs) > 1 {
+		var err error
+		ordering := convertToColumnOrdering(spec.Ordering)
+		input, err = makeOrderedSync(
+			ordering, &flowCtx.evalCtx, inputs, NewRowComparator(ordering, types, &flowCtx.evalCtx),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m := &merger{
+		flowCtx:  flowCtx,
+		input:    MakeNoMetadataRowSource(input, output),
+		rawInput: input,
+	}
+	if err := m.out.init(post, types, &flowCtx.evalCtx, output); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Run is part of the processor interface.
+func (m *merger) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "Merger", nil)
+	ctx, span := processorSpan(ctx, "merger")
+	defer tracing.FinishSpan(span)
+
+	if log.V(2) {
+		log.Infof(ctx, "starting merger run")
+		defer log.Infof(ctx, "exiting merger run")
+	}
+
+	err := m.mainLoop(ctx)
+	if err != nil {
+		log.Errorf(ctx, "error merging rows: %s", err)
+	}
+	DrainAndClose(ctx, m.out.output, err, m.rawInput)
+}
+
+// mainLoop pushes the merged rows to the output. It returns once either all
+// the inputs have been exhausted or the consumer indicated that no more rows
+// are needed.
+func (m *merger) mainLoop(ctx context.Context) error {
+	for {
+		row, err := m.input.NextRow()
+		if err != nil || row == nil {
+			return err
+		}
+		consumerStatus, err := m.out.emitRow(ctx, row)
+		if err != nil || consumerStatus != NeedMoreRows {
+			return err
+		}
+	}
+}
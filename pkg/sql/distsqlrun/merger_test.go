@@ -0,0 +1,198 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestMerger(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	v := [6]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i)))
+	}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+
+	asc := encoding.Ascending
+	desc := encoding.Descending
+
+	testCases := []struct {
+		name     string
+		ordering sqlbase.ColumnOrdering
+		post     PostProcessSpec
+		inputs   []sqlbase.EncDatumRows
+		expected sqlbase.EncDatumRows
+	}{
+		{
+			name: "SingleInput",
+			ordering: sqlbase.ColumnOrdering{
+				{ColIdx: 0, Direction: asc},
+			},
+			inputs: []sqlbase.EncDatumRows{
+				{
+					{v[0], v[1]},
+					{v[1], v[0]},
+				},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[1]},
+				{v[1], v[0]},
+			},
+		},
+		{
+			name: "MultipleInputs",
+			ordering: sqlbase.ColumnOrdering{
+				{ColIdx: 0, Direction: asc},
+				{ColIdx: 1, Direction: desc},
+			},
+			inputs: []sqlbase.EncDatumRows{
+				{
+					{v[0], v[4]},
+					{v[2], v[5]},
+					{v[2], v[1]},
+				},
+				// Empty inputs must not prevent the merge.
+				{},
+				{
+					{v[0], v[5]},
+					{v[1], v[0]},
+				},
+				{
+					{v[3], v[3]},
+				},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[5]},
+				{v[0], v[4]},
+				{v[1], v[0]},
+				{v[2], v[5]},
+				{v[2], v[1]},
+				{v[3], v[3]},
+			},
+		},
+		{
+			name: "Limit",
+			ordering: sqlbase.ColumnOrdering{
+				{ColIdx: 1, Direction: asc},
+			},
+			post: PostProcessSpec{Limit: 3},
+			inputs: []sqlbase.EncDatumRows{
+				{
+					{v[0], v[1]},
+					{v[0], v[3]},
+					{v[0], v[5]},
+				},
+				{
+					{v[1], v[0]},
+					{v[1], v[2]},
+					{v[1], v[4]},
+				},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[1], v[0]},
+				{v[0], v[1]},
+				{v[1], v[2]},
+			},
+		},
+		{
+			name: "AllEmpty",
+			ordering: sqlbase.ColumnOrdering{
+				{ColIdx: 0, Direction: asc},
+			},
+			inputs:   []sqlbase.EncDatumRows{{}, {}},
+			expected: nil,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			inputs := make([]RowSource, len(c.inputs))
+			for i, rows := range c.inputs {
+				in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+				// Every input sends some metadata before its rows.
+				in.Push(nil /* row */, ProducerMetadata{Ranges: []roachpb.RangeInfo{{}}})
+				for _, row := range rows {
+					in.Push(row, ProducerMetadata{})
+				}
+				in.ProducerDone()
+				inputs[i] = in
+			}
+			out := &RowBuffer{}
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+
+			spec := MergerSpec{Ordering: convertToSpecOrdering(c.ordering)}
+			m, err := newMerger(&flowCtx, &spec, inputs, &c.post, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Run(ctx, nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var retRows sqlbase.EncDatumRows
+			numMeta := 0
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					if meta.Err != nil {
+						t.Fatal(meta.Err)
+					}
+					numMeta++
+					continue
+				}
+				if row == nil {
+					break
+				}
+				retRows = append(retRows, row)
+			}
+
+			if numMeta != len(c.inputs) {
+				t.Errorf("expected %d metadata records, got %d", len(c.inputs), numMeta)
+			}
+			if expStr, retStr := c.expected.String(), retRows.String(); expStr != retStr {
+				t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+			}
+		})
+	}
+}
+
+func TestMergerNoInputs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{evalCtx: evalCtx}
+	if _, err := newMerger(
+		&flowCtx, &MergerSpec{}, nil /* inputs */, &PostProcessSpec{}, &RowBuffer{},
+	); err == nil {
+		t.Fatal("expected error when creating a merger without inputs")
+	}
+}
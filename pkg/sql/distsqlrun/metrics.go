@@ -0,0 +1,61 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
+
+var (
+	metaSortSpillCount = metric.Metadata{
+		Name: "sql.distsql.sort.spill.count",
+		Help: "Number of DistSQL sorts that spilled to disk"}
+	metaSortSpilledBytes = metric.Metadata{
+		Name: "sql.distsql.sort.spill.bytes",
+		Help: "Number of bytes written to temporary storage by DistSQL sorts"}
+	metaSortDiskCurBytes = metric.Metadata{
+		Name: "sql.distsql.sort.disk.current",
+		Help: "Number of bytes currently in temporary storage for DistSQL sorts"}
+	metaSortFirstRowLatency = metric.Metadata{
+		Name: "sql.distsql.sort.first_row_latency",
+		Help: "Latency from the start of DistSQL sorts to their first output row"}
+)
+
+// DistSQLMetrics is the set of metrics for a DistSQL server. Unlike the memory
+// metrics, which are maintained by the server's memory monitors, these are
+// updated by the processors themselves.
+type DistSQLMetrics struct {
+	SortSpillCount   *metric.Counter
+	SortSpilledBytes *metric.Counter
+	SortDiskCurBytes *metric.Gauge
+	// SortFirstRowLatency is the time it takes sorters to output their first
+	// row, which tells the sorts that stream their output (e.g. with the
+	// sortChunksStrategy) apart from those that buffer their whole input.
+	SortFirstRowLatency *metric.Histogram
+}
+
+// MakeDistSQLMetrics instantiates the metrics for a DistSQL server. The
+// windowed portion of the histograms retains values for approximately
+// histogramWindow.
+func MakeDistSQLMetrics(histogramWindow time.Duration) DistSQLMetrics {
+	return DistSQLMetrics{
+		SortSpillCount:      metric.NewCounter(metaSortSpillCount),
+		SortSpilledBytes:    metric.NewCounter(metaSortSpilledBytes),
+		SortDiskCurBytes:    metric.NewGauge(metaSortDiskCurBytes),
+		SortFirstRowLatency: metric.NewLatency(metaSortFirstRowLatency, histogramWindow),
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// batchRowReceiver is implemented by the RowReceivers that can accept several
+// rows at once more cheaply than one at a time (e.g. by taking their lock
+// once).
+type batchRowReceiver interface {
+	RowReceiver
+	// PushBatch pushes the rows like as many calls to Push without metadata
+	// would, and returns the status of the consumer after the last one.
+	PushBatch(rows sqlbase.EncDatumRows) ConsumerStatus
+}
+
+var _ batchRowReceiver = &RowBuffer{}
+
+// batchingRowReceiver is a RowReceiver that buffers the rows pushed to it and
+// pushes them to its output in batches of size rows, with PushBatch if the
+// output implements batchRowReceiver. This saves a producer that outputs rows
+// in bursts (e.g. a sorter) from contending on the output for every row.
+//
+// The buffered rows are pushed before any metadata, so that the order of the
+// rows and metadata is preserved, and before ProducerDone is forwarded. They
+// can also be pushed with flush, e.g. before the producer blocks on its input.
+//
+// Since the rows are only pushed once a batch is full, the status that Push
+// returns for a buffered row is the status returned by the output for the
+// previous batch: the producer learns that the consumer doesn't need more rows
+// at most size rows late, and those rows are discarded like any row pushed
+// after the consumer's status changed.
+type batchingRowReceiver struct {
+	output RowReceiver
+	// batchOutput is output, if it implements batchRowReceiver.
+	batchOutput batchRowReceiver
+	size        int
+
+	mu struct {
+		syncutil.Mutex
+		rows sqlbase.EncDatumRows
+		// status is the status of the consumer as last returned by the output.
+		status ConsumerStatus
+	}
+}
+
+var _ RowReceiver = &batchingRowReceiver{}
+
+// newBatchingRowReceiver returns a batchingRowReceiver pushing batches of size
+// rows to output.
+func newBatchingRowReceiver(output RowReceiver, size int) *batchingRowReceiver {
+	b := &batchingRowReceiver{output: output, size: size}
+	b.batchOutput, _ = output.(batchRowReceiver)
+	b.mu.rows = make(sqlbase.EncDatumRows, 0, size)
+	return b
+}
+
+// Push is part of the RowReceiver interface.
+func (b *batchingRowReceiver) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if row != nil {
+		if b.mu.status != NeedMoreRows {
+			// The output would discard the row.
+			return b.mu.status
+		}
+		b.mu.rows = append(b.mu.rows, row)
+		if len(b.mu.rows) >= b.size {
+			b.flushLocked()
+		}
+		return b.mu.status
+	}
+	b.flushLocked()
+	b.mu.status = b.output.Push(nil /* row */, meta)
+	return b.mu.status
+}
+
+// flush pushes the buffered rows to the output, and returns the status of the
+// consumer.
+func (b *batchingRowReceiver) flush() ConsumerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+	return b.mu.status
+}
+
+func (b *batchingRowReceiver) flushLocked() {
+	if len(b.mu.rows) == 0 {
+		return
+	}
+	if b.batchOutput != nil {
+		b.mu.status = b.batchOutput.PushBatch(b.mu.rows)
+	} else {
+		for _, row := range b.mu.rows {
+			if b.mu.status = b.output.Push(row, ProducerMetadata{}); b.mu.status != NeedMoreRows {
+				break
+			}
+		}
+	}
+	// Don't hold on to the rows, which belong to the output now.
+	for i := range b.mu.rows {
+		b.mu.rows[i] = nil
+	}
+	b.mu.rows = b.mu.rows[:0]
+}
+
+// ProducerDone is part of the RowReceiver interface.
+func (b *batchingRowReceiver) ProducerDone() {
+	b.flush()
+	b.output.ProducerDone()
+}
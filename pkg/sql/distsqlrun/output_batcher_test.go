@@ -0,0 +1,122 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestBatchingRowReceiver verifies that a batchingRowReceiver pushes its rows
+// once a batch is full, before any metadata, when flushed and when the
+// producer is done, in the order in which they were pushed, whether its output
+// accepts batches or not. It also verifies that rows are no longer buffered
+// once the consumer doesn't need them.
+func TestBatchingRowReceiver(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	makeRow := func(i int) sqlbase.EncDatumRow {
+		return sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+		}
+	}
+	meta := ProducerMetadata{Ranges: []roachpb.RangeInfo{{}}}
+	// records returns the records pushed to out, with "M" standing for
+	// metadata.
+	records := func(out *RowBuffer) string {
+		out.mu.Lock()
+		defer out.mu.Unlock()
+		var s []string
+		for _, r := range out.mu.records {
+			if r.Row != nil {
+				s = append(s, r.Row[0].String())
+			} else {
+				s = append(s, "M")
+			}
+		}
+		return strings.Join(s, " ")
+	}
+
+	for _, batch := range []bool{true, false} {
+		t.Run(fmt.Sprintf("Batch=%t", batch), func(t *testing.T) {
+			out := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+			var output RowReceiver = out
+			if !batch {
+				// Hide PushBatch.
+				output = struct{ RowReceiver }{out}
+			}
+			b := newBatchingRowReceiver(output, 4 /* size */)
+			if batch != (b.batchOutput != nil) {
+				t.Fatalf("expected batch output %t", batch)
+			}
+
+			push := func(from, to int) {
+				for i := from; i < to; i++ {
+					if status := b.Push(makeRow(i), ProducerMetadata{}); status != NeedMoreRows {
+						t.Fatalf("unexpected status %d", status)
+					}
+				}
+			}
+			for _, step := range []struct {
+				fn       func()
+				expected string
+			}{
+				{fn: func() { push(0, 3) }, expected: ""},
+				{fn: func() { push(3, 4) }, expected: "0 1 2 3"},
+				{fn: func() { push(4, 6); b.Push(nil /* row */, meta) }, expected: "0 1 2 3 4 5 M"},
+				{fn: func() { push(6, 7); b.flush() }, expected: "0 1 2 3 4 5 M 6"},
+				{fn: func() { push(7, 9); b.ProducerDone() }, expected: "0 1 2 3 4 5 M 6 7 8"},
+			} {
+				step.fn()
+				if actual := records(out); actual != step.expected {
+					t.Fatalf("expected records %q, got %q", step.expected, actual)
+				}
+			}
+			if !out.ProducerClosed {
+				t.Fatal("expected ProducerDone to be forwarded")
+			}
+		})
+	}
+
+	t.Run("DrainRequested", func(t *testing.T) {
+		out := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+		b := newBatchingRowReceiver(out, 2 /* size */)
+		b.Push(makeRow(0), ProducerMetadata{})
+		out.ConsumerDone()
+		// The status is only known once the batch is pushed.
+		if status := b.Push(makeRow(1), ProducerMetadata{}); status != DrainRequested {
+			t.Fatalf("expected DrainRequested, got %d", status)
+		}
+		if status := b.Push(makeRow(2), ProducerMetadata{}); status != DrainRequested {
+			t.Fatalf("expected DrainRequested, got %d", status)
+		}
+		if len(b.mu.rows) != 0 {
+			t.Fatalf("expected no rows to be buffered while draining, got %d", len(b.mu.rows))
+		}
+		b.Push(nil /* row */, meta)
+		b.ProducerDone()
+		if actual := records(out); actual != "M" {
+			t.Fatalf("expected only the metadata to be pushed, got %q", actual)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// rowPrefetcher is a RowSource that reads the rows and metadata of its input in
+// a background goroutine, buffering up to rowChannelBufSize records. This
+// allows the input to be read while the consumer is busy processing the rows
+// that were already read (e.g. sorting a chunk of them).
+//
+// The memory taken up by the buffered rows is accounted for by a monitor; if
+// it can't be reserved, the error is forwarded to the consumer and the input
+// is drained. If the context is canceled, the prefetcher stops reading the
+// input and the consumer receives the context's error.
+//
+// Only the background goroutine interacts with the input so, once started, the
+// input must not be used other than through the prefetcher. Close must be
+// called once the prefetcher is no longer used.
+type rowPrefetcher struct {
+	input RowSource
+	ch    chan RowChannelMsg
+
+	// drainCh is closed when the consumer calls ConsumerDone.
+	drainCh   chan struct{}
+	drainOnce sync.Once
+	// stopCh is closed when the consumer calls ConsumerClosed or Close.
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	// err is set by the background goroutine if it stopped because the context
+	// was canceled. It can be read once ch is closed.
+	err error
+	// inputClosed is set by the background goroutine if it called
+	// input.ConsumerClosed. It can be read once the goroutine has exited.
+	inputClosed bool
+
+	mu struct {
+		syncutil.Mutex
+		// acc accounts for the rows buffered in ch.
+		acc mon.BoundAccount
+	}
+}
+
+var _ RowSource = &rowPrefetcher{}
+
+// startRowPrefetcher creates a rowPrefetcher for the given input and starts
+// reading the input in the background. The memory used by the buffered rows is
+// accounted for by m.
+func startRowPrefetcher(
+	ctx context.Context, input RowSource, m *mon.MemoryMonitor,
+) *rowPrefetcher {
+	p := &rowPrefetcher{
+		input:   input,
+		ch:      make(chan RowChannelMsg, rowChannelBufSize),
+		drainCh: make(chan struct{}),
+		stopCh:  make(chan struct{}),
+	}
+	p.mu.acc = m.MakeBoundAccount()
+	p.wg.Add(1)
+	go p.run(ctx)
+	return p
+}
+
+// run is the main loop of the background goroutine.
+func (p *rowPrefetcher) run(ctx context.Context) {
+	defer p.wg.Done()
+	defer close(p.ch)
+
+	draining := false
+	for {
+		if !draining {
+			select {
+			case <-p.drainCh:
+				draining = true
+				p.input.ConsumerDone()
+			default:
+			}
+		}
+
+		row, meta := p.input.Next()
+		if row == nil && meta.Empty() {
+			return
+		}
+		if row != nil {
+			if draining {
+				// The consumer only needs the metadata.
+				continue
+			}
+			p.mu.Lock()
+			err := p.mu.acc.Grow(ctx, int64(row.Size()))
+			p.mu.Unlock()
+			if err != nil {
+				// Forward the error instead of the row and drain the input.
+				row, meta = nil, ProducerMetadata{Err: err}
+				draining = true
+				p.input.ConsumerDone()
+			}
+		}
+
+		select {
+		case p.ch <- RowChannelMsg{Row: row, Meta: meta}:
+		case <-p.stopCh:
+			return
+		case <-ctx.Done():
+			p.err = ctx.Err()
+			p.input.ConsumerClosed()
+			p.inputClosed = true
+			return
+		}
+	}
+}
+
+// Types is part of the RowSource interface.
+func (p *rowPrefetcher) Types() []sqlbase.ColumnType {
+	return p.input.Types()
+}
+
+// Next is part of the RowSource interface.
+func (p *rowPrefetcher) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	msg, ok := <-p.ch
+	if !ok {
+		if err := p.err; err != nil {
+			// Only return the error once.
+			p.err = nil
+			return nil, ProducerMetadata{Err: err}
+		}
+		return nil, ProducerMetadata{}
+	}
+	if msg.Row != nil {
+		p.mu.Lock()
+		p.mu.acc.Shrink(context.TODO(), int64(msg.Row.Size()))
+		p.mu.Unlock()
+	}
+	return msg.Row, msg.Meta
+}
+
+// ConsumerDone is part of the RowSource interface.
+func (p *rowPrefetcher) ConsumerDone() {
+	p.drainOnce.Do(func() {
+		close(p.drainCh)
+	})
+}
+
+// ConsumerClosed is part of the RowSource interface.
+func (p *rowPrefetcher) ConsumerClosed() {
+	p.stop()
+	if !p.inputClosed {
+		p.input.ConsumerClosed()
+		p.inputClosed = true
+	}
+}
+
+// stop stops the background goroutine and waits for it to exit.
+func (p *rowPrefetcher) stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+	p.wg.Wait()
+}
+
+// Close stops the background goroutine, if it is still running, and releases
+// the memory accounted for the rows that are still buffered.
+func (p *rowPrefetcher) Close(ctx context.Context) {
+	p.stop()
+	p.mu.Lock()
+	p.mu.acc.Close(ctx)
+	p.mu.Unlock()
+}
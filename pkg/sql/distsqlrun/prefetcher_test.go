@@ -0,0 +1,159 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/pkg/errors"
+)
+
+func TestRowPrefetcher(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	makeRow := func(i int) sqlbase.EncDatumRow {
+		return sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+		}
+	}
+	// makeInput returns an input with numRows rows, with a metadata record
+	// after every 10 rows.
+	makeInput := func(numRows int) *RowBuffer {
+		in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+		for i := 0; i < numRows; i++ {
+			in.Push(makeRow(i), ProducerMetadata{})
+			if i%10 == 9 {
+				in.Push(nil /* row */, ProducerMetadata{Ranges: []roachpb.RangeInfo{{}}})
+			}
+		}
+		in.ProducerDone()
+		return in
+	}
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	t.Run("ReadAll", func(t *testing.T) {
+		in := makeInput(100)
+		p := startRowPrefetcher(ctx, in, evalCtx.Mon)
+		var numRows, numMeta int
+		for {
+			row, meta := p.Next()
+			if meta.Err != nil {
+				t.Fatal(meta.Err)
+			}
+			if !meta.Empty() {
+				numMeta++
+				continue
+			}
+			if row == nil {
+				break
+			}
+			if expected := makeRow(numRows).String(); row.String() != expected {
+				t.Fatalf("expected row %s, got %s", expected, row)
+			}
+			numRows++
+		}
+		p.Close(ctx)
+		if numRows != 100 || numMeta != 10 {
+			t.Fatalf("expected 100 rows and 10 metadata records, got %d and %d", numRows, numMeta)
+		}
+		if n := evalCtx.Mon.GetCurrentAllocationForTesting(); n != 0 {
+			t.Fatalf("expected all memory to be released, %d bytes still allocated", n)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+		in.Push(makeRow(0), ProducerMetadata{})
+		in.Push(nil /* row */, ProducerMetadata{Err: errors.New("test error")})
+		in.ProducerDone()
+		p := startRowPrefetcher(ctx, in, evalCtx.Mon)
+		defer p.Close(ctx)
+		src := MakeNoMetadataRowSource(p, &RowBuffer{})
+		if row, err := src.NextRow(); err != nil || row == nil {
+			t.Fatalf("expected a row, got %s, %v", row, err)
+		}
+		if _, err := src.NextRow(); !testutils.IsError(err, "test error") {
+			t.Fatalf("expected test error, got %v", err)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		in := makeInput(100)
+		p := startRowPrefetcher(ctx, in, evalCtx.Mon)
+		if row, meta := p.Next(); row == nil || !meta.Empty() {
+			t.Fatalf("expected a row, got %s, %+v", row, meta)
+		}
+		out := &RowBuffer{}
+		DrainAndForwardMetadata(ctx, p, out)
+		p.Close(ctx)
+		if in.ConsumerStatus != DrainRequested {
+			t.Fatalf("expected the input to be drained, got status %d", in.ConsumerStatus)
+		}
+		// All the metadata must have been forwarded, even though the rows were
+		// discarded.
+		numMeta := 0
+		for {
+			row, meta := out.Next()
+			if row == nil && meta.Empty() {
+				break
+			}
+			numMeta++
+		}
+		if numMeta != 10 {
+			t.Fatalf("expected 10 metadata records, got %d", numMeta)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		// The input has more rows than can be buffered, so the background
+		// goroutine blocks until the context is canceled.
+		in := makeInput(10 * rowChannelBufSize)
+		ctx, cancel := context.WithCancel(ctx)
+		p := startRowPrefetcher(ctx, in, evalCtx.Mon)
+		cancel()
+		var err error
+		for {
+			row, meta := p.Next()
+			if meta.Err != nil {
+				err = meta.Err
+			}
+			if row == nil && meta.Empty() {
+				break
+			}
+		}
+		p.Close(ctx)
+		if err != context.Canceled {
+			t.Fatalf("expected context canceled error, got %v", err)
+		}
+		if in.ConsumerStatus != ConsumerClosed {
+			t.Fatalf("expected the input to be closed, got status %d", in.ConsumerStatus)
+		}
+		if n := evalCtx.Mon.GetCurrentAllocationForTesting(); n != 0 {
+			t.Fatalf("expected all memory to be released, %d bytes still allocated", n)
+		}
+	})
+}
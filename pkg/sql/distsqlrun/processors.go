@@ -49,6 +49,8 @@ type procOutputHelper struct {
 	renderExprs []exprHelper
 	renderTypes []sqlbase.ColumnType
 	outputCols  []uint32
+	// outputTypes is the schema of the rows emitted by the helper.
+	outputTypes []sqlbase.ColumnType
 
 	// offset is the number of rows that are suppressed.
 	offset uint64
@@ -103,6 +105,16 @@ func (h *procOutputHelper) init(
 			h.renderTypes[i] = sqlbase.DatumTypeToColumnType(h.renderExprs[i].expr.ResolvedType())
 		}
 	}
+	if h.outputCols != nil {
+		h.outputTypes = make([]sqlbase.ColumnType, len(h.outputCols))
+		for i, col := range h.outputCols {
+			h.outputTypes[i] = types[col]
+		}
+	} else if h.renderExprs != nil {
+		h.outputTypes = h.renderTypes
+	} else {
+		h.outputTypes = types
+	}
 
 	h.offset = post.Offset
 	if post.Limit == 0 || post.Limit >= math.MaxUint64-h.offset {
@@ -284,6 +296,45 @@ func (h *procOutputHelper) emitRow(
 	return NeedMoreRows, nil
 }
 
+// setLimit replaces the limit of the helper, which init takes from the
+// PostProcessSpec, with the given number of rows. Unlike with
+// PostProcessSpec.Limit, a zero limit lets no rows through.
+func (h *procOutputHelper) setLimit(limit uint64) {
+	if limit >= math.MaxUint64-h.offset {
+		h.maxRowIdx = math.MaxUint64
+	} else {
+		h.maxRowIdx = h.offset + limit
+	}
+}
+
+// isNoop returns true if the helper emits every row unchanged: there is no
+// filter, rendering, projection, offset or limit.
+func (h *procOutputHelper) isNoop() bool {
+	return h.filter == nil && h.renderExprs == nil && h.outputCols == nil &&
+		h.offset == 0 && h.maxRowIdx == math.MaxUint64
+}
+
+// skipOffset is used by processors that can discard the rows suppressed by the
+// offset themselves, without pushing them through emitRow. It returns the
+// number of rows that the caller must not emit; emitRow considers them
+// suppressed already. It returns 0 if the offset needs to be applied by emitRow
+// (i.e. there is a filter, which needs to see all the rows, or rows have
+// already been emitted).
+func (h *procOutputHelper) skipOffset() uint64 {
+	if h.filter != nil || h.rowIdx != 0 {
+		return 0
+	}
+	h.rowIdx = h.offset
+	return h.offset
+}
+
+// reset prepares the helper to post-process a new stream of rows, pushing
+// them to the given output.
+func (h *procOutputHelper) reset(output RowReceiver) {
+	h.output = output
+	h.rowIdx = 0
+}
+
 func (h *procOutputHelper) close() {
 	h.output.ProducerDone()
 }
@@ -422,6 +473,12 @@ func newProcessor(
 		}
 		return newAlgebraicSetOp(flowCtx, core.SetOp, inputs[0], inputs[1], post, outputs[0])
 	}
+	if core.Merger != nil {
+		if len(outputs) != 1 {
+			return nil, errors.Errorf("expected 1 output, got %d", len(outputs))
+		}
+		return newMerger(flowCtx, core.Merger, inputs, post, outputs[0])
+	}
 	return nil, errors.Errorf("unsupported processor core %s", core)
 }
 
@@ -17,13 +17,20 @@
 package distsqlrun
 
 import (
+	"bytes"
 	"container/heap"
+	"math"
 	"sort"
+	"sync"
 
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 )
 
@@ -34,8 +41,9 @@ type sortableRowContainer interface {
 	// Sort sorts the rows according to an ordering specified at initialization.
 	Sort()
 	// NewIterator returns a rowIterator that can be used to iterate over
-	// the rows.
-	NewIterator(context.Context) rowIterator
+	// the rows. It returns an error if the rows couldn't be made readable
+	// (e.g. written to temporary storage).
+	NewIterator(context.Context) (rowIterator, error)
 
 	// Close frees up resources held by the sortableRowContainer.
 	Close(context.Context)
@@ -75,6 +83,14 @@ type rowIterator interface {
 	Close()
 }
 
+// memRowOverhead is the memory, in bytes, accounted for each row of a
+// memRowContainer in addition to the size of its datums. The datums decoded for
+// a row use more memory than their sizes reflect, since the allocator rounds
+// the allocations of variable-sized values (e.g. the bytes of a string) up to
+// its size classes. Without this, a sort of many small rows would use more
+// memory than its limit before falling back to disk.
+var memRowOverhead = envutil.EnvOrDefaultInt64("COCKROACH_DISTSQL_ROW_OVERHEAD_BYTES", 16)
+
 // memRowContainer is the wrapper around sqlbase.RowContainer that provides more
 // functionality, especially around converting to/from EncDatumRows and
 // facilitating sorting.
@@ -82,9 +98,32 @@ type memRowContainer struct {
 	sqlbase.RowContainer
 	types         []sqlbase.ColumnType
 	invertSorting bool // Inverts the sorting predicate.
+	stable        bool // Preserves the order of equal rows in Sort.
 	ordering      sqlbase.ColumnOrdering
+	// comparators, if set, contains a comparator for each column of ordering.
+	// The columns with a nil comparator are compared with Datum.Compare.
+	comparators []datumComparator
+	// keyCols, if positive, is the number of leading columns of ordering on
+	// which rows are compared through their key encoding (see useKeys). keys
+	// then holds the encoding of these columns for each row, at the index of
+	// the row, and keyAcc accounts for it.
+	keyCols       int
+	keys          [][]byte
+	keyAcc        mon.BoundAccount
+	scratchKey    []byte
 	scratchRow    parser.Datums
 	scratchEncRow sqlbase.EncDatumRow
+	// comparisons, if set, is incremented for every comparison of two rows made
+	// by the container.
+	comparisons *int64
+	// spillAfterRows, if positive, makes AddRow fail with a memory budget error
+	// once the container holds that many rows, as if the budget was exhausted.
+	// It is only set by tests (see sorter.testingKnobSpillAfterRows).
+	spillAfterRows int
+	// growLimit, if set, is called when a row doesn't fit in the memory budget
+	// of the container. If it returns true, the budget was raised and adding
+	// the row is attempted again.
+	growLimit func(ctx context.Context) bool
 
 	evalCtx *parser.EvalContext
 
@@ -97,26 +136,333 @@ var _ sortableRowContainer = &memRowContainer{}
 func makeRowContainer(
 	ordering sqlbase.ColumnOrdering, types []sqlbase.ColumnType, evalCtx *parser.EvalContext,
 ) memRowContainer {
+	var sv memRowContainer
+	sv.init(ordering, types, evalCtx)
+	return sv
+}
+
+// init initializes the container, accounting its memory usage against the
+// monitor of evalCtx. The scratch rows of a previously used container are
+// reused if they are large enough.
+func (sv *memRowContainer) init(
+	ordering sqlbase.ColumnOrdering, types []sqlbase.ColumnType, evalCtx *parser.EvalContext,
+) {
 	acc := evalCtx.Mon.MakeBoundAccount()
-	return memRowContainer{
-		RowContainer:  sqlbase.MakeRowContainer(acc, sqlbase.ColTypeInfoFromColTypes(types), 0),
-		types:         types,
-		ordering:      ordering,
-		scratchRow:    make(parser.Datums, len(types)),
-		scratchEncRow: make(sqlbase.EncDatumRow, len(types)),
-		evalCtx:       evalCtx,
+	sv.RowContainer = sqlbase.MakeRowContainer(acc, sqlbase.ColTypeInfoFromColTypes(types), 0)
+	sv.SetRowOverhead(memRowOverhead)
+	sv.types = types
+	sv.invertSorting = false
+	sv.stable = false
+	sv.ordering = ordering
+	sv.comparators = nil
+	sv.keyCols = 0
+	sv.keys = sv.keys[:0]
+	sv.keyAcc = evalCtx.Mon.MakeBoundAccount()
+	if cap(sv.scratchRow) >= len(types) {
+		sv.scratchRow = sv.scratchRow[:len(types)]
+		sv.scratchEncRow = sv.scratchEncRow[:len(types)]
+	} else {
+		sv.scratchRow = make(parser.Datums, len(types))
+		sv.scratchEncRow = make(sqlbase.EncDatumRow, len(types))
+	}
+	sv.evalCtx = evalCtx
+}
+
+// rowContainerPool is a pool of memRowContainers. It allows processors that
+// create many short-lived containers (e.g. the sorters of a flow with many
+// small sorts) to reuse their allocations.
+var rowContainerPool = sync.Pool{
+	New: func() interface{} {
+		return &memRowContainer{}
+	},
+}
+
+// getRowContainer returns a memRowContainer from rowContainerPool, initialized
+// like a container created by makeRowContainer. The container must be released
+// with putRowContainer once it is no longer used.
+func getRowContainer(
+	ordering sqlbase.ColumnOrdering, types []sqlbase.ColumnType, evalCtx *parser.EvalContext,
+) *memRowContainer {
+	sv := rowContainerPool.Get().(*memRowContainer)
+	sv.init(ordering, types, evalCtx)
+	return sv
+}
+
+// putRowContainer closes the given container, which releases its rows and the
+// memory accounted for them back to its monitor, and returns it to
+// rowContainerPool. The container must not be closed by the caller.
+func putRowContainer(ctx context.Context, sv *memRowContainer) {
+	sv.Close(ctx)
+	// Don't hold on to the rows, the types or the monitor of the previous user.
+	sv.RowContainer = sqlbase.RowContainer{}
+	for i := range sv.scratchRow {
+		sv.scratchRow[i] = nil
 	}
+	for i := range sv.scratchEncRow {
+		sv.scratchEncRow[i] = sqlbase.EncDatum{}
+	}
+	sv.types = nil
+	sv.ordering = nil
+	sv.comparators = nil
+	sv.keyAcc = mon.BoundAccount{}
+	sv.comparisons = nil
+	sv.growLimit = nil
+	sv.evalCtx = nil
+	rowContainerPool.Put(sv)
+}
+
+// keyComparableTypes are the column types whose key encoding orders their
+// values like Datum.Compare does, equal values included. The other types
+// either can't be key-encoded or have composite key encodings, whose keys can
+// differ for equal values (e.g. the decimals 1.0 and 1.00).
+var keyComparableTypes = map[sqlbase.ColumnType_SemanticType]bool{
+	sqlbase.ColumnType_BOOL:        true,
+	sqlbase.ColumnType_INT:         true,
+	sqlbase.ColumnType_DATE:        true,
+	sqlbase.ColumnType_TIMESTAMP:   true,
+	sqlbase.ColumnType_TIMESTAMPTZ: true,
+	sqlbase.ColumnType_STRING:      true,
+	sqlbase.ColumnType_BYTES:       true,
+	sqlbase.ColumnType_NAME:        true,
+	sqlbase.ColumnType_OID:         true,
+	sqlbase.ColumnType_UUID:        true,
+}
+
+// useKeys makes the container compare its rows through the key encoding of
+// the longest prefix of its ordering columns whose type is in
+// keyComparableTypes and that don't have an explicit NULL ordering (the key
+// encoding orders NULLs first in the direction of the column). The other
+// ordering columns are compared on their datums. It must be called before any
+// row is added.
+//
+// A key is built for every added row, but the encoding of a column is reused
+// if the row already has it (see EncDatum.Encode), which is the case of
+// columns that come from an index with a matching ordering. The keys then only
+// cost a copy, while the comparisons of the sort are plain bytes.Compare
+// calls, which are cheaper than comparing datums.
+func (sv *memRowContainer) useKeys() {
+	sv.keyCols = 0
+	for _, c := range sv.ordering {
+		if c.HasExplicitNullsOrder() || !keyComparableTypes[sv.types[c.ColIdx].SemanticType] {
+			break
+		}
+		sv.keyCols++
+	}
+}
+
+// encodeKey appends the key of row, i.e. the encoding of its first keyCols
+// ordering columns, to buf.
+func (sv *memRowContainer) encodeKey(buf []byte, row sqlbase.EncDatumRow) ([]byte, error) {
+	for _, c := range sv.ordering[:sv.keyCols] {
+		enc := sqlbase.DatumEncoding_ASCENDING_KEY
+		if c.Direction == encoding.Descending {
+			enc = sqlbase.DatumEncoding_DESCENDING_KEY
+		}
+		var err error
+		buf, err = row[c.ColIdx].Encode(&sv.datumAlloc, enc, buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// datumComparator is a comparison function specialized for the datums of a
+// given column type. It compares two datums like Datum.Compare would; the
+// datums can also be NULL.
+type datumComparator func(evalCtx *parser.EvalContext, lhs, rhs parser.Datum) int
+
+// specializedComparators contains the datumComparators of the column types for
+// which the generic comparison is too expensive to be used in hot paths.
+var specializedComparators = map[sqlbase.ColumnType_SemanticType]datumComparator{
+	sqlbase.ColumnType_INT: compareInts,
+}
+
+func compareInts(evalCtx *parser.EvalContext, lhs, rhs parser.Datum) int {
+	l, lok := lhs.(*parser.DInt)
+	r, rok := rhs.(*parser.DInt)
+	if !lok || !rok {
+		// At least one of the datums is NULL.
+		return lhs.Compare(evalCtx, rhs)
+	}
+	switch {
+	case *l < *r:
+		return -1
+	case *l > *r:
+		return 1
+	}
+	return 0
+}
+
+// makeComparators returns the comparators, indexed like the ordering columns,
+// that can be used by a memRowContainer with the given ordering and types. It
+// returns nil if none of the ordering columns has a specialized comparator.
+func makeComparators(
+	ordering sqlbase.ColumnOrdering, types []sqlbase.ColumnType,
+) []datumComparator {
+	var comparators []datumComparator
+	for i, c := range ordering {
+		if cmp, ok := specializedComparators[types[c.ColIdx].SemanticType]; ok {
+			if comparators == nil {
+				comparators = make([]datumComparator, len(ordering))
+			}
+			comparators[i] = cmp
+		}
+	}
+	return comparators
+}
+
+// compare compares two rows like sqlbase.CompareDatums would, using the
+// container's comparators. NULLs are compared without dispatching to the
+// datums, which is cheaper for columns that are mostly NULL.
+func (sv *memRowContainer) compare(lhs, rhs parser.Datums) int {
+	return sv.compareFrom(0, lhs, rhs)
+}
+
+// compareFrom compares two rows like compare does, but only on the ordering
+// columns from the start-th one on.
+func (sv *memRowContainer) compareFrom(start int, lhs, rhs parser.Datums) int {
+	return compareDatumRows(sv.evalCtx, sv.ordering, sv.comparators, start, lhs, rhs)
+}
+
+// NewRowComparator returns a function that compares two rows on the given
+// ordering the way a memRowContainer with that ordering and types sorts them
+// (with the specialized comparators of the column types, see makeComparators).
+// The function returns a negative number if a sorts before b, a positive one
+// if it sorts after b, and 0 if the rows are equal on the ordering.
+//
+// The ordering columns of the rows are decoded in place if needed; an error is
+// returned if one of them fails to decode. The function reuses scratch space
+// across calls and must not be used concurrently.
+func NewRowComparator(
+	ordering sqlbase.ColumnOrdering, types []sqlbase.ColumnType, evalCtx *parser.EvalContext,
+) func(a, b sqlbase.EncDatumRow) (int, error) {
+	comparators := makeComparators(ordering, types)
+	var alloc sqlbase.DatumAlloc
+	lhs, rhs := make(parser.Datums, len(types)), make(parser.Datums, len(types))
+	decode := func(row sqlbase.EncDatumRow, datums parser.Datums) error {
+		for _, c := range ordering {
+			if err := row[c.ColIdx].EnsureDecoded(&alloc); err != nil {
+				return err
+			}
+			datums[c.ColIdx] = row[c.ColIdx].Datum
+		}
+		return nil
+	}
+	return func(a, b sqlbase.EncDatumRow) (int, error) {
+		if err := decode(a, lhs); err != nil {
+			return 0, err
+		}
+		if err := decode(b, rhs); err != nil {
+			return 0, err
+		}
+		return compareDatumRows(evalCtx, ordering, comparators, 0 /* start */, lhs, rhs), nil
+	}
+}
+
+// compareDatumRows compares two rows on the ordering columns from the start-th
+// one on, using the given comparators (indexed like the ordering columns, see
+// makeComparators), which can be nil. NULLs are compared without dispatching
+// to the datums, which is cheaper for columns that are mostly NULL.
+func compareDatumRows(
+	evalCtx *parser.EvalContext,
+	ordering sqlbase.ColumnOrdering,
+	comparators []datumComparator,
+	start int,
+	lhs, rhs parser.Datums,
+) int {
+	for i := start; i < len(ordering); i++ {
+		c := ordering[i]
+		l, r := lhs[c.ColIdx], rhs[c.ColIdx]
+		if lNull, rNull := l == parser.DNull, r == parser.DNull; lNull || rNull {
+			if cmp := compareNulls(c, lNull, rNull); cmp != 0 {
+				return cmp
+			}
+			continue
+		}
+		var cmp int
+		if comparators != nil && comparators[i] != nil {
+			cmp = comparators[i](evalCtx, l, r)
+		} else {
+			cmp = l.Compare(evalCtx, r)
+		}
+		if cmp != 0 {
+			if c.Direction == encoding.Descending {
+				cmp = -cmp
+			}
+			return cmp
+		}
+	}
+	return 0
+}
+
+// compareNulls compares two values of the column of c, at least one of which
+// is NULL, in the direction of the column.
+func compareNulls(c sqlbase.ColumnOrderInfo, lNull, rNull bool) int {
+	cmp, ok := c.CompareNulls(lNull, rNull)
+	if !ok {
+		// Without an explicit NULL ordering, NULLs sort before any other value
+		// (like with Datum.Compare) in the direction of the column.
+		if !rNull {
+			cmp = -1
+		} else if !lNull {
+			cmp = 1
+		}
+		if c.Direction == encoding.Descending {
+			cmp = -cmp
+		}
+	}
+	return cmp
 }
 
 // Less is part of heap.Interface and is only meant to be used internally.
 func (sv *memRowContainer) Less(i, j int) bool {
-	cmp := sqlbase.CompareDatums(sv.ordering, sv.evalCtx, sv.At(i), sv.At(j))
+	sv.countComparison()
+	var cmp int
+	if sv.keyCols > 0 {
+		// The key encoding already accounts for the direction of the columns.
+		if cmp = bytes.Compare(sv.keys[i], sv.keys[j]); cmp == 0 {
+			cmp = sv.compareFrom(sv.keyCols, sv.At(i), sv.At(j))
+		}
+	} else {
+		cmp = sv.compare(sv.At(i), sv.At(j))
+	}
 	if sv.invertSorting {
 		cmp = -cmp
 	}
 	return cmp < 0
 }
 
+// compareEncRow compares row to the idx-th row like Less does. Only the
+// ordering columns of row that aren't compared through its key are decoded.
+// The key of row is left in scratchKey.
+func (sv *memRowContainer) compareEncRow(row sqlbase.EncDatumRow, idx int) (int, error) {
+	sv.countComparison()
+	if sv.keyCols > 0 {
+		var err error
+		if sv.scratchKey, err = sv.encodeKey(sv.scratchKey[:0], row); err != nil {
+			return 0, err
+		}
+		if cmp := bytes.Compare(sv.scratchKey, sv.keys[idx]); cmp != 0 {
+			return cmp, nil
+		}
+	}
+	for _, c := range sv.ordering[sv.keyCols:] {
+		if err := row[c.ColIdx].EnsureDecoded(&sv.datumAlloc); err != nil {
+			return 0, err
+		}
+		sv.scratchRow[c.ColIdx] = row[c.ColIdx].Datum
+	}
+	return sv.compareFrom(sv.keyCols, sv.scratchRow, sv.At(idx)), nil
+}
+
+// countComparison counts a comparison of two rows if comparisons is set.
+func (sv *memRowContainer) countComparison() {
+	if sv.comparisons != nil {
+		*sv.comparisons++
+	}
+}
+
 // EncRow returns the idx-th row as an EncDatumRow. The slice itself is reused
 // so it is only valid until the next call to EncRow.
 func (sv *memRowContainer) EncRow(idx int) sqlbase.EncDatumRow {
@@ -132,22 +478,387 @@ func (sv *memRowContainer) AddRow(ctx context.Context, row sqlbase.EncDatumRow)
 	if len(row) != len(sv.types) {
 		log.Fatalf(ctx, "invalid row length %d, expected %d", len(row), len(sv.types))
 	}
+	if sv.spillAfterRows > 0 && sv.Len() >= sv.spillAfterRows {
+		return pgerror.NewErrorf(pgerror.CodeOutOfMemoryError,
+			"memory budget exceeded: testing knob limit of %d rows reached", sv.spillAfterRows)
+	}
+	for {
+		err := sv.addRow(ctx, row)
+		if pgErr, ok := err.(*pgerror.Error); !(ok && pgErr.Code == pgerror.CodeOutOfMemoryError) ||
+			sv.growLimit == nil || !sv.growLimit(ctx) {
+			return err
+		}
+	}
+}
+
+// addRow adds a row to the container, whose length has been checked.
+func (sv *memRowContainer) addRow(ctx context.Context, row sqlbase.EncDatumRow) error {
+	var key []byte
+	if sv.keyCols > 0 {
+		var err error
+		if key, err = sv.encodeKey(nil, row); err != nil {
+			return err
+		}
+		if err := sv.keyAcc.Grow(ctx, int64(len(key))); err != nil {
+			return err
+		}
+	}
 	for i := range row {
 		err := row[i].EnsureDecoded(&sv.datumAlloc)
 		if err != nil {
+			sv.keyAcc.Shrink(ctx, int64(len(key)))
 			return err
 		}
 		sv.scratchRow[i] = row[i].Datum
 	}
-	_, err := sv.RowContainer.AddRow(ctx, sv.scratchRow)
-	return err
+	if _, err := sv.RowContainer.AddRow(ctx, sv.scratchRow); err != nil {
+		sv.keyAcc.Shrink(ctx, int64(len(key)))
+		return err
+	}
+	if sv.keyCols > 0 {
+		sv.keys = append(sv.keys, key)
+	}
+	return nil
+}
+
+// Swap is part of sort.Interface.
+func (sv *memRowContainer) Swap(i, j int) {
+	sv.RowContainer.Swap(i, j)
+	if sv.keyCols > 0 {
+		sv.keys[i], sv.keys[j] = sv.keys[j], sv.keys[i]
+	}
+}
+
+// PopFirst discards the first row in the container.
+func (sv *memRowContainer) PopFirst() {
+	sv.RowContainer.PopFirst()
+	if sv.keyCols > 0 {
+		sv.keys[0] = nil
+		sv.keys = sv.keys[1:]
+	}
+}
+
+// MemUsage returns the memory accounted for the rows of the container,
+// including their keys.
+func (sv *memRowContainer) MemUsage() int64 {
+	return sv.RowContainer.MemUsage() + sv.keyAcc.CurrentlyAllocated()
+}
+
+// Clear removes all the rows from the container and releases their memory.
+func (sv *memRowContainer) Clear(ctx context.Context) {
+	sv.RowContainer.Clear(ctx)
+	sv.clearKeys()
+	sv.keyAcc.Clear(ctx)
+}
+
+// Close releases the rows and their memory.
+func (sv *memRowContainer) Close(ctx context.Context) {
+	sv.RowContainer.Close(ctx)
+	sv.clearKeys()
+	sv.keyAcc.Close(ctx)
+}
+
+func (sv *memRowContainer) clearKeys() {
+	for i := range sv.keys {
+		sv.keys[i] = nil
+	}
+	sv.keys = sv.keys[:0]
 }
 
+// Sort is part of the sortableRowContainer interface. If the container is
+// stable, rows that are equal according to the ordering keep the order in
+// which they were added.
 func (sv *memRowContainer) Sort() {
 	sv.invertSorting = false
+	if sv.stable {
+		sort.Stable(sv)
+		return
+	}
 	sort.Sort(sv)
 }
 
+// columnarSortTypes are the column types whose values sortColumnar extracts
+// into typed slices: they are all fixed-width numbers.
+var columnarSortTypes = map[sqlbase.ColumnType_SemanticType]bool{
+	sqlbase.ColumnType_INT:   true,
+	sqlbase.ColumnType_DATE:  true,
+	sqlbase.ColumnType_FLOAT: true,
+}
+
+// sortColumnar sorts the rows like Sort does, for orderings whose columns all
+// have a type in columnarSortTypes. The values of the ordering columns are
+// first extracted into typed slices, and a permutation of the rows is sorted
+// on them: this is faster than comparing the datums of the rows since the
+// values being compared are contiguous in memory, and compared without
+// dispatching on their type. The rows are then reordered according to the
+// permutation.
+//
+// It returns false, without sorting the rows, if an ordering column has
+// another type (or a datum that isn't of the column's type, e.g. a wrapped
+// one), or if the memory for the slices can't be allocated. Sort must then be
+// used instead.
+func (sv *memRowContainer) sortColumnar(ctx context.Context) bool {
+	n := sv.Len()
+	if n < 2 || len(sv.ordering) == 0 {
+		return false
+	}
+	for _, c := range sv.ordering {
+		if !columnarSortTypes[sv.types[c.ColIdx].SemanticType] {
+			return false
+		}
+	}
+	// Every row takes a value and a NULL flag for each column, and an index in
+	// the permutation.
+	acc := sv.evalCtx.Mon.MakeBoundAccount()
+	defer acc.Close(ctx)
+	if err := acc.Grow(ctx, int64(n)*(int64(len(sv.ordering))*9+8)); err != nil {
+		return false
+	}
+	keys := make([]columnarSortKey, len(sv.ordering))
+	for k, c := range sv.ordering {
+		key := &keys[k]
+		key.order = c
+		if key.isFloat = sv.types[c.ColIdx].SemanticType == sqlbase.ColumnType_FLOAT; key.isFloat {
+			key.floats = make([]float64, n)
+		} else {
+			key.ints = make([]int64, n)
+		}
+		for i := 0; i < n; i++ {
+			if !key.set(i, sv.At(i)[c.ColIdx]) {
+				return false
+			}
+		}
+	}
+	s := columnarSorter{sv: sv, keys: keys, perm: make([]int, n)}
+	for i := range s.perm {
+		s.perm[i] = i
+	}
+	if sv.stable {
+		sort.Stable(&s)
+	} else {
+		sort.Sort(&s)
+	}
+	sv.permute(s.perm)
+	sv.invertSorting = false
+	return true
+}
+
+// permute reorders the rows so that the i-th row is the one that was at index
+// perm[i]. perm is reset to the identity permutation.
+func (sv *memRowContainer) permute(perm []int) {
+	for i := range perm {
+		// Follow the cycle of the permutation that starts at i: every swap
+		// moves a row into its place, and the row that was at i to the next
+		// place of the cycle, which is where it belongs once the cycle is
+		// closed.
+		cur := i
+		for perm[cur] != i {
+			next := perm[cur]
+			sv.Swap(cur, next)
+			perm[cur] = cur
+			cur = next
+		}
+		perm[cur] = cur
+	}
+}
+
+// maxSortBuckets is the number of distinct values up to which the chunks of
+// rows with low-cardinality ordering columns are sorted with sortBuckets. With
+// more values, looking up the bucket of every row costs about as many
+// comparisons as sorting the rows.
+const maxSortBuckets = 64
+
+// sortBuckets sorts the rows like a stable Sort does, for rows that have few
+// distinct values on the ordering columns from the start-th one on and are
+// equal on the ones before it (e.g. a chunk of the sortChunksStrategy, whose
+// rows share an ordering prefix). The distinct values, each represented by the
+// first row that holds it, are kept sorted, and each row is looked up among
+// them with a binary search: this takes O(n*log(b)) comparisons for b distinct
+// values, rather than O(n*log(n)). The rows are then placed bucket by bucket,
+// in the order in which they were added.
+//
+// It returns false, leaving the rows in their order, if the rows have more than
+// maxBuckets distinct values or if the memory for the buckets can't be
+// allocated. Sort must then be used instead.
+func (sv *memRowContainer) sortBuckets(ctx context.Context, start int, maxBuckets int) bool {
+	n := sv.Len()
+	if n < 2 {
+		return false
+	}
+	// Every row takes the id of its bucket and an index in the permutation.
+	acc := sv.evalCtx.Mon.MakeBoundAccount()
+	defer acc.Close(ctx)
+	if err := acc.Grow(ctx, int64(n)*16); err != nil {
+		return false
+	}
+	// The ids of the buckets are the order in which they were created: first
+	// holds the index of the first row of each bucket, and sorted the ids in
+	// the order of the values of their rows.
+	first := make([]int, 0, maxBuckets)
+	sorted := make([]int, 0, maxBuckets)
+	rowBuckets := make([]int, n)
+	for i := 0; i < n; i++ {
+		row := sv.At(i)
+		// Find the first bucket whose value doesn't sort before the row's.
+		lo, hi := 0, len(sorted)
+		for lo < hi {
+			mid := (lo + hi) / 2
+			sv.countComparison()
+			cmp := sv.compareFrom(start, sv.At(first[sorted[mid]]), row)
+			if cmp == 0 {
+				lo, hi = mid, -1
+				break
+			}
+			if cmp < 0 {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if hi == -1 {
+			rowBuckets[i] = sorted[lo]
+			continue
+		}
+		if len(first) == maxBuckets {
+			return false
+		}
+		id := len(first)
+		first = append(first, i)
+		sorted = append(sorted, 0)
+		copy(sorted[lo+1:], sorted[lo:])
+		sorted[lo] = id
+		rowBuckets[i] = id
+	}
+	// offsets[id] is the position of the next row of the bucket.
+	offsets := make([]int, len(first))
+	for _, id := range rowBuckets {
+		offsets[id]++
+	}
+	pos := 0
+	for _, id := range sorted {
+		pos, offsets[id] = pos+offsets[id], pos
+	}
+	perm := make([]int, n)
+	for i, id := range rowBuckets {
+		perm[offsets[id]] = i
+		offsets[id]++
+	}
+	sv.permute(perm)
+	sv.invertSorting = false
+	return true
+}
+
+// columnarSortKey holds the values of an ordering column of the rows of a
+// memRowContainer, indexed like the rows, for sortColumnar. Either ints or
+// floats is used, depending on isFloat.
+type columnarSortKey struct {
+	order   sqlbase.ColumnOrderInfo
+	isFloat bool
+	ints    []int64
+	floats  []float64
+	// nulls, if set, tells which rows have a NULL in the column. It is only
+	// allocated if the column has NULLs.
+	nulls []bool
+}
+
+// set sets the value of the i-th row. It returns false if the datum isn't of
+// the type of the column.
+func (k *columnarSortKey) set(i int, d parser.Datum) bool {
+	switch t := d.(type) {
+	case *parser.DInt:
+		if k.isFloat {
+			return false
+		}
+		k.ints[i] = int64(*t)
+		return true
+	case *parser.DDate:
+		if k.isFloat {
+			return false
+		}
+		k.ints[i] = int64(*t)
+		return true
+	case *parser.DFloat:
+		if !k.isFloat {
+			return false
+		}
+		k.floats[i] = float64(*t)
+		return true
+	}
+	if d != parser.DNull {
+		return false
+	}
+	if k.nulls == nil {
+		k.nulls = make([]bool, len(k.ints)+len(k.floats))
+	}
+	k.nulls[i] = true
+	return true
+}
+
+// compare compares the values of the i-th and j-th rows like compareFrom
+// compares datums, in the direction of the column.
+func (k *columnarSortKey) compare(i, j int) int {
+	if k.nulls != nil {
+		if lNull, rNull := k.nulls[i], k.nulls[j]; lNull || rNull {
+			return compareNulls(k.order, lNull, rNull)
+		}
+	}
+	var cmp int
+	if k.isFloat {
+		l, r := k.floats[i], k.floats[j]
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		case l != r:
+			// At least one of the values is NaN, which sorts before the other
+			// values (like with DFloat.Compare).
+			if lNaN, rNaN := math.IsNaN(l), math.IsNaN(r); lNaN && !rNaN {
+				cmp = -1
+			} else if !lNaN && rNaN {
+				cmp = 1
+			}
+		}
+	} else {
+		l, r := k.ints[i], k.ints[j]
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+	}
+	if k.order.Direction == encoding.Descending {
+		cmp = -cmp
+	}
+	return cmp
+}
+
+// columnarSorter sorts a permutation of the rows of a memRowContainer on the
+// values of their ordering columns.
+type columnarSorter struct {
+	sv   *memRowContainer
+	keys []columnarSortKey
+	perm []int
+}
+
+var _ sort.Interface = &columnarSorter{}
+
+func (s *columnarSorter) Len() int { return len(s.perm) }
+
+func (s *columnarSorter) Swap(i, j int) { s.perm[i], s.perm[j] = s.perm[j], s.perm[i] }
+
+func (s *columnarSorter) Less(i, j int) bool {
+	s.sv.countComparison()
+	a, b := s.perm[i], s.perm[j]
+	for k := range s.keys {
+		if cmp := s.keys[k].compare(a, b); cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return false
+}
+
 // Push is part of heap.Interface.
 func (sv *memRowContainer) Push(_ interface{}) { panic("unimplemented") }
 
@@ -156,22 +867,39 @@ func (sv *memRowContainer) Pop() interface{} { panic("unimplemented") }
 
 // MaybeReplaceMax replaces the maximum element with the given row, if it is smaller.
 // Assumes InitMaxHeap was called.
-func (sv *memRowContainer) MaybeReplaceMax(row sqlbase.EncDatumRow) error {
-	max := sv.At(0)
-	cmp, err := row.CompareToDatums(&sv.datumAlloc, sv.ordering, sv.evalCtx, max)
+func (sv *memRowContainer) MaybeReplaceMax(ctx context.Context, row sqlbase.EncDatumRow) error {
+	cmp, err := sv.compareEncRow(row, 0)
 	if err != nil {
 		return err
 	}
 	if cmp < 0 {
 		// row is smaller than the max; replace.
-		for i := range row {
-			if err := row[i].EnsureDecoded(&sv.datumAlloc); err != nil {
-				return err
-			}
-			max[i] = row[i].Datum
+		return sv.replaceMax(ctx, row)
+	}
+	return nil
+}
+
+// replaceMax replaces the maximum element with the given row, which must be
+// smaller and must have just been compared to it with compareEncRow. Assumes
+// InitMaxHeap was called.
+func (sv *memRowContainer) replaceMax(ctx context.Context, row sqlbase.EncDatumRow) error {
+	if sv.keyCols > 0 {
+		// The key of row was left in scratchKey by compareEncRow.
+		if err := sv.keyAcc.ResizeItem(
+			ctx, int64(len(sv.keys[0])), int64(len(sv.scratchKey)),
+		); err != nil {
+			return err
 		}
-		heap.Fix(sv, 0)
+		sv.keys[0] = append(sv.keys[0][:0], sv.scratchKey...)
 	}
+	max := sv.At(0)
+	for i := range row {
+		if err := row[i].EnsureDecoded(&sv.datumAlloc); err != nil {
+			return err
+		}
+		max[i] = row[i].Datum
+	}
+	heap.Fix(sv, 0)
 	return nil
 }
 
@@ -181,6 +909,43 @@ func (sv *memRowContainer) InitMaxHeap() {
 	heap.Init(sv)
 }
 
+// SortLargest arranges the n largest rows of a max-heap (see InitMaxHeap) in
+// ascending order at the end of the container, by repeatedly moving the
+// maximum of the heap past its end. The order of the other rows is left
+// unspecified. This costs O(n*log(Len())) instead of the O(Len()*log(Len())) of
+// Sort, which is cheaper when only a suffix of the sorted rows is needed.
+func (sv *memRowContainer) SortLargest(n int) {
+	h := heapPrefix{memRowContainer: sv, n: sv.Len()}
+	for i := 0; i < n && h.n > 0; i++ {
+		heap.Pop(&h)
+	}
+	sv.invertSorting = false
+}
+
+// heapPrefix is a heap.Interface over the first n rows of a memRowContainer.
+// Popping from it moves the root of the heap (the maximum of a max-heap, see
+// InitMaxHeap, or else the minimum) right past the end of the prefix and
+// shrinks the prefix.
+type heapPrefix struct {
+	*memRowContainer
+	n int
+}
+
+var _ heap.Interface = &heapPrefix{}
+
+// Len is part of heap.Interface.
+func (h *heapPrefix) Len() int { return h.n }
+
+// Push is part of heap.Interface.
+func (h *heapPrefix) Push(_ interface{}) { panic("unimplemented") }
+
+// Pop is part of heap.Interface. The popped row has already been swapped
+// to the end of the prefix by heap.Pop, so it only needs to be excluded.
+func (h *heapPrefix) Pop() interface{} {
+	h.n--
+	return nil
+}
+
 // memRowIterator is a rowIterator that iterates over a memRowContainer. This
 // iterator doesn't iterate over a snapshot of memRowContainer and deletes rows
 // as soon as they are iterated over to free up memory eagerly.
@@ -194,8 +959,8 @@ var _ rowIterator = memRowIterator{}
 // memRowContainer. Note that this iterator doesn't iterate over a snapshot
 // of memRowContainer and that it deletes rows as soon as they are iterated
 // over.
-func (sv *memRowContainer) NewIterator(_ context.Context) rowIterator {
-	return memRowIterator{memRowContainer: sv}
+func (sv *memRowContainer) NewIterator(_ context.Context) (rowIterator, error) {
+	return memRowIterator{memRowContainer: sv}, nil
 }
 
 // Rewind implements the rowIterator interface.
@@ -0,0 +1,776 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+// TestRowContainerPool verifies that containers obtained from the pool don't
+// leak memory accounting or rows from their previous users.
+func TestRowContainerPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+	for _, numCols := range []int{3, 1, 5} {
+		types := make([]sqlbase.ColumnType, numCols)
+		for i := range types {
+			types[i] = columnTypeInt
+		}
+		sv := getRowContainer(ordering, types, &evalCtx)
+		if sv.Len() != 0 {
+			t.Fatalf("expected an empty container, got %d rows", sv.Len())
+		}
+		for i := 10; i > 0; i-- {
+			row := make(sqlbase.EncDatumRow, numCols)
+			for j := range row {
+				row[j] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i)))
+			}
+			if err := sv.AddRow(ctx, row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sv.Sort()
+		if row := sv.EncRow(0); len(row) != numCols {
+			t.Fatalf("expected %d columns, got %d", numCols, len(row))
+		} else if row[0].String() != "1" {
+			t.Fatalf("expected the smallest row first, got %s", row)
+		}
+		if evalCtx.Mon.GetCurrentAllocationForTesting() == 0 {
+			t.Fatal("expected the rows to be accounted for")
+		}
+		putRowContainer(ctx, sv)
+		if n := evalCtx.Mon.GetCurrentAllocationForTesting(); n != 0 {
+			t.Fatalf("expected all memory to be released, %d bytes still allocated", n)
+		}
+	}
+}
+
+// TestRowContainerComparators verifies that the container compares rows like
+// sqlbase.CompareDatums, with or without the specialized comparators, and that
+// sorting with them gives the same results. It also verifies that the
+// functions returned by NewRowComparator compare encoded rows the same way.
+func TestRowContainerComparators(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	rng, _ := randutil.NewPseudoRand()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeString, columnTypeInt}
+	rows := make(sqlbase.EncDatumRows, 200)
+	for i := range rows {
+		rows[i] = make(sqlbase.EncDatumRow, len(types))
+		for j, typ := range types {
+			var d parser.Datum = parser.DNull
+			if rng.Intn(10) != 0 {
+				if typ.SemanticType == sqlbase.ColumnType_INT {
+					d = parser.NewDInt(parser.DInt(rng.Intn(20) - 10))
+				} else {
+					d = parser.NewDString(fmt.Sprint(rng.Intn(20)))
+				}
+			}
+			rows[i][j] = sqlbase.DatumToEncDatum(typ, d)
+		}
+	}
+
+	for _, ordering := range []sqlbase.ColumnOrdering{
+		{{ColIdx: 0, Direction: encoding.Ascending}},
+		{{ColIdx: 2, Direction: encoding.Descending}, {ColIdx: 1, Direction: encoding.Ascending}},
+		{
+			{ColIdx: 1, Direction: encoding.Descending},
+			{ColIdx: 0, Direction: encoding.Descending, NullsOrder: sqlbase.NullsFirst},
+			{ColIdx: 2, Direction: encoding.Ascending, NullsOrder: sqlbase.NullsLast},
+		},
+	} {
+		sortRows := func(comparators []datumComparator) string {
+			sv := makeRowContainer(ordering, types, &evalCtx)
+			defer sv.Close(ctx)
+			sv.comparators = comparators
+			for _, row := range rows {
+				if err := sv.AddRow(ctx, row); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sv.Sort()
+			var sorted sqlbase.EncDatumRows
+			for sv.Len() > 0 {
+				// Only the ordering columns are compared since the sort isn't
+				// stable.
+				var row sqlbase.EncDatumRow
+				for _, c := range ordering {
+					row = append(row, sv.EncRow(0)[c.ColIdx])
+				}
+				sorted = append(sorted, row)
+				sv.PopFirst()
+			}
+			return sorted.String()
+		}
+		comparators := makeComparators(ordering, types)
+		if comparators == nil {
+			t.Fatalf("expected specialized comparators for ordering %v", ordering)
+		}
+		if expected, actual := sortRows(nil), sortRows(comparators); expected != actual {
+			t.Errorf("ordering %v: expected\n%s\ngot\n%s", ordering, expected, actual)
+		}
+
+		var alloc sqlbase.DatumAlloc
+		datums := make([]parser.Datums, len(rows))
+		for i, row := range rows {
+			datums[i] = make(parser.Datums, len(row))
+			for j := range row {
+				if err := row[j].EnsureDecoded(&alloc); err != nil {
+					t.Fatal(err)
+				}
+				datums[i][j] = row[j].Datum
+			}
+		}
+		for _, cmps := range [][]datumComparator{nil, comparators} {
+			sv := makeRowContainer(ordering, types, &evalCtx)
+			sv.comparators = cmps
+			for _, l := range datums {
+				for _, r := range datums {
+					if expected, actual := sqlbase.CompareDatums(ordering, &evalCtx, l, r),
+						sv.compare(l, r); expected != actual {
+						t.Fatalf("ordering %v: expected %s vs %s to be %d, got %d",
+							ordering, l, r, expected, actual)
+					}
+				}
+			}
+			sv.Close(ctx)
+		}
+
+		// The rows are re-encoded so that the comparator has to decode them.
+		encoded := make(sqlbase.EncDatumRows, len(rows))
+		for i, row := range rows {
+			encoded[i] = make(sqlbase.EncDatumRow, len(row))
+			for j := range row {
+				enc, err := row[j].Encode(&alloc, sqlbase.DatumEncoding_VALUE, nil /* appendTo */)
+				if err != nil {
+					t.Fatal(err)
+				}
+				encoded[i][j] = sqlbase.EncDatumFromEncoded(types[j], sqlbase.DatumEncoding_VALUE, enc)
+			}
+		}
+		compare := NewRowComparator(ordering, types, &evalCtx)
+		for i, l := range encoded {
+			for j, r := range encoded {
+				actual, err := compare(l, r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected := sqlbase.CompareDatums(
+					ordering, &evalCtx, datums[i], datums[j],
+				); expected != actual {
+					t.Fatalf("ordering %v: expected %s vs %s to be %d, got %d",
+						ordering, l, r, expected, actual)
+				}
+			}
+		}
+		// A row that doesn't decode is reported instead of compared.
+		corrupt := make(sqlbase.EncDatumRow, len(types))
+		copy(corrupt, encoded[0])
+		colIdx := ordering[0].ColIdx
+		corrupt[colIdx] = sqlbase.EncDatumFromEncoded(
+			types[colIdx], sqlbase.DatumEncoding_VALUE, []byte{0xff},
+		)
+		if _, err := compare(corrupt, encoded[1]); err == nil {
+			t.Fatalf("ordering %v: expected an error comparing %s", ordering, corrupt)
+		}
+	}
+}
+
+// TestRowContainerSortColumnar verifies that sortColumnar sorts rows like
+// Sort, and that it refuses to sort orderings on other types than those of
+// columnarSortTypes.
+func TestRowContainerSortColumnar(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	rng, _ := randutil.NewPseudoRand()
+
+	// The last column is unique so that the sorts can be compared on whole rows
+	// when they are stable.
+	types := []sqlbase.ColumnType{
+		{SemanticType: sqlbase.ColumnType_INT},
+		{SemanticType: sqlbase.ColumnType_FLOAT},
+		{SemanticType: sqlbase.ColumnType_DATE},
+		{SemanticType: sqlbase.ColumnType_STRING},
+		{SemanticType: sqlbase.ColumnType_INT},
+	}
+	floats := []float64{math.NaN(), math.Inf(-1), -1.5, math.Copysign(0, -1), 0, 2.5, math.Inf(1)}
+	rows := make(sqlbase.EncDatumRows, 300)
+	for i := range rows {
+		rows[i] = make(sqlbase.EncDatumRow, len(types))
+		for j, typ := range types {
+			var d parser.Datum = parser.DNull
+			switch {
+			case j == len(types)-1:
+				d = parser.NewDInt(parser.DInt(i))
+			case rng.Intn(10) == 0:
+			case typ.SemanticType == sqlbase.ColumnType_INT:
+				d = parser.NewDInt(parser.DInt(rng.Intn(20) - 10))
+			case typ.SemanticType == sqlbase.ColumnType_FLOAT:
+				d = parser.NewDFloat(parser.DFloat(floats[rng.Intn(len(floats))]))
+			case typ.SemanticType == sqlbase.ColumnType_DATE:
+				d = parser.NewDDate(parser.DDate(rng.Intn(20) - 10))
+			default:
+				d = parser.NewDString(fmt.Sprint(rng.Intn(20)))
+			}
+			rows[i][j] = sqlbase.DatumToEncDatum(typ, d)
+		}
+	}
+
+	for _, ordering := range []sqlbase.ColumnOrdering{
+		{{ColIdx: 0, Direction: encoding.Ascending}},
+		{{ColIdx: 1, Direction: encoding.Descending}},
+		{{ColIdx: 2, Direction: encoding.Descending}, {ColIdx: 1, Direction: encoding.Ascending}},
+		{
+			{ColIdx: 1, Direction: encoding.Ascending, NullsOrder: sqlbase.NullsLast},
+			{ColIdx: 0, Direction: encoding.Descending, NullsOrder: sqlbase.NullsFirst},
+			{ColIdx: 2, Direction: encoding.Ascending},
+		},
+	} {
+		for _, stable := range []bool{false, true} {
+			sortRows := func(columnar bool) string {
+				sv := makeRowContainer(ordering, types, &evalCtx)
+				defer sv.Close(ctx)
+				sv.stable = stable
+				for _, row := range rows {
+					if err := sv.AddRow(ctx, row); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !columnar {
+					sv.Sort()
+				} else if !sv.sortColumnar(ctx) {
+					t.Fatalf("ordering %v: expected a columnar sort", ordering)
+				}
+				var sorted sqlbase.EncDatumRows
+				for sv.Len() > 0 {
+					row := sv.EncRow(0)
+					if !stable {
+						// Only the ordering columns are compared since the sort
+						// isn't stable.
+						row = nil
+						for _, c := range ordering {
+							row = append(row, sv.EncRow(0)[c.ColIdx])
+						}
+					}
+					sorted = append(sorted, append(sqlbase.EncDatumRow(nil), row...))
+					sv.PopFirst()
+				}
+				return sorted.String()
+			}
+			if expected, actual := sortRows(false), sortRows(true); expected != actual {
+				t.Errorf("ordering %v, stable %t: expected\n%s\ngot\n%s",
+					ordering, stable, expected, actual)
+			}
+		}
+	}
+
+	sv := makeRowContainer(
+		sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending}, {ColIdx: 3, Direction: encoding.Ascending},
+		},
+		types, &evalCtx,
+	)
+	defer sv.Close(ctx)
+	for _, row := range rows {
+		if err := sv.AddRow(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sv.sortColumnar(ctx) {
+		t.Fatal("expected no columnar sort of an ordering on a STRING column")
+	}
+}
+
+// TestRowContainerSortBuckets verifies that sortBuckets sorts rows like a
+// stable Sort, whether or not the rows share the ordering columns before the
+// ones it buckets on, and that it leaves the rows alone when they have too many
+// distinct values.
+func TestRowContainerSortBuckets(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	rng, _ := randutil.NewPseudoRand()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeString, columnTypeInt}
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Descending},
+	}
+	// The last column is unique so that the sorts can be compared on whole rows.
+	makeRows := func(prefixes, values int) sqlbase.EncDatumRows {
+		rows := make(sqlbase.EncDatumRows, 200)
+		for i := range rows {
+			var d parser.Datum = parser.DNull
+			if v := rng.Intn(values + 1); v < values {
+				d = parser.NewDString(fmt.Sprint(v))
+			}
+			rows[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Intn(prefixes)))),
+				sqlbase.DatumToEncDatum(columnTypeString, d),
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+			}
+		}
+		return rows
+	}
+	sortRows := func(rows sqlbase.EncDatumRows, start int, buckets bool) (string, bool) {
+		sv := makeRowContainer(ordering, types, &evalCtx)
+		defer sv.Close(ctx)
+		sv.stable = true
+		for _, row := range rows {
+			if err := sv.AddRow(ctx, row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ok := true
+		if !buckets {
+			sv.Sort()
+		} else {
+			ok = sv.sortBuckets(ctx, start, 10 /* maxBuckets */)
+		}
+		var sorted sqlbase.EncDatumRows
+		for sv.Len() > 0 {
+			sorted = append(sorted, append(sqlbase.EncDatumRow(nil), sv.EncRow(0)...))
+			sv.PopFirst()
+		}
+		return sorted.String(), ok
+	}
+
+	for _, tc := range []struct {
+		name     string
+		prefixes int
+		start    int
+	}{
+		// The rows share the first column, which isn't compared.
+		{name: "Prefix", prefixes: 1, start: 1},
+		// The rows are bucketed on both ordering columns.
+		{name: "All", prefixes: 3, start: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rows := makeRows(tc.prefixes, 3)
+			expected, _ := sortRows(rows, tc.start, false)
+			actual, ok := sortRows(rows, tc.start, true)
+			if !ok {
+				t.Fatal("expected the rows to be bucketed")
+			}
+			if expected != actual {
+				t.Fatalf("expected\n%s\ngot\n%s", expected, actual)
+			}
+		})
+	}
+
+	t.Run("TooManyBuckets", func(t *testing.T) {
+		rows := makeRows(1, 20)
+		actual, ok := sortRows(rows, 1, true)
+		if ok {
+			t.Fatal("expected too many buckets")
+		}
+		if expected := rows.String(); expected != actual {
+			t.Fatalf("expected the rows to be left alone:\n%s\ngot\n%s", expected, actual)
+		}
+	})
+}
+
+// TestRowContainerSortLargest verifies that SortLargest arranges the largest
+// rows of a max-heap at the end of the container, in the same order as Sort.
+func TestRowContainerSortLargest(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	rng, _ := randutil.NewPseudoRand()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+	const numRows = 50
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Intn(20)))),
+		}
+	}
+
+	// lastRows sorts the rows, either with Sort or with SortLargest, and returns
+	// the last n ones.
+	lastRows := func(n int, sortLargest bool) string {
+		sv := makeRowContainer(ordering, types, &evalCtx)
+		defer sv.Close(ctx)
+		for _, row := range rows {
+			if err := sv.AddRow(ctx, row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if sortLargest {
+			sv.InitMaxHeap()
+			sv.SortLargest(n)
+		} else {
+			sv.Sort()
+		}
+		var sorted sqlbase.EncDatumRows
+		for i := numRows - n; i < numRows; i++ {
+			sorted = append(sorted, sqlbase.EncDatumRow{sv.EncRow(i)[0]})
+		}
+		return sorted.String()
+	}
+	for _, n := range []int{0, 1, 10, numRows - 1, numRows} {
+		if expected, actual := lastRows(n, false), lastRows(n, true); expected != actual {
+			t.Errorf("n=%d: expected\n%s\ngot\n%s", n, expected, actual)
+		}
+	}
+}
+
+// TestRowContainerKeys verifies that a container that compares its rows
+// through their keys (see useKeys) sorts them like one that compares their
+// datums, whether or not the rows are already key-encoded, and with columns
+// that can't be compared through their keys.
+func TestRowContainerKeys(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	rng, _ := randutil.NewPseudoRand()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	columnTypeDecimal := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_DECIMAL}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeString, columnTypeDecimal}
+	const numRows = 200
+	var alloc sqlbase.DatumAlloc
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = make(sqlbase.EncDatumRow, len(types))
+		for j, typ := range types {
+			var d parser.Datum = parser.DNull
+			if rng.Intn(10) != 0 {
+				switch typ.SemanticType {
+				case sqlbase.ColumnType_INT:
+					d = parser.NewDInt(parser.DInt(rng.Intn(20) - 10))
+				case sqlbase.ColumnType_STRING:
+					d = parser.NewDString(fmt.Sprint(rng.Intn(20)))
+				default:
+					dec := &parser.DDecimal{}
+					if err := dec.SetString(fmt.Sprint(rng.Intn(20))); err != nil {
+						t.Fatal(err)
+					}
+					d = dec
+				}
+			}
+			rows[i][j] = sqlbase.DatumToEncDatum(typ, d)
+			if rng.Intn(2) == 0 {
+				// Some of the rows come key-encoded, in either direction.
+				enc := sqlbase.DatumEncoding_ASCENDING_KEY
+				if rng.Intn(2) == 0 {
+					enc = sqlbase.DatumEncoding_DESCENDING_KEY
+				}
+				encoded, err := rows[i][j].Encode(&alloc, enc, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rows[i][j] = sqlbase.EncDatumFromEncoded(typ, enc, encoded)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		ordering sqlbase.ColumnOrdering
+		keyCols  int
+	}{
+		{
+			ordering: sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}},
+			keyCols:  1,
+		},
+		{
+			ordering: sqlbase.ColumnOrdering{
+				{ColIdx: 1, Direction: encoding.Descending},
+				{ColIdx: 0, Direction: encoding.Ascending},
+			},
+			keyCols: 2,
+		},
+		{
+			ordering: sqlbase.ColumnOrdering{
+				{ColIdx: 0, Direction: encoding.Descending},
+				{ColIdx: 2, Direction: encoding.Ascending},
+				{ColIdx: 1, Direction: encoding.Ascending},
+			},
+			keyCols: 1,
+		},
+		{
+			ordering: sqlbase.ColumnOrdering{
+				{ColIdx: 1, Direction: encoding.Ascending},
+				{ColIdx: 0, Direction: encoding.Ascending, NullsOrder: sqlbase.NullsLast},
+			},
+			keyCols: 1,
+		},
+		{
+			ordering: sqlbase.ColumnOrdering{
+				{ColIdx: 2, Direction: encoding.Descending},
+				{ColIdx: 1, Direction: encoding.Descending},
+			},
+			keyCols: 0,
+		},
+	} {
+		ordering := tc.ordering
+		// sortRows sorts the rows, or only keeps the smallest k of them in a
+		// max-heap if k is positive, and returns their ordering columns.
+		sortRows := func(keys bool, k int) string {
+			sv := makeRowContainer(ordering, types, &evalCtx)
+			defer sv.Close(ctx)
+			if keys {
+				sv.useKeys()
+				if sv.keyCols != tc.keyCols {
+					t.Fatalf("ordering %v: expected %d key columns, got %d",
+						ordering, tc.keyCols, sv.keyCols)
+				}
+			}
+			for i, row := range rows {
+				var err error
+				if k == 0 || i < k {
+					err = sv.AddRow(ctx, row)
+				} else {
+					if i == k {
+						sv.InitMaxHeap()
+					}
+					err = sv.MaybeReplaceMax(ctx, row)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			sv.Sort()
+			var sorted sqlbase.EncDatumRows
+			for sv.Len() > 0 {
+				// Only the ordering columns are compared since the sort isn't
+				// stable.
+				var row sqlbase.EncDatumRow
+				for _, c := range ordering {
+					row = append(row, sv.EncRow(0)[c.ColIdx])
+				}
+				sorted = append(sorted, row)
+				sv.PopFirst()
+			}
+			return sorted.String()
+		}
+		for _, k := range []int{0, 10} {
+			if expected, actual := sortRows(false, k), sortRows(true, k); expected != actual {
+				t.Errorf("ordering %v, k=%d: expected\n%s\ngot\n%s", ordering, k, expected, actual)
+			}
+		}
+	}
+	if n := evalCtx.Mon.GetCurrentAllocationForTesting(); n != 0 {
+		t.Fatalf("expected all memory to be released, %d bytes still allocated", n)
+	}
+}
+
+// BenchmarkRowContainerSortAlgorithm compares the in-memory sort algorithms
+// (see sorterAlgorithm) on sorted, reverse-sorted and random inputs, as well as
+// on inputs that are mostly sorted and ones with few distinct values.
+func BenchmarkRowContainerSortAlgorithm(b *testing.B) {
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	rng, _ := randutil.NewPseudoRand()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+	const numRows = 1 << 16
+	for _, input := range []struct {
+		name  string
+		value func(i int) int
+	}{
+		{name: "Sorted", value: func(i int) int { return i }},
+		{name: "Reverse", value: func(i int) int { return numRows - i }},
+		{name: "Random", value: func(int) int { return rng.Int() }},
+		{name: "MostlySorted", value: func(i int) int {
+			if rng.Intn(100) == 0 {
+				return rng.Intn(numRows)
+			}
+			return i
+		}},
+		{name: "FewDistinct", value: func(int) int { return rng.Intn(16) }},
+	} {
+		rows := make(sqlbase.EncDatumRows, numRows)
+		for i := range rows {
+			rows[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(input.value(i)))),
+			}
+		}
+		for _, algorithm := range []struct {
+			name   string
+			stable bool
+		}{
+			{name: "Introsort"},
+			{name: "Mergesort", stable: true},
+		} {
+			b.Run(fmt.Sprintf("%s/%s", input.name, algorithm.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					sv := makeRowContainer(ordering, types, &evalCtx)
+					sv.comparators = makeComparators(ordering, types)
+					sv.stable = algorithm.stable
+					for _, row := range rows {
+						if err := sv.AddRow(ctx, row); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.StartTimer()
+					sv.Sort()
+					b.StopTimer()
+					sv.Close(ctx)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkRowContainerSort(b *testing.B) {
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	rng, _ := randutil.NewPseudoRand()
+
+	// One column integer rows.
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+	for _, numRows := range []int{1 << 12, 1 << 20} {
+		rows := make(sqlbase.EncDatumRows, numRows)
+		for i := range rows {
+			rows[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Int()))),
+			}
+		}
+
+		for _, tc := range []struct {
+			name        string
+			comparators []datumComparator
+			keys        bool
+			columnar    bool
+		}{
+			{name: "Generic"},
+			{name: "Specialized", comparators: makeComparators(ordering, types)},
+			{name: "Keys", keys: true},
+			{name: "Columnar", columnar: true},
+		} {
+			b.Run(fmt.Sprintf("rows=%d/%s", numRows, tc.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					sv := makeRowContainer(ordering, types, &evalCtx)
+					sv.comparators = tc.comparators
+					if tc.keys {
+						sv.useKeys()
+					}
+					for _, row := range rows {
+						if err := sv.AddRow(ctx, row); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.StartTimer()
+					if !tc.columnar {
+						sv.Sort()
+					} else if !sv.sortColumnar(ctx) {
+						b.Fatal("expected a columnar sort")
+					}
+					b.StopTimer()
+					sv.Close(ctx)
+				}
+			})
+		}
+	}
+}
+
+// TestRowContainerMemAccounting verifies that the memory accounted by a
+// memRowContainer holding many small rows is close to the growth of the heap.
+func TestRowContainerMemAccounting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	// The rows are encoded so that their datums are decoded and allocated by
+	// the container, like those of the rows read from a sorter's input.
+	const numRows = 1 << 16
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{columnTypeString}
+	rows := make(sqlbase.EncDatumRows, numRows)
+	var alloc sqlbase.DatumAlloc
+	for i := range rows {
+		d := sqlbase.DatumToEncDatum(
+			columnTypeString, parser.NewDString(fmt.Sprintf("%010d", i)),
+		)
+		enc, err := d.Encode(&alloc, sqlbase.DatumEncoding_VALUE, nil /* appendTo */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.EncDatumFromEncoded(columnTypeString, sqlbase.DatumEncoding_VALUE, enc),
+		}
+	}
+
+	sv := makeRowContainer(sqlbase.ColumnOrdering{}, types, &evalCtx)
+	defer sv.Close(ctx)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for _, row := range rows {
+		if err := sv.AddRow(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(sv)
+
+	heapGrowth := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	accounted := sv.MemUsage()
+	if accounted < heapGrowth*8/10 || accounted > heapGrowth*2 {
+		t.Fatalf("accounted %d bytes for %d rows, but the heap grew by %d bytes",
+			accounted, numRows, heapGrowth)
+	}
+}
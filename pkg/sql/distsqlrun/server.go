@@ -34,6 +34,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
@@ -76,6 +77,70 @@ var distSQLUseTempStorage = settings.RegisterBoolSetting(
 	false,
 )
 
+var distSQLTempStorageCompression = settings.RegisterBoolSetting(
+	"sql.defaults.distsql.tempstorage.compression",
+	"set to true to compress the rows that larger distributed sql queries store on disk",
+	false,
+)
+
+var distSQLTempStorageEncoding = settings.RegisterEnumSetting(
+	"sql.defaults.distsql.tempstorage.encoding",
+	"layout of the rows that larger distributed sql queries store on disk",
+	"row",
+	map[int64]string{
+		int64(diskRowEncodingRow):      "row",
+		int64(diskRowEncodingColumnar): "columnar",
+	},
+)
+
+var distSQLTempStorageColumnEncoding = settings.RegisterEnumSetting(
+	"sql.defaults.distsql.tempstorage.column_encoding",
+	"encoding of the columns of the rows that larger distributed sql queries store on disk, "+
+		"other than those they are sorted on; auto picks the smaller encoding for each column type",
+	"value",
+	map[int64]string{
+		int64(diskColumnEncodingValue): "value",
+		int64(diskColumnEncodingKey):   "key",
+		int64(diskColumnEncodingAuto):  "auto",
+	},
+)
+
+// minTempStorageWriteBatchSize and maxTempStorageWriteBatchSize bound the
+// accepted values of distSQLTempStorageWriteBatchSize: smaller batches would be
+// written to disk for little more than a few rows each, while larger ones would
+// take up a large part of the memory budget of a sort.
+const (
+	minTempStorageWriteBatchSize = 4 << 10
+	maxTempStorageWriteBatchSize = 4 << 20
+)
+
+// distSQLTempStorageWriteBatchSize is the number of bytes of rows that the disk
+// row containers buffer before writing them to temporary storage. The rows
+// aren't written in runs that are merged later: the temporary engine keeps them
+// sorted as they are written, so there is no merge fan-in to trade off against
+// the batch size. Smaller batches only mean more and smaller writes, while
+// larger ones buffer more rows in memory. The batch is accounted against the
+// memory budget of the sort, which falls back to the default batch size of the
+// engine if it doesn't fit.
+var distSQLTempStorageWriteBatchSize = settings.RegisterValidatedByteSizeSetting(
+	"sql.defaults.distsql.tempstorage.write_batch_size",
+	"size of the batches in which larger distributed sql queries write rows to disk",
+	minTempStorageWriteBatchSize,
+	func(v int64) error {
+		if v < minTempStorageWriteBatchSize {
+			return errors.Errorf(
+				"write batch size must be at least %s", humanizeutil.IBytes(minTempStorageWriteBatchSize),
+			)
+		}
+		if v > maxTempStorageWriteBatchSize {
+			return errors.Errorf(
+				"write batch size must be at most %s", humanizeutil.IBytes(maxTempStorageWriteBatchSize),
+			)
+		}
+		return nil
+	},
+)
+
 var noteworthyMemoryUsageBytes = envutil.EnvOrDefaultInt64("COCKROACH_NOTEWORTHY_DISTSQL_MEMORY_USAGE", 10*1024)
 
 // ServerConfig encompasses the configuration required to create a
@@ -103,6 +168,10 @@ type ServerConfig struct {
 	// cockroach node does not have an engine for temporary storage.
 	TempStorage engine.Engine
 
+	// HistogramWindowInterval is (server.Config).HistogramWindowInterval, the
+	// window of the histograms of the server's metrics.
+	HistogramWindowInterval time.Duration
+
 	// NodeID is the id of the node on which this Server is running.
 	NodeID    *base.NodeIDContainer
 	ClusterID uuid.UUID
@@ -119,6 +188,10 @@ type ServerImpl struct {
 	// larger than memory. It can be nil, in which case processors should still
 	// gracefully OOM if the working set gets too large.
 	tempStorage engine.Engine
+	metrics     DistSQLMetrics
+	// sorterSpills keeps track of the sorters running on this node that can
+	// fall back to disk.
+	sorterSpills sorterSpillRegistry
 }
 
 var _ DistSQLServer = &ServerImpl{}
@@ -133,11 +206,31 @@ func NewServer(ctx context.Context, cfg ServerConfig) *ServerImpl {
 		memMonitor: mon.MakeMonitor("distsql",
 			cfg.Counter, cfg.Hist, -1 /* increment: use default block size */, noteworthyMemoryUsageBytes),
 		tempStorage: cfg.TempStorage,
+		metrics:     MakeDistSQLMetrics(cfg.HistogramWindowInterval),
 	}
 	ds.memMonitor.Start(ctx, cfg.ParentMemoryMonitor, mon.BoundAccount{})
 	return ds
 }
 
+// Metrics returns the metrics for the server, which need to be registered
+// by the caller.
+func (ds *ServerImpl) Metrics() DistSQLMetrics {
+	return ds.metrics
+}
+
+// SpillSorters asks the sorters running on this node that can fall back to
+// disk to spill the rows they buffer in memory to temporary storage, in order
+// to relieve memory pressure. It returns the number of sorters that were
+// asked; they spill asynchronously, once they are done with the row that they
+// are processing.
+func (ds *ServerImpl) SpillSorters(ctx context.Context) int {
+	n := ds.sorterSpills.requestSpill()
+	if n > 0 {
+		log.Infof(ctx, "asked %d sorters to spill to disk", n)
+	}
+	return n
+}
+
 // Start launches workers for the server.
 func (ds *ServerImpl) Start() {
 	ds.flowScheduler.Start()
@@ -200,6 +293,8 @@ func (ds *ServerImpl) setupFlow(
 			// own context.
 			return ctx
 		},
+
+		ReverseSortColumns: req.EvalContext.ReverseSortColumns,
 	}
 	evalCtx.SetStmtTimestamp(time.Unix(0 /* sec */, req.EvalContext.StmtTimestampNanos))
 	evalCtx.SetTxnTimestamp(time.Unix(0 /* sec */, req.EvalContext.TxnTimestampNanos))
@@ -219,6 +314,12 @@ func (ds *ServerImpl) setupFlow(
 		testingKnobs:   ds.TestingKnobs,
 		nodeID:         nodeID,
 		tempStorage:    ds.tempStorage,
+		metrics:        &ds.metrics,
+		sorterSpills:   &ds.sorterSpills,
+
+		sendSorterStats:      req.Flow.SendSorterStats,
+		deadlineAwareSorters: req.Flow.DeadlineAwareSorters,
+		sendSorterProgress:   req.Flow.SendSorterProgress,
 	}
 
 	ctx = flowCtx.AnnotateCtx(ctx)
@@ -350,6 +451,14 @@ type TestingKnobs struct {
 	// executing the chunk. It is always called even when the backfill
 	// function returns an error, or if the table has already been dropped.
 	RunAfterBackfillChunk func()
+
+	// DisableSorterTopK makes the sorters sort all their rows when a limit
+	// applies, as if there was no limit. The limit and the offset are then only
+	// applied by the procOutputHelper: the sortAll strategy is used instead of
+	// the sortTopK strategy, and the sortChunks strategy outputs every chunk
+	// without a max-heap. This helps telling the bugs of the sorters' limit
+	// handling apart from those of the post-processing.
+	DisableSorterTopK bool
 }
 
 // ModuleTestingKnobs is part of the base.ModuleTestingKnobs interface.
@@ -0,0 +1,244 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+)
+
+// sortedAggregator aggregates the sorted rows of a sorter that has an
+// aggregation (see SorterSpec.Aggregation), in place of the aggregator that
+// would otherwise consume them. The rows are sorted on the group columns
+// first, so the rows of each group are contiguous: a group is complete, and
+// its aggregated row is output, as soon as a row of the next group is sorted.
+// Unlike the aggregator, only the aggregate functions of the current group are
+// kept.
+type sortedAggregator struct {
+	spec *AggregatorSpec
+	// constructors and outputTypes are those of each aggregation.
+	constructors []func(*parser.EvalContext) parser.AggregateFunc
+	outputTypes  []sqlbase.ColumnType
+	// groupOrdering is the prefix of the sorter's ordering on the group
+	// columns.
+	groupOrdering sqlbase.ColumnOrdering
+
+	// The fields below are reset by start.
+
+	evalCtx *parser.EvalContext
+	// acc accounts for the aggregate functions of the current group and for the
+	// values seen by its DISTINCT aggregations.
+	acc mon.BoundAccount
+	// funcs are the aggregate functions of the current group, or nil if there
+	// is no current group.
+	funcs []parser.AggregateFunc
+	// seen contains, for each DISTINCT aggregation, the encoded values already
+	// added to the current group.
+	seen []map[string]struct{}
+	// group contains the values of the group columns of the current group, at
+	// the index of their column.
+	group parser.Datums
+	// numGroups is the number of groups aggregated so far.
+	numGroups int
+	// done is set once the consumer doesn't need more rows.
+	done bool
+
+	// outRow is reused for the aggregated rows, which are copied when they are
+	// pushed.
+	outRow     sqlbase.EncDatumRow
+	datumAlloc sqlbase.DatumAlloc
+	scratch    []byte
+}
+
+// newSortedAggregator returns the sortedAggregator of a sorter with the given
+// ordering, whose input has the given types.
+func newSortedAggregator(
+	spec *AggregatorSpec, inputTypes []sqlbase.ColumnType, ordering sqlbase.ColumnOrdering,
+) (*sortedAggregator, error) {
+	groupOrdering, err := orderingPrefixOn(spec.GroupCols, len(inputTypes), ordering, "group")
+	if err != nil {
+		return nil, err
+	}
+	constructors, outputTypes, err := makeAggregateConstructors(spec, inputTypes)
+	if err != nil {
+		return nil, err
+	}
+	return &sortedAggregator{
+		spec:          spec,
+		constructors:  constructors,
+		outputTypes:   outputTypes,
+		groupOrdering: groupOrdering,
+		group:         make(parser.Datums, len(inputTypes)),
+		outRow:        make(sqlbase.EncDatumRow, len(spec.Aggregations)),
+	}, nil
+}
+
+// start prepares the aggregator for a run of the sorter. close must be called
+// once the run is done.
+func (a *sortedAggregator) start(evalCtx *parser.EvalContext) {
+	a.evalCtx = evalCtx
+	a.acc = evalCtx.Mon.MakeBoundAccount()
+	a.funcs = nil
+	a.numGroups = 0
+	a.done = false
+}
+
+// close releases the aggregate functions and the memory account.
+func (a *sortedAggregator) close(ctx context.Context) {
+	a.closeFuncs(ctx)
+	a.acc.Close(ctx)
+}
+
+func (a *sortedAggregator) closeFuncs(ctx context.Context) {
+	for _, fn := range a.funcs {
+		fn.Close(ctx)
+	}
+	a.funcs = nil
+	a.acc.Clear(ctx)
+}
+
+// startGroup creates the aggregate functions of a new group.
+func (a *sortedAggregator) startGroup(ctx context.Context) error {
+	if err := a.acc.Grow(ctx, sizeOfAggregateFunc*int64(len(a.constructors))); err != nil {
+		return err
+	}
+	a.funcs = make([]parser.AggregateFunc, len(a.constructors))
+	for i, create := range a.constructors {
+		a.funcs[i] = create(a.evalCtx)
+	}
+	if a.seen == nil {
+		a.seen = make([]map[string]struct{}, len(a.spec.Aggregations))
+	}
+	for i, aggInfo := range a.spec.Aggregations {
+		if aggInfo.Distinct {
+			a.seen[i] = make(map[string]struct{})
+		}
+	}
+	a.numGroups++
+	return nil
+}
+
+// addRow adds a sorted row to its group, first outputting the current group if
+// the row starts a new one.
+func (a *sortedAggregator) addRow(
+	ctx context.Context, s *sorter, row sqlbase.EncDatumRow,
+) (ConsumerStatus, error) {
+	if a.funcs != nil {
+		cmp, err := row.CompareToDatums(&a.datumAlloc, a.groupOrdering, a.evalCtx, a.group)
+		if err != nil {
+			return ConsumerClosed, err
+		}
+		if cmp != 0 {
+			if consumerStatus, err := a.emitGroup(ctx, s); err != nil || consumerStatus != NeedMoreRows {
+				return consumerStatus, err
+			}
+		}
+	}
+	if a.funcs == nil {
+		if err := a.startGroup(ctx); err != nil {
+			return ConsumerClosed, err
+		}
+		for _, c := range a.groupOrdering {
+			if err := row[c.ColIdx].EnsureDecoded(&a.datumAlloc); err != nil {
+				return ConsumerClosed, err
+			}
+			a.group[c.ColIdx] = row[c.ColIdx].Datum
+		}
+	}
+	for i, aggInfo := range a.spec.Aggregations {
+		if aggInfo.FilterColIdx != nil {
+			if err := row[*aggInfo.FilterColIdx].EnsureDecoded(&a.datumAlloc); err != nil {
+				return ConsumerClosed, err
+			}
+			if row[*aggInfo.FilterColIdx].Datum != parser.DBoolTrue {
+				// This row doesn't contribute to this aggregation.
+				continue
+			}
+		}
+		var value parser.Datum
+		if len(aggInfo.ColIdx) != 0 {
+			c := aggInfo.ColIdx[0]
+			if err := row[c].EnsureDecoded(&a.datumAlloc); err != nil {
+				return ConsumerClosed, err
+			}
+			value = row[c].Datum
+		}
+		if seen := a.seen[i]; seen != nil {
+			encoded, err := sqlbase.EncodeDatum(a.scratch[:0], value)
+			if err != nil {
+				return ConsumerClosed, err
+			}
+			a.scratch = encoded
+			if _, ok := seen[string(encoded)]; ok {
+				continue
+			}
+			if err := a.acc.Grow(ctx, int64(len(encoded))); err != nil {
+				return ConsumerClosed, err
+			}
+			seen[string(encoded)] = struct{}{}
+		}
+		if err := a.funcs[i].Add(ctx, value); err != nil {
+			return ConsumerClosed, err
+		}
+	}
+	return NeedMoreRows, nil
+}
+
+// emitGroup outputs the aggregated row of the current group, which is then
+// discarded.
+func (a *sortedAggregator) emitGroup(ctx context.Context, s *sorter) (ConsumerStatus, error) {
+	row := a.outRow
+	for i, fn := range a.funcs {
+		result, err := fn.Result()
+		if err != nil {
+			return ConsumerClosed, err
+		}
+		if result == nil {
+			// Special case useful when this is a local stage of a distributed
+			// aggregation.
+			result = parser.DNull
+		}
+		row[i] = sqlbase.DatumToEncDatum(a.outputTypes[i], result)
+	}
+	a.closeFuncs(ctx)
+	consumerStatus, err := s.pushRow(ctx, row)
+	if err != nil || consumerStatus != NeedMoreRows {
+		a.done = true
+	}
+	return consumerStatus, err
+}
+
+// finish outputs the last group once all the sorted rows have been added,
+// unless the consumer doesn't need more rows.
+func (a *sortedAggregator) finish(ctx context.Context, s *sorter) error {
+	if a.done {
+		return nil
+	}
+	if a.numGroups == 0 && len(a.spec.GroupCols) == 0 {
+		// Queries like `SELECT MAX(n) FROM t` expect a row of NULLs if nothing
+		// was aggregated.
+		if err := a.startGroup(ctx); err != nil {
+			return err
+		}
+	}
+	if a.funcs == nil {
+		return nil
+	}
+	_, err := a.emitGroup(ctx, s)
+	return err
+}
@@ -0,0 +1,292 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+)
+
+// SortedCursor materializes the sorted output of a sorter, which can then be
+// fetched a few rows at a time, e.g. by a SQL cursor. Unlike a
+// sortingRowSource, whose rows are meant to be consumed right away, the rows
+// of a SortedCursor can be retained for as long as the cursor is open.
+//
+// Nothing is read from the input until the first call to Fetch, which runs the
+// sorter (with the same strategy selection and memory monitoring as a sorter
+// processor) to completion and retains all its output rows. The sorter and its
+// input are done once the rows are materialized, so they don't need to be kept
+// open while the rows are fetched.
+//
+// The retained rows are accounted for by a monitor of their own, under the
+// flow's monitor. If temporary storage can be used, the monitor is limited to
+// the sorters' work_mem (see workMemLimit) and the rows are moved to a
+// diskRowContainer once they don't fit in memory anymore; otherwise, the
+// memory budget error is returned by Fetch. The memory of the rows is released
+// when the cursor is closed, or when they are spilled. The rows stored on disk
+// are kept in the order in which they were output, since the diskRowContainer
+// has no ordering (its keys are the row IDs).
+//
+// The SortedCursor is the RowReceiver to which its sorter pushes its output;
+// it is not meant to be used as a RowReceiver otherwise.
+type SortedCursor struct {
+	ctx     context.Context
+	flowCtx *FlowCtx
+	sorter  *sorter
+	types   []sqlbase.ColumnType
+
+	// testingKnobMemLimit, if set, is the limit of the retained rows' monitor,
+	// and makes the rows fall back to disk once it is reached.
+	testingKnobMemLimit int64
+
+	// materialized is set once the sorter has run (or once the cursor has been
+	// closed without running the sorter).
+	materialized bool
+	// consumerStatus is returned to the sorter by Push.
+	consumerStatus ConsumerStatus
+	// err is the first error pushed by the sorter or encountered while
+	// retaining its rows. It is returned by Fetch.
+	err error
+	// meta is the metadata pushed by the sorter, other than errors.
+	meta []ProducerMetadata
+
+	// memMon accounts for the rows retained in memory.
+	memMon  mon.MemoryMonitor
+	evalCtx parser.EvalContext
+	// rows are the retained rows, until they are spilled to disk. The rows
+	// that have been fetched are popped.
+	rows memRowContainer
+	// disk, if set, holds the retained rows once they have been spilled, and
+	// iter the position of the next row to fetch once the rows are fetched.
+	disk *diskRowContainer
+	iter rowIterator
+
+	closed bool
+}
+
+var _ RowReceiver = &SortedCursor{}
+
+// NewSortedCursor returns a SortedCursor over the rows of the given input,
+// sorted according to the spec and with the post-processing spec applied to
+// them. The input is only read once rows are fetched from the cursor. Close
+// must be called once the cursor is no longer used.
+func NewSortedCursor(
+	ctx context.Context,
+	flowCtx *FlowCtx,
+	spec *SorterSpec,
+	input RowSource,
+	post *PostProcessSpec,
+) (*SortedCursor, error) {
+	c := &SortedCursor{ctx: ctx, flowCtx: flowCtx}
+	s, err := newSorter(flowCtx, spec, input, post, c)
+	if err != nil {
+		return nil, err
+	}
+	c.sorter = s
+	c.types = s.out.outputTypes
+	return c, nil
+}
+
+// Types returns the types of the rows of the cursor.
+func (c *SortedCursor) Types() []sqlbase.ColumnType {
+	return c.types
+}
+
+// useTempStorage returns whether the retained rows can fall back to disk.
+func (c *SortedCursor) useTempStorage() bool {
+	return (distSQLUseTempStorage.Get() || c.testingKnobMemLimit > 0) &&
+		c.flowCtx.tempStorage != nil && !c.sorter.diskSpillDisallowed
+}
+
+// materialize runs the sorter, retaining its output.
+func (c *SortedCursor) materialize() {
+	c.materialized = true
+	limit := int64(0)
+	if c.useTempStorage() {
+		limit = c.testingKnobMemLimit
+		if limit <= 0 {
+			limit = workMemLimit(c.flowCtx.evalCtx.Mon)
+		}
+	}
+	parentMon := c.flowCtx.evalCtx.Mon
+	c.memMon = mon.MakeMonitorInheritWithLimit("sortedcursor-mem", limit, parentMon)
+	c.memMon.Start(c.ctx, parentMon, mon.BoundAccount{})
+	c.evalCtx = c.flowCtx.evalCtx
+	c.evalCtx.Mon = &c.memMon
+	c.rows = makeRowContainer(nil /* ordering */, c.types, &c.evalCtx)
+
+	c.sorter.Run(c.ctx, nil /* wg */)
+}
+
+// Push is part of the RowReceiver interface.
+func (c *SortedCursor) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
+	switch c.consumerStatus {
+	case ConsumerClosed:
+		return c.consumerStatus
+	case DrainRequested:
+		if meta.Empty() {
+			return c.consumerStatus
+		}
+	}
+	if row != nil {
+		if err := c.retainRow(row); err != nil {
+			// Only accept metadata from now on.
+			c.setErr(err)
+			c.consumerStatus = DrainRequested
+		}
+		return c.consumerStatus
+	}
+	if meta.Err != nil {
+		c.setErr(meta.Err)
+		return c.consumerStatus
+	}
+	c.meta = append(c.meta, meta)
+	return c.consumerStatus
+}
+
+func (c *SortedCursor) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// retainRow adds a row pushed by the sorter to the retained rows, spilling
+// them to disk if they don't fit in memory. The row is copied (its datums are
+// decoded by the memRowContainer, or encoded by the diskRowContainer), since
+// the sorter reuses its rows.
+func (c *SortedCursor) retainRow(row sqlbase.EncDatumRow) error {
+	if c.disk != nil {
+		return c.disk.AddRow(c.ctx, row)
+	}
+	err := c.rows.AddRow(c.ctx, row)
+	if err == nil {
+		return nil
+	}
+	if pgErr, ok := err.(*pgerror.Error); !(ok && pgErr.Code == pgerror.CodeOutOfMemoryError) ||
+		!c.useTempStorage() {
+		return err
+	}
+	d, err := makeDiskRowContainer(
+		c.ctx, c.types, nil /* ordering */, c.rows, c.flowCtx.tempStorage,
+		distSQLTempStorageCompression.Get(), diskRowEncoding(distSQLTempStorageEncoding.Get()),
+		diskColumnEncoding(distSQLTempStorageColumnEncoding.Get()),
+		int(distSQLTempStorageWriteBatchSize.Get()), c.flowCtx.metrics,
+	)
+	if err != nil {
+		return err
+	}
+	c.disk = &d
+	// The rows are all on disk now.
+	c.rows.Clear(c.ctx)
+	return c.disk.AddRow(c.ctx, row)
+}
+
+// ProducerDone is part of the RowReceiver interface.
+func (c *SortedCursor) ProducerDone() {}
+
+// Fetch returns the next rows of the cursor, at most n of them. Fewer rows are
+// only returned once the last row has been fetched, after which no rows are
+// returned. The first call runs the sorter, which materializes all the rows.
+//
+// If the sorter or the retention of its rows failed, the error is returned by
+// every call, and no rows are returned.
+func (c *SortedCursor) Fetch(n int) (sqlbase.EncDatumRows, error) {
+	if c.closed {
+		return nil, nil
+	}
+	if !c.materialized {
+		c.materialize()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	var rows sqlbase.EncDatumRows
+	for len(rows) < n {
+		row, err := c.nextRow()
+		if err != nil {
+			c.setErr(err)
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// nextRow returns a copy of the next row to fetch, and moves past it. It
+// returns nil once all the rows have been fetched.
+func (c *SortedCursor) nextRow() (sqlbase.EncDatumRow, error) {
+	if c.disk == nil {
+		if c.rows.Len() == 0 {
+			return nil, nil
+		}
+		row := append(sqlbase.EncDatumRow(nil), c.rows.EncRow(0)...)
+		c.rows.PopFirst()
+		return row, nil
+	}
+	if c.iter == nil {
+		iter, err := c.disk.NewIterator(c.ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.iter = iter
+		c.iter.Rewind()
+	}
+	if ok, err := c.iter.Valid(); err != nil || !ok {
+		return nil, err
+	}
+	row, err := c.iter.Row()
+	if err != nil {
+		return nil, err
+	}
+	c.iter.Next()
+	return append(sqlbase.EncDatumRow(nil), row...), nil
+}
+
+// Metadata returns the metadata pushed by the sorter (e.g. its trace data or
+// its stats), other than errors, which are returned by Fetch. It is complete
+// once Fetch has been called.
+func (c *SortedCursor) Metadata() []ProducerMetadata {
+	return c.meta
+}
+
+// Close releases the retained rows. If no rows were fetched, the input is
+// closed without being read.
+func (c *SortedCursor) Close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if !c.materialized {
+		c.materialized = true
+		c.consumerStatus = ConsumerClosed
+		c.sorter.rawInput.ConsumerClosed()
+		return
+	}
+	if c.iter != nil {
+		c.iter.Close()
+	}
+	if c.disk != nil {
+		c.disk.Close(c.ctx)
+	}
+	c.rows.Close(c.ctx)
+	c.memMon.Stop(c.ctx)
+}
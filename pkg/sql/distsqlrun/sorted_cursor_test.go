@@ -0,0 +1,169 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestSortedCursor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	rng, _ := randutil.NewPseudoRand()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 200
+	input := make(sqlbase.EncDatumRows, numRows)
+	expected := make([]int, numRows)
+	for i := range input {
+		v := rng.Intn(numRows)
+		input[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(v))),
+		}
+		expected[i] = v
+	}
+	sort.Ints(expected)
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+		}),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		memLimit int64
+	}{
+		{name: "Memory"},
+		// The retained rows don't fit in memory and are moved to disk.
+		{name: "Disk", memLimit: 1 << 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			in := NewRowBuffer(types, input, RowBufferArgs{})
+			// The metadata of the input is retained.
+			in.Push(nil /* row */, ProducerMetadata{Ranges: []roachpb.RangeInfo{{}}})
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx, tempStorage: tempEngine}
+
+			c, err := NewSortedCursor(ctx, &flowCtx, &spec, in, &PostProcessSpec{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.testingKnobMemLimit = tc.memLimit
+			if in.Done {
+				t.Fatal("input read before Fetch was called")
+			}
+
+			// The rows are fetched a few at a time, after the sorter and its
+			// input are done.
+			var ret []int
+			for {
+				rows, err := c.Fetch(7)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !in.Done {
+					t.Fatal("input not consumed by the first Fetch")
+				}
+				for _, row := range rows {
+					ret = append(ret, int(*row[0].Datum.(*parser.DInt)))
+				}
+				if len(rows) < 7 {
+					break
+				}
+			}
+			if rows, err := c.Fetch(7); err != nil || len(rows) != 0 {
+				t.Fatalf("expected no more rows, got %s, %v", rows, err)
+			}
+			if fmt.Sprint(expected) != fmt.Sprint(ret) {
+				t.Fatalf("expected %v, got %v", expected, ret)
+			}
+			if spilled := c.disk != nil; spilled != (tc.memLimit > 0) {
+				t.Errorf("expected spilled to disk %t, got %t", tc.memLimit > 0, spilled)
+			}
+			if meta := c.Metadata(); len(meta) != 1 || len(meta[0].Ranges) != 1 {
+				t.Errorf("expected the input's metadata, got %+v", meta)
+			}
+			if tc.memLimit == 0 && evalCtx.Mon.GetCurrentAllocationForTesting() == 0 {
+				t.Error("expected the retained rows to be accounted for")
+			}
+
+			c.Close()
+			if n := evalCtx.Mon.GetCurrentAllocationForTesting(); n != 0 {
+				t.Errorf("expected all memory to be released, %d bytes still allocated", n)
+			}
+		})
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		in := NewRowBuffer(types, input, RowBufferArgs{})
+		in.Push(nil /* row */, ProducerMetadata{Err: errors.New("test error")})
+		evalCtx := parser.MakeTestingEvalContext()
+		defer evalCtx.Stop(ctx)
+		flowCtx := FlowCtx{evalCtx: evalCtx}
+
+		c, err := NewSortedCursor(ctx, &flowCtx, &spec, in, &PostProcessSpec{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		for i := 0; i < 2; i++ {
+			if rows, err := c.Fetch(7); !testutils.IsError(err, "test error") || len(rows) != 0 {
+				t.Fatalf("expected the input's error, got %s, %v", rows, err)
+			}
+		}
+	})
+
+	t.Run("CloseBeforeFetch", func(t *testing.T) {
+		in := NewRowBuffer(types, input, RowBufferArgs{})
+		evalCtx := parser.MakeTestingEvalContext()
+		defer evalCtx.Stop(ctx)
+		flowCtx := FlowCtx{evalCtx: evalCtx}
+
+		c, err := NewSortedCursor(ctx, &flowCtx, &spec, in, &PostProcessSpec{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if in.ConsumerStatus != ConsumerClosed {
+			t.Fatalf("expected the input to be closed, got status %d", in.ConsumerStatus)
+		}
+		if rows, err := c.Fetch(7); err != nil || len(rows) != 0 {
+			t.Fatalf("expected no rows after Close, got %s, %v", rows, err)
+		}
+	})
+}
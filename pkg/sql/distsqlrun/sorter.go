@@ -17,16 +17,31 @@
 package distsqlrun
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/pkg/errors"
 )
 
 // sorter sorts the input rows according to the column ordering specified by ordering. Note
@@ -42,45 +57,987 @@ type sorter struct {
 	out      procOutputHelper
 	ordering sqlbase.ColumnOrdering
 	matchLen uint32
+	// specMatchLen is the match length of the spec, after the session's
+	// reversals. matchLen is raised above it when the input is known to be
+	// ordered like the sorter (see initMatchLen).
+	specMatchLen uint32
+	// preferTopK is set if the sortTopKStrategy is used when a limit applies,
+	// even if matchLen is set (see SorterSpec.PreferTopK).
+	preferTopK bool
+	// lowCardinalityChunkColumns is set if the ordering columns after the first
+	// matchLen ones have few distinct values, which the sortChunksStrategy
+	// buckets the rows of its chunks on (see
+	// SorterSpec.LowCardinalityChunkColumns).
+	lowCardinalityChunkColumns bool
 	// count is the maximum number of rows that the sorter will push to the
 	// procOutputHelper. 0 if the sorter should sort and push all the rows from
 	// the input.
 	count int64
+	// countOverflow is set if the limit and offset of the post-processing
+	// stage add up to more rows than the count can hold, in which case count is
+	// 0.
+	countOverflow bool
+	// limitExpr, if set, is the expression of SorterSpec.LimitExpr. It is
+	// evaluated at the start of every run to set count, countOverflow and the
+	// limit of the procOutputHelper (see evalLimit). limitSpec is the spec of
+	// the sorter, which count depends on.
+	limitExpr *exprHelper
+	limitSpec *SorterSpec
+	// memLimit is the memory limit for the in-memory working set of the
+	// sortAllStrategy and sortTopKStrategy, as specified by the spec. If not
+	// positive, the default limit (see workMemLimit) is used instead.
+	memLimit int64
+	// memMonLimit is the limit of the sorter's memory monitor, set during Run.
+	// Zero means no limit.
+	memMonLimit int64
+	// diskSpillDisallowed is set if the sorter must return an error instead of
+	// falling back to disk once memMonLimit is exceeded.
+	diskSpillDisallowed bool
+	// maxRows, if positive, is the maximum number of rows that the sorter can
+	// buffer.
+	maxRows int64
+	// estimatedInputRows, if positive, is the spec's estimate of the number of
+	// input rows, against which the sorter reports the progress of reading its
+	// input (see SorterSpec.EstimatedInputRows).
+	estimatedInputRows int64
+	// partialResultsAfter, if positive, is the time after which the sorter
+	// stops reading its input and outputs the rows read so far (see
+	// SorterSpec.PartialResultsAfterNanos).
+	partialResultsAfter time.Duration
 	// testingKnobMemLimit is used in testing to set a limit on the memory that
-	// should be used by the sortAllStrategy. Minimum value to enable is 1.
+	// should be used by the sortAllStrategy and sortTopKStrategy. Minimum value
+	// to enable is 1.
 	testingKnobMemLimit int64
+	// testingKnobSpillAfterRows is used in testing to make the strategies that
+	// can fall back to disk do so once exactly that many rows are buffered in
+	// memory, whatever their size, as if the memory limit was reached then.
+	// Like testingKnobMemLimit, it enables the use of temporary storage.
+	testingKnobSpillAfterRows int
+	// testingKnobCountComparisons is used in testing to count the comparisons
+	// of rows made by the sorter (see sorterStats.memComparisons).
+	testingKnobCountComparisons bool
+	// testingKnobOnEmitRow, if set, is called by emitRow with every sorted row
+	// that a strategy emits, in order, before the row is deduplicated,
+	// aggregated or post-processed. The row is reused once the call returns.
+	testingKnobOnEmitRow func(row sqlbase.EncDatumRow)
 	// tempStorage is used to store rows when the working set is larger than can
-	// be stored in memory.
+	// be stored in memory. It is flowCtx.tempStorage, but tests can replace it
+	// after newSorter, e.g. with an engine that counts the writes.
 	tempStorage engine.Engine
+	// writeBatchAcc accounts, against the memory monitor of the sort, for the
+	// rows that the disk row container created by spillToDisk buffers before
+	// writing them to tempStorage.
+	writeBatchAcc mon.BoundAccount
+	// stable is set if rows that are equal according to ordering must be output
+	// in the order in which they were read from the input.
+	stable bool
+	// runBoundaries are the indexes of the input rows that start a new sorted
+	// run, if the input consists of runs (see SorterSpec.InputRunBoundaries).
+	runBoundaries []uint64
+	// keyEncodedOrdering is set if the in-memory rows are compared through the
+	// key encoding of their ordering columns (see memRowContainer.useKeys).
+	keyEncodedOrdering bool
+	// seqNums is set if a sequence number column is appended to each row read
+	// from the input and used as a final tie-breaker in the ordering. It is
+	// needed for a stable sort by the strategies that don't otherwise preserve
+	// the input order of equal rows; the column is removed from output rows.
+	seqNums bool
+	// orderingExprs are the expressions of the spec's ordering_exprs. Their
+	// values are computed once per input row and appended to it (before the
+	// sequence number, if any) so that ordering can refer to them; they are
+	// stored in the row containers along with the row, and removed from output
+	// rows. This makes them the way to order by a computed key, e.g. a custom
+	// precedence of values expressed with a CASE: the key is cached with its
+	// row, its memory is accounted for with the row's (and released with it),
+	// and it is spilled to disk with it.
+	orderingExprs []exprHelper
+	// orderingExprTypes are the types of the values of orderingExprs.
+	orderingExprTypes []sqlbase.ColumnType
+	// numInputCols is the number of columns of the input rows, which are the
+	// ones that are emitted.
+	numInputCols int
+	// directOutput is set if the post-processing stage doesn't do anything, in
+	// which case the sorted rows are pushed straight to the output by emitRow.
+	directOutput bool
+	// batchOutput, if set, is the out.output through which the rows are pushed
+	// in batches to the sorter's output (see sorterOutputBatchSize).
+	batchOutput *batchingRowReceiver
+	// agg, if set, aggregates the sorted rows, which are then not output (see
+	// SorterSpec.Aggregation).
+	agg *sortedAggregator
+	// distinctOrdering, if set, is the prefix of ordering on the distinct
+	// columns (see SorterSpec.Distinct): a sorted row is only output if it
+	// differs from the previous one on these columns. distinctRow holds the
+	// values of the distinct columns of the last row output, at the index of
+	// their column, if haveDistinctRow is set.
+	distinctOrdering sqlbase.ColumnOrdering
+	distinctRow      parser.Datums
+	haveDistinctRow  bool
+	distinctAlloc    sqlbase.DatumAlloc
+	rowAlloc         sqlbase.EncDatumRowAlloc
+	// verifyRow holds the values of the ordering columns of the last row
+	// emitted, at the index of their column, if haveVerifyRow is set. It is only
+	// used if sorterVerifyOutput is set (see verifyOrder).
+	verifyRow     parser.Datums
+	haveVerifyRow bool
+	verifyAlloc   sqlbase.DatumAlloc
+
+	// stats are collected during Run.
+	stats sorterStats
+	// phase is the sortPhase the sorter is in, lastProgress the time at which
+	// it last sent its progress (or started running), and inputDone is set once
+	// the input has been read entirely. They are maintained during Run, and the
+	// progress is only sent if the flow asks for it (see maybeReportProgress).
+	phase        sortPhase
+	lastProgress time.Time
+	inputDone    bool
+	// inputDeadline is the time at which the sorter stops reading its input if
+	// partialResultsAfter is set, and partial is set once it has done so (see
+	// nextRow). They are maintained during Run.
+	inputDeadline time.Time
+	partial       bool
+	// runStart is the time at which Run started, from which
+	// stats.firstRowLatency is measured.
+	runStart time.Time
+	// spillRequestedFlag is set, atomically, when the sorter is asked to spill
+	// its rows to disk during Run; see spillRequested.
+	spillRequestedFlag int32
+	// consumerClosed is set once pushing a row returned ConsumerClosed. The
+	// consumer won't read anything else, so the input isn't drained at the end
+	// of Run.
+	consumerClosed bool
+	// outputStatus is the status returned by the output for the last row
+	// pushed to it (see outputSatisfied).
+	outputStatus ConsumerStatus
 }
 
 var _ processor = &sorter{}
 
+// sorterStats are the execution statistics collected by a sorter. Once the
+// sorter has finished running, they are sent to its consumer as metadata if
+// the flow asks for them (see toMetadata and FlowSpec.SendSorterStats). The
+// flow diagram only describes the specs of the processors, so it doesn't show
+// these statistics.
+type sorterStats struct {
+	// inputRows is the number of rows read from the input.
+	inputRows int64
+	// outputRows is the number of rows pushed to the procOutputHelper.
+	outputRows int64
+	// maxAllocatedMem is the maximum amount of memory, in bytes, that was
+	// allocated by the sorter at one time.
+	maxAllocatedMem int64
+	// spilledToDisk is set if the sorter had to fall back to disk because its
+	// memory budget was exceeded.
+	spilledToDisk bool
+	// spilledBytes is the number of bytes written to temporary storage.
+	spilledBytes int64
+	// sortTime is the time spent executing the sort strategy.
+	sortTime time.Duration
+	// firstRowLatency is the time from the start of Run to the first row
+	// pushed to the procOutputHelper, or 0 if no row was pushed. It is much
+	// shorter for the strategies that stream their output than for those that
+	// buffer their whole input, and costs reading the clock once per run.
+	firstRowLatency time.Duration
+	// outputWaitTime is the part of sortTime spent pushing output rows, which
+	// is mostly time spent waiting for the consumer to accept them when it is
+	// slower than the sort. It includes the post-processing of the rows, if
+	// any. It is only measured if the flow sends the sorter stats
+	// (FlowSpec.SendSorterStats), which saves reading the clock for every row
+	// otherwise.
+	outputWaitTime time.Duration
+	// rowSizes counts the input rows by size. Like outputWaitTime, it is only
+	// collected if the flow sends the sorter stats, since it costs the
+	// computation of the size of every row.
+	rowSizes rowSizeHistogram
+	// strategy is the sorterStrategy that was used.
+	strategy sorterStrategyName
+	// countOverflow is set if the limit and offset of the post-processing stage
+	// overflowed the sorter's count, so that strategy sorted all the rows
+	// instead of keeping the top ones (see sorterCount).
+	countOverflow bool
+	// sortedChunks is the number of chunks sorted by the sortChunksStrategy.
+	sortedChunks int64
+	// memComparisons is the number of comparisons of rows made while sorting
+	// rows in memory, and diskComparisons the number made by the sortTopKStrategy
+	// to only store rows that can still be output once it fell back to disk.
+	// The rows stored on disk are kept sorted by the engine, whose comparisons
+	// are not counted. They are only counted if testingKnobCountComparisons is
+	// set.
+	memComparisons  int64
+	diskComparisons int64
+}
+
+// toMetadata returns the statistics sent by the sorter as metadata (see
+// FlowSpec.SendSorterStats).
+func (s *sorterStats) toMetadata() *RemoteProducerMetadata_SorterStats {
+	return &RemoteProducerMetadata_SorterStats{
+		Strategy:        string(s.strategy),
+		InputRows:       s.inputRows,
+		OutputRows:      s.outputRows,
+		MaxAllocatedMem: s.maxAllocatedMem,
+		SpilledBytes:    s.spilledBytes,
+		OutputWaitNanos: s.outputWaitTime.Nanoseconds(),
+		RowSizeCounts:   s.rowSizes.counts(),
+		FirstRowNanos:   s.firstRowLatency.Nanoseconds(),
+		CountOverflow:   s.countOverflow,
+	}
+}
+
+// numRowSizeBuckets is the number of buckets of a rowSizeHistogram. The last
+// one counts the rows of 2GiB and more.
+const numRowSizeBuckets = 32
+
+// rowSizeHistogram counts rows by size, in bytes, in buckets of sizes between
+// powers of two: bucket i counts the rows of 2^i to 2^(i+1)-1 bytes, and the
+// last one all the larger rows as well. The logarithmic buckets bound the cost
+// of adding a row, while still telling a few wide rows apart from many narrow
+// ones when looking at why a sort used a lot of memory.
+type rowSizeHistogram [numRowSizeBuckets]int64
+
+// add counts a row of the given size.
+func (h *rowSizeHistogram) add(size int64) {
+	i := 0
+	for ; size > 1 && i < numRowSizeBuckets-1; i++ {
+		size >>= 1
+	}
+	h[i]++
+}
+
+// counts returns the counts of the buckets, without the trailing empty ones.
+func (h *rowSizeHistogram) counts() []int64 {
+	n := len(h)
+	for n > 0 && h[n-1] == 0 {
+		n--
+	}
+	if n == 0 {
+		return nil
+	}
+	return append([]int64(nil), h[:n]...)
+}
+
+// String formats the counts of the non-empty buckets, e.g.
+// "[64 B, 128 B): 10, [1.0 KiB, 2.0 KiB): 1".
+func (h *rowSizeHistogram) String() string {
+	var buf bytes.Buffer
+	for i, c := range h {
+		if c == 0 {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString(", ")
+		}
+		lo := int64(1) << uint(i)
+		if i == 0 {
+			lo = 0
+		}
+		if i == numRowSizeBuckets-1 {
+			fmt.Fprintf(&buf, "[%s, +inf): %d", humanizeutil.IBytes(lo), c)
+		} else {
+			fmt.Fprintf(&buf, "[%s, %s): %d",
+				humanizeutil.IBytes(lo), humanizeutil.IBytes(int64(2)<<uint(i)), c)
+		}
+	}
+	return buf.String()
+}
+
+// sorterStrategyName identifies a sorterStrategy in logs and stats.
+type sorterStrategyName string
+
+const (
+	sortAllStrategyName     sorterStrategyName = "sortAll"
+	sortTopKStrategyName    sorterStrategyName = "sortTopK"
+	sortChunksStrategyName  sorterStrategyName = "sortChunks"
+	sortRunsStrategyName    sorterStrategyName = "sortRuns"
+	passThroughStrategyName sorterStrategyName = "passThrough"
+)
+
+// sorterCount returns the number of rows that a sorter with the given spec and
+// post-processing stage needs to produce, or 0 if it needs to produce all of
+// them. overflow is set if the limit and offset add up to more rows than an
+// int64 can hold.
+func sorterCount(spec *SorterSpec, post *PostProcessSpec) (count int64, overflow bool) {
+	if post.Limit == 0 || spec.Aggregation != nil || spec.Distinct {
+		// Without a limit, all the rows are needed even if there is an offset:
+		// they are all sorted, and the procOutputHelper suppresses the first
+		// Offset ones as they are emitted (so an offset alone never leads to the
+		// sortTopKStrategy). With an aggregation, the limit and offset apply to
+		// the aggregated rows, each of which can aggregate any number of sorted
+		// rows. Likewise, any number of sorted rows can be duplicates of an
+		// output row.
+		return 0, false
+	}
+	if post.Offset <= math.MaxInt64 && post.Limit <= math.MaxInt64-post.Offset {
+		// The sorter needs to produce Offset + Limit rows. The procOutputHelper
+		// will discard the first Offset ones.
+		return int64(post.Limit + post.Offset), false
+	}
+	// No input has that many rows, so all of them are sorted. The
+	// procOutputHelper still applies the limit and the offset.
+	return 0, true
+}
+
+// chooseSorterStrategy returns the strategy used by a sorter with the given
+// ordering match length, number of ordering columns, count (see sorter.count)
+// and SorterSpec.PreferTopK hint. sortedRuns is set if the input consists of
+// sorted runs (see SorterSpec.InputRunBoundaries).
+func chooseSorterStrategy(
+	matchLen uint32, numOrderingCols int, count int64, preferTopK bool, sortedRuns bool,
+) sorterStrategyName {
+	switch {
+	case int(matchLen) == numOrderingCols:
+		// The input is already fully sorted.
+		return passThroughStrategyName
+	case sortedRuns:
+		return sortRunsStrategyName
+	case count != 0 && (matchLen == 0 || preferTopK):
+		return sortTopKStrategyName
+	case matchLen != 0:
+		return sortChunksStrategyName
+	default:
+		return sortAllStrategyName
+	}
+}
+
+// sorterNearDeadline is how close the deadline of a sorter's context must be
+// for a deadline-aware sorter to prefer streaming its output (see
+// deadlineAwareStrategy).
+const sorterNearDeadline = 10 * time.Second
+
+// deadlineAwareStrategy returns the strategy that a sorter of a flow with
+// deadline-aware sorters (see FlowSpec.DeadlineAwareSorters) uses instead of
+// the given one, which was returned by chooseSorterStrategy.
+//
+// If ctx has a deadline that is less than sorterNearDeadline away (or already
+// past) and the input is ordered on a prefix of the ordering (matchLen > 0),
+// the sortTopKStrategy and the sortRunsStrategy are replaced by the
+// sortChunksStrategy: the chunks strategy outputs the rows of each group that
+// shares the ordering prefix as soon as the group is read, whereas the other
+// two strategies output nothing until the whole input has been read. A query
+// that runs out of time then still produces its first rows. The other
+// strategies are kept: the passThroughStrategy already streams its rows, and
+// the chooseSorterStrategy never picks the sortAllStrategy when matchLen > 0.
+//
+// This is only a heuristic, which can make the sorter do more work: the chunks
+// strategy sorts the rows of every group instead of only keeping the rows
+// needed by the limit, or instead of merging runs that are already sorted.
+func deadlineAwareStrategy(
+	ctx context.Context, strategy sorterStrategyName, matchLen uint32,
+) sorterStrategyName {
+	if matchLen == 0 ||
+		(strategy != sortTopKStrategyName && strategy != sortRunsStrategyName) {
+		return strategy
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || deadline.Sub(timeutil.Now()) >= sorterNearDeadline {
+		return strategy
+	}
+	return sortChunksStrategyName
+}
+
+// SortEffort describes how much work a sorter does to order its input.
+type SortEffort int
+
+const (
+	// SortEffortNone means that the input is already in the requested order
+	// and the rows are passed through.
+	SortEffortNone SortEffort = iota
+	// SortEffortChunks means that the input is ordered on a prefix of the
+	// requested ordering, and each group of rows sharing that prefix is sorted
+	// separately.
+	SortEffortChunks
+	// SortEffortFull means that all the input rows are buffered and sorted.
+	SortEffortFull
+	// SortEffortTopK means that only the rows needed by the limit and offset
+	// are kept and sorted.
+	SortEffortTopK
+	// SortEffortMerge means that the input consists of sorted runs, whose rows
+	// are all buffered and merged.
+	SortEffortMerge
+)
+
+// SortEffort returns the work that a sorter with this spec and the given
+// post-processing stage does, without creating the sorter. It mirrors the
+// choice of strategy in sorter.Run, except for the deadline-aware choice (see
+// deadlineAwareStrategy), which depends on the context of the run, and for the
+// pass-through of an input that already guarantees the ordering (see
+// orderedRowSource), which depends on the input.
+func (spec *SorterSpec) SortEffort(post *PostProcessSpec) SortEffort {
+	return spec.sortEffort(post, nil /* reverseSortColumns */)
+}
+
+// sortEffort is like SortEffort, for a sorter whose flow reverses the sort
+// direction of some ordering columns (see EvalContext.ReverseSortColumns).
+func (spec *SorterSpec) sortEffort(post *PostProcessSpec, reverseSortColumns []uint32) SortEffort {
+	count, _ := sorterCount(spec, post)
+	matchLen := reverseMatchLen(spec.OrderingMatchLen, reverseSortColumns)
+	switch chooseSorterStrategy(
+		matchLen, len(spec.OutputOrdering.Columns), count, spec.PreferTopK,
+		len(spec.InputRunBoundaries) > 0,
+	) {
+	case passThroughStrategyName:
+		return SortEffortNone
+	case sortChunksStrategyName:
+		return SortEffortChunks
+	case sortTopKStrategyName:
+		return SortEffortTopK
+	case sortRunsStrategyName:
+		return SortEffortMerge
+	default:
+		return SortEffortFull
+	}
+}
+
+// reverseMatchLen returns the ordering match length of a sorter whose ordering
+// has the direction of the columns at the given 1-based positions reversed:
+// the input isn't ordered on a prefix that includes a reversed column.
+func reverseMatchLen(matchLen uint32, reverseSortColumns []uint32) uint32 {
+	for _, pos := range reverseSortColumns {
+		if pos >= 1 && pos <= matchLen {
+			matchLen = pos - 1
+		}
+	}
+	return matchLen
+}
+
 func newSorter(
 	flowCtx *FlowCtx, spec *SorterSpec, input RowSource, post *PostProcessSpec, output RowReceiver,
 ) (*sorter, error) {
-	count := int64(0)
-	if post.Limit != 0 {
-		// The sorter needs to produce Offset + Limit rows. The procOutputHelper
-		// will discard the first Offset ones.
-		count = int64(post.Limit) + int64(post.Offset)
+	count, countOverflow := sorterCount(spec, post)
+	if flowCtx.testingKnobs.DisableSorterTopK {
+		count = 0
+	}
+	if int(spec.OrderingMatchLen) > len(spec.OutputOrdering.Columns) {
+		return nil, errors.Errorf(
+			"ordering match length %d exceeds the number of ordering columns %d",
+			spec.OrderingMatchLen, len(spec.OutputOrdering.Columns),
+		)
+	}
+	// The ordering is validated before anything indexes rows with it. Note
+	// that an input without columns can't be ordered, unless the ordering is on
+	// expressions: all its rows are equal. With an empty ordering, the rows are
+	// passed through (see passThroughStrategy).
+	numCols := len(input.Types()) + len(spec.OrderingExprs)
+	for _, c := range spec.OutputOrdering.Columns {
+		if int(c.ColIdx) >= numCols {
+			return nil, errors.Errorf(
+				"invalid ordering column %d (only %d available)", c.ColIdx, numCols,
+			)
+		}
+	}
+	for i := 1; i < len(spec.InputRunBoundaries); i++ {
+		if prev, b := spec.InputRunBoundaries[i-1], spec.InputRunBoundaries[i]; b <= prev {
+			return nil, errors.Errorf(
+				"input run boundary %d follows %d; the boundaries must be increasing", b, prev,
+			)
+		}
+	}
+	batchOutput := maybeBatchOutput(output)
+	if batchOutput != nil {
+		output = batchOutput
 	}
 	s := &sorter{
 		flowCtx:     flowCtx,
+		batchOutput: batchOutput,
 		input:       MakeNoMetadataRowSource(input, output),
 		rawInput:    input,
 		ordering:    convertToColumnOrdering(spec.OutputOrdering),
 		matchLen:    spec.OrderingMatchLen,
 		count:       count,
+		memLimit:    spec.MemLimit,
 		tempStorage: flowCtx.tempStorage,
+		stable:      spec.Stable,
+
+		keyEncodedOrdering:  spec.KeyEncodedOrdering,
+		runBoundaries:       spec.InputRunBoundaries,
+		diskSpillDisallowed: spec.DiskSpillDisallowed,
+		maxRows:             spec.MaxRows,
+		estimatedInputRows:  spec.EstimatedInputRows,
+		partialResultsAfter: time.Duration(spec.PartialResultsAfterNanos),
+		preferTopK:          spec.PreferTopK,
+		numInputCols:        len(input.Types()),
+		countOverflow:       countOverflow,
+
+		lowCardinalityChunkColumns: spec.LowCardinalityChunkColumns,
+	}
+	if reverse := flowCtx.evalCtx.ReverseSortColumns; len(reverse) > 0 {
+		// The sort direction of some columns is overridden by the session, for
+		// debugging. The ordering is reversed before the strategy is chosen, so
+		// that they all sort the same way.
+		for _, pos := range reverse {
+			if pos >= 1 && int(pos) <= len(s.ordering) {
+				s.ordering[pos-1].Direction = s.ordering[pos-1].Direction.Reverse()
+			}
+		}
+		s.matchLen = reverseMatchLen(s.matchLen, reverse)
+	}
+	s.specMatchLen = s.matchLen
+	s.initMatchLen(input)
+	if len(spec.OrderingExprs) > 0 {
+		s.orderingExprs = make([]exprHelper, len(spec.OrderingExprs))
+		s.orderingExprTypes = make([]sqlbase.ColumnType, len(spec.OrderingExprs))
+		for i, expr := range spec.OrderingExprs {
+			if err := s.orderingExprs[i].init(expr, input.Types(), &flowCtx.evalCtx); err != nil {
+				return nil, err
+			}
+			if s.orderingExprs[i].expr == nil {
+				return nil, errors.Errorf("ordering expression %d is empty", i)
+			}
+			s.orderingExprTypes[i] = sqlbase.DatumTypeToColumnType(
+				s.orderingExprs[i].expr.ResolvedType(),
+			)
+		}
+	}
+	if spec.Distinct {
+		if spec.Aggregation != nil {
+			return nil, errors.Errorf("a sorter can't both aggregate and deduplicate its rows")
+		}
+		distinctCols := spec.DistinctColumns
+		if len(distinctCols) == 0 {
+			distinctCols = make([]uint32, s.numInputCols)
+			for i := range distinctCols {
+				distinctCols[i] = uint32(i)
+			}
+		}
+		var err error
+		s.distinctOrdering, err = orderingPrefixOn(distinctCols, s.numInputCols, s.ordering, "distinct")
+		if err != nil {
+			return nil, err
+		}
+		s.distinctRow = make(parser.Datums, s.numInputCols)
+	}
+	outputTypes := input.Types()
+	if spec.Aggregation != nil {
+		var err error
+		s.agg, err = newSortedAggregator(spec.Aggregation, input.Types(), s.ordering)
+		if err != nil {
+			return nil, err
+		}
+		outputTypes = s.agg.outputTypes
 	}
-	if err := s.out.init(post, input.Types(), &flowCtx.evalCtx, output); err != nil {
+	if err := s.out.init(post, outputTypes, &flowCtx.evalCtx, output); err != nil {
 		return nil, err
 	}
+	s.directOutput = s.out.isNoop()
+	if spec.LimitExpr.Expr != "" {
+		if post.Limit != 0 {
+			return nil, errors.Errorf("a sorter can't have both a limit and a limit expression")
+		}
+		s.limitExpr = &exprHelper{}
+		if err := s.limitExpr.init(spec.LimitExpr, nil /* types */, &flowCtx.evalCtx); err != nil {
+			return nil, err
+		}
+		if typ := s.limitExpr.expr.ResolvedType(); !typ.Equivalent(parser.TypeInt) {
+			return nil, errors.Errorf(
+				"limit expression %s must be of type %s, not %s", s.limitExpr, parser.TypeInt, typ,
+			)
+		}
+		s.limitSpec = spec
+	}
 	return s, nil
 }
 
-var workMem = envutil.EnvOrDefaultInt64("COCKROACH_WORK_MEM", 64*1024*1024 /* 64MB */)
+// evalLimit evaluates the sorter's limit expression, and returns its value. The
+// sorter then sorts as if the limit of its post-processing stage was the value
+// of the expression, which the procOutputHelper applies. Unlike the limit of a
+// PostProcessSpec, a value of 0 means that no rows are output.
+func (s *sorter) evalLimit() (uint64, error) {
+	d, err := s.limitExpr.eval(nil /* row */)
+	if err != nil {
+		return 0, err
+	}
+	limit, ok := d.(*parser.DInt)
+	if !ok || *limit < 0 {
+		return 0, errors.Errorf(
+			"limit expression %s evaluated to %s; it must be non-negative", s.limitExpr, d,
+		)
+	}
+	s.out.setLimit(uint64(*limit))
+	s.directOutput = s.out.isNoop()
+	s.count, s.countOverflow = sorterCount(
+		s.limitSpec, &PostProcessSpec{Limit: uint64(*limit), Offset: s.out.offset},
+	)
+	if s.flowCtx.testingKnobs.DisableSorterTopK {
+		s.count = 0
+	}
+	return uint64(*limit), nil
+}
+
+// orderingPrefixOn returns the prefix of ordering on the given columns, which
+// must be the columns of its first len(cols) ordering columns, in any order, so
+// that the rows that are equal on these columns are contiguous once sorted.
+// The columns must be input columns; kind names them in errors.
+func orderingPrefixOn(
+	cols []uint32, numInputCols int, ordering sqlbase.ColumnOrdering, kind string,
+) (sqlbase.ColumnOrdering, error) {
+	if len(cols) > len(ordering) {
+		return nil, errors.Errorf(
+			"%d %s columns but only %d ordering columns", len(cols), kind, len(ordering),
+		)
+	}
+	for _, col := range cols {
+		if col >= uint32(numInputCols) {
+			return nil, errors.Errorf("%s column %d out of range", kind, col)
+		}
+	}
+	prefix := ordering[:len(cols)]
+	for _, c := range prefix {
+		found := false
+		for _, col := range cols {
+			if c.ColIdx == int(col) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf(
+				"ordering column %d is not a %s column; the first %d ordering columns must be the %s columns",
+				c.ColIdx, kind, len(prefix), kind,
+			)
+		}
+	}
+	return prefix, nil
+}
+
+// initMatchLen sets the match length used with the given input.
+func (s *sorter) initMatchLen(input RowSource) {
+	s.matchLen = s.specMatchLen
+	if in, ok := input.(orderedRowSource); ok && s.ordering.IsPrefixOf(in.outputOrdering()) {
+		// The input already returns its rows in the order of the sorter (the
+		// comparison is done after the session's reversals, which the input
+		// doesn't know about), so they are passed through.
+		s.matchLen = uint32(len(s.ordering))
+	}
+}
+
+// Reset prepares a sorter that has finished running to sort a new input,
+// pushing the results to a new output, without being reallocated. The input
+// must have the same schema as the sorter's previous input. The statistics of
+// the previous run are discarded.
+//
+// The memory monitor and the row containers (including those on temporary
+// storage) used by a run are released before Run returns, so there is nothing
+// else to tear down.
+func (s *sorter) Reset(input RowSource, output RowReceiver) error {
+	types := input.Types()
+	prevTypes := s.rawInput.Types()
+	if len(types) != s.numInputCols {
+		return errors.Errorf(
+			"sorter input has %d columns, expected %d", len(types), s.numInputCols,
+		)
+	}
+	for i := range types {
+		if !types[i].Equal(prevTypes[i]) {
+			return errors.Errorf(
+				"sorter input column %d has type %s, expected %s", i, types[i].String(), prevTypes[i].String(),
+			)
+		}
+	}
+	s.batchOutput = maybeBatchOutput(output)
+	if s.batchOutput != nil {
+		output = s.batchOutput
+	}
+	s.input = MakeNoMetadataRowSource(input, output)
+	s.rawInput = input
+	s.initMatchLen(input)
+	s.out.reset(output)
+	s.seqNums = false
+	s.stats = sorterStats{}
+	return nil
+}
+
+// sorterPrefetch enables reading the input of sorters that use the
+// sortChunksStrategy in the background.
+var sorterPrefetch = settings.RegisterBoolSetting(
+	"sql.distsql.sorter.prefetch.enabled",
+	"set to true to read ahead the input of sorters of partially ordered rows",
+	false,
+)
+
+// sorterOutputBatchSize is the number of rows that sorters buffer before
+// pushing them to their output (see batchingRowReceiver). It is read when a
+// sorter is created or reset.
+var sorterOutputBatchSize = settings.RegisterValidatedIntSetting(
+	"sql.distsql.sorter.output_batch_size",
+	"number of output rows that sorters buffer before pushing them to their consumer, to reduce "+
+		"contention on the consumer (set to 0 or 1 to push the rows one at a time)",
+	0,
+	func(v int64) error {
+		if v < 0 || v > maxSorterOutputBatchSize {
+			return errors.Errorf("must be between 0 and %d: %d", maxSorterOutputBatchSize, v)
+		}
+		return nil
+	},
+)
+
+// maxSorterOutputBatchSize bounds sorterOutputBatchSize, so that the memory
+// held by the buffered rows, which isn't accounted for, stays small.
+const maxSorterOutputBatchSize = 1024
+
+// maybeBatchOutput returns a batchingRowReceiver pushing to output if sorters
+// batch their output rows (see sorterOutputBatchSize), and nil otherwise.
+func maybeBatchOutput(output RowReceiver) *batchingRowReceiver {
+	n := sorterOutputBatchSize.Get()
+	if n <= 1 {
+		return nil
+	}
+	return newBatchingRowReceiver(output, int(n))
+}
+
+// flushOutput pushes the rows buffered to be pushed in a batch, if any, and
+// returns the status of the consumer.
+func (s *sorter) flushOutput() ConsumerStatus {
+	if s.batchOutput == nil {
+		return NeedMoreRows
+	}
+	return s.batchOutput.flush()
+}
+
+// inMemorySortAlgorithm is an algorithm with which the sorters sort the rows
+// they hold in memory (see sorterAlgorithm).
+type inMemorySortAlgorithm int64
+
+const (
+	// sortAlgorithmIntrosort is sort.Sort: a quicksort that falls back to a
+	// heapsort when it recurses too deep, so it is O(n*log(n)) even on the
+	// inputs that are adversarial to the quicksort. It doesn't preserve the
+	// order of equal rows.
+	sortAlgorithmIntrosort inMemorySortAlgorithm = iota
+	// sortAlgorithmMergesort is sort.Stable: an in-place mergesort, which
+	// preserves the order of equal rows but makes O(n*log(n)*log(n)) swaps.
+	sortAlgorithmMergesort
+)
+
+// sorterAlgorithm is the algorithm with which the sorters sort the rows they
+// hold in memory, unless the sort must be stable (see SorterSpec.Stable), in
+// which case the mergesort is always used. Which one is faster depends on the
+// input; see BenchmarkRowContainerSortAlgorithm for sorted, reverse-sorted and
+// random inputs.
+var sorterAlgorithm = settings.RegisterEnumSetting(
+	"sql.distsql.sorter.algorithm",
+	"algorithm with which sorters sort the rows they hold in memory (mergesort is stable, "+
+		"at the cost of moving the rows around more)",
+	"introsort",
+	map[int64]string{
+		int64(sortAlgorithmIntrosort): "introsort",
+		int64(sortAlgorithmMergesort): "mergesort",
+	},
+)
+
+// sorterMinChunkSize is the size under which the sortChunksStrategy sorts a
+// chunk together with the following ones.
+var sorterMinChunkSize = settings.RegisterByteSizeSetting(
+	"sql.distsql.sorter.min_chunk_size",
+	"size under which sorters of partially ordered rows sort groups of rows sharing an ordering "+
+		"prefix together with the following groups (set to 0 to sort each group separately)",
+	0,
+)
+
+// sorterSpillAfter is the wall-clock budget of sorters that accumulate all
+// their rows in memory; see sortAllStrategy.
+var sorterSpillAfter = settings.RegisterDurationSetting(
+	"sql.distsql.sorter.spill_after",
+	"duration after which sorters that buffer all their input rows in memory spill them to disk, "+
+		"if allowed to, to bound the time spent sorting in memory (set to 0 to disable)",
+	0,
+)
+
+// sorterSharedWorkMem makes the sorters of a flow that can fall back to disk
+// share a single memory limit.
+var sorterSharedWorkMem = settings.RegisterBoolSetting(
+	"sql.distsql.sorter.shared_work_mem.enabled",
+	"set to true to limit the memory used by all the sorters of a flow that can spill to disk, "+
+		"instead of limiting each of them separately",
+	false,
+)
+
+// sharedSorterMemory is the memory budget of the sorters of a flow that can
+// fall back to disk, when they share a limit (see sorterSharedWorkMem). The
+// sorters allocate their memory from the shared monitor, so that the memory
+// they use together is bounded. Each sorter is additionally limited to an
+// equal share of the budget so that it can't take up the memory that the
+// others need: a sorter that exceeds its share, or that can't get it because
+// the budget is used up, falls back to disk.
+type sharedSorterMemory struct {
+	mon   mon.MemoryMonitor
+	limit int64
+	// numSorters is the number of sorters among which the budget is shared.
+	numSorters int
+}
+
+// start starts the shared monitor, as a child of parent.
+func (m *sharedSorterMemory) start(
+	ctx context.Context, parent *mon.MemoryMonitor, limit int64, numSorters int,
+) {
+	m.limit = limit
+	m.numSorters = numSorters
+	m.mon = mon.MakeMonitorInheritWithLimit("flow-sorters", limit, parent)
+	m.mon.Start(ctx, parent, mon.BoundAccount{})
+}
+
+// stop stops the shared monitor, once the sorters are done.
+func (m *sharedSorterMemory) stop(ctx context.Context) {
+	m.mon.Stop(ctx)
+}
+
+// share returns the memory limit of each sorter.
+func (m *sharedSorterMemory) share() int64 {
+	share := m.limit / int64(m.numSorters)
+	if share < 1 {
+		// A limit of zero would mean no limit at all.
+		share = 1
+	}
+	return share
+}
+
+// sorterSpillRegistry keeps track of the running sorters of a node that can
+// fall back to disk, so that they can be asked to spill their rows when the
+// node is under memory pressure (see ServerImpl.SpillSorters).
+type sorterSpillRegistry struct {
+	mu struct {
+		syncutil.Mutex
+		nextID int
+		// requestSpill contains the callback of each registered sorter.
+		requestSpill map[int]func()
+	}
+}
+
+// register adds a sorter, identified by the callback that asks it to spill,
+// to the registry. The returned function removes it.
+func (r *sorterSpillRegistry) register(requestSpill func()) (unregister func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.requestSpill == nil {
+		r.mu.requestSpill = make(map[int]func())
+	}
+	id := r.mu.nextID
+	r.mu.nextID++
+	r.mu.requestSpill[id] = requestSpill
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.mu.requestSpill, id)
+	}
+}
+
+// requestSpill asks all the registered sorters to spill, and returns how many
+// were asked.
+func (r *sorterSpillRegistry) requestSpill() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, fn := range r.mu.requestSpill {
+		fn()
+	}
+	return len(r.mu.requestSpill)
+}
+
+// spillRequested returns whether the sorter was asked to spill its rows to
+// disk since it started running (see sorterSpillRegistry).
+func (s *sorter) spillRequested() bool {
+	return atomic.LoadInt32(&s.spillRequestedFlag) != 0
+}
+
+const defaultWorkMem = 64 * 1024 * 1024 /* 64MB */
+
+// sorterAdaptiveMemMultiple is the multiple of the work_mem limit (see
+// sorterWorkMem) up to which the memory limit of a sorter that can fall back
+// to disk grows, instead of spilling, if the node has spare memory (see
+// sorter.growMemLimit).
+var sorterAdaptiveMemMultiple = settings.RegisterValidatedIntSetting(
+	"sql.distsql.sorter.adaptive_mem_multiple",
+	"multiple of work_mem up to which the memory limit of a sorter grows instead of spilling "+
+		"to disk, if the node has spare memory (set to 1 to disable)",
+	1,
+	func(v int64) error {
+		if v < 1 {
+			return errors.Errorf("cannot be set to a value lower than 1: %d", v)
+		}
+		return nil
+	},
+)
+
+// sorterWorkMem determines the default memory limit of sorters that can fall
+// back to disk. It is either a number of bytes or a percentage (e.g. "25%") of
+// the memory budget available to the sorter. It is read at the start of every
+// sorter run, so changes apply to the sorts that start afterwards. Its default
+// is the value of the COCKROACH_WORK_MEM environment variable, which is how the
+// limit was set before it became a cluster setting.
+var sorterWorkMem = settings.RegisterValidatedStringSetting(
+	"sql.distsql.sorter.work_mem",
+	"default memory limit of sorters that can spill to disk, in bytes or as a percentage "+
+		"of the memory available to them (e.g. 25%)",
+	workMemDefault(envutil.EnvOrDefaultString("COCKROACH_WORK_MEM", "")),
+	func(s string) error {
+		_, _, err := parseWorkMemValue(s)
+		return err
+	},
+)
+
+// workMemDefault returns the default value of sorterWorkMem for the given
+// COCKROACH_WORK_MEM value, which is the value itself unless it is empty or
+// cannot be parsed.
+func workMemDefault(s string) string {
+	bytes, percent := parseWorkMem(s)
+	if percent != 0 {
+		return strconv.FormatInt(percent, 10) + "%"
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+// parseWorkMem parses a COCKROACH_WORK_MEM value, returning either a number of
+// bytes or a percentage between 1 and 100. The default limit is used if the
+// value is empty or cannot be parsed.
+func parseWorkMem(s string) (bytes int64, percent int64) {
+	if s == "" {
+		return defaultWorkMem, 0
+	}
+	bytes, percent, err := parseWorkMemValue(s)
+	if err != nil {
+		log.Warningf(context.Background(), "invalid COCKROACH_WORK_MEM value %q: %s", s, err)
+		return defaultWorkMem, 0
+	}
+	return bytes, percent
+}
+
+// parseWorkMemValue parses a value of sorterWorkMem, returning either a number
+// of bytes or a percentage between 1 and 100.
+func parseWorkMemValue(s string) (bytes int64, percent int64, err error) {
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseInt(strings.TrimSuffix(s, "%"), 10, 64)
+		if err != nil || p < 1 || p > 100 {
+			return 0, 0, errors.Errorf("invalid percentage %q; must be between 1%% and 100%%", s)
+		}
+		return 0, p, nil
+	}
+	b, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return b, 0, nil
+}
+
+// workMemLimit returns the default memory limit of a sorter that allocates
+// memory through the given monitor.
+func workMemLimit(m *mon.MemoryMonitor) int64 {
+	bytes, percent, err := parseWorkMemValue(sorterWorkMem.Get())
+	if err != nil {
+		// The setting is validated, but testing overrides are not.
+		return defaultWorkMem
+	}
+	if percent == 0 {
+		return bytes
+	}
+	capacity := m.Capacity()
+	if capacity == math.MaxInt64 {
+		// The monitor is unbounded so a percentage of it doesn't make sense.
+		return defaultWorkMem
+	}
+	limit := capacity / 100 * percent
+	if limit < 1 {
+		// A limit of zero would mean no limit at all.
+		limit = 1
+	}
+	return limit
+}
 
 // Run is part of the processor interface.
 func (s *sorter) Run(ctx context.Context, wg *sync.WaitGroup) {
@@ -88,6 +1045,7 @@ func (s *sorter) Run(ctx context.Context, wg *sync.WaitGroup) {
 		defer wg.Done()
 	}
 
+	s.runStart = timeutil.Now()
 	ctx = log.WithLogTag(ctx, "Sorter", nil)
 	ctx, span := processorSpan(ctx, "sorter")
 	defer tracing.FinishSpan(span)
@@ -97,61 +1055,598 @@ func (s *sorter) Run(ctx context.Context, wg *sync.WaitGroup) {
 		defer log.Infof(ctx, "exiting sorter run")
 	}
 
-	var sv memRowContainer
-	// Enable fall back to disk if the cluster setting is set or a memory limit
-	// has been set through testing.
-	useTempStorage := distSQLUseTempStorage.Get() || s.testingKnobMemLimit > 0
-	if s.matchLen == 0 && s.count == 0 && useTempStorage {
-		// We will use the sortAllStrategy in this case and potentially fall
-		// back to disk.
-		// Limit the memory use by creating a child monitor with a hard limit.
+	if s.limitExpr != nil {
+		limit, err := s.evalLimit()
+		if err != nil {
+			DrainAndClose(ctx, s.out.output, err, s.rawInput)
+			return
+		}
+		if limit == 0 {
+			// No rows are needed (and a count of 0 would mean sorting all of
+			// them), so the input is only drained of its metadata.
+			if s.flowCtx.sendSorterStats {
+				s.out.output.Push(nil /* row */, ProducerMetadata{SorterStats: s.stats.toMetadata()})
+			}
+			DrainAndClose(ctx, s.out.output, nil /* cause */, s.rawInput)
+			return
+		}
+	}
+
+	// Enable fall back to disk if the cluster setting is set or a memory or row
+	// limit has been set through testing.
+	useTempStorage := distSQLUseTempStorage.Get() || s.testingKnobMemLimit > 0 ||
+		s.testingKnobSpillAfterRows > 0
+	strategy := chooseSorterStrategy(
+		s.matchLen, len(s.ordering), s.count, s.preferTopK, len(s.runBoundaries) > 0,
+	)
+	if s.flowCtx.deadlineAwareSorters {
+		strategy = deadlineAwareStrategy(ctx, strategy, s.matchLen)
+	}
+	// The sorter always uses its own memory monitor so that the memory it uses
+	// can be reported in its stats.
+	monName := "sorter-mem"
+	limit := int64(0)
+	// maxLimit, if larger than limit, is the limit up to which the sorter's
+	// monitor can grow when the node has spare memory.
+	maxLimit := int64(0)
+	if (strategy == sortAllStrategyName || strategy == sortTopKStrategyName ||
+		strategy == sortRunsStrategyName) && useTempStorage {
+		// We will use the sortAllStrategy, the sortTopKStrategy or the
+		// sortRunsStrategy in this case and potentially fall back to disk.
+		// Limit the memory use by setting a hard limit on the monitor.
 		// The strategy will overflow to disk if this limit is not enough.
-		limit := s.testingKnobMemLimit
+		monName = "sortall-limited"
+		if strategy == sortTopKStrategyName {
+			monName = "sorttopk-limited"
+		} else if strategy == sortRunsStrategyName {
+			monName = "sortruns-limited"
+		}
+		limit = s.testingKnobMemLimit
 		if limit <= 0 {
-			limit = workMem
+			limit = s.memLimit
 		}
-		limitedMon := mon.MakeMonitorInheritWithLimit(
-			"sortall-limited", limit, s.flowCtx.evalCtx.Mon,
-		)
-		limitedMon.Start(ctx, s.flowCtx.evalCtx.Mon, mon.BoundAccount{})
-		defer limitedMon.Stop(ctx)
+		if limit <= 0 {
+			limit = workMemLimit(s.flowCtx.evalCtx.Mon)
+			if multiple := sorterAdaptiveMemMultiple.Get(); limit > math.MaxInt64/multiple {
+				maxLimit = math.MaxInt64
+			} else {
+				maxLimit = limit * multiple
+			}
+		}
+		if s.tempStorage == nil && !s.diskSpillDisallowed &&
+			s.memLimit <= 0 && s.testingKnobMemLimit <= 0 {
+			// The rows can't fall back to disk without temporary storage (e.g. if
+			// it is disabled on this node). Rather than failing as soon as the
+			// work_mem limit is reached, sort in memory on a best-effort basis,
+			// within the limits of the flow's monitor; the error returned if they
+			// are exceeded says that the rows couldn't be spilled (see
+			// checkDiskFallback). A limit requested by the spec still applies.
+			log.Eventf(ctx, "no temporary storage available; sorting in memory")
+			monName, limit = "sorter-mem", 0
+		}
+	}
+	parentMon := s.flowCtx.evalCtx.Mon
+	if shared := s.flowCtx.sorterMem; shared != nil && limit > 0 {
+		// The memory is allocated from the budget shared by the sorters of the
+		// flow, of which this sorter can use at most its share.
+		parentMon = &shared.mon
+		if share := shared.share(); limit > share {
+			limit = share
+		}
+		// The limit is the sorter's share of the budget, which can't grow.
+		maxLimit = 0
+	}
+	s.memMonLimit = limit
+	atomic.StoreInt32(&s.spillRequestedFlag, 0)
+	if r := s.flowCtx.sorterSpills; r != nil && limit > 0 && s.tempStorage != nil &&
+		!s.diskSpillDisallowed {
+		// The sorter can be asked to spill under memory pressure. The request is
+		// only recorded here: the strategy spills the rows itself, between two
+		// rows, so that the accounting of the rows is consistent.
+		unregister := r.register(func() {
+			atomic.StoreInt32(&s.spillRequestedFlag, 1)
+		})
+		defer unregister()
+	}
+	memMon := mon.MakeMonitorInheritWithLimit(monName, limit, parentMon)
+	memMon.Start(ctx, parentMon, mon.BoundAccount{})
+	defer memMon.Stop(ctx)
+
+	if strategy == sortChunksStrategyName && sorterPrefetch.Get() {
+		// Read the next chunk in the background while the current one is being
+		// sorted and output.
+		p := startRowPrefetcher(ctx, s.rawInput, &memMon)
+		defer p.Close(ctx)
+		s.rawInput = p
+		s.input = MakeNoMetadataRowSource(p, s.out.output)
+	}
+
+	evalCtx := s.flowCtx.evalCtx
+	evalCtx.Mon = &memMon
+	// If the input is already fully sorted, the rows are simply passed through.
+	passThrough := strategy == passThroughStrategyName
 
-		evalCtx := s.flowCtx.evalCtx
-		evalCtx.Mon = &limitedMon
-		sv = makeRowContainer(s.ordering, s.rawInput.Types(), &evalCtx)
-	} else {
-		sv = makeRowContainer(s.ordering, s.rawInput.Types(), &s.flowCtx.evalCtx)
+	types := s.rawInput.Types()
+	if len(s.orderingExprTypes) > 0 {
+		types = append(types[:len(types):len(types)], s.orderingExprTypes...)
 	}
+	ordering := s.ordering
+	if s.stable && s.count != 0 && !passThrough {
+		// With a limit, the rows are arranged in a max-heap (see sortTopKStrategy
+		// and sortChunksStrategy), which loses their input order. Break the ties
+		// with a sequence number instead.
+		s.seqNums = true
+		types = append(types[:len(types):len(types)], seqNumType)
+		ordering = append(ordering[:len(ordering):len(ordering)], sqlbase.ColumnOrderInfo{
+			ColIdx: len(types) - 1, Direction: encoding.Ascending,
+		})
+	}
+	// The container is released once the strategy is done with it.
+	sv := getRowContainer(ordering, types, &evalCtx)
+	defer putRowContainer(ctx, sv)
+	// The mergesort is how stable containers sort their rows.
+	sv.stable = s.stable || sorterAlgorithm.Get() == int64(sortAlgorithmMergesort)
+	sv.comparators = makeComparators(ordering, types)
+	if s.keyEncodedOrdering {
+		sv.useKeys()
+	}
+	if s.testingKnobCountComparisons {
+		sv.comparisons = &s.stats.memComparisons
+	}
+	if maxLimit > limit && s.tempStorage != nil && !s.diskSpillDisallowed {
+		sv.growLimit = func(ctx context.Context) bool {
+			return s.growMemLimit(ctx, &memMon, parentMon, maxLimit)
+		}
+	}
+	if strategy != sortChunksStrategyName {
+		// The sortChunksStrategy can't fall back to disk.
+		sv.spillAfterRows = s.testingKnobSpillAfterRows
+	}
+
 	// Construct the optimal sorterStrategy.
 	var ss sorterStrategy
-	if s.matchLen == 0 {
-		if s.count == 0 {
-			// No specified ordering match length and unspecified limit; no
-			// optimizations are possible so we simply load all rows into memory and
-			// sort all values in-place. It has a worst-case time complexity of
-			// O(n*log(n)) and a worst-case space complexity of O(n).
-			ss = newSortAllStrategy(sv, useTempStorage)
-		} else {
-			// No specified ordering match length but specified limit; we can optimize
-			// our sort procedure by maintaining a max-heap populated with only the
-			// smallest k rows seen. It has a worst-case time complexity of
-			// O(n*log(k)) and a worst-case space complexity of O(k).
-			ss = newSortTopKStrategy(sv, s.count)
-		}
-	} else {
+	switch strategy {
+	case passThroughStrategyName:
+		ss = newPassThroughStrategy(s.count)
+	case sortAllStrategyName:
+		// No specified ordering match length and unspecified limit; no
+		// optimizations are possible so we simply load all rows into memory and
+		// sort all values in-place. It has a worst-case time complexity of
+		// O(n*log(n)) and a worst-case space complexity of O(n).
+		ss = newSortAllStrategy(sv, useTempStorage)
+	case sortTopKStrategyName:
+		// No specified ordering match length (or one that the spec prefers to
+		// ignore) but specified limit; we can optimize our sort procedure by
+		// maintaining a max-heap populated with only the smallest k rows seen.
+		// It has a worst-case time complexity of O(n*log(k)) and a worst-case
+		// space complexity of O(k).
+		ss = newSortTopKStrategy(sv, s.count, useTempStorage)
+	case sortChunksStrategyName:
 		// Ordering match length is specified. We will be able to use existing
 		// ordering in order to avoid loading all the rows into memory. If we're
 		// scanning an index with a prefix matching an ordering prefix, we can only
 		// accumulate values for equal fields in this prefix, sort the accumulated
-		// chunk and then output.
-		// TODO(irfansharif): Add optimization for case where both ordering match
-		// length and limit is specified.
-		ss = newSortChunksStrategy(sv)
+		// chunk and then output. If a limit is specified as well, we stop
+		// consuming the input once enough rows have been output.
+		ss = newSortChunksStrategy(
+			sv, s.ordering, s.matchLen, s.count, sorterMinChunkSize.Get(), s.lowCardinalityChunkColumns,
+		)
+	case sortRunsStrategyName:
+		// The input consists of sorted runs, whose boundaries are specified.
+		// The runs can overlap, so all the rows are loaded into memory, but
+		// they only need to be merged. It has a worst-case time complexity of
+		// O(n*log(r)) for r runs and a worst-case space complexity of O(n).
+		ss = newSortRunsStrategy(sv, s.runBoundaries, useTempStorage)
+	}
+	s.stats.strategy = strategy
+	s.stats.countOverflow = s.countOverflow
+	if s.countOverflow {
+		log.Eventf(ctx, "limit and offset overflow the row count; sorting all the rows")
+	}
+	if log.V(2) {
+		log.Infof(ctx, "using %s strategy (matchLen: %d, count: %d, useTempStorage: %t)",
+			s.stats.strategy, s.matchLen, s.count, useTempStorage)
 	}
 
+	if s.agg != nil {
+		// The memory of the aggregation isn't part of the working set of the
+		// strategy, to which the limit of the sorter's monitor applies.
+		s.agg.start(&s.flowCtx.evalCtx)
+		defer s.agg.close(ctx)
+	}
+
+	s.haveDistinctRow = false
+	s.haveVerifyRow = false
+	s.consumerClosed = false
+	s.outputStatus = NeedMoreRows
+
+	start := timeutil.Now()
+	s.phase = sortPhaseAccumulating
+	s.lastProgress = start
+	s.inputDone = false
+	s.inputDeadline = start.Add(s.partialResultsAfter)
+	s.partial = false
 	sortErr := ss.Execute(ctx, s)
+	if sortErr == nil && s.agg != nil {
+		sortErr = s.agg.finish(ctx, s)
+	}
+	s.stats.sortTime = timeutil.Since(start)
+	s.stats.maxAllocatedMem = memMon.MaximumBytes()
+	if m := s.flowCtx.metrics; m != nil && s.stats.outputRows > 0 {
+		m.SortFirstRowLatency.RecordValue(s.stats.firstRowLatency.Nanoseconds())
+	}
+	log.VEventf(ctx, 1,
+		"sorter stats: strategy: %s, %d input rows, %d bytes max memory, spilled: %t, sort time: %s, "+
+			"output wait time: %s, time to first row: %s",
+		s.stats.strategy, s.stats.inputRows, s.stats.maxAllocatedMem, s.stats.spilledToDisk,
+		s.stats.sortTime, s.stats.outputWaitTime, s.stats.firstRowLatency)
 	if sortErr != nil {
 		log.Errorf(ctx, "error sorting rows: %s", sortErr)
 	}
+	if s.consumerClosed {
+		// Neither sortErr nor the metadata of the input would be read, so the
+		// input is closed instead of drained: it might have many rows left to
+		// produce before it gets to its metadata.
+		log.VEventf(ctx, 1, "consumer closed; closing the input without draining it")
+		if !s.partial {
+			s.rawInput.ConsumerClosed()
+		}
+		s.out.close()
+		return
+	}
+	if s.partial {
+		// The rows output are only those read before the time budget ran out;
+		// the consumer is told so after the last of them.
+		s.out.output.Push(nil /* row */, ProducerMetadata{
+			SorterPartialResult: &RemoteProducerMetadata_SorterPartialResult{
+				InputRows: s.stats.inputRows,
+			},
+		})
+	}
+	if s.flowCtx.sendSorterStats {
+		s.out.output.Push(nil /* row */, ProducerMetadata{SorterStats: s.stats.toMetadata()})
+	}
+	if s.partial {
+		// The input was drained when the sorter stopped reading it.
+		DrainAndClose(ctx, s.out.output, sortErr)
+		return
+	}
 	DrainAndClose(ctx, s.out.output, sortErr, s.rawInput)
 }
+
+// sortPhase is a phase of the run of a sorter, as reported in its progress
+// (see FlowSpec.SendSorterProgress). The sorter starts out accumulating its
+// input rows. The strategies that interleave reading their input with
+// outputting rows (the passThroughStrategy, and the sortChunksStrategy once it
+// has sorted its first chunk) are outputting from then on.
+type sortPhase string
+
+const (
+	sortPhaseAccumulating sortPhase = "accumulating"
+	sortPhaseSorting      sortPhase = "sorting"
+	sortPhaseMerging      sortPhase = "merging"
+	sortPhaseOutputting   sortPhase = "outputting"
+)
+
+// sorterProgressInterval is the minimum interval between two progress reports
+// of a sorter. It is a variable so that tests can lower it.
+var sorterProgressInterval = time.Second
+
+// setPhase records that the sorter enters the given phase, and reports its
+// progress if it is due.
+func (s *sorter) setPhase(phase sortPhase) {
+	if !s.flowCtx.sendSorterProgress {
+		return
+	}
+	s.phase = phase
+	s.maybeReportProgress()
+}
+
+// maybeReportProgress pushes the progress of the sorter as metadata, unless it
+// was last reported (or the sorter started running) less than
+// sorterProgressInterval ago. It is called when the sorter changes phase and
+// every cancelCheckInterval rows read or output, so that the clock isn't read
+// for every row. A sorter that is done quickly doesn't report any progress;
+// its stats are enough (see FlowSpec.SendSorterStats).
+func (s *sorter) maybeReportProgress() {
+	now := timeutil.Now()
+	if now.Sub(s.lastProgress) < sorterProgressInterval {
+		return
+	}
+	s.lastProgress = now
+	s.out.output.Push(nil /* row */, ProducerMetadata{SorterProgress: s.progress()})
+}
+
+// progress returns the progress sent by the sorter as metadata.
+func (s *sorter) progress() *RemoteProducerMetadata_SorterProgress {
+	p := &RemoteProducerMetadata_SorterProgress{
+		Phase:              string(s.phase),
+		InputRows:          s.stats.inputRows,
+		EstimatedInputRows: s.estimatedInputRows,
+		OutputRows:         s.stats.outputRows,
+		SpilledToDisk:      s.stats.spilledToDisk,
+	}
+	if s.estimatedInputRows > 0 {
+		// The estimate can be off either way: the percentage only gets to 100
+		// once the input has been read entirely.
+		if s.inputDone {
+			p.InputPercent = 100
+		} else if p.InputPercent = s.stats.inputRows * 100 / s.estimatedInputRows; p.InputPercent > 99 {
+			p.InputPercent = 99
+		}
+	}
+	return p
+}
+
+// growMemLimit doubles the limit of the sorter's monitor m, up to maxLimit, if
+// its pool has at least twice as much memory available as the increase. It is
+// called when a row doesn't fit in the limit, before the sorter falls back to
+// disk, and returns whether the limit was raised. The memory is still reserved
+// from the pool as it is allocated, so the pool's limits apply. Leaving half
+// of the pool's spare memory to its other clients makes the sorter spill as
+// usual once the node runs low on memory.
+func (s *sorter) growMemLimit(
+	ctx context.Context, m *mon.MemoryMonitor, pool *mon.MemoryMonitor, maxLimit int64,
+) bool {
+	limit := s.memMonLimit
+	if limit >= maxLimit {
+		return false
+	}
+	newLimit := maxLimit
+	if limit <= maxLimit/2 {
+		newLimit = 2 * limit
+	}
+	if pool.Available()/2 < newLimit-limit {
+		return false
+	}
+	m.SetLimit(newLimit)
+	s.memMonLimit = newLimit
+	log.Eventf(ctx, "sorter memory limit raised to %d bytes instead of spilling", newLimit)
+	return true
+}
+
+// newLimitError returns the error returned by a sorter that reached one of its
+// limits instead of spilling to disk. It is an insufficient resources error
+// so that clients know that the query can be retried (e.g. with a larger
+// limit, or with spilling to disk allowed).
+func newLimitError(format string, args ...interface{}) error {
+	return pgerror.NewErrorf(pgerror.CodeInsufficientResourcesError, format, args...)
+}
+
+// checkMaxRows returns an error if buffering numRows rows would exceed the
+// sorter's row limit.
+func (s *sorter) checkMaxRows(numRows int64) error {
+	if s.maxRows > 0 && numRows > s.maxRows {
+		return newLimitError(
+			"sorter row limit exceeded: %d rows buffered, limit is %d rows", numRows, s.maxRows,
+		)
+	}
+	return nil
+}
+
+var seqNumType = sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+
+// nextRow reads the next row from the input, keeping track of the number of
+// rows read. The returned row has an additional column with the value of each
+// of s.orderingExprs and, if s.seqNums is set, one with the number of rows
+// read so far.
+//
+// The context's error is returned instead if it has been canceled, so that the
+// strategies stop pulling rows from the input, whose rows can be expensive to
+// produce, as soon as the flow is canceled.
+//
+// If s.partialResultsAfter is set, the input is treated as exhausted once the
+// deadline has passed (which is only checked between rows): the input is
+// drained, its metadata forwarded, and s.partial set, so that the strategy
+// outputs the rows read so far.
+func (s *sorter) nextRow(ctx context.Context) (sqlbase.EncDatumRow, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if s.partial {
+		return nil, nil
+	}
+	if s.partialResultsAfter > 0 && !s.inputDone && timeutil.Now().After(s.inputDeadline) {
+		log.Eventf(ctx, "time budget of %s exhausted after %d input rows; returning partial results",
+			s.partialResultsAfter, s.stats.inputRows)
+		s.partial = true
+		DrainAndForwardMetadata(ctx, s.rawInput, s.out.output)
+		return nil, nil
+	}
+	row, err := s.input.NextRow()
+	if err != nil || row == nil {
+		s.inputDone = err == nil
+		return row, err
+	}
+	s.stats.inputRows++
+	if s.flowCtx.sendSorterProgress && s.stats.inputRows%cancelCheckInterval == 0 {
+		s.maybeReportProgress()
+	}
+	if s.flowCtx.sendSorterStats {
+		s.stats.rowSizes.add(int64(row.Size()))
+	}
+	if len(s.orderingExprs) == 0 && !s.seqNums {
+		return row, nil
+	}
+	numCols := len(row) + len(s.orderingExprs)
+	if s.seqNums {
+		numCols++
+	}
+	extRow := s.rowAlloc.AllocRow(numCols)
+	copy(extRow, row)
+	for i := range s.orderingExprs {
+		d, err := s.orderingExprs[i].eval(row)
+		if err != nil {
+			return nil, err
+		}
+		extRow[len(row)+i] = sqlbase.DatumToEncDatum(s.orderingExprTypes[i], d)
+	}
+	if s.seqNums {
+		extRow[numCols-1] = sqlbase.DatumToEncDatum(
+			seqNumType, parser.NewDInt(parser.DInt(s.stats.inputRows)),
+		)
+	}
+	return extRow, nil
+}
+
+// emitRow pushes a sorted row to the procOutputHelper, removing the columns
+// added by nextRow. If s.agg is set, the row is aggregated instead, and only
+// the aggregated rows are pushed. If s.distinctOrdering is set, the row is
+// skipped if it's a duplicate of the previous one; since this happens before
+// the procOutputHelper, its limit and offset apply to the distinct rows.
+func (s *sorter) emitRow(ctx context.Context, row sqlbase.EncDatumRow) (ConsumerStatus, error) {
+	if s.outputSatisfied() {
+		// No more work is done for rows that aren't needed, whatever the
+		// strategy.
+		return s.outputStatus, nil
+	}
+	if sorterVerifyOutput {
+		s.verifyOrder(row)
+	}
+	row = row[:s.numInputCols]
+	if s.testingKnobOnEmitRow != nil {
+		s.testingKnobOnEmitRow(row)
+	}
+	if s.distinctOrdering != nil {
+		if s.haveDistinctRow {
+			cmp, err := row.CompareToDatums(
+				&s.distinctAlloc, s.distinctOrdering, &s.flowCtx.evalCtx, s.distinctRow,
+			)
+			if err != nil {
+				return ConsumerClosed, err
+			}
+			if cmp == 0 {
+				return NeedMoreRows, nil
+			}
+		}
+		// The decoded values are kept since the strategies reuse their rows.
+		for _, c := range s.distinctOrdering {
+			if err := row[c.ColIdx].EnsureDecoded(&s.distinctAlloc); err != nil {
+				return ConsumerClosed, err
+			}
+			s.distinctRow[c.ColIdx] = row[c.ColIdx].Datum
+		}
+		s.haveDistinctRow = true
+	}
+	if s.agg != nil {
+		return s.agg.addRow(ctx, s, row)
+	}
+	return s.pushRow(ctx, row)
+}
+
+// sorterVerifyOutput makes sorters verify that their strategies emit their rows
+// in order, and panic with the offending rows if they don't (see verifyOrder).
+// It is meant to catch bugs in the comparisons of rows, in memory or on disk,
+// during development.
+var sorterVerifyOutput = envutil.EnvOrDefaultBool("COCKROACH_SORTER_VERIFY_OUTPUT", false)
+
+// verifyOrder panics if the given row, emitted by the strategy, sorts before
+// the previous one according to the ordering, and remembers it otherwise. The
+// row is the one emitted, so it can still have the ordering expressions'
+// columns.
+func (s *sorter) verifyOrder(row sqlbase.EncDatumRow) {
+	if s.haveVerifyRow {
+		cmp, err := row.CompareToDatums(&s.verifyAlloc, s.ordering, &s.flowCtx.evalCtx, s.verifyRow)
+		if err != nil {
+			panic(fmt.Sprintf("unable to verify the order of sorted row %s: %v", row, err))
+		}
+		if cmp < 0 {
+			prev := make(parser.Datums, len(s.ordering))
+			for i, c := range s.ordering {
+				prev[i] = s.verifyRow[c.ColIdx]
+			}
+			panic(fmt.Sprintf(
+				"sorted row %s emitted after a row with the values %s on the ordering columns %v",
+				row, parser.AsString(prev), s.ordering,
+			))
+		}
+	}
+	if len(s.verifyRow) != len(row) {
+		s.verifyRow = make(parser.Datums, len(row))
+	}
+	for _, c := range s.ordering {
+		if err := row[c.ColIdx].EnsureDecoded(&s.verifyAlloc); err != nil {
+			panic(fmt.Sprintf("unable to verify the order of sorted row %s: %v", row, err))
+		}
+		s.verifyRow[c.ColIdx] = row[c.ColIdx].Datum
+	}
+	s.haveVerifyRow = true
+}
+
+// pushRow pushes an output row to the procOutputHelper. If s.directOutput is
+// set, the procOutputHelper is bypassed and the row is pushed to the output
+// directly. Either way, the row is copied since the strategies reuse their
+// rows.
+func (s *sorter) pushRow(ctx context.Context, row sqlbase.EncDatumRow) (ConsumerStatus, error) {
+	s.stats.outputRows++
+	if s.stats.outputRows == 1 {
+		s.stats.firstRowLatency = timeutil.Since(s.runStart)
+	}
+	if s.flowCtx.sendSorterProgress && s.stats.outputRows%cancelCheckInterval == 0 {
+		s.maybeReportProgress()
+	}
+	if !s.flowCtx.sendSorterStats {
+		return s.pushRowUntimed(ctx, row)
+	}
+	start := timeutil.Now()
+	consumerStatus, err := s.pushRowUntimed(ctx, row)
+	s.stats.outputWaitTime += timeutil.Since(start)
+	return consumerStatus, err
+}
+
+// pushRowUntimed is pushRow, without measuring outputWaitTime.
+func (s *sorter) pushRowUntimed(
+	ctx context.Context, row sqlbase.EncDatumRow,
+) (ConsumerStatus, error) {
+	if !s.directOutput {
+		consumerStatus, err := s.out.emitRow(ctx, row)
+		// emitRow also returns ConsumerClosed with its errors, which are still
+		// to be pushed.
+		s.consumerClosed = err == nil && consumerStatus == ConsumerClosed
+		s.outputStatus = consumerStatus
+		return consumerStatus, err
+	}
+	outRow := s.rowAlloc.AllocRow(len(row))
+	copy(outRow, row)
+	consumerStatus := s.out.output.Push(outRow, ProducerMetadata{})
+	if consumerStatus != NeedMoreRows {
+		log.VEventf(ctx, 1, "no more rows required. drain requested: %t",
+			consumerStatus == DrainRequested)
+	}
+	s.consumerClosed = consumerStatus == ConsumerClosed
+	s.outputStatus = consumerStatus
+	return consumerStatus, nil
+}
+
+// outputSatisfied returns whether the output doesn't need more rows: either
+// the consumer said so, or the procOutputHelper has let through all the rows
+// its limit allows, whether or not the limit was pushed into s.count. The
+// strategies stop once a push returns such a status, and emitRow doesn't do
+// any work for the rows emitted after that.
+func (s *sorter) outputSatisfied() bool {
+	return s.outputStatus != NeedMoreRows
+}
+
+// incrementalSortFraction is the fraction of its rows, as a divisor, that the
+// limit of the procOutputHelper must let through at most for the
+// sortAllStrategy to take the rows it outputs from a heap rather than sorting
+// them all (see emitSmallestRows). Taking all the rows out of a heap is slower
+// than sorting them, and the limit only bounds the number of rows needed from
+// below: some sorted rows may not count towards it (e.g. duplicates, with
+// SorterSpec.Distinct).
+const incrementalSortFraction = 8
+
+// fewRowsNeeded returns whether the output of the sorter is expected to be
+// satisfied after few of the numRows sorted rows, as far as the limit of the
+// procOutputHelper tells: this is the case when the limit wasn't pushed into
+// s.count (e.g. with an aggregation). A stable sorter always sorts all the
+// rows, since the heap doesn't preserve the order of equal rows, and so does a
+// sorter whose TestingKnobs.DisableSorterTopK is set.
+func (s *sorter) fewRowsNeeded(numRows int) bool {
+	if s.directOutput || s.stable || s.flowCtx.testingKnobs.DisableSorterTopK {
+		return false
+	}
+	return s.out.maxRowIdx-s.out.rowIdx <= uint64(numRows/incrementalSortFraction)
+}
@@ -18,20 +18,105 @@ package distsqlrun
 
 import (
 	"fmt"
+	"math"
+	"math/big"
 	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"testing/quick"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// runSorter runs a sorter with the given spec and post-processing stage on
+// input, and returns the rows and the metadata that it output, along with the
+// sorter for its stats. The sorter is passed to the configure functions before
+// it runs, e.g. to set its testing knobs. If flowCtx has no evalCtx (i.e. no
+// memory monitor), the sorter uses a testing one.
+func runSorter(
+	t testing.TB,
+	flowCtx *FlowCtx,
+	spec *SorterSpec,
+	post *PostProcessSpec,
+	input RowSource,
+	configure ...func(*sorter),
+) (sqlbase.EncDatumRows, []ProducerMetadata, *sorter) {
+	ctx := context.Background()
+	if flowCtx.evalCtx.Mon == nil {
+		evalCtx := parser.MakeTestingEvalContext()
+		defer evalCtx.Stop(ctx)
+		withEvalCtx := *flowCtx
+		withEvalCtx.evalCtx = evalCtx
+		flowCtx = &withEvalCtx
+	}
+	out := &RowBuffer{}
+	s, err := newSorter(flowCtx, spec, input, post, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range configure {
+		f(s)
+	}
+	s.Run(ctx, nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	var rows sqlbase.EncDatumRows
+	var meta []ProducerMetadata
+	for {
+		row, m := out.Next()
+		if !m.Empty() {
+			meta = append(meta, m)
+			continue
+		}
+		if row == nil {
+			break
+		}
+		rows = append(rows, row)
+	}
+	return rows, meta, s
+}
+
+// intColumn returns the values of the given INT column of the rows.
+func intColumn(rows sqlbase.EncDatumRows, col int) []int {
+	var values []int
+	for _, row := range rows {
+		values = append(values, int(*row[col].Datum.(*parser.DInt)))
+	}
+	return values
+}
+
+// metaErr returns the last error in the metadata output by a sorter, or nil.
+func metaErr(meta []ProducerMetadata) error {
+	var err error
+	for _, m := range meta {
+		if m.Err != nil {
+			err = m.Err
+		}
+	}
+	return err
+}
+
 func TestSorter(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -41,9 +126,86 @@ func TestSorter(t *testing.T) {
 		v[i] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i)))
 	}
 
+	null := sqlbase.DatumToEncDatum(columnTypeInt, parser.DNull)
+
+	// Collated strings, whose order depends on the locale rather than on their
+	// bytes: "ä" sorts between "a" and "b" in German, and "å" before "ä" in
+	// Swedish.
+	var collationEnv parser.CollationEnvironment
+	collated := func(locale string, contents string) sqlbase.EncDatum {
+		typ := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_COLLATEDSTRING, Locale: &locale}
+		return sqlbase.DatumToEncDatum(typ, parser.NewDCollatedString(contents, locale, &collationEnv))
+	}
+	de := func(contents string) sqlbase.EncDatum { return collated("de", contents) }
+	sv := func(contents string) sqlbase.EncDatum { return collated("sv", contents) }
+
 	asc := encoding.Ascending
 	desc := encoding.Descending
 
+	// SELECT @1, MIN(@2), MAX(@2), COUNT(DISTINCT @2), COUNT(*) GROUP BY @1.
+	groupAgg := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Aggregations: []AggregatorSpec_Aggregation{
+			{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+			{Func: AggregatorSpec_MIN, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_MAX, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_COUNT, Distinct: true, ColIdx: []uint32{1}},
+			{Func: AggregatorSpec_COUNT_ROWS},
+		},
+	}
+	aggInput := sqlbase.EncDatumRows{
+		{v[2], v[5]},
+		{v[1], v[3]},
+		{v[2], v[5]},
+		{v[3], v[1]},
+		{v[1], v[2]},
+		{v[2], v[4]},
+	}
+	// aggInput, ordered on the first column.
+	orderedAggInput := sqlbase.EncDatumRows{
+		{v[1], v[3]},
+		{v[1], v[2]},
+		{v[2], v[5]},
+		{v[2], v[4]},
+		{v[2], v[5]},
+		{v[3], v[1]},
+	}
+	groups := sqlbase.EncDatumRows{
+		{v[1], v[2], v[3], v[2], v[2]},
+		{v[2], v[4], v[5], v[2], v[3]},
+		{v[3], v[1], v[1], v[1], v[1]},
+	}
+	distinctInput := sqlbase.EncDatumRows{
+		{v[2], v[5]},
+		{v[1], v[3]},
+		{v[2], v[5]},
+		{v[3], v[1]},
+		{v[1], v[3]},
+		{v[2], v[4]},
+		{v[1], v[2]},
+	}
+	// distinctInput, ordered on the first column.
+	orderedDistinctInput := sqlbase.EncDatumRows{
+		{v[1], v[3]},
+		{v[1], v[2]},
+		{v[1], v[3]},
+		{v[2], v[5]},
+		{v[2], v[4]},
+		{v[2], v[5]},
+		{v[3], v[1]},
+	}
+	distinctRows := sqlbase.EncDatumRows{
+		{v[1], v[2]},
+		{v[1], v[3]},
+		{v[2], v[4]},
+		{v[2], v[5]},
+		{v[3], v[1]},
+	}
+	fullOrdering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: asc},
+		{ColIdx: 1, Direction: asc},
+	})
+
 	testCases := []struct {
 		name     string
 		spec     SorterSpec
@@ -175,69 +337,706 @@ func TestSorter(t *testing.T) {
 				{v[0], v[2], v[2], v[4]},
 				{v[1], v[2], v[2], v[5]},
 			},
+		}, {
+			name: "SortMatchOrderingLimit",
+			// Specified match ordering length and limit; the limit falls in the
+			// middle of a chunk.
+			spec: SorterSpec{
+				OrderingMatchLen: 1,
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+						{ColIdx: 1, Direction: asc},
+					}),
+			},
+			post: PostProcessSpec{Limit: 3, Offset: 2},
+			input: sqlbase.EncDatumRows{
+				{v[0], v[3]},
+				{v[0], v[1]},
+				{v[0], v[2]},
+				{v[1], v[5]},
+				{v[1], v[0]},
+				{v[1], v[4]},
+				{v[1], v[2]},
+				{v[2], v[0]},
+				{v[3], v[0]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[3]},
+				{v[1], v[0]},
+				{v[1], v[2]},
+			},
+		}, {
+			name: "SortMatchOrderingPreferTopK",
+			// Specified match ordering length and limit, with the top k
+			// strategy preferred; it stops reading the input at the first row
+			// whose prefix is greater than the k-th row's.
+			spec: SorterSpec{
+				OrderingMatchLen: 1,
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+						{ColIdx: 1, Direction: asc},
+					}),
+				PreferTopK: true,
+			},
+			post: PostProcessSpec{Limit: 3, Offset: 2},
+			input: sqlbase.EncDatumRows{
+				{v[0], v[3]},
+				{v[0], v[1]},
+				{v[0], v[2]},
+				{v[1], v[5]},
+				{v[1], v[0]},
+				{v[1], v[4]},
+				{v[1], v[2]},
+				{v[2], v[0]},
+				{v[3], v[0]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[3]},
+				{v[1], v[0]},
+				{v[1], v[2]},
+			},
+		}, {
+			name: "SortMatchOrderingFull",
+			// The input is already sorted according to the full ordering.
+			spec: SorterSpec{
+				OrderingMatchLen: 2,
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+						{ColIdx: 1, Direction: desc},
+					}),
+			},
+			post: PostProcessSpec{Limit: 3, Offset: 1},
+			input: sqlbase.EncDatumRows{
+				{v[0], v[3]},
+				{v[0], v[1]},
+				{v[1], v[5]},
+				{v[1], v[2]},
+				{v[1], v[2]},
+				{v[2], v[0]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[1]},
+				{v[1], v[5]},
+				{v[1], v[2]},
+			},
+		}, {
+			name: "SortLimitDecreasingInput",
+			// No specified input ordering but specified limit. Every row is smaller
+			// than the previous ones, so all of them are among the smallest seen.
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+					}),
+			},
+			post: PostProcessSpec{Limit: 2},
+			input: sqlbase.EncDatumRows{
+				{v[5]},
+				{v[4]},
+				{v[3]},
+				{v[2]},
+				{v[1]},
+				{v[0]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0]},
+				{v[1]},
+			},
+		}, {
+			name: "SortLimitOffset",
+			// No specified input ordering but specified limit and offset. The rows
+			// before the offset are discarded by the sorter.
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+						{ColIdx: 1, Direction: desc},
+					}),
+			},
+			post: PostProcessSpec{Limit: 2, Offset: 3},
+			input: sqlbase.EncDatumRows{
+				{v[3], v[3]},
+				{v[3], v[4]},
+				{v[1], v[0]},
+				{v[0], v[0]},
+				{v[4], v[4]},
+				{v[2], v[5]},
+				{v[3], v[2]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[3], v[4]},
+				{v[3], v[3]},
+			},
+		}, {
+			name: "SortLimitOffsetPastInput",
+			// The offset is larger than the number of rows in the input.
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+					}),
+			},
+			post: PostProcessSpec{Limit: 2, Offset: 5},
+			input: sqlbase.EncDatumRows{
+				{v[3]},
+				{v[1]},
+				{v[2]},
+			},
+			expected: nil,
+		}, {
+			name: "SortAllNullsOrder",
+			// No specified input ordering and unspecified limit, with explicit
+			// NULL orderings.
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: desc, NullsOrder: sqlbase.NullsLast},
+						{ColIdx: 1, Direction: asc, NullsOrder: sqlbase.NullsLast},
+					}),
+			},
+			input: sqlbase.EncDatumRows{
+				{null, v[1]},
+				{v[2], null},
+				{v[1], v[0]},
+				{v[2], v[1]},
+				{null, null},
+				{v[1], null},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[2], v[1]},
+				{v[2], null},
+				{v[1], v[0]},
+				{v[1], null},
+				{null, v[1]},
+				{null, null},
+			},
+		}, {
+			name: "SortLimitNullsOrder",
+			// No specified input ordering but specified limit, with explicit NULL
+			// orderings.
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: desc, NullsOrder: sqlbase.NullsLast},
+						{ColIdx: 1, Direction: asc, NullsOrder: sqlbase.NullsLast},
+					}),
+			},
+			post: PostProcessSpec{Limit: 4},
+			input: sqlbase.EncDatumRows{
+				{null, v[1]},
+				{v[2], null},
+				{v[1], v[0]},
+				{v[2], v[1]},
+				{null, null},
+				{v[1], null},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[2], v[1]},
+				{v[2], null},
+				{v[1], v[0]},
+				{v[1], null},
+			},
+		}, {
+			name: "SortMatchOrderingNullsOrder",
+			// Specified match ordering length, with explicit NULL orderings.
+			spec: SorterSpec{
+				OrderingMatchLen: 1,
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: desc, NullsOrder: sqlbase.NullsLast},
+						{ColIdx: 1, Direction: asc, NullsOrder: sqlbase.NullsLast},
+					}),
+			},
+			input: sqlbase.EncDatumRows{
+				{v[2], null},
+				{v[2], v[1]},
+				{v[1], null},
+				{v[1], v[0]},
+				{null, null},
+				{null, v[1]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[2], v[1]},
+				{v[2], null},
+				{v[1], v[0]},
+				{v[1], null},
+				{null, v[1]},
+				{null, null},
+			},
+		}, {
+			name: "SortAllStable",
+			// Rows that are equal according to the ordering keep their input order.
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+					}),
+				Stable: true,
+			},
+			input: sqlbase.EncDatumRows{
+				{v[1], v[0]},
+				{v[0], v[1]},
+				{v[1], v[2]},
+				{v[0], v[3]},
+				{v[1], v[4]},
+				{v[0], v[5]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[1]},
+				{v[0], v[3]},
+				{v[0], v[5]},
+				{v[1], v[0]},
+				{v[1], v[2]},
+				{v[1], v[4]},
+			},
+		}, {
+			name: "SortLimitWide",
+			// The rows are wide enough to be kept narrow by the
+			// sortTopKStrategy.
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 2, Direction: desc},
+						{ColIdx: 0, Direction: asc},
+					}),
+			},
+			post: PostProcessSpec{Limit: 3},
+			input: sqlbase.EncDatumRows{
+				{v[0], v[1], v[2], v[3], v[4], v[5]},
+				{v[1], v[2], v[5], v[4], null, v[0]},
+				{v[2], v[3], v[0], v[5], v[0], v[1]},
+				{v[3], v[4], v[5], v[0], v[1], v[2]},
+				{v[4], v[5], v[1], v[1], v[2], null},
+				{v[5], null, v[3], v[2], v[3], v[4]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[1], v[2], v[5], v[4], null, v[0]},
+				{v[3], v[4], v[5], v[0], v[1], v[2]},
+				{v[5], null, v[3], v[2], v[3], v[4]},
+			},
+		}, {
+			name: "SortLimitStable",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+					}),
+				Stable: true,
+			},
+			post: PostProcessSpec{Limit: 4},
+			input: sqlbase.EncDatumRows{
+				{v[1], v[0]},
+				{v[0], v[1]},
+				{v[1], v[2]},
+				{v[0], v[3]},
+				{v[1], v[4]},
+				{v[0], v[5]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[1]},
+				{v[0], v[3]},
+				{v[0], v[5]},
+				{v[1], v[0]},
+			},
+		}, {
+			name: "SortLimitOffsetStable",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+					}),
+				Stable: true,
+			},
+			post: PostProcessSpec{Limit: 3, Offset: 2},
+			input: sqlbase.EncDatumRows{
+				{v[1], v[0]},
+				{v[0], v[1]},
+				{v[1], v[2]},
+				{v[0], v[3]},
+				{v[1], v[4]},
+				{v[0], v[5]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[5]},
+				{v[1], v[0]},
+				{v[1], v[2]},
+			},
+		}, {
+			name: "SortExpr",
+			// Sort by the sum of the two columns, which isn't part of the rows.
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 2, Direction: desc},
+						{ColIdx: 0, Direction: asc},
+					}),
+				OrderingExprs: []Expression{{Expr: "@1 + @2"}},
+			},
+			input: sqlbase.EncDatumRows{
+				{v[1], v[0]},
+				{v[0], v[3]},
+				{v[2], v[2]},
+				{v[4], v[1]},
+				{v[3], v[0]},
+				{v[1], v[3]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[4], v[1]},
+				{v[1], v[3]},
+				{v[2], v[2]},
+				{v[0], v[3]},
+				{v[3], v[0]},
+				{v[1], v[0]},
+			},
+		}, {
+			name: "SortExprLimitStable",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 2, Direction: asc},
+					}),
+				OrderingExprs: []Expression{{Expr: "@1 * @2"}},
+				Stable:        true,
+			},
+			post: PostProcessSpec{Limit: 3},
+			input: sqlbase.EncDatumRows{
+				{v[2], v[2]},
+				{v[0], v[5]},
+				{v[3], v[1]},
+				{v[4], v[0]},
+				{v[1], v[3]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[5]},
+				{v[4], v[0]},
+				{v[3], v[1]},
+			},
+		}, {
+			name: "SortMatchOrderingLimitStable",
+			spec: SorterSpec{
+				OrderingMatchLen: 1,
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+						{ColIdx: 1, Direction: asc},
+					}),
+				Stable: true,
+			},
+			post: PostProcessSpec{Limit: 5},
+			input: sqlbase.EncDatumRows{
+				{v[0], v[1], v[5]},
+				{v[0], v[0], v[4]},
+				{v[0], v[1], v[3]},
+				{v[1], v[1], v[2]},
+				{v[1], v[1], v[1]},
+				{v[1], v[0], v[0]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[0], v[4]},
+				{v[0], v[1], v[5]},
+				{v[0], v[1], v[3]},
+				{v[1], v[0], v[0]},
+				{v[1], v[1], v[2]},
+			},
 		},
-	}
-
-	ctx := context.Background()
-	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer tempEngine.Close()
-
-	for _, c := range testCases {
-		// Test with several memory limits:
-		// 0: Use the default limit.
-		// 1: Immediately switch to disk.
-		// 1150: This is the memory used after we store a couple of rows in
-		// memory. Tests the transfer of rows from memory to disk on
-		// initialization.
-		// 2048: A memory limit that should not be hit; the strategy will not
-		// use disk.
-		for _, memLimit := range []int64{0, 1, 1150, 2048} {
-			t.Run(fmt.Sprintf("%sMemLimit=%d", c.name, memLimit), func(t *testing.T) {
-				types := make([]sqlbase.ColumnType, len(c.input[0]))
-				for i := range types {
-					types[i] = c.input[0][i].Type
-				}
-				in := NewRowBuffer(types, c.input, RowBufferArgs{})
-				out := &RowBuffer{}
-				evalCtx := parser.MakeTestingEvalContext()
-				defer evalCtx.Stop(ctx)
-				flowCtx := FlowCtx{
-					evalCtx:     evalCtx,
-					tempStorage: tempEngine,
-				}
-
-				s, err := newSorter(&flowCtx, &c.spec, in, &c.post, out)
-				if err != nil {
-					t.Fatal(err)
-				}
-				// Override the default memory limit. This will result in using
-				// a memory row container which will hit this limit and fall
-				// back to using a disk row container.
-				s.testingKnobMemLimit = memLimit
-				s.Run(ctx, nil)
-				if !out.ProducerClosed {
-					t.Fatalf("output RowReceiver not closed")
-				}
-
-				var retRows sqlbase.EncDatumRows
-				for {
-					row, meta := out.Next()
-					if !meta.Empty() {
-						t.Fatalf("unexpected metadata: %v", meta)
-					}
-					if row == nil {
-						break
-					}
-					retRows = append(retRows, row)
-				}
-
-				expStr := c.expected.String()
-				retStr := retRows.String()
-				if expStr != retStr {
-					t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s",
+		{
+			name: "SortCollated",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: asc},
+					}),
+			},
+			input: sqlbase.EncDatumRows{
+				{de("z")},
+				{de("ä")},
+				{de("b")},
+				{de("a")},
+			},
+			expected: sqlbase.EncDatumRows{
+				{de("a")},
+				{de("ä")},
+				{de("b")},
+				{de("z")},
+			},
+		},
+		{
+			name: "SortCollatedLimit",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: desc},
+					}),
+			},
+			post: PostProcessSpec{Limit: 3},
+			input: sqlbase.EncDatumRows{
+				{sv("ä")},
+				{sv("a")},
+				{sv("ö")},
+				{sv("å")},
+			},
+			expected: sqlbase.EncDatumRows{
+				{sv("ö")},
+				{sv("ä")},
+				{sv("å")},
+			},
+		},
+		{
+			name: "Aggregate",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+				}),
+				Aggregation: &groupAgg,
+			},
+			input:    aggInput,
+			expected: groups,
+		},
+		{
+			name: "AggregateDesc",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: desc},
+					{ColIdx: 1, Direction: asc},
+				}),
+				Aggregation: &groupAgg,
+			},
+			input:    aggInput,
+			expected: sqlbase.EncDatumRows{groups[2], groups[1], groups[0]},
+		},
+		{
+			// The limit applies to the aggregated rows, all the input rows are
+			// sorted.
+			name: "AggregateLimit",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+				}),
+				Aggregation: &groupAgg,
+			},
+			post:     PostProcessSpec{Offset: 1, Limit: 1},
+			input:    aggInput,
+			expected: groups[1:2],
+		},
+		{
+			name: "AggregateMatchOrdering",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+					{ColIdx: 1, Direction: asc},
+				}),
+				OrderingMatchLen: 1,
+				Aggregation:      &groupAgg,
+			},
+			input:    orderedAggInput,
+			expected: groups,
+		},
+		{
+			name: "AggregateMatchOrderingFull",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+				}),
+				OrderingMatchLen: 1,
+				Aggregation:      &groupAgg,
+			},
+			input:    orderedAggInput,
+			expected: groups,
+		},
+		{
+			name: "AggregateMultipleGroupCols",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 1, Direction: asc},
+					{ColIdx: 0, Direction: asc},
+				}),
+				Aggregation: &AggregatorSpec{
+					GroupCols: []uint32{0, 1},
+					Aggregations: []AggregatorSpec_Aggregation{
+						{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+						{Func: AggregatorSpec_IDENT, ColIdx: []uint32{1}},
+						{Func: AggregatorSpec_COUNT_ROWS},
+					},
+				},
+			},
+			input: aggInput,
+			expected: sqlbase.EncDatumRows{
+				{v[3], v[1], v[1]},
+				{v[1], v[2], v[1]},
+				{v[1], v[3], v[1]},
+				{v[2], v[4], v[1]},
+				{v[2], v[5], v[2]},
+			},
+		},
+		{
+			name:     "Distinct",
+			spec:     SorterSpec{OutputOrdering: fullOrdering, Distinct: true},
+			input:    distinctInput,
+			expected: distinctRows,
+		},
+		{
+			// Only the first row of each value of the first column is output.
+			name: "DistinctOn",
+			spec: SorterSpec{
+				OutputOrdering:  fullOrdering,
+				Distinct:        true,
+				DistinctColumns: []uint32{0},
+			},
+			input:    distinctInput,
+			expected: sqlbase.EncDatumRows{{v[1], v[2]}, {v[2], v[4]}, {v[3], v[1]}},
+		},
+		{
+			name: "DistinctOnDesc",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: desc},
+					{ColIdx: 1, Direction: desc},
+				}),
+				Distinct:        true,
+				DistinctColumns: []uint32{0},
+			},
+			input:    distinctInput,
+			expected: sqlbase.EncDatumRows{{v[3], v[1]}, {v[2], v[5]}, {v[1], v[3]}},
+		},
+		{
+			// The limit and offset apply to the distinct rows, so the top-k
+			// strategy can't be used.
+			name:     "DistinctLimit",
+			spec:     SorterSpec{OutputOrdering: fullOrdering, Distinct: true},
+			post:     PostProcessSpec{Offset: 1, Limit: 2},
+			input:    distinctInput,
+			expected: distinctRows[1:3],
+		},
+		{
+			name: "DistinctMatchOrdering",
+			spec: SorterSpec{
+				OutputOrdering:   fullOrdering,
+				OrderingMatchLen: 1,
+				Distinct:         true,
+			},
+			input:    orderedDistinctInput,
+			expected: distinctRows,
+		},
+		{
+			// The rows are sorted in chunks of equal values of both columns, but
+			// deduplicated on the first one: duplicates are found across chunks.
+			name: "DistinctAcrossChunks",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+					{ColIdx: 1, Direction: asc},
+					{ColIdx: 2, Direction: asc},
+				}),
+				OrderingExprs:    []Expression{{Expr: "@2 * -1"}},
+				OrderingMatchLen: 2,
+				Distinct:         true,
+				DistinctColumns:  []uint32{0},
+			},
+			input:    distinctRows,
+			expected: sqlbase.EncDatumRows{{v[1], v[2]}, {v[2], v[4]}, {v[3], v[1]}},
+		},
+		{
+			name: "DistinctMatchOrderingFull",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+				}),
+				OrderingMatchLen: 1,
+				Distinct:         true,
+				DistinctColumns:  []uint32{0},
+			},
+			post:     PostProcessSpec{Limit: 2},
+			input:    orderedDistinctInput,
+			expected: sqlbase.EncDatumRows{{v[1], v[3]}, {v[2], v[5]}},
+		},
+	}
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	for _, c := range testCases {
+		// Test with several memory limits:
+		// 0: Use the default limit.
+		// 1: Immediately switch to disk.
+		// 1150: This is the memory used after we store a couple of rows in
+		// memory. Tests the transfer of rows from memory to disk on
+		// initialization.
+		// 2048: A memory limit that should not be hit; the strategy will not
+		// use disk.
+		for _, memLimit := range []int64{0, 1, 1150, 2048} {
+			t.Run(fmt.Sprintf("%sMemLimit=%d", c.name, memLimit), func(t *testing.T) {
+				types := make([]sqlbase.ColumnType, len(c.input[0]))
+				for i := range types {
+					types[i] = c.input[0][i].Type
+				}
+				in := NewRowBuffer(types, c.input, RowBufferArgs{})
+				metrics := MakeDistSQLMetrics(metric.TestSampleInterval)
+				flowCtx := FlowCtx{tempStorage: tempEngine, metrics: &metrics}
+				retRows, meta, s := runSorter(t, &flowCtx, &c.spec, &c.post, in, func(s *sorter) {
+					// Override the default memory limit. This will result in
+					// using a memory row container which will hit this limit
+					// and fall back to using a disk row container.
+					s.testingKnobMemLimit = memLimit
+				})
+				if len(meta) != 0 {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+
+				stats := s.stats
+				// The limit only reduces the rows that are sorted if it applies
+				// to the sorted rows (see sorterCount).
+				count, _ := sorterCount(&c.spec, &c.post)
+				expStrategy := sortChunksStrategyName
+				if int(c.spec.OrderingMatchLen) == len(c.spec.OutputOrdering.Columns) {
+					expStrategy = passThroughStrategyName
+				} else if count != 0 && (c.spec.OrderingMatchLen == 0 || c.spec.PreferTopK) {
+					expStrategy = sortTopKStrategyName
+				} else if c.spec.OrderingMatchLen == 0 {
+					expStrategy = sortAllStrategyName
+				}
+				if stats.strategy != expStrategy {
+					t.Errorf("expected the %s strategy, got %s", expStrategy, stats.strategy)
+				}
+				if effort := c.spec.SortEffort(&c.post); effort != strategyEfforts[stats.strategy] {
+					t.Errorf("expected a sort effort of %d for the %s strategy, got %d",
+						strategyEfforts[stats.strategy], stats.strategy, effort)
+				}
+				if c.spec.OrderingMatchLen == 0 && stats.inputRows != int64(len(c.input)) {
+					t.Errorf("expected %d input rows, got %d", len(c.input), stats.inputRows)
+				}
+				// The sortAllStrategy and sortTopKStrategy can fall back to disk.
+				canSpill := expStrategy == sortAllStrategyName || expStrategy == sortTopKStrategyName
+				if canSpill && memLimit == 1 && !stats.spilledToDisk {
+					t.Errorf("expected sorter to spill to disk")
+				}
+				if memLimit == 0 && stats.spilledToDisk {
+					t.Errorf("unexpected spill to disk")
+				}
+				expSpills := int64(0)
+				if stats.spilledToDisk {
+					expSpills = 1
+				}
+				if n := metrics.SortSpillCount.Count(); n != expSpills {
+					t.Errorf("expected %d spills to be counted, got %d", expSpills, n)
+				}
+				if n := metrics.SortDiskCurBytes.Value(); n != 0 {
+					t.Errorf("expected the temporary storage to be released, %d bytes remain", n)
+				}
+				if !stats.spilledToDisk && stats.maxAllocatedMem == 0 {
+					t.Errorf("expected memory usage to be reported")
+				}
+
+				expStr := c.expected.String()
+				retStr := retRows.String()
+				if expStr != retStr {
+					t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s",
 						expStr, retStr)
 				}
 			})
@@ -245,6 +1044,4793 @@ func TestSorter(t *testing.T) {
 	}
 }
 
+// strategyEfforts maps each sorterStrategy to the SortEffort it corresponds
+// to.
+var strategyEfforts = map[sorterStrategyName]SortEffort{
+	passThroughStrategyName: SortEffortNone,
+	sortChunksStrategyName:  SortEffortChunks,
+	sortAllStrategyName:     SortEffortFull,
+	sortTopKStrategyName:    SortEffortTopK,
+	sortRunsStrategyName:    SortEffortMerge,
+}
+
+func TestSorterSpecSortEffort(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	asc := encoding.Ascending
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: asc},
+		{ColIdx: 1, Direction: asc},
+	})
+	testCases := []struct {
+		spec      SorterSpec
+		post      PostProcessSpec
+		expEffort SortEffort
+	}{
+		{spec: SorterSpec{}, expEffort: SortEffortNone},
+		{spec: SorterSpec{OutputOrdering: ordering}, expEffort: SortEffortFull},
+		{
+			spec:      SorterSpec{OutputOrdering: ordering},
+			post:      PostProcessSpec{Limit: 10, Offset: 5},
+			expEffort: SortEffortTopK,
+		},
+		{
+			// The offset alone doesn't bound the number of rows to sort.
+			spec:      SorterSpec{OutputOrdering: ordering},
+			post:      PostProcessSpec{Offset: 5},
+			expEffort: SortEffortFull,
+		},
+		{
+			// The limit and offset overflow the count of rows to keep.
+			spec:      SorterSpec{OutputOrdering: ordering},
+			post:      PostProcessSpec{Limit: math.MaxUint64, Offset: 1},
+			expEffort: SortEffortFull,
+		},
+		{
+			spec:      SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 1},
+			expEffort: SortEffortChunks,
+		},
+		{
+			spec:      SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 1},
+			post:      PostProcessSpec{Limit: 10},
+			expEffort: SortEffortChunks,
+		},
+		{
+			spec:      SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 1, PreferTopK: true},
+			post:      PostProcessSpec{Limit: 10},
+			expEffort: SortEffortTopK,
+		},
+		{
+			// The hint only applies if there is a limit.
+			spec:      SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 1, PreferTopK: true},
+			expEffort: SortEffortChunks,
+		},
+		{
+			spec:      SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 2},
+			post:      PostProcessSpec{Limit: 10},
+			expEffort: SortEffortNone,
+		},
+		{
+			spec:      SorterSpec{OutputOrdering: ordering, InputRunBoundaries: []uint64{10}},
+			post:      PostProcessSpec{Limit: 10},
+			expEffort: SortEffortMerge,
+		},
+	}
+	for i, tc := range testCases {
+		if effort := tc.spec.SortEffort(&tc.post); effort != tc.expEffort {
+			t.Errorf("%d: expected a sort effort of %d, got %d", i, tc.expEffort, effort)
+		}
+	}
+}
+
+// TestSorterSpecMemLimit verifies that the memory limit specified through the
+// SorterSpec is respected when falling back to disk is enabled.
+func TestSorterSpecMemLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&distSQLUseTempStorage, true)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	rows := make(sqlbase.EncDatumRows, 10)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(len(rows)-i))),
+		}
+	}
+
+	for _, tc := range []struct {
+		memLimit int64
+		expErr   bool
+	}{
+		// The default limit is large enough to sort all the rows in memory.
+		{memLimit: 0, expErr: false},
+		{memLimit: -1, expErr: false},
+		// A small limit forces the sorter to fall back to disk, which fails
+		// because no temporary storage is provided.
+		{memLimit: 1, expErr: true},
+	} {
+		t.Run(fmt.Sprintf("MemLimit=%d", tc.memLimit), func(t *testing.T) {
+			spec := SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+				MemLimit: tc.memLimit,
+			}
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			ret, meta, _ := runSorter(t, &FlowCtx{}, &spec, &PostProcessSpec{}, in)
+			errSeen := metaErr(meta)
+			if tc.expErr {
+				if !testutils.IsError(errSeen, "external storage not provided") {
+					t.Fatalf("expected external storage error, got %v", errSeen)
+				}
+			} else {
+				if errSeen != nil {
+					t.Fatal(errSeen)
+				}
+				if len(ret) != len(rows) {
+					t.Fatalf("expected %d rows, got %d", len(rows), len(ret))
+				}
+			}
+		})
+	}
+}
+
+// TestSorterNoTempStorage verifies that a sorter that would have to spill but
+// has no temporary storage sorts its rows in memory, beyond the work_mem
+// limit, and that it returns a clear error if the flow's memory limit is
+// reached.
+func TestSorterNoTempStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&distSQLUseTempStorage, true)()
+	// The rows don't fit in work_mem.
+	defer settings.TestingSetString(&sorterWorkMem, "1")()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 1000
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	for _, tc := range []struct {
+		name string
+		// flowLimit, if set, is the limit of the flow's monitor.
+		flowLimit int64
+		expErr    string
+	}{
+		{name: "WorkMem"},
+		{name: "FlowLimit", flowLimit: 1 << 10, expErr: "disk spill unavailable"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+			if tc.flowLimit > 0 {
+				flowMon := mon.MakeMonitorInheritWithLimit("test-flow", tc.flowLimit, evalCtx.Mon)
+				flowMon.Start(ctx, evalCtx.Mon, mon.BoundAccount{})
+				defer flowMon.Stop(ctx)
+				flowCtx.evalCtx.Mon = &flowMon
+			}
+
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			ret, meta, s := runSorter(t, &flowCtx, &spec, &PostProcessSpec{}, in)
+			errSeen := metaErr(meta)
+			if tc.expErr != "" {
+				if !testutils.IsError(errSeen, tc.expErr) {
+					t.Fatalf("expected %q error, got %v", tc.expErr, errSeen)
+				}
+				return
+			}
+			if errSeen != nil {
+				t.Fatal(errSeen)
+			}
+			if len(ret) != numRows {
+				t.Fatalf("expected %d rows, got %d", numRows, len(ret))
+			}
+			if s.memMonLimit != 0 {
+				t.Errorf("expected the sorter's memory not to be limited, got limit %d", s.memMonLimit)
+			}
+		})
+	}
+}
+
+func TestSorterInvalidMatchLen(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{evalCtx: evalCtx}
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	in := NewRowBuffer([]sqlbase.ColumnType{columnTypeInt}, nil /* rows */, RowBufferArgs{})
+	spec := SorterSpec{
+		OrderingMatchLen: 2,
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+	if _, err := newSorter(
+		&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{},
+	); !testutils.IsError(err, "ordering match length 2 exceeds the number of ordering columns 1") {
+		t.Fatalf("expected invalid match length error, got %v", err)
+	}
+}
+
+// TestSorterInvalidOrderingColumn verifies that a sorter can't be created with
+// an ordering on a column that its input doesn't have, instead of failing when
+// rows are compared.
+func TestSorterInvalidOrderingColumn(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	asc := encoding.Ascending
+
+	testCases := []struct {
+		name     string
+		spec     SorterSpec
+		post     PostProcessSpec
+		reversed []uint32
+		// inputCols is the number of input columns, 2 by default.
+		inputCols int
+		expErr    string
+	}{
+		{
+			name: "PastInput",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+					{ColIdx: 2, Direction: asc},
+				}),
+			},
+			expErr: "invalid ordering column 2 \\(only 2 available\\)",
+		},
+		{
+			// Column 1 is the ordering expression; column 2 doesn't exist.
+			name:      "PastExprs",
+			inputCols: 1,
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 1, Direction: asc},
+					{ColIdx: 2, Direction: asc},
+				}),
+				OrderingExprs: []Expression{{Expr: "@1 + 1"}},
+			},
+			expErr: "invalid ordering column 2 \\(only 2 available\\)",
+		},
+		{
+			name: "TopK",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 5, Direction: asc},
+				}),
+			},
+			post:   PostProcessSpec{Limit: 3},
+			expErr: "invalid ordering column 5 \\(only 2 available\\)",
+		},
+		{
+			name: "Chunks",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+					{ColIdx: math.MaxUint32, Direction: asc},
+				}),
+				OrderingMatchLen: 1,
+			},
+			expErr: "invalid ordering column 4294967295 \\(only 2 available\\)",
+		},
+		{
+			name: "Reversed",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 3, Direction: asc},
+				}),
+			},
+			reversed: []uint32{1},
+			expErr:   "invalid ordering column 3 \\(only 2 available\\)",
+		},
+		{
+			// The ordering is validated before the aggregation, which relies on
+			// it.
+			name: "Aggregation",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 2, Direction: asc},
+				}),
+				Aggregation: &AggregatorSpec{
+					GroupCols: []uint32{0},
+					Aggregations: []AggregatorSpec_Aggregation{
+						{Func: AggregatorSpec_COUNT_ROWS},
+					},
+				},
+			},
+			expErr: "invalid ordering column 2 \\(only 2 available\\)",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			evalCtx.ReverseSortColumns = c.reversed
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+
+			inputTypes := types
+			if c.inputCols != 0 {
+				inputTypes = types[:c.inputCols]
+			}
+			in := NewRowBuffer(inputTypes, nil /* rows */, RowBufferArgs{})
+			if _, err := newSorter(
+				&flowCtx, &c.spec, in, &c.post, &RowBuffer{},
+			); !testutils.IsError(err, c.expErr) {
+				t.Fatalf("expected error %q, got %v", c.expErr, err)
+			}
+		})
+	}
+}
+
+// TestSorterLimitOverflow verifies that a sorter whose limit and offset add up
+// to more rows than the count can hold sorts all the rows.
+func TestSorterLimitOverflow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	rows := make(sqlbase.EncDatumRows, 10)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(len(rows)-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	testCases := []struct {
+		post        PostProcessSpec
+		expCount    int64
+		expOverflow bool
+		expStrategy sorterStrategyName
+		expFirst    string
+		expRows     int
+	}{
+		{
+			post:     PostProcessSpec{Limit: 3, Offset: 2},
+			expCount: 5, expStrategy: sortTopKStrategyName, expFirst: "3", expRows: 3,
+		},
+		{
+			post:     PostProcessSpec{Limit: math.MaxInt64, Offset: 0},
+			expCount: math.MaxInt64, expStrategy: sortTopKStrategyName, expFirst: "1", expRows: 10,
+		},
+		{
+			post:     PostProcessSpec{Limit: math.MaxInt64, Offset: 2},
+			expCount: 0, expOverflow: true,
+			expStrategy: sortAllStrategyName, expFirst: "3", expRows: 8,
+		},
+		{
+			post:     PostProcessSpec{Limit: 3, Offset: math.MaxUint64 - 1},
+			expCount: 0, expOverflow: true,
+			expStrategy: sortAllStrategyName, expRows: 0,
+		},
+		{
+			post:     PostProcessSpec{Limit: math.MaxUint64, Offset: 1},
+			expCount: 0, expOverflow: true,
+			expStrategy: sortAllStrategyName, expFirst: "2", expRows: 9,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Limit=%d,Offset=%d", tc.post.Limit, tc.post.Offset), func(t *testing.T) {
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			retRows, meta, s := runSorter(t, &FlowCtx{sendSorterStats: true}, &spec, &tc.post, in)
+			if len(meta) != 1 || meta[0].SorterStats == nil {
+				t.Fatalf("expected the sorter stats, got %v", meta)
+			}
+			// The clamp is reported along with the stats.
+			if overflow := meta[0].SorterStats.CountOverflow; overflow != tc.expOverflow {
+				t.Fatalf("expected a count overflow of %t in the stats, got %t", tc.expOverflow, overflow)
+			}
+			if s.count != tc.expCount {
+				t.Fatalf("expected a count of %d, got %d", tc.expCount, s.count)
+			}
+			if strategy := s.stats.strategy; strategy != tc.expStrategy {
+				t.Fatalf("expected the %s strategy, got %s", tc.expStrategy, strategy)
+			}
+			if len(retRows) != tc.expRows {
+				t.Fatalf("expected %d rows, got %d", tc.expRows, len(retRows))
+			}
+			if len(retRows) > 0 && retRows[0][0].String() != tc.expFirst {
+				t.Fatalf("expected the first row to be %s, got %s", tc.expFirst, retRows[0])
+			}
+		})
+	}
+}
+
+// TestSorterCountQuick checks sorterCount against arbitrary limits and offsets,
+// including ones whose sum overflows an int64 or a uint64: the count is never
+// negative, it is Limit+Offset whenever that fits in an int64, and the
+// sortTopKStrategy is only chosen with a count.
+func TestSorterCountQuick(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rnd, seed := randutil.NewPseudoRand()
+	cfg := quick.Config{
+		MaxCount: 10000,
+		Rand:     rnd,
+	}
+	maxCount := big.NewInt(math.MaxInt64)
+	if err := quick.Check(func(
+		limit, offset uint64, limitShift, offsetShift uint8, aggregate, distinct bool,
+	) bool {
+		// The shifts make small values as likely as ones close to the maximum.
+		post := PostProcessSpec{
+			Limit: limit >> (limitShift % 64), Offset: offset >> (offsetShift % 64),
+		}
+		spec := SorterSpec{Distinct: distinct}
+		if aggregate {
+			spec.Aggregation = &AggregatorSpec{}
+		}
+		count, overflow := sorterCount(&spec, &post)
+		if count < 0 {
+			t.Errorf("%+v: negative count %d", post, count)
+			return false
+		}
+		sum := new(big.Int).Add(
+			new(big.Int).SetUint64(post.Limit), new(big.Int).SetUint64(post.Offset),
+		)
+		switch {
+		case post.Limit == 0 || aggregate || distinct:
+			if count != 0 || overflow {
+				t.Errorf("%+v: expected all the rows to be needed, got %d (overflow %t)",
+					post, count, overflow)
+				return false
+			}
+		case sum.Cmp(maxCount) > 0:
+			if count != 0 || !overflow {
+				t.Errorf("%+v: expected an overflow, got %d (overflow %t)", post, count, overflow)
+				return false
+			}
+		default:
+			if count != sum.Int64() || overflow {
+				t.Errorf("%+v: expected a count of %s, got %d (overflow %t)", post, sum, count, overflow)
+				return false
+			}
+		}
+		strategy := chooseSorterStrategy(0 /* matchLen */, 1, count, false, false)
+		if topK := strategy == sortTopKStrategyName; topK != (count > 0) {
+			t.Errorf("%+v: count %d led to the %s strategy", post, count, strategy)
+			return false
+		}
+		return true
+	}, &cfg); err != nil {
+		t.Fatal(errors.Wrapf(err, "with seed %d", seed))
+	}
+}
+
+// TestSorterLimitOffset verifies that the strategies that only keep the
+// smallest Limit+Offset rows output the right rows across combinations of
+// limit and offset, including offsets past the end of the input.
+func TestSorterLimitOffset(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	rng, _ := randutil.NewPseudoRand()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	const numRows = 50
+	rows := make(sqlbase.EncDatumRows, numRows)
+	expected := make([]int, numRows)
+	for i := range rows {
+		// The values have duplicates, but equal rows are identical so the
+		// output doesn't depend on the order of equal rows.
+		v := rng.Intn(numRows / 2)
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(v/5))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(v))),
+		}
+		expected[i] = v
+	}
+	sort.Ints(expected)
+	// The input is ordered on the first column for the chunks strategy.
+	sort.Slice(rows, func(i, j int) bool {
+		return *rows[i][0].Datum.(*parser.DInt) < *rows[j][0].Datum.(*parser.DInt)
+	})
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+
+	testCases := []struct {
+		name     string
+		spec     SorterSpec
+		memLimit int64
+		// disableTopK sets TestingKnobs.DisableSorterTopK, so that only the
+		// procOutputHelper applies the limit and the offset.
+		disableTopK bool
+		strategy    sorterStrategyName
+	}{
+		{name: "SortTopK", spec: SorterSpec{}, strategy: sortTopKStrategyName},
+		{name: "SortTopKDisk", spec: SorterSpec{}, memLimit: 1, strategy: sortTopKStrategyName},
+		{name: "SortChunks", spec: SorterSpec{OrderingMatchLen: 1}, strategy: sortChunksStrategyName},
+		{
+			name:     "SortChunksPreferTopK",
+			spec:     SorterSpec{OrderingMatchLen: 1, PreferTopK: true},
+			strategy: sortTopKStrategyName,
+		},
+		{name: "DisableTopK", spec: SorterSpec{}, disableTopK: true, strategy: sortAllStrategyName},
+		{
+			name:        "DisableTopKChunks",
+			spec:        SorterSpec{OrderingMatchLen: 1, PreferTopK: true},
+			disableTopK: true,
+			strategy:    sortChunksStrategyName,
+		},
+	}
+	for _, tc := range testCases {
+		for _, limit := range []uint64{1, 3, numRows - 1, numRows, 2 * numRows} {
+			for _, offset := range []uint64{0, 1, 7, numRows - 1, numRows, 3 * numRows} {
+				name := fmt.Sprintf("%s/Limit=%d/Offset=%d", tc.name, limit, offset)
+				t.Run(name, func(t *testing.T) {
+					flowCtx := FlowCtx{
+						tempStorage:  tempEngine,
+						testingKnobs: TestingKnobs{DisableSorterTopK: tc.disableTopK},
+					}
+					spec := tc.spec
+					spec.OutputOrdering = convertToSpecOrdering(ordering)
+					in := NewRowBuffer(types, rows, RowBufferArgs{})
+					post := PostProcessSpec{Limit: limit, Offset: offset}
+					retRows, meta, s := runSorter(t, &flowCtx, &spec, &post, in, func(s *sorter) {
+						s.testingKnobMemLimit = tc.memLimit
+					})
+					if len(meta) != 0 {
+						t.Fatalf("unexpected metadata: %v", meta)
+					}
+					if strategy := s.stats.strategy; strategy != tc.strategy {
+						t.Fatalf("expected the %s strategy, got %s", tc.strategy, strategy)
+					}
+
+					var exp []int
+					if offset < numRows {
+						exp = expected[offset:]
+						if limit < uint64(len(exp)) {
+							exp = exp[:limit]
+						}
+					}
+					if ret := intColumn(retRows, 1); fmt.Sprint(exp) != fmt.Sprint(ret) {
+						t.Fatalf("expected %v, got %v", exp, ret)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestSorterOffsetWithoutLimit verifies that a sorter whose post-processing
+// stage has an offset but no limit sorts all the rows, with every strategy that
+// doesn't depend on a limit, and only outputs the ones after the offset.
+func TestSorterOffsetWithoutLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	rng, _ := randutil.NewPseudoRand()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	const numRows = 50
+	values := make([]int, numRows)
+	for i := range values {
+		values[i] = rng.Intn(numRows / 2)
+	}
+	makeRows := func(values []int) sqlbase.EncDatumRows {
+		rows := make(sqlbase.EncDatumRows, len(values))
+		for i, v := range values {
+			// Equal rows are identical, so the output doesn't depend on the
+			// order of equal rows.
+			rows[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(v/5))),
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(v))),
+			}
+		}
+		return rows
+	}
+	unordered := makeRows(values)
+	// The runs input consists of two sorted halves.
+	runs := append([]int(nil), values...)
+	sort.Ints(runs[:numRows/2])
+	sort.Ints(runs[numRows/2:])
+	expected := append([]int(nil), values...)
+	sort.Ints(expected)
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	})
+
+	testCases := []struct {
+		name     string
+		spec     SorterSpec
+		input    sqlbase.EncDatumRows
+		memLimit int64
+		strategy sorterStrategyName
+	}{
+		{name: "SortAll", input: unordered, strategy: sortAllStrategyName},
+		{name: "SortAllDisk", input: unordered, memLimit: 1, strategy: sortAllStrategyName},
+		{
+			name:     "SortChunks",
+			spec:     SorterSpec{OrderingMatchLen: 1},
+			input:    makeRows(expected),
+			strategy: sortChunksStrategyName,
+		},
+		{
+			// The hint only matters with a limit.
+			name:     "SortChunksPreferTopK",
+			spec:     SorterSpec{OrderingMatchLen: 1, PreferTopK: true},
+			input:    makeRows(expected),
+			strategy: sortChunksStrategyName,
+		},
+		{
+			name:     "SortRuns",
+			spec:     SorterSpec{InputRunBoundaries: []uint64{numRows / 2}},
+			input:    makeRows(runs),
+			strategy: sortRunsStrategyName,
+		},
+		{
+			name:     "SortRunsDisk",
+			spec:     SorterSpec{InputRunBoundaries: []uint64{numRows / 2}},
+			input:    makeRows(runs),
+			memLimit: 1,
+			strategy: sortRunsStrategyName,
+		},
+	}
+	for _, tc := range testCases {
+		for _, offset := range []uint64{1, 7, numRows - 1, numRows, 3 * numRows} {
+			t.Run(fmt.Sprintf("%s/Offset=%d", tc.name, offset), func(t *testing.T) {
+				spec := tc.spec
+				spec.OutputOrdering = ordering
+				in := NewRowBuffer(types, tc.input, RowBufferArgs{})
+				post := PostProcessSpec{Offset: offset}
+				retRows, meta, s := runSorter(
+					t, &FlowCtx{tempStorage: tempEngine}, &spec, &post, in, func(s *sorter) {
+						s.testingKnobMemLimit = tc.memLimit
+					},
+				)
+				if len(meta) != 0 {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if s.count != 0 {
+					t.Fatalf("expected a count of 0 without a limit, got %d", s.count)
+				}
+				if strategy := s.stats.strategy; strategy != tc.strategy {
+					t.Fatalf("expected the %s strategy, got %s", tc.strategy, strategy)
+				}
+
+				var exp []int
+				if offset < numRows {
+					exp = expected[offset:]
+				}
+				if ret := intColumn(retRows, 1); fmt.Sprint(exp) != fmt.Sprint(ret) {
+					t.Fatalf("expected %v, got %v", exp, ret)
+				}
+			})
+		}
+	}
+}
+
+// TestSorterLimitExpr verifies that a sorter with a limit expression evaluates
+// it when it runs, and sorts and outputs the rows as if it was the limit of its
+// post-processing stage.
+func TestSorterLimitExpr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 20
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-1-i))),
+		}
+	}
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+	})
+
+	testCases := []struct {
+		expr   string
+		offset uint64
+		// expected is the output, or expErr the error returned by the sorter
+		// when it runs.
+		expected []int
+		expErr   string
+		strategy sorterStrategyName
+	}{
+		{expr: "3", expected: []int{0, 1, 2}, strategy: sortTopKStrategyName},
+		{expr: "1 + 2", offset: 2, expected: []int{2, 3, 4}, strategy: sortTopKStrategyName},
+		{expr: "1 - 2", expErr: "it must be non-negative"},
+		{expr: "NULL::INT", expErr: "it must be non-negative"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			spec := SorterSpec{OutputOrdering: ordering, LimitExpr: Expression{Expr: tc.expr}}
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			retRows, meta, s := runSorter(t, &FlowCtx{}, &spec, &PostProcessSpec{Offset: tc.offset}, in)
+			retErr := metaErr(meta)
+			if tc.expErr != "" {
+				if !testutils.IsError(retErr, tc.expErr) {
+					t.Fatalf("expected error %q, got %v", tc.expErr, retErr)
+				}
+				return
+			}
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if strategy := s.stats.strategy; strategy != tc.strategy {
+				t.Fatalf("expected the %s strategy, got %s", tc.strategy, strategy)
+			}
+			if ret := intColumn(retRows, 0); fmt.Sprint(tc.expected) != fmt.Sprint(ret) {
+				t.Fatalf("expected %v, got %v", tc.expected, ret)
+			}
+		})
+	}
+
+	// A zero limit lets no rows through: the input is drained without being
+	// read or sorted.
+	t.Run("Zero", func(t *testing.T) {
+		spec := SorterSpec{OutputOrdering: ordering, LimitExpr: Expression{Expr: "1 - 1"}}
+		var read int
+		in := NewRowBuffer(types, rows, RowBufferArgs{
+			OnNext: func(rb *RowBuffer) (sqlbase.EncDatumRow, ProducerMetadata) {
+				if rb.ConsumerStatus == NeedMoreRows {
+					read++
+				}
+				return nil, ProducerMetadata{}
+			},
+		})
+		retRows, meta, s := runSorter(t, &FlowCtx{}, &spec, &PostProcessSpec{}, in)
+		if len(retRows) != 0 || len(meta) != 0 {
+			t.Fatalf("expected no output, got %s %v", retRows, meta)
+		}
+		if read != 0 || s.stats.inputRows != 0 {
+			t.Fatalf("expected the input not to be read, %d rows were read", read)
+		}
+		if in.ConsumerStatus != DrainRequested {
+			t.Fatalf("expected the input to be drained, got status %d", in.ConsumerStatus)
+		}
+		if s.stats.strategy != "" {
+			t.Fatalf("expected no strategy to be used, got %s", s.stats.strategy)
+		}
+	})
+
+	// Some expressions are rejected when the sorter is created.
+	invalidCases := []struct {
+		expr   string
+		limit  uint64
+		expErr string
+	}{
+		// The expression can't refer to the input columns, and must be an INT.
+		{expr: "2 * @1", expErr: "invalid column ordinal"},
+		{expr: "'3'", expErr: "must be of type int"},
+		{expr: "3", limit: 3, expErr: "both a limit and a limit expression"},
+	}
+	for _, tc := range invalidCases {
+		t.Run(fmt.Sprintf("Invalid/%s/Limit=%d", tc.expr, tc.limit), func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+
+			spec := SorterSpec{OutputOrdering: ordering, LimitExpr: Expression{Expr: tc.expr}}
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			_, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{Limit: tc.limit}, &RowBuffer{})
+			if !testutils.IsError(err, tc.expErr) {
+				t.Fatalf("expected error %q, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestSorterReset(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	makeRows := func(vals ...int) sqlbase.EncDatumRows {
+		rows := make(sqlbase.EncDatumRows, len(vals))
+		for i, v := range vals {
+			rows[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(v))),
+			}
+		}
+		return rows
+	}
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{evalCtx: evalCtx}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+	// The offset makes sure that the rows emitted by the previous run are not
+	// taken into account.
+	post := PostProcessSpec{Limit: 2, Offset: 1}
+
+	in := NewRowBuffer(types, makeRows(5, 3, 4, 1), RowBufferArgs{})
+	out := &RowBuffer{}
+	s, err := newSorter(&flowCtx, &spec, in, &post, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		input    sqlbase.EncDatumRows
+		expected string
+	}{
+		{input: makeRows(5, 3, 4, 1), expected: "[[3] [4]]"},
+		{input: makeRows(9, 7, 8), expected: "[[8] [9]]"},
+		{input: makeRows(2), expected: "[]"},
+	} {
+		if i > 0 {
+			in = NewRowBuffer(types, tc.input, RowBufferArgs{})
+			out = &RowBuffer{}
+			if err := s.Reset(in, out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Run(ctx, nil)
+		if !out.ProducerClosed {
+			t.Fatalf("%d: output RowReceiver not closed", i)
+		}
+		if n := s.stats.inputRows; n != int64(len(tc.input)) {
+			t.Fatalf("%d: expected %d input rows, got %d", i, len(tc.input), n)
+		}
+		var retRows sqlbase.EncDatumRows
+		for {
+			row, meta := out.Next()
+			if !meta.Empty() {
+				t.Fatalf("%d: unexpected metadata: %v", i, meta)
+			}
+			if row == nil {
+				break
+			}
+			retRows = append(retRows, row)
+		}
+		if retRows.String() != tc.expected {
+			t.Fatalf("%d: expected %s, got %s", i, tc.expected, retRows.String())
+		}
+	}
+
+	// The input of a sorter can't be replaced by one with a different schema.
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	if err := s.Reset(
+		NewRowBuffer([]sqlbase.ColumnType{columnTypeString}, nil /* rows */, RowBufferArgs{}), &RowBuffer{},
+	); !testutils.IsError(err, "sorter input column 0 has type") {
+		t.Fatalf("expected a column type error, got %v", err)
+	}
+}
+
+// orderedRowBuffer is a RowBuffer that claims to return its rows in the given
+// ordering.
+type orderedRowBuffer struct {
+	*RowBuffer
+	ordering sqlbase.ColumnOrdering
+}
+
+var _ orderedRowSource = orderedRowBuffer{}
+
+// outputOrdering is part of the orderedRowSource interface.
+func (r orderedRowBuffer) outputOrdering() sqlbase.ColumnOrdering {
+	return r.ordering
+}
+
+// TestSorterResetOrderedInput verifies that a sorter whose rows were passed
+// through because its input was ordered sorts the rows of an unordered input
+// after being reset.
+func TestSorterResetOrderedInput(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	makeRows := func(vals ...int) sqlbase.EncDatumRows {
+		rows := make(sqlbase.EncDatumRows, len(vals))
+		for i, v := range vals {
+			rows[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(v))),
+			}
+		}
+		return rows
+	}
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{evalCtx: evalCtx}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+	spec := SorterSpec{OutputOrdering: convertToSpecOrdering(ordering)}
+
+	in := orderedRowBuffer{
+		RowBuffer: NewRowBuffer(types, makeRows(1, 2, 3), RowBufferArgs{}),
+		ordering:  ordering,
+	}
+	out := &RowBuffer{}
+	s, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		input    RowSource
+		strategy sorterStrategyName
+	}{
+		{input: in, strategy: passThroughStrategyName},
+		{
+			input:    NewRowBuffer(types, makeRows(3, 1, 2), RowBufferArgs{}),
+			strategy: sortAllStrategyName,
+		},
+	} {
+		if i > 0 {
+			out = &RowBuffer{}
+			if err := s.Reset(tc.input, out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Run(ctx, nil)
+		if !out.ProducerClosed {
+			t.Fatalf("%d: output RowReceiver not closed", i)
+		}
+		if s.stats.strategy != tc.strategy {
+			t.Fatalf("%d: expected the %s strategy, got %s", i, tc.strategy, s.stats.strategy)
+		}
+		var retRows sqlbase.EncDatumRows
+		for {
+			row, meta := out.Next()
+			if !meta.Empty() {
+				t.Fatalf("%d: unexpected metadata: %v", i, meta)
+			}
+			if row == nil {
+				break
+			}
+			retRows = append(retRows, row)
+		}
+		if expected := "[[1] [2] [3]]"; retRows.String() != expected {
+			t.Fatalf("%d: expected %s, got %s", i, expected, retRows.String())
+		}
+	}
+}
+
+func TestSorterCancel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 10 * cancelCheckInterval
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{evalCtx: evalCtx}
+
+	// Cancel the context once a few rows have been accumulated.
+	numRead := 0
+	in := NewRowBuffer(types, rows, RowBufferArgs{
+		OnNext: func(*RowBuffer) (sqlbase.EncDatumRow, ProducerMetadata) {
+			numRead++
+			if numRead == cancelCheckInterval+1 {
+				cancel()
+			}
+			return nil, ProducerMetadata{}
+		},
+	})
+	out := &RowBuffer{}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+	s, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Run(ctx, nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+
+	var errSeen error
+	for {
+		row, meta := out.Next()
+		if row != nil {
+			t.Fatalf("unexpected row %s", row)
+		}
+		if meta.Err != nil {
+			errSeen = meta.Err
+		}
+		if meta.Empty() {
+			break
+		}
+	}
+	if errSeen != context.Canceled {
+		t.Fatalf("expected context canceled error, got %v", errSeen)
+	}
+	// The accumulation must have stopped at the next check.
+	if inputRows := s.stats.inputRows; inputRows >= 2*cancelCheckInterval+1 {
+		t.Fatalf("expected the sorter to stop reading its input, read %d rows", inputRows)
+	}
+	if n := evalCtx.Mon.GetCurrentAllocationForTesting(); n != 0 {
+		t.Fatalf("expected all memory to be released, %d bytes still allocated", n)
+	}
+}
+
+// TestSorterCancelStrategies verifies that no strategy reads more rows from
+// its input once the context is canceled, in memory or on disk, and that no
+// goroutine started by the sorter (e.g. to prefetch its input) is left running
+// once Run returns.
+func TestSorterCancelStrategies(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	tempEngine, err := engine.NewTempEngine(context.Background(), base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	const numRows = 1000
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		// The rows are ordered on the first column, in chunks of 100 rows.
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/100))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	const cancelAt = 10
+	asc := encoding.Ascending
+
+	testCases := []struct {
+		name        string
+		spec        SorterSpec
+		post        PostProcessSpec
+		memLimit    int64
+		prefetch    bool
+		expStrategy sorterStrategyName
+	}{
+		{
+			name: "SortAll",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{{ColIdx: 1, Direction: asc}}),
+			},
+			expStrategy: sortAllStrategyName,
+		},
+		{
+			name: "SortAllDisk",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{{ColIdx: 1, Direction: asc}}),
+			},
+			memLimit:    1,
+			expStrategy: sortAllStrategyName,
+		},
+		{
+			name: "SortTopK",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{{ColIdx: 1, Direction: asc}}),
+			},
+			post:        PostProcessSpec{Limit: 5},
+			expStrategy: sortTopKStrategyName,
+		},
+		{
+			name: "SortTopKDisk",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{{ColIdx: 1, Direction: asc}}),
+			},
+			post:        PostProcessSpec{Limit: 5},
+			memLimit:    1,
+			expStrategy: sortTopKStrategyName,
+		},
+		{
+			// The second column is in descending order in each half of the input.
+			name: "SortRuns",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 1, Direction: encoding.Descending},
+				}),
+				InputRunBoundaries: []uint64{numRows / 2},
+			},
+			expStrategy: sortRunsStrategyName,
+		},
+		{
+			name: "SortChunks",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+					{ColIdx: 1, Direction: asc},
+				}),
+				OrderingMatchLen: 1,
+			},
+			expStrategy: sortChunksStrategyName,
+		},
+		{
+			name: "SortChunksPrefetch",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+					{ColIdx: 1, Direction: asc},
+				}),
+				OrderingMatchLen: 1,
+			},
+			prefetch:    true,
+			expStrategy: sortChunksStrategyName,
+		},
+		{
+			name: "PassThrough",
+			spec: SorterSpec{
+				OutputOrdering:   convertToSpecOrdering(sqlbase.ColumnOrdering{{ColIdx: 0, Direction: asc}}),
+				OrderingMatchLen: 1,
+			},
+			expStrategy: passThroughStrategyName,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Checked once Run has returned, before anything else is stopped.
+			checkLeaks := leaktest.AfterTest(t)
+			defer settings.TestingSetBool(&sorterPrefetch, tc.prefetch)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{evalCtx: evalCtx, tempStorage: tempEngine}
+
+			numRead := 0
+			in := NewRowBuffer(types, rows, RowBufferArgs{
+				OnNext: func(*RowBuffer) (sqlbase.EncDatumRow, ProducerMetadata) {
+					numRead++
+					if numRead == cancelAt {
+						cancel()
+					}
+					return nil, ProducerMetadata{}
+				},
+			})
+			out := &RowBuffer{}
+			s, err := newSorter(&flowCtx, &tc.spec, in, &tc.post, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.testingKnobMemLimit = tc.memLimit
+			s.Run(ctx, nil)
+			checkLeaks()
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if spilled := s.stats.spilledToDisk; spilled != (tc.memLimit > 0) {
+				t.Fatalf("expected spilled to disk %t, got %t", tc.memLimit > 0, spilled)
+			}
+			if strategy := s.stats.strategy; strategy != tc.expStrategy {
+				t.Fatalf("expected the %s strategy, got %s", tc.expStrategy, strategy)
+			}
+
+			var errSeen error
+			for {
+				row, meta := out.Next()
+				if meta.Err != nil {
+					errSeen = meta.Err
+				}
+				if row == nil && meta.Empty() {
+					break
+				}
+			}
+			if errSeen != context.Canceled {
+				t.Fatalf("expected context canceled error, got %v", errSeen)
+			}
+			// The prefetcher reads the input ahead of the sorter, which can get
+			// fewer rows before it sees the cancellation.
+			if inputRows := s.stats.inputRows; inputRows > cancelAt ||
+				(!tc.prefetch && inputRows != cancelAt) {
+				t.Fatalf("expected the sorter to stop reading its input after %d rows, read %d rows",
+					cancelAt, inputRows)
+			}
+		})
+	}
+}
+
+// TestSorterConsumerClosed verifies that a sorter closes its input without
+// draining it once its consumer is closed, and still drains it when its
+// consumer only asks for draining. With prefetching, the goroutine reading the
+// input must not be leaked.
+func TestSorterConsumerClosed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	const numRows = 100
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/10))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(-i))),
+		}
+	}
+	// The input is ordered on the first column, so the chunks strategy outputs
+	// rows before it has read all of them.
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+			{ColIdx: 1, Direction: encoding.Ascending},
+		}),
+		OrderingMatchLen: 1,
+	}
+
+	for _, tc := range []struct {
+		status   ConsumerStatus
+		prefetch bool
+	}{
+		{status: DrainRequested},
+		{status: ConsumerClosed},
+		{status: DrainRequested, prefetch: true},
+		{status: ConsumerClosed, prefetch: true},
+	} {
+		status := tc.status
+		t.Run(fmt.Sprintf("status=%d/prefetch=%t", status, tc.prefetch), func(t *testing.T) {
+			defer settings.TestingSetBool(&sorterPrefetch, tc.prefetch)()
+			reads := 0
+			in := NewRowBuffer(types, rows, RowBufferArgs{
+				OnNext: func(*RowBuffer) (sqlbase.EncDatumRow, ProducerMetadata) {
+					reads++
+					return nil, ProducerMetadata{}
+				},
+			})
+			out := &RowBuffer{ConsumerStatus: status}
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+
+			s, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Run(ctx, nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if in.ConsumerStatus != status {
+				t.Fatalf("expected input status %d, got %d", status, in.ConsumerStatus)
+			}
+			if status == ConsumerClosed {
+				// Only the first chunk and the first row of the second one are
+				// needed; the prefetcher may read ahead, but not all the rows.
+				if !tc.prefetch && reads != 11 {
+					t.Fatalf("expected 11 rows to be read, got %d", reads)
+				}
+				if in.Done {
+					t.Fatalf("expected the input not to be drained, %d rows were read", reads)
+				}
+			} else if !in.Done {
+				t.Fatalf("expected the input to be drained, %d rows were read", reads)
+			}
+		})
+	}
+}
+
+func TestSorterLimits(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&distSQLUseTempStorage, true)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	rows := make(sqlbase.EncDatumRows, 10)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(len(rows)-i))),
+		}
+	}
+
+	const memErr = "sorter memory limit exceeded: 0 rows buffered, limit is 1 bytes"
+	const rowsErr = "sorter row limit exceeded: 6 rows buffered, limit is 5 rows"
+	for _, tc := range []struct {
+		name    string
+		spec    SorterSpec
+		limit   uint64
+		expRows int
+		expErr  string
+	}{
+		{
+			name:    "SpillDisallowedNoLimitHit",
+			spec:    SorterSpec{DiskSpillDisallowed: true},
+			expRows: 10,
+		},
+		{
+			name:   "SpillDisallowed",
+			spec:   SorterSpec{DiskSpillDisallowed: true, MemLimit: 1},
+			expErr: memErr,
+		},
+		{
+			name:   "SpillDisallowedTopK",
+			spec:   SorterSpec{DiskSpillDisallowed: true, MemLimit: 1},
+			limit:  3,
+			expErr: memErr,
+		},
+		{
+			name:    "MaxRowsNotReached",
+			spec:    SorterSpec{MaxRows: 10},
+			expRows: 10,
+		},
+		{
+			name:   "MaxRows",
+			spec:   SorterSpec{MaxRows: 5},
+			expErr: rowsErr,
+		},
+		{
+			name:   "MaxRowsOnDisk",
+			spec:   SorterSpec{MaxRows: 5, MemLimit: 1},
+			expErr: rowsErr,
+		},
+		{
+			// The top K rows fit within the row limit.
+			name:    "MaxRowsTopK",
+			spec:    SorterSpec{MaxRows: 5},
+			limit:   3,
+			expRows: 3,
+		},
+		{
+			name:   "MaxRowsTopKExceeded",
+			spec:   SorterSpec{MaxRows: 5},
+			limit:  8,
+			expErr: rowsErr,
+		},
+		{
+			name:   "MaxRowsTopKOnDisk",
+			spec:   SorterSpec{MaxRows: 5, MemLimit: 1},
+			limit:  8,
+			expErr: rowsErr,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			spec := tc.spec
+			spec.OutputOrdering = convertToSpecOrdering(
+				sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}})
+			retRows, meta, _ := runSorter(
+				t, &FlowCtx{tempStorage: tempEngine}, &spec, &PostProcessSpec{Limit: tc.limit}, in,
+			)
+			errSeen := metaErr(meta)
+			if tc.expErr != "" {
+				if !testutils.IsError(errSeen, tc.expErr) {
+					t.Fatalf("expected error %q, got %v", tc.expErr, errSeen)
+				}
+				if pgErr, ok := pgerror.GetPGCause(errSeen); !ok ||
+					pgErr.Code != pgerror.CodeInsufficientResourcesError {
+					t.Fatalf("expected an insufficient resources error, got %v", errSeen)
+				}
+				return
+			}
+			if errSeen != nil {
+				t.Fatal(errSeen)
+			}
+			if len(retRows) != tc.expRows {
+				t.Fatalf("expected %d rows, got %d", tc.expRows, len(retRows))
+			}
+		})
+	}
+}
+
+// TestSorterRowTooLarge verifies that a sorter whose first row doesn't fit in
+// its memory limit sorts the rows on disk if it can, and otherwise returns an
+// error saying that the row is too large.
+func TestSorterRowTooLarge(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&distSQLUseTempStorage, true)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{columnTypeString}
+	makeRow := func(s string) sqlbase.EncDatumRow {
+		return sqlbase.EncDatumRow{sqlbase.DatumToEncDatum(columnTypeString, parser.NewDString(s))}
+	}
+	huge := strings.Repeat("z", 1<<20)
+	// The rows after the first one are sorted so that they form a run.
+	rows := sqlbase.EncDatumRows{makeRow(huge), makeRow("a"), makeRow("b"), makeRow("c")}
+
+	const tooLargeErr = "row too large for sort memory limit"
+	for _, tc := range []struct {
+		name        string
+		spec        SorterSpec
+		limit       uint64
+		tempStorage bool
+		expErr      string
+	}{
+		{name: "OnDisk", tempStorage: true},
+		{name: "OnDiskTopK", limit: 3, tempStorage: true},
+		{name: "OnDiskRuns", spec: SorterSpec{InputRunBoundaries: []uint64{1}}, tempStorage: true},
+		{name: "SpillDisallowed", spec: SorterSpec{DiskSpillDisallowed: true}, expErr: tooLargeErr},
+		{name: "NoTempStorage", expErr: tooLargeErr},
+		{name: "NoTempStorageTopK", limit: 3, expErr: tooLargeErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			var flowCtx FlowCtx
+			if tc.tempStorage {
+				flowCtx.tempStorage = tempEngine
+			}
+			spec := tc.spec
+			spec.OutputOrdering = convertToSpecOrdering(
+				sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}})
+			retRows, meta, s := runSorter(
+				t, &flowCtx, &spec, &PostProcessSpec{Limit: tc.limit}, in, func(s *sorter) {
+					// The limit is much smaller than the first row.
+					s.testingKnobMemLimit = 1 << 10
+				},
+			)
+			errSeen := metaErr(meta)
+			var sorted []string
+			for _, row := range retRows {
+				if err := row[0].EnsureDecoded(&sqlbase.DatumAlloc{}); err != nil {
+					t.Fatal(err)
+				}
+				str := string(*row[0].Datum.(*parser.DString))
+				if str == huge {
+					str = "huge"
+				}
+				sorted = append(sorted, str)
+			}
+			if tc.expErr != "" {
+				if !testutils.IsError(errSeen, tc.expErr) {
+					t.Fatalf("expected error %q, got %v", tc.expErr, errSeen)
+				}
+				return
+			}
+			if errSeen != nil {
+				t.Fatal(errSeen)
+			}
+			expected := []string{"a", "b", "c", "huge"}
+			if tc.limit != 0 {
+				expected = expected[:tc.limit]
+			}
+			if !reflect.DeepEqual(sorted, expected) {
+				t.Fatalf("expected %v, got %v", expected, sorted)
+			}
+			if !s.stats.spilledToDisk {
+				t.Fatal("expected the rows to be sorted on disk")
+			}
+		})
+	}
+}
+
+// TestSorterSpillAfter verifies that a sorter that buffers all its rows spills
+// to disk once it has exceeded its time budget, if it is allowed to.
+func TestSorterSpillAfter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&distSQLUseTempStorage, true)()
+	// The budget is exceeded as soon as it is first checked.
+	defer settings.TestingSetDuration(&sorterSpillAfter, time.Nanosecond)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 3 * cancelCheckInterval
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+
+	for _, spillDisallowed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SpillDisallowed=%t", spillDisallowed), func(t *testing.T) {
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			spec := SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+				DiskSpillDisallowed: spillDisallowed,
+			}
+			retRows, meta, s := runSorter(
+				t, &FlowCtx{tempStorage: tempEngine}, &spec, &PostProcessSpec{}, in,
+			)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if spilled := s.stats.spilledToDisk; spilled == spillDisallowed {
+				t.Fatalf("expected spilled to disk to be %t", !spillDisallowed)
+			}
+			if len(retRows) != numRows {
+				t.Fatalf("expected %d rows, got %d", numRows, len(retRows))
+			}
+			for i, row := range retRows {
+				if exp := fmt.Sprint(i + 1); row[0].String() != exp {
+					t.Fatalf("expected row %d to be %s, got %s", i, exp, row[0].String())
+				}
+			}
+		})
+	}
+}
+
+// countingEngine is an engine that counts the writes made to it, directly or
+// through write-only batches. If panicAtCommit is positive, the commit of the
+// batch with this number panics instead, after the previous batches were
+// written. If commitErr is set, the commits of the batches fail with it.
+type countingEngine struct {
+	engine.Engine
+	puts          int
+	commits       int
+	panicAtCommit int
+	commitErr     error
+}
+
+func (e *countingEngine) Put(key engine.MVCCKey, value []byte) error {
+	e.puts++
+	return e.Engine.Put(key, value)
+}
+
+func (e *countingEngine) NewWriteOnlyBatch() engine.Batch {
+	return &countingBatch{Batch: e.Engine.NewWriteOnlyBatch(), e: e}
+}
+
+type countingBatch struct {
+	engine.Batch
+	e *countingEngine
+}
+
+func (b *countingBatch) Commit(sync bool) error {
+	b.e.commits++
+	if b.e.commits == b.e.panicAtCommit {
+		panic("injected panic")
+	}
+	if b.e.commitErr != nil {
+		return b.e.commitErr
+	}
+	return b.Batch.Commit(sync)
+}
+
+// TestSorterTempStorageFull verifies that a sorter whose temporary storage
+// runs out of space when the rows it spilled are flushed to be read back
+// returns a disk full error as metadata.
+func TestSorterTempStorageFull(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	// The rows fit in a single batch, which is only written when they are read
+	// back.
+	const numRows = 50
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	for _, limit := range []uint64{0, 10} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			e := &countingEngine{
+				Engine: tempEngine, commitErr: errors.New("IO error: No space left on device"),
+			}
+			retRows, meta, _ := runSorter(
+				t, &FlowCtx{tempStorage: tempEngine}, &spec, &PostProcessSpec{Limit: limit}, in,
+				func(s *sorter) {
+					s.tempStorage = e
+					s.testingKnobMemLimit = 1
+				},
+			)
+			if e.commits != 1 {
+				t.Fatalf("expected only the final flush to be committed, got %d commits", e.commits)
+			}
+			if len(retRows) != 0 {
+				t.Fatalf("unexpected rows %s", retRows)
+			}
+			retErr := metaErr(meta)
+			if pgErr, ok := pgerror.GetPGCause(retErr); !ok || pgErr.Code != pgerror.CodeDiskFullError {
+				t.Fatalf("expected a disk full error, got %v", retErr)
+			}
+		})
+	}
+}
+
+// TestSorterVerifyOutput verifies that sorters that verify their output don't
+// complain about correctly sorted rows, in memory or on disk, and panic when
+// their strategy emits a row out of order.
+func TestSorterVerifyOutput(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer func(prev bool) { sorterVerifyOutput = prev }(sorterVerifyOutput)
+	sorterVerifyOutput = true
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	rng, _ := randutil.NewPseudoRand()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 100
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Intn(numRows)))),
+		}
+	}
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Descending},
+	})
+
+	run := func(t *testing.T, spec SorterSpec, post PostProcessSpec, memLimit int64) {
+		spec.OutputOrdering = ordering
+		in := NewRowBuffer(types, rows, RowBufferArgs{})
+		flowCtx := FlowCtx{tempStorage: tempEngine}
+		_, meta, _ := runSorter(t, &flowCtx, &spec, &post, in, func(s *sorter) {
+			s.testingKnobMemLimit = memLimit
+		})
+		if len(meta) != 0 {
+			t.Fatalf("unexpected metadata: %v", meta)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		post     PostProcessSpec
+		memLimit int64
+	}{
+		{name: "SortAll"},
+		{name: "SortAllDisk", memLimit: 1},
+		{name: "SortTopK", post: PostProcessSpec{Limit: 10}},
+		{name: "SortTopKDisk", post: PostProcessSpec{Limit: 10}, memLimit: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, SorterSpec{}, tc.post, tc.memLimit)
+		})
+	}
+
+	t.Run("OutOfOrder", func(t *testing.T) {
+		// The input claims to be sorted, so its rows are passed through.
+		defer func() {
+			if r := recover(); !testutils.IsError(errors.Errorf("%v", r), "emitted after a row") {
+				t.Fatalf("expected a panic about rows out of order, got %v", r)
+			}
+		}()
+		run(t, SorterSpec{OrderingMatchLen: 1}, PostProcessSpec{}, 0 /* memLimit */)
+	})
+}
+
+// TestSorterSpillAfterRows verifies that the strategies that can fall back to
+// disk do so exactly once testingKnobSpillAfterRows rows are buffered in
+// memory, and that they output the same rows either way.
+func TestSorterSpillAfterRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 20
+	rows := make(sqlbase.EncDatumRows, numRows)
+	expected := make([]int, numRows)
+	for i := range rows {
+		// Both halves of the input are sorted runs.
+		v := (i % (numRows / 2)) * 2
+		if i >= numRows/2 {
+			v++
+		}
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(v))),
+		}
+		expected[i] = i
+	}
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+	})
+	const limit = 5
+
+	testCases := []struct {
+		name string
+		spec SorterSpec
+		post PostProcessSpec
+		// maxRows is the number of rows buffered in memory by the strategy.
+		maxRows  int
+		strategy sorterStrategyName
+	}{
+		{name: "SortAll", maxRows: numRows, strategy: sortAllStrategyName},
+		{
+			name:     "SortTopK",
+			post:     PostProcessSpec{Limit: limit},
+			maxRows:  limit,
+			strategy: sortTopKStrategyName,
+		},
+		{
+			name:     "SortRuns",
+			spec:     SorterSpec{InputRunBoundaries: []uint64{numRows / 2}},
+			maxRows:  numRows,
+			strategy: sortRunsStrategyName,
+		},
+	}
+	for _, tc := range testCases {
+		for _, spillAfter := range []int{1, tc.maxRows - 1, tc.maxRows} {
+			t.Run(fmt.Sprintf("%s/SpillAfter=%d", tc.name, spillAfter), func(t *testing.T) {
+				spec := tc.spec
+				spec.OutputOrdering = ordering
+				in := NewRowBuffer(types, rows, RowBufferArgs{})
+				retRows, meta, s := runSorter(
+					t, &FlowCtx{tempStorage: tempEngine}, &spec, &tc.post, in, func(s *sorter) {
+						s.testingKnobSpillAfterRows = spillAfter
+					},
+				)
+				if len(meta) != 0 {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				stats := s.stats
+				if stats.strategy != tc.strategy {
+					t.Fatalf("expected the %s strategy, got %s", tc.strategy, stats.strategy)
+				}
+				// The rows only spill if one more row than the knob allows needs to
+				// be buffered.
+				if expSpilled := spillAfter < tc.maxRows; stats.spilledToDisk != expSpilled {
+					t.Fatalf("expected spilled to disk %t, got %t", expSpilled, stats.spilledToDisk)
+				}
+
+				exp := expected
+				if tc.post.Limit != 0 {
+					exp = exp[:tc.post.Limit]
+				}
+				if ret := intColumn(retRows, 0); fmt.Sprint(exp) != fmt.Sprint(ret) {
+					t.Fatalf("expected %v, got %v", exp, ret)
+				}
+			})
+		}
+	}
+}
+
+// TestSorterTimestampTZ verifies that TIMESTAMPTZ values are sorted by the
+// instant they represent rather than by their local time, whatever their
+// offset, both in memory (comparing datums or key encodings) and on disk.
+// Values that represent the same instant are equal, and keep their input
+// order in a stable sort.
+func TestSorterTimestampTZ(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeTZ := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_TIMESTAMPTZ}
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeTZ, columnTypeInt}
+	// The offsets of New York on either side of its DST transitions, as fixed
+	// zones so that the test doesn't depend on the time zone database.
+	est := time.FixedZone("EST", -5*60*60)
+	edt := time.FixedZone("EDT", -4*60*60)
+	tokyo := time.FixedZone("JST", 9*60*60)
+	// The values are listed in the reverse order of their instants, ties aside,
+	// and identified by the second column.
+	values := []time.Time{
+		// Around the end of DST: the same local time, an hour apart.
+		time.Date(2017, 11, 5, 1, 30, 0, 0, est),
+		time.Date(2017, 11, 5, 1, 30, 0, 0, edt),
+		// 2017-11-05 05:00 UTC, in three offsets.
+		time.Date(2017, 11, 5, 0, 0, 0, 0, est),
+		time.Date(2017, 11, 5, 14, 0, 0, 0, tokyo),
+		time.Date(2017, 11, 5, 5, 0, 0, 0, time.UTC),
+		// Around the start of DST: a second apart, although their local times
+		// are an hour apart.
+		time.Date(2017, 3, 12, 3, 0, 0, 0, edt),
+		time.Date(2017, 3, 12, 1, 59, 59, 0, est),
+		// An hour before them, although its local time is later that day.
+		time.Date(2017, 3, 12, 15, 0, 0, 0, tokyo),
+	}
+	rows := make(sqlbase.EncDatumRows, len(values))
+	for i, v := range values {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeTZ, parser.MakeDTimestampTZ(v, time.Microsecond)),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+		}
+	}
+	// expected are the ids of the rows in order. The rows of the same instant
+	// (2, 3 and 4) are in input order either way.
+	for _, dir := range []struct {
+		name      string
+		direction encoding.Direction
+		expected  []int
+	}{
+		{name: "Asc", direction: encoding.Ascending, expected: []int{7, 6, 5, 2, 3, 4, 1, 0}},
+		{name: "Desc", direction: encoding.Descending, expected: []int{0, 1, 2, 3, 4, 5, 6, 7}},
+	} {
+		for _, tc := range []struct {
+			name       string
+			keyEncoded bool
+			spill      bool
+		}{
+			{name: "Memory"},
+			{name: "KeyEncoded", keyEncoded: true},
+			{name: "Disk", spill: true},
+		} {
+			t.Run(fmt.Sprintf("%s/%s", dir.name, tc.name), func(t *testing.T) {
+				spec := SorterSpec{
+					OutputOrdering: convertToSpecOrdering(
+						sqlbase.ColumnOrdering{{ColIdx: 0, Direction: dir.direction}}),
+					Stable:             true,
+					KeyEncodedOrdering: tc.keyEncoded,
+				}
+				in := NewRowBuffer(types, rows, RowBufferArgs{})
+				retRows, meta, s := runSorter(
+					t, &FlowCtx{tempStorage: tempEngine}, &spec, &PostProcessSpec{}, in, func(s *sorter) {
+						if tc.spill {
+							s.testingKnobSpillAfterRows = 1
+						}
+					},
+				)
+				if len(meta) != 0 {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if s.stats.spilledToDisk != tc.spill {
+					t.Fatalf("expected spilled to disk %t, got %t", tc.spill, s.stats.spilledToDisk)
+				}
+
+				var ret []int
+				var alloc sqlbase.DatumAlloc
+				for _, row := range retRows {
+					for i := range row {
+						if err := row[i].EnsureDecoded(&alloc); err != nil {
+							t.Fatal(err)
+						}
+					}
+					id := int(*row[1].Datum.(*parser.DInt))
+					// The instant survives the round trip through the encodings.
+					if ts := row[0].Datum.(*parser.DTimestampTZ).Time; !ts.Equal(values[id]) {
+						t.Fatalf("row %d: expected %s, got %s", id, values[id], ts)
+					}
+					ret = append(ret, id)
+				}
+				if exp := dir.expected; fmt.Sprint(exp) != fmt.Sprint(ret) {
+					t.Fatalf("expected %v, got %v", exp, ret)
+				}
+			})
+		}
+	}
+}
+
+// TestSorterTempStorageWrites verifies that a sorter only writes to its temp
+// storage when its memory limit is exceeded.
+func TestSorterTempStorageWrites(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 100
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	testCases := []struct {
+		name     string
+		limit    uint64
+		memLimit int64
+		spill    bool
+	}{
+		{name: "SortAll", memLimit: 1 << 20},
+		{name: "SortAllSpill", memLimit: 1, spill: true},
+		{name: "SortTopK", limit: 10, memLimit: 1 << 20},
+		{name: "SortTopKSpill", limit: 10, memLimit: 1, spill: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			e := &countingEngine{Engine: tempEngine}
+			retRows, meta, s := runSorter(
+				t, &FlowCtx{tempStorage: tempEngine}, &spec, &PostProcessSpec{Limit: tc.limit}, in,
+				func(s *sorter) {
+					s.tempStorage = e
+					s.testingKnobMemLimit = tc.memLimit
+				},
+			)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if spilled := s.stats.spilledToDisk; spilled != tc.spill {
+				t.Fatalf("expected spilled to disk to be %t", tc.spill)
+			}
+			if wrote := e.puts+e.commits > 0; wrote != tc.spill {
+				t.Fatalf("expected writes to temp storage: %t, got %d puts and %d batch commits",
+					tc.spill, e.puts, e.commits)
+			}
+
+			expRows := numRows
+			if tc.limit != 0 {
+				expRows = int(tc.limit)
+			}
+			if len(retRows) != expRows {
+				t.Fatalf("expected %d rows, got %d", expRows, len(retRows))
+			}
+			for i, row := range retRows {
+				if exp := fmt.Sprintf("[%d]", i+1); row.String() != exp {
+					t.Fatalf("expected row %s, got %s", exp, row)
+				}
+			}
+		})
+	}
+}
+
+// TestSorterPanicTempStorageCleanup verifies that the rows that a sorter stored
+// in its temp storage are removed if it panics, whether it panics while
+// spilling its rows or afterwards.
+func TestSorterPanicTempStorageCleanup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+	// Every row spilled is written in a batch of its own.
+	defer settings.TestingSetByteSize(&distSQLTempStorageWriteBatchSize, 1)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 1000
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	testCases := []struct {
+		name  string
+		limit uint64
+		// memLimit is high enough for some rows to be spilled from memory.
+		memLimit int64
+		// If panicAtCommit is set, writing a row to disk panics; otherwise,
+		// reading the input panics once half of it was read.
+		panicAtCommit int
+	}{
+		{name: "SortAllWhileSpilling", memLimit: 1 << 12, panicAtCommit: 3},
+		{name: "SortAllAfterSpilling", memLimit: 1 << 12},
+		{name: "SortTopKAfterSpilling", limit: numRows - 1, memLimit: 1 << 12},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx, tempStorage: tempEngine}
+
+			numRead := 0
+			in := &nextHookRowSource{
+				RowSource: NewRowBuffer(types, rows, RowBufferArgs{}),
+				onNext: func() {
+					if numRead++; tc.panicAtCommit == 0 && numRead > numRows/2 {
+						panic("injected panic")
+					}
+				},
+			}
+			s, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{Limit: tc.limit}, &RowBuffer{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := &countingEngine{Engine: tempEngine, panicAtCommit: tc.panicAtCommit}
+			s.tempStorage = e
+			s.testingKnobMemLimit = tc.memLimit
+			func() {
+				defer func() {
+					if r := recover(); r != "injected panic" {
+						t.Fatalf("expected the injected panic, got %v", r)
+					}
+				}()
+				s.Run(ctx, nil)
+			}()
+
+			if e.commits < 2 {
+				t.Fatalf("expected rows to be written to temp storage, got %d batch commits", e.commits)
+			}
+			i := tempEngine.NewIterator(false /* prefix */)
+			defer i.Close()
+			i.Seek(engine.NilKey)
+			if ok, err := i.Valid(); err != nil {
+				t.Fatal(err)
+			} else if ok {
+				t.Fatalf("expected temp storage to be empty, found key %s", i.Key())
+			}
+		})
+	}
+}
+
+// TestSorterSharedMemory verifies that a sorter that shares its memory budget
+// with other sorters is limited to its share, and falls back to disk when it
+// can't get it.
+func TestSorterSharedMemory(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&distSQLUseTempStorage, true)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 200
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	// The rows don't fit in the share of one of the two sorters.
+	const sharedLimit = 8192
+	for _, exhausted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Exhausted=%t", exhausted), func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			var shared sharedSorterMemory
+			shared.start(ctx, evalCtx.Mon, sharedLimit, 2 /* numSorters */)
+			defer shared.stop(ctx)
+			if exhausted {
+				// Another sorter took up the whole budget.
+				acc := shared.mon.MakeBoundAccount()
+				if err := acc.Grow(ctx, sharedLimit); err != nil {
+					t.Fatal(err)
+				}
+				defer acc.Close(ctx)
+			}
+			flowCtx := FlowCtx{evalCtx: evalCtx, tempStorage: tempEngine, sorterMem: &shared}
+
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			retRows, meta, s := runSorter(t, &flowCtx, &spec, &PostProcessSpec{}, in)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if s.memMonLimit != sharedLimit/2 {
+				t.Fatalf("expected a limit of %d bytes, got %d", sharedLimit/2, s.memMonLimit)
+			}
+			if !s.stats.spilledToDisk {
+				t.Fatal("expected the sorter to spill to disk")
+			}
+			if len(retRows) != numRows {
+				t.Fatalf("expected %d rows, got %d", numRows, len(retRows))
+			}
+			for i, row := range retRows {
+				if exp := fmt.Sprint(i + 1); row[0].String() != exp {
+					t.Fatalf("expected row %d to be %s, got %s", i+1, exp, row[0].String())
+				}
+			}
+		})
+	}
+}
+
+// TestSorterAdaptiveMemLimit verifies that the memory limit of a sorter grows
+// beyond work_mem instead of spilling if the node has spare memory, and that
+// the sorter spills as usual if it hasn't.
+func TestSorterAdaptiveMemLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&distSQLUseTempStorage, true)()
+	const workMem = 8192
+	defer settings.TestingSetString(&sorterWorkMem, fmt.Sprint(workMem))()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	// The rows don't fit in work_mem.
+	const numRows = 1000
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		multiple int64
+		// flowLimit, if set, is the limit of the flow's monitor.
+		flowLimit  int64
+		expSpilled bool
+	}{
+		{name: "Disabled", multiple: 1, expSpilled: true},
+		{name: "Grown", multiple: 64, expSpilled: false},
+		// The flow doesn't have twice as much memory left as the limit would
+		// grow by.
+		{name: "LowMemory", multiple: 64, flowLimit: 2 * workMem, expSpilled: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer settings.TestingSetInt(&sorterAdaptiveMemMultiple, tc.multiple)()
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx, tempStorage: tempEngine}
+			if tc.flowLimit > 0 {
+				flowMon := mon.MakeMonitorInheritWithLimit("test-flow", tc.flowLimit, evalCtx.Mon)
+				flowMon.Start(ctx, evalCtx.Mon, mon.BoundAccount{})
+				defer flowMon.Stop(ctx)
+				flowCtx.evalCtx.Mon = &flowMon
+			}
+
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			retRows, meta, s := runSorter(t, &flowCtx, &spec, &PostProcessSpec{}, in)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if spilled := s.stats.spilledToDisk; spilled != tc.expSpilled {
+				t.Fatalf("expected spilled to disk %t, got %t", tc.expSpilled, spilled)
+			}
+			if tc.expSpilled {
+				if s.memMonLimit != workMem {
+					t.Fatalf("expected a limit of %d bytes, got %d", workMem, s.memMonLimit)
+				}
+			} else if s.memMonLimit <= workMem || s.memMonLimit > tc.multiple*workMem {
+				t.Fatalf("expected a limit between %d and %d bytes, got %d",
+					workMem, tc.multiple*workMem, s.memMonLimit)
+			}
+			if len(retRows) != numRows {
+				t.Fatalf("expected %d rows, got %d", numRows, len(retRows))
+			}
+			for i, row := range retRows {
+				if exp := fmt.Sprint(i + 1); row[0].String() != exp {
+					t.Fatalf("expected row %d to be %s, got %s", i+1, exp, row[0].String())
+				}
+			}
+		})
+	}
+}
+
+func TestSorterPrefetch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&sorterPrefetch, true)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	spec := SorterSpec{
+		OrderingMatchLen: 1,
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{
+				{ColIdx: 0, Direction: encoding.Ascending},
+				{ColIdx: 1, Direction: encoding.Ascending},
+			}),
+	}
+
+	for _, tc := range []struct {
+		name    string
+		limit   uint64
+		err     bool
+		expRows int
+	}{
+		{name: "All", expRows: 100},
+		{name: "Limit", limit: 25, expRows: 25},
+		{name: "Error", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The input is made of 10 chunks of 10 rows, with a metadata record
+			// after each chunk.
+			in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+			for i := 0; i < 100; i++ {
+				in.Push(sqlbase.EncDatumRow{
+					sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/10))),
+					sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(10-i%10))),
+				}, ProducerMetadata{})
+				if i%10 == 9 {
+					in.Push(nil /* row */, ProducerMetadata{Ranges: []roachpb.RangeInfo{{}}})
+				}
+				if tc.err && i == 50 {
+					in.Push(nil /* row */, ProducerMetadata{Err: errors.New("test error")})
+				}
+			}
+			in.ProducerDone()
+			rows, meta, _ := runSorter(t, &FlowCtx{}, &spec, &PostProcessSpec{Limit: tc.limit}, in)
+			errSeen := metaErr(meta)
+			numMeta := 0
+			for _, m := range meta {
+				if m.Err == nil {
+					numMeta++
+				}
+			}
+			if tc.err {
+				if !testutils.IsError(errSeen, "test error") {
+					t.Fatalf("expected test error, got %v", errSeen)
+				}
+			} else if errSeen != nil {
+				t.Fatal(errSeen)
+			}
+			// The metadata is forwarded even if the input isn't fully consumed.
+			if numMeta != 10 {
+				t.Errorf("expected 10 metadata records, got %d", numMeta)
+			}
+			if tc.err {
+				return
+			}
+			if len(rows) != tc.expRows {
+				t.Fatalf("expected %d rows, got %d", tc.expRows, len(rows))
+			}
+			for i, row := range rows {
+				if expected := fmt.Sprintf("[%d %d]", i/10, i%10+1); row.String() != expected {
+					t.Fatalf("expected row %d to be %s, got %s", i, expected, row)
+				}
+			}
+		})
+	}
+}
+
+// TestSorterMinChunkSize verifies that the sortChunksStrategy sorts small
+// chunks together when sql.distsql.sorter.min_chunk_size is set, without
+// changing its output.
+// TestSorterAlgorithm verifies that the rows are sorted with either in-memory
+// sort algorithm, and that the mergesort keeps equal rows in input order even
+// if the spec doesn't ask for a stable sort. Both the columnar sort, for INT
+// ordering columns, and the sort of the rows themselves are tested.
+func TestSorterAlgorithm(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+	const numRows = 200
+
+	for _, keyType := range []sqlbase.ColumnType{columnTypeInt, columnTypeString} {
+		// The rows have many duplicates in the ordering column; the second
+		// column is the index of the row in the input.
+		types := []sqlbase.ColumnType{keyType, columnTypeInt}
+		rows := make(sqlbase.EncDatumRows, numRows)
+		for i := range rows {
+			key := rng.Intn(10)
+			var d parser.Datum = parser.NewDInt(parser.DInt(key))
+			if keyType.SemanticType == sqlbase.ColumnType_STRING {
+				d = parser.NewDString(fmt.Sprint(key))
+			}
+			rows[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(keyType, d),
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+			}
+		}
+		for _, tc := range []struct {
+			name      string
+			algorithm inMemorySortAlgorithm
+		}{
+			{name: "Introsort", algorithm: sortAlgorithmIntrosort},
+			{name: "Mergesort", algorithm: sortAlgorithmMergesort},
+		} {
+			t.Run(fmt.Sprintf("%s/%s", keyType.SemanticType, tc.name), func(t *testing.T) {
+				defer settings.TestingSetEnum(&sorterAlgorithm, int64(tc.algorithm))()
+				evalCtx := parser.MakeTestingEvalContext()
+				defer evalCtx.Stop(ctx)
+
+				in := NewRowBuffer(types, rows, RowBufferArgs{})
+				retRows, meta, _ := runSorter(t, &FlowCtx{evalCtx: evalCtx}, &spec, &PostProcessSpec{}, in)
+				if len(meta) != 0 {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if len(retRows) != numRows {
+					t.Fatalf("expected %d rows, got %d", numRows, len(retRows))
+				}
+
+				var alloc sqlbase.DatumAlloc
+				var prev sqlbase.EncDatumRow
+				for _, row := range retRows {
+					if prev == nil {
+						prev = row
+						continue
+					}
+					cmp, err := prev[0].Compare(&alloc, &evalCtx, &row[0])
+					if err != nil {
+						t.Fatal(err)
+					}
+					if cmp > 0 {
+						t.Fatalf("row %s output after %s", row, prev)
+					}
+					if cmp == 0 && tc.algorithm == sortAlgorithmMergesort &&
+						*prev[1].Datum.(*parser.DInt) > *row[1].Datum.(*parser.DInt) {
+						t.Fatalf("equal rows not kept in input order: %s output after %s", row, prev)
+					}
+					prev = row
+				}
+			})
+		}
+	}
+}
+
+func TestSorterMinChunkSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	// The rows are ordered on the first column, which changes every two rows,
+	// and are to be sorted on the second column too.
+	const numRows = 100
+	const numChunks = numRows / 2
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/2))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+			{ColIdx: 1, Direction: encoding.Ascending},
+		}),
+		OrderingMatchLen: 1,
+	}
+
+	testCases := []struct {
+		minChunkSize int64
+		limit        uint64
+		expChunks    int64
+	}{
+		{minChunkSize: 0, expChunks: numChunks},
+		{minChunkSize: 1 << 30, expChunks: 1},
+		{minChunkSize: 0, limit: 5, expChunks: 3},
+		// The chunks are only sorted together until the limit is reached.
+		{minChunkSize: 1 << 30, limit: 5, expChunks: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("MinChunkSize=%d,Limit=%d", tc.minChunkSize, tc.limit), func(t *testing.T) {
+			defer settings.TestingSetByteSize(&sorterMinChunkSize, tc.minChunkSize)()
+
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			retRows, meta, s := runSorter(t, &FlowCtx{}, &spec, &PostProcessSpec{Limit: tc.limit}, in)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if chunks := s.stats.sortedChunks; chunks != tc.expChunks {
+				t.Fatalf("expected %d sorted chunks, got %d", tc.expChunks, chunks)
+			}
+
+			expRows := numRows
+			if tc.limit != 0 {
+				expRows = int(tc.limit)
+			}
+			if len(retRows) != expRows {
+				t.Fatalf("expected %d rows, got %d", expRows, len(retRows))
+			}
+			for i, row := range retRows {
+				// Within each chunk the second column is sorted, which reverses
+				// the order of its two rows.
+				exp := fmt.Sprintf("[%d %d]", i/2, numRows-i/2*2-1+i%2)
+				if row.String() != exp {
+					t.Fatalf("expected row %d to be %s, got %s", i, exp, row)
+				}
+			}
+		})
+	}
+}
+
+// TestSorterInputRuns verifies that a sorter whose input consists of sorted
+// runs merges them, stably, both in memory and after falling back to disk.
+func TestSorterInputRuns(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	rng, _ := randutil.NewPseudoRand()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	const numRuns = 8
+	var rows sqlbase.EncDatumRows
+	var boundaries []uint64
+	for r := 0; r < numRuns; r++ {
+		if len(rows) > 0 {
+			boundaries = append(boundaries, uint64(len(rows)))
+		}
+		// The runs overlap, and the values have duplicates across and within
+		// runs. The second column is the index of the row, which tells equal
+		// rows apart.
+		values := make([]int, rng.Intn(20)+1)
+		for i := range values {
+			values[i] = rng.Intn(30)
+		}
+		sort.Ints(values)
+		for _, v := range values {
+			rows = append(rows, sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(v))),
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(len(rows)))),
+			})
+		}
+	}
+	expected := append(sqlbase.EncDatumRows(nil), rows...)
+	sort.SliceStable(expected, func(i, j int) bool {
+		return *expected[i][0].Datum.(*parser.DInt) < *expected[j][0].Datum.(*parser.DInt)
+	})
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+	})
+
+	testCases := []struct {
+		name     string
+		post     PostProcessSpec
+		memLimit int64
+		expected sqlbase.EncDatumRows
+	}{
+		{name: "InMemory", expected: expected},
+		{name: "Limit", post: PostProcessSpec{Limit: 10, Offset: 3}, expected: expected[3:13]},
+		{name: "Spill", memLimit: 1, expected: expected},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := SorterSpec{OutputOrdering: ordering, InputRunBoundaries: boundaries}
+			if effort := spec.SortEffort(&tc.post); effort != SortEffortMerge {
+				t.Fatalf("expected a sort effort of %d, got %d", SortEffortMerge, effort)
+			}
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			retRows, meta, s := runSorter(
+				t, &FlowCtx{tempStorage: tempEngine}, &spec, &tc.post, in, func(s *sorter) {
+					s.testingKnobMemLimit = tc.memLimit
+				},
+			)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if expStr, retStr := tc.expected.String(), retRows.String(); expStr != retStr {
+				t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+			}
+			stats := s.stats
+			if stats.strategy != sortRunsStrategyName {
+				t.Errorf("expected the %s strategy, got %s", sortRunsStrategyName, stats.strategy)
+			}
+			if spilled := tc.memLimit > 0; stats.spilledToDisk != spilled {
+				t.Errorf("expected spilledToDisk to be %t", spilled)
+			}
+		})
+	}
+}
+
+// TestSorterInvalidInputRuns verifies that a sorter can't be created with run
+// boundaries that aren't increasing, and that it returns an error if one of
+// the runs of its input isn't sorted.
+func TestSorterInvalidInputRuns(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{evalCtx: evalCtx}
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+	})
+	for _, boundaries := range [][]uint64{{3, 3}, {5, 2}} {
+		in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+		spec := SorterSpec{OutputOrdering: ordering, InputRunBoundaries: boundaries}
+		if _, err := newSorter(
+			&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{},
+		); !testutils.IsError(err, "the boundaries must be increasing") {
+			t.Errorf("%v: expected invalid run boundaries error, got %v", boundaries, err)
+		}
+	}
+
+	v := [5]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i)))
+	}
+	// The second run, which starts at the fourth row, isn't sorted.
+	rows := sqlbase.EncDatumRows{{v[1]}, {v[2]}, {v[4]}, {v[0]}, {v[3]}, {v[2]}, {v[4]}}
+	in := NewRowBuffer(types, rows, RowBufferArgs{})
+	spec := SorterSpec{OutputOrdering: ordering, InputRunBoundaries: []uint64{3}}
+	retRows, meta, _ := runSorter(t, &flowCtx, &spec, &PostProcessSpec{}, in)
+	if len(retRows) != 0 {
+		t.Errorf("unexpected rows: %s", retRows)
+	}
+	sortErr := metaErr(meta)
+	if !testutils.IsError(sortErr, `input run 1 is not sorted: row \[2\] is after \[3\]`) {
+		t.Fatalf("expected unsorted run error, got %v", sortErr)
+	}
+}
+
+// TestSorterTopKNarrowRows verifies that the sortTopKStrategy uses less memory
+// when it keeps wide rows narrow, and that it produces the same rows.
+func TestSorterTopKNarrowRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The rows have an INT column to sort on, followed by a number of wide
+	// STRING columns.
+	const numRows = 1000
+	const numCols = 10
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := make([]sqlbase.ColumnType, numCols)
+	types[0] = columnTypeInt
+	for i := 1; i < numCols; i++ {
+		types[i] = columnTypeString
+	}
+	rng, _ := randutil.NewPseudoRand()
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = make(sqlbase.EncDatumRow, numCols)
+		rows[i][0] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Int63())))
+		for j := 1; j < numCols; j++ {
+			rows[i][j] = sqlbase.DatumToEncDatum(
+				columnTypeString, parser.NewDString(fmt.Sprintf("%0100d", rng.Int63())),
+			)
+		}
+	}
+	// SELECT * ... ORDER BY 1 LIMIT 10.
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+		}),
+	}
+	post := PostProcessSpec{Limit: 10}
+
+	run := func(narrowMinCols int) (sqlbase.EncDatumRows, int64) {
+		defer func(n int) { narrowTopKMinCols = n }(narrowTopKMinCols)
+		narrowTopKMinCols = narrowMinCols
+
+		in := NewRowBuffer(types, rows, RowBufferArgs{})
+		retRows, meta, s := runSorter(t, &FlowCtx{}, &spec, &post, in)
+		if len(meta) != 0 {
+			t.Fatalf("unexpected metadata: %v", meta)
+		}
+		return retRows, s.stats.maxAllocatedMem
+	}
+
+	wideRows, wideMem := run(math.MaxInt32)
+	narrowRows, narrowMem := run(1)
+	if len(narrowRows) != int(post.Limit) {
+		t.Fatalf("expected %d rows, got %d", post.Limit, len(narrowRows))
+	}
+	if wideStr, narrowStr := wideRows.String(), narrowRows.String(); wideStr != narrowStr {
+		t.Fatalf("narrow rows differ; expected:\n   %s\ngot:\n   %s", wideStr, narrowStr)
+	}
+	if narrowMem >= wideMem {
+		t.Fatalf("expected narrow rows to use less than %d bytes, used %d", wideMem, narrowMem)
+	}
+}
+
+// pushCountingReceiver is a RowReceiver that counts the rows pushed to it.
+type pushCountingReceiver struct {
+	RowReceiver
+	rows int
+}
+
+func (r *pushCountingReceiver) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
+	if row != nil {
+		r.rows++
+	}
+	return r.RowReceiver.Push(row, meta)
+}
+
+// nextHookRowSource is a RowSource that calls onNext before each call to Next.
+type nextHookRowSource struct {
+	RowSource
+	onNext func()
+}
+
+func (s *nextHookRowSource) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	s.onNext()
+	return s.RowSource.Next()
+}
+
+// TestSorterChunkOutputLatency verifies that the sortChunksStrategy pushes the
+// rows of each chunk to the output as soon as the chunk is complete, before it
+// reads any further input.
+func TestSorterChunkOutputLatency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	const numRows = 20
+	const chunkSize = 4
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/chunkSize))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+			{ColIdx: 1, Direction: encoding.Ascending},
+		}),
+		OrderingMatchLen: 1,
+	}
+
+	testCases := []struct {
+		name string
+		post PostProcessSpec
+	}{
+		{name: "Direct"},
+		{name: "Projection", post: PostProcessSpec{Projection: true, OutputColumns: []uint32{1, 0}}},
+		{name: "Limit", post: PostProcessSpec{Limit: 10}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &pushCountingReceiver{RowReceiver: &RowBuffer{}}
+			// read is the number of times the input was read.
+			read := 0
+			in := &nextHookRowSource{
+				RowSource: NewRowBuffer(types, rows, RowBufferArgs{}),
+				onNext: func() {
+					// By the time the input is read past the first row of a
+					// chunk, all the previous chunks must have been pushed.
+					expPushed := 0
+					if read > 0 {
+						expPushed = (read - 1) / chunkSize * chunkSize
+					}
+					if tc.post.Limit != 0 && expPushed > int(tc.post.Limit) {
+						expPushed = int(tc.post.Limit)
+					}
+					if out.rows != expPushed {
+						t.Errorf("expected %d rows to be pushed before reading row %d, got %d",
+							expPushed, read, out.rows)
+					}
+					read++
+				},
+			}
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+
+			s, err := newSorter(&flowCtx, &spec, in, &tc.post, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Run(ctx, nil)
+
+			expRows := numRows
+			if tc.post.Limit != 0 {
+				expRows = int(tc.post.Limit)
+			}
+			if out.rows != expRows {
+				t.Fatalf("expected %d rows, got %d", expRows, out.rows)
+			}
+		})
+	}
+}
+
+// TestSorterComparisons verifies that the comparisons of rows made by the
+// sorter are counted when testingKnobCountComparisons is set.
+func TestSorterComparisons(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	const numRows = 1000
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	rng, _ := randutil.NewPseudoRand()
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Int63()))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+		}),
+	}
+
+	run := func(limit uint64, memLimit int64, count bool) sorterStats {
+		in := NewRowBuffer(types, rows, RowBufferArgs{})
+		_, meta, s := runSorter(
+			t, &FlowCtx{tempStorage: tempEngine}, &spec, &PostProcessSpec{Limit: limit}, in,
+			func(s *sorter) {
+				s.testingKnobMemLimit = memLimit
+				s.testingKnobCountComparisons = count
+			},
+		)
+		if len(meta) != 0 {
+			t.Fatalf("unexpected metadata: %v", meta)
+		}
+		return s.stats
+	}
+
+	if stats := run(0 /* limit */, 0 /* memLimit */, false /* count */); stats.memComparisons != 0 {
+		t.Fatalf("expected no comparisons to be counted, got %d", stats.memComparisons)
+	}
+
+	all := run(0 /* limit */, 0 /* memLimit */, true /* count */)
+	if all.memComparisons < numRows-1 || all.diskComparisons != 0 {
+		t.Fatalf("expected at least %d comparisons in memory and none on disk, got %d and %d",
+			numRows-1, all.memComparisons, all.diskComparisons)
+	}
+
+	// Keeping the smallest rows takes fewer comparisons than sorting them all.
+	topK := run(10 /* limit */, 0 /* memLimit */, true /* count */)
+	if topK.memComparisons >= all.memComparisons || topK.diskComparisons != 0 {
+		t.Fatalf("expected fewer than %d comparisons in memory and none on disk, got %d and %d",
+			all.memComparisons, topK.memComparisons, topK.diskComparisons)
+	}
+
+	topKOnDisk := run(10 /* limit */, 1 /* memLimit */, true /* count */)
+	if !topKOnDisk.spilledToDisk {
+		t.Fatal("expected the sorter to spill to disk")
+	}
+	// Every row but the first k is compared to the k-th smallest row on disk.
+	if topKOnDisk.diskComparisons < numRows-20 {
+		t.Fatalf("expected at least %d comparisons on disk, got %d",
+			numRows-20, topKOnDisk.diskComparisons)
+	}
+}
+
+// TestSorterOutputSatisfied verifies that a sorter that sorts all its rows
+// with a limit that wasn't pushed into its count stops once the limit is
+// reached, having only taken the rows it needed out of a heap (see
+// emitSmallestRows), and that the rows it outputs up to the limit are sorted.
+// A stable sorter still sorts all the rows, to keep equal rows in order.
+func TestSorterOutputSatisfied(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	const numRows = 1000
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	rng, _ := randutil.NewPseudoRand()
+	// The first column has many duplicates; the second one is the index of the
+	// row in the input.
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Intn(100)))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+		}
+	}
+	value := func(row sqlbase.EncDatumRow, col int) int {
+		return int(*row[col].Datum.(*parser.DInt))
+	}
+	sorted := append(sqlbase.EncDatumRows(nil), rows...)
+	sort.SliceStable(sorted, func(i, j int) bool { return value(sorted[i], 0) < value(sorted[j], 0) })
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+
+	// The sortTopKStrategy is disabled by disableTopK, so that a limit is
+	// applied by the sortAllStrategy.
+	run := func(
+		spec SorterSpec, post PostProcessSpec, disableTopK bool,
+	) (*sorter, sqlbase.EncDatumRows) {
+		in := NewRowBuffer(types, rows, RowBufferArgs{})
+		flowCtx := FlowCtx{testingKnobs: TestingKnobs{DisableSorterTopK: disableTopK}}
+		spec.OutputOrdering = convertToSpecOrdering(ordering)
+		ret, meta, s := runSorter(t, &flowCtx, &spec, &post, in, func(s *sorter) {
+			s.testingKnobCountComparisons = true
+		})
+		if len(meta) != 0 {
+			t.Fatalf("unexpected metadata: %v", meta)
+		}
+		if strategy := s.stats.strategy; strategy != sortAllStrategyName {
+			t.Fatalf("expected the %s strategy, got %s", sortAllStrategyName, strategy)
+		}
+		return s, ret
+	}
+
+	all, _ := run(SorterSpec{}, PostProcessSpec{}, false /* disableTopK */)
+
+	t.Run("Limit", func(t *testing.T) {
+		const limit, offset = 10, 5
+		s, ret := run(
+			SorterSpec{}, PostProcessSpec{Limit: limit, Offset: offset}, true, /* disableTopK */
+		)
+		// The order of equal rows is unspecified.
+		exp := intColumn(sorted[offset:offset+limit], 0)
+		if actual := intColumn(ret, 0); !reflect.DeepEqual(actual, exp) {
+			t.Fatalf("expected %v, got %v", exp, actual)
+		}
+		// No rows are pushed once the limit is reached.
+		if s.stats.outputRows != offset+limit {
+			t.Fatalf("expected %d rows to be pushed, got %d", offset+limit, s.stats.outputRows)
+		}
+		// The DisableSorterTopK knob promises a full sort: the rows are not
+		// taken from a heap, but sorted by sortColumnar, as without a limit.
+		evalCtx := parser.MakeTestingEvalContext()
+		defer evalCtx.Stop(ctx)
+		sv := makeRowContainer(ordering, types, &evalCtx)
+		defer sv.Close(ctx)
+		for _, row := range rows {
+			if err := sv.AddRow(ctx, row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var columnarComparisons int64
+		sv.comparisons = &columnarComparisons
+		if !sv.sortColumnar(ctx) {
+			t.Fatal("expected a columnar sort")
+		}
+		if s.stats.memComparisons != columnarComparisons {
+			t.Fatalf("expected the %d comparisons of a columnar sort, got %d",
+				columnarComparisons, s.stats.memComparisons)
+		}
+	})
+
+	t.Run("Distinct", func(t *testing.T) {
+		const limit = 3
+		s, ret := run(
+			SorterSpec{Distinct: true, DistinctColumns: []uint32{0}}, PostProcessSpec{Limit: limit},
+			false, /* disableTopK */
+		)
+		var exp []int
+		for _, row := range sorted {
+			if v := value(row, 0); len(exp) == 0 || exp[len(exp)-1] != v {
+				exp = append(exp, v)
+			}
+		}
+		exp = exp[:limit]
+		if actual := intColumn(ret, 0); !reflect.DeepEqual(actual, exp) {
+			t.Fatalf("expected %v, got %v", exp, actual)
+		}
+		if s.stats.memComparisons >= all.stats.memComparisons {
+			t.Fatalf("expected fewer than the %d comparisons of a full sort, got %d",
+				all.stats.memComparisons, s.stats.memComparisons)
+		}
+	})
+
+	t.Run("Stable", func(t *testing.T) {
+		const limit = 10
+		_, ret := run(SorterSpec{Stable: true}, PostProcessSpec{Limit: limit}, true /* disableTopK */)
+		// The equal rows are in the order of the input.
+		exp := intColumn(sorted[:limit], 1)
+		if actual := intColumn(ret, 1); !reflect.DeepEqual(actual, exp) {
+			t.Fatalf("expected %v, got %v", exp, actual)
+		}
+	})
+}
+
+// TestSorterOnEmitRow verifies that the testingKnobOnEmitRow of a sorter sees
+// every row that its strategy emits, in order, before the rows are
+// deduplicated or limited.
+func TestSorterOnEmitRow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	const numRows = 100
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	rng, _ := randutil.NewPseudoRand()
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		v := parser.NewDInt(parser.DInt(rng.Intn(numRows / 4)))
+		rows[i] = sqlbase.EncDatumRow{sqlbase.DatumToEncDatum(columnTypeInt, v)}
+	}
+	sortedRows := append(sqlbase.EncDatumRows(nil), rows...)
+	sort.Slice(sortedRows, func(i, j int) bool {
+		return *sortedRows[i][0].Datum.(*parser.DInt) < *sortedRows[j][0].Datum.(*parser.DInt)
+	})
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+	})
+
+	testCases := []struct {
+		name     string
+		spec     SorterSpec
+		input    sqlbase.EncDatumRows
+		post     PostProcessSpec
+		memLimit int64
+		// expEmitted is the number of rows seen by the knob.
+		expEmitted int
+	}{
+		{name: "SortAll", input: rows, expEmitted: numRows},
+		{name: "SortAllDisk", input: rows, memLimit: 1, expEmitted: numRows},
+		{name: "SortTopK", input: rows, post: PostProcessSpec{Limit: 10}, expEmitted: 10},
+		{
+			name:       "SortChunks",
+			spec:       SorterSpec{OrderingMatchLen: 1},
+			input:      sortedRows,
+			expEmitted: numRows,
+		},
+		// The duplicates are emitted by the strategy and then skipped.
+		{name: "Distinct", spec: SorterSpec{Distinct: true}, input: rows, expEmitted: numRows},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := tc.spec
+			spec.OutputOrdering = ordering
+			in := NewRowBuffer(types, tc.input, RowBufferArgs{})
+			var emitted int
+			var prev *parser.DInt
+			var alloc sqlbase.DatumAlloc
+			_, meta, _ := runSorter(
+				t, &FlowCtx{tempStorage: tempEngine}, &spec, &tc.post, in, func(s *sorter) {
+					s.testingKnobMemLimit = tc.memLimit
+					s.testingKnobOnEmitRow = func(row sqlbase.EncDatumRow) {
+						if err := row[0].EnsureDecoded(&alloc); err != nil {
+							t.Fatal(err)
+						}
+						v := row[0].Datum.(*parser.DInt)
+						if prev != nil && *v < *prev {
+							t.Fatalf("row %d (%d) emitted after %d", emitted, *v, *prev)
+						}
+						prev = v
+						emitted++
+					}
+				},
+			)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if emitted != tc.expEmitted {
+				t.Fatalf("expected %d rows to be emitted, got %d", tc.expEmitted, emitted)
+			}
+		})
+	}
+}
+
+// TestSorterPreferTopK verifies that a sorter that prefers the top k strategy
+// over an input that is ordered on a prefix of the ordering stops reading the
+// input once the smallest rows are known.
+// TestSorterOrderedInput verifies that a sorter passes the rows of an input
+// that guarantees their ordering through when it refines the sorter's
+// ordering, and sorts them otherwise.
+func TestSorterOrderedInput(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	// The rows of each source are ordered on both columns, in ascending order.
+	const numRows = 20
+	var sources [2]sqlbase.EncDatumRows
+	var expected sqlbase.EncDatumRows
+	for i := 0; i < numRows; i++ {
+		row := sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/2))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+		}
+		sources[i%2] = append(sources[i%2], row)
+		expected = append(expected, row)
+	}
+	asc := func(colIdx int) sqlbase.ColumnOrderInfo {
+		return sqlbase.ColumnOrderInfo{ColIdx: colIdx, Direction: encoding.Ascending}
+	}
+	syncOrdering := sqlbase.ColumnOrdering{asc(0), asc(1)}
+
+	testCases := []struct {
+		name     string
+		ordering sqlbase.ColumnOrdering
+		// reverse are the ReverseSortColumns of the session.
+		reverse  []uint32
+		strategy sorterStrategyName
+	}{
+		{name: "Same", ordering: syncOrdering, strategy: passThroughStrategyName},
+		{name: "Prefix", ordering: sqlbase.ColumnOrdering{asc(0)}, strategy: passThroughStrategyName},
+		{name: "OtherColumn", ordering: sqlbase.ColumnOrdering{asc(1)}, strategy: sortAllStrategyName},
+		{
+			name: "OtherDirection",
+			ordering: sqlbase.ColumnOrdering{
+				{ColIdx: 0, Direction: encoding.Descending},
+			},
+			strategy: sortAllStrategyName,
+		},
+		{
+			name:     "Reversed",
+			ordering: sqlbase.ColumnOrdering{asc(0)},
+			reverse:  []uint32{1},
+			strategy: sortAllStrategyName,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			evalCtx.ReverseSortColumns = tc.reverse
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+
+			in, err := makeOrderedSync(syncOrdering, &flowCtx.evalCtx, []RowSource{
+				NewRowBuffer(types, sources[0], RowBufferArgs{}),
+				NewRowBuffer(types, sources[1], RowBufferArgs{}),
+			}, nil /* compare */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spec := SorterSpec{OutputOrdering: convertToSpecOrdering(tc.ordering)}
+			retRows, meta, s := runSorter(t, &flowCtx, &spec, &PostProcessSpec{}, in)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if strategy := s.stats.strategy; strategy != tc.strategy {
+				t.Fatalf("expected the %s strategy, got %s", tc.strategy, strategy)
+			}
+			if len(retRows) != numRows {
+				t.Fatalf("expected %d rows, got %d", numRows, len(retRows))
+			}
+			if tc.strategy == passThroughStrategyName {
+				if expStr, retStr := expected.String(), retRows.String(); expStr != retStr {
+					t.Fatalf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+				}
+			}
+			var alloc sqlbase.DatumAlloc
+			for i := 1; i < len(retRows); i++ {
+				cmp, err := retRows[i-1].Compare(&alloc, s.ordering, &flowCtx.evalCtx, retRows[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cmp > 0 {
+					t.Fatalf("rows %s and %s out of order", retRows[i-1], retRows[i])
+				}
+			}
+		})
+	}
+}
+
+// TestSorterArrays verifies that sorters order ARRAY columns like the array
+// comparison does (element by element, with NULL elements first and prefixes
+// first), both in memory and once spilled to disk, where the arrays are
+// followed by the keys of the other ordering columns.
+func TestSorterArrays(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	rng, _ := randutil.NewPseudoRand()
+	intKind := sqlbase.ColumnType_INT
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeIntArray := sqlbase.ColumnType{
+		SemanticType: sqlbase.ColumnType_ARRAY, ArrayContents: &intKind,
+	}
+	types := []sqlbase.ColumnType{columnTypeIntArray, columnTypeInt}
+	const numRows = 200
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		var array parser.Datum = parser.DNull
+		if rng.Intn(10) != 0 {
+			a := parser.NewDArray(parser.TypeInt)
+			for n := rng.Intn(4); n > 0; n-- {
+				var elem parser.Datum = parser.DNull
+				if rng.Intn(4) != 0 {
+					elem = parser.NewDInt(parser.DInt(rng.Intn(3)))
+				}
+				if err := a.Append(elem); err != nil {
+					t.Fatal(err)
+				}
+			}
+			array = a
+		}
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeIntArray, array),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Intn(3)))),
+		}
+	}
+
+	for _, dir := range []struct {
+		name string
+		dir  encoding.Direction
+	}{
+		{name: "Asc", dir: encoding.Ascending},
+		{name: "Desc", dir: encoding.Descending},
+	} {
+		ordering := sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: dir.dir},
+			{ColIdx: 1, Direction: encoding.Ascending},
+		}
+		evalCtx := parser.MakeTestingEvalContext()
+		defer evalCtx.Stop(ctx)
+		// Equal rows are identical, so the output doesn't depend on the order of
+		// equal rows.
+		expected := append(sqlbase.EncDatumRows(nil), rows...)
+		var alloc sqlbase.DatumAlloc
+		sort.Slice(expected, func(i, j int) bool {
+			cmp, err := expected[i].Compare(&alloc, ordering, &evalCtx, expected[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return cmp < 0
+		})
+
+		for _, memLimit := range []int64{0, 1} {
+			t.Run(fmt.Sprintf("%s/MemLimit=%d", dir.name, memLimit), func(t *testing.T) {
+				spec := SorterSpec{OutputOrdering: convertToSpecOrdering(ordering)}
+				in := NewRowBuffer(types, rows, RowBufferArgs{})
+				retRows, meta, s := runSorter(
+					t, &FlowCtx{tempStorage: tempEngine}, &spec, &PostProcessSpec{}, in, func(s *sorter) {
+						s.testingKnobMemLimit = memLimit
+					},
+				)
+				if len(meta) != 0 {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if spilled := s.stats.spilledToDisk; spilled != (memLimit > 0) {
+					t.Fatalf("expected spilled to disk %t, got %t", memLimit > 0, spilled)
+				}
+				if expStr, retStr := expected.String(), retRows.String(); expStr != retStr {
+					t.Fatalf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+				}
+			})
+		}
+	}
+}
+
+// TestSorterComputedKey verifies that a sorter can order rows by a key computed
+// from each row, here a custom precedence of the values of a column, and that
+// the memory of the keys is accounted for and released.
+func TestSorterComputedKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	rng, _ := randutil.NewPseudoRand()
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{columnTypeString}
+	values := []string{"high", "medium", "low"}
+	const numRows = 100
+	rows := make(sqlbase.EncDatumRows, numRows)
+	var expected []string
+	counts := make([]int, len(values))
+	for i := range rows {
+		v := rng.Intn(len(values))
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeString, parser.NewDString(values[v])),
+		}
+		counts[v]++
+	}
+	for v, n := range counts {
+		for i := 0; i < n; i++ {
+			expected = append(expected, values[v])
+		}
+	}
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 1, Direction: encoding.Ascending},
+	})
+	// The key is padded so that its size dominates the memory of the rows.
+	const keySize = 1000
+	keyExpr := fmt.Sprintf(
+		"CASE @1 WHEN 'high' THEN '1' WHEN 'medium' THEN '2' ELSE '3' END || repeat('x', %d)",
+		keySize,
+	)
+
+	for _, memLimit := range []int64{0, 1} {
+		t.Run(fmt.Sprintf("MemLimit=%d", memLimit), func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx, tempStorage: tempEngine}
+
+			spec := SorterSpec{
+				OutputOrdering: ordering,
+				OrderingExprs:  []Expression{{Expr: keyExpr}},
+			}
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			retRows, meta, s := runSorter(t, &flowCtx, &spec, &PostProcessSpec{}, in, func(s *sorter) {
+				s.testingKnobMemLimit = memLimit
+			})
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			stats := s.stats
+			if memLimit == 0 && stats.maxAllocatedMem < numRows*keySize {
+				t.Errorf("expected the keys to be accounted for, only %d bytes allocated",
+					stats.maxAllocatedMem)
+			}
+			if spilled := stats.spilledToDisk; spilled != (memLimit > 0) {
+				t.Errorf("expected spilled to disk %t, got %t", memLimit > 0, spilled)
+			}
+			if n := evalCtx.Mon.GetCurrentAllocationForTesting(); n != 0 {
+				t.Errorf("expected all memory to be released, %d bytes still allocated", n)
+			}
+
+			var ret []string
+			for _, row := range retRows {
+				if len(row) != len(types) {
+					t.Fatalf("expected the key to be removed from the output, got %s", row)
+				}
+				ret = append(ret, string(*row[0].Datum.(*parser.DString)))
+			}
+			if fmt.Sprint(expected) != fmt.Sprint(ret) {
+				t.Fatalf("expected %v, got %v", expected, ret)
+			}
+		})
+	}
+}
+
+func TestSorterPreferTopK(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	// Every row has its own prefix value.
+	const numRows = 100
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+			{ColIdx: 1, Direction: encoding.Ascending},
+		}),
+		OrderingMatchLen: 1,
+		PreferTopK:       true,
+	}
+	const limit = 5
+
+	in := NewRowBuffer(types, rows, RowBufferArgs{})
+	retRows, meta, s := runSorter(t, &FlowCtx{}, &spec, &PostProcessSpec{Limit: limit}, in)
+	if len(meta) != 0 {
+		t.Fatalf("unexpected metadata: %v", meta)
+	}
+	stats := s.stats
+	if stats.strategy != sortTopKStrategyName {
+		t.Fatalf("expected the %s strategy, got %s", sortTopKStrategyName, stats.strategy)
+	}
+	// The row after the k-th one has a greater prefix.
+	if stats.inputRows != limit+1 {
+		t.Fatalf("expected %d input rows to be read, got %d", limit+1, stats.inputRows)
+	}
+	if expStr, retStr := rows[:limit].String(), retRows.String(); expStr != retStr {
+		t.Fatalf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+	}
+}
+
+// TestSorterDeadlineAware verifies that the sorters of a flow with
+// deadline-aware sorters use the sortChunksStrategy instead of the
+// sortTopKStrategy or the sortRunsStrategy when the deadline of their context
+// is near, and that they output the same rows.
+func TestSorterDeadlineAware(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	const numRows = 100
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/10))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i%10))),
+		}
+	}
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	})
+	const limit = 15
+
+	testCases := []struct {
+		name          string
+		spec          SorterSpec
+		post          PostProcessSpec
+		deadlineAware bool
+		// timeout is the time left before the deadline of the context, if set.
+		timeout  time.Duration
+		expected sorterStrategyName
+	}{
+		{
+			name:     "TopKNoDeadline",
+			spec:     SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 1, PreferTopK: true},
+			post:     PostProcessSpec{Limit: limit},
+			expected: sortTopKStrategyName,
+		},
+		{
+			name:          "TopKFarDeadline",
+			spec:          SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 1, PreferTopK: true},
+			post:          PostProcessSpec{Limit: limit},
+			deadlineAware: true,
+			timeout:       time.Hour,
+			expected:      sortTopKStrategyName,
+		},
+		{
+			name:     "TopKNearDeadlineNotAware",
+			spec:     SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 1, PreferTopK: true},
+			post:     PostProcessSpec{Limit: limit},
+			timeout:  time.Second,
+			expected: sortTopKStrategyName,
+		},
+		{
+			name:          "TopKNearDeadline",
+			spec:          SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 1, PreferTopK: true},
+			post:          PostProcessSpec{Limit: limit},
+			deadlineAware: true,
+			timeout:       time.Second,
+			expected:      sortChunksStrategyName,
+		},
+		{
+			// Without an ordering prefix, there are no chunks to stream.
+			name:          "TopKNearDeadlineNoMatchLen",
+			spec:          SorterSpec{OutputOrdering: ordering},
+			post:          PostProcessSpec{Limit: limit},
+			deadlineAware: true,
+			timeout:       time.Second,
+			expected:      sortTopKStrategyName,
+		},
+		{
+			name: "RunsFarDeadline",
+			spec: SorterSpec{
+				OutputOrdering: ordering, OrderingMatchLen: 1, InputRunBoundaries: []uint64{30, 70},
+			},
+			deadlineAware: true,
+			timeout:       time.Hour,
+			expected:      sortRunsStrategyName,
+		},
+		{
+			name: "RunsNearDeadline",
+			spec: SorterSpec{
+				OutputOrdering: ordering, OrderingMatchLen: 1, InputRunBoundaries: []uint64{30, 70},
+			},
+			deadlineAware: true,
+			timeout:       time.Second,
+			expected:      sortChunksStrategyName,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout != 0 {
+				var cancel func()
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			out := &RowBuffer{}
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx, deadlineAwareSorters: tc.deadlineAware}
+
+			post := tc.post
+			s, err := newSorter(&flowCtx, &tc.spec, in, &post, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Run(ctx, nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			if strategy := s.stats.strategy; strategy != tc.expected {
+				t.Fatalf("expected the %s strategy, got %s", tc.expected, strategy)
+			}
+			var retRows sqlbase.EncDatumRows
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				retRows = append(retRows, row)
+			}
+			expected := rows
+			if tc.post.Limit != 0 {
+				expected = rows[:tc.post.Limit]
+			}
+			if expStr, retStr := expected.String(), retRows.String(); expStr != retStr {
+				t.Fatalf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+			}
+		})
+	}
+}
+
+// TestSorterKeyEncodedOrdering verifies that sorters that compare their rows
+// through their keys (see SorterSpec.KeyEncodedOrdering) output the same rows
+// as the ones that compare their datums.
+func TestSorterKeyEncodedOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeString, columnTypeInt}
+	const numRows = 100
+	var alloc sqlbase.DatumAlloc
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		// The first column is ordered, like the prefix of an index.
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/10))),
+			sqlbase.DatumToEncDatum(columnTypeString, parser.NewDString(fmt.Sprint(rng.Intn(10)))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+		}
+		if rng.Intn(5) == 0 {
+			rows[i][1] = sqlbase.DatumToEncDatum(columnTypeString, parser.DNull)
+		}
+		for j := range rows[i][:2] {
+			encoded, err := rows[i][j].Encode(&alloc, sqlbase.DatumEncoding_ASCENDING_KEY, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows[i][j] = sqlbase.EncDatumFromEncoded(
+				types[j], sqlbase.DatumEncoding_ASCENDING_KEY, encoded,
+			)
+		}
+	}
+
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Descending},
+		{ColIdx: 2, Direction: encoding.Ascending},
+	})
+	testCases := []struct {
+		name     string
+		spec     SorterSpec
+		post     PostProcessSpec
+		memLimit int64
+	}{
+		{name: "SortAll", spec: SorterSpec{OutputOrdering: ordering}},
+		{name: "SortAllStable", spec: SorterSpec{OutputOrdering: ordering, Stable: true}},
+		{name: "SortTopK", spec: SorterSpec{OutputOrdering: ordering}, post: PostProcessSpec{Limit: 15}},
+		{name: "SortChunks", spec: SorterSpec{OutputOrdering: ordering, OrderingMatchLen: 1}},
+		{name: "SortAllSpill", spec: SorterSpec{OutputOrdering: ordering}, memLimit: 1},
+	}
+
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sortRows := func(keys bool) string {
+				spec := tc.spec
+				spec.KeyEncodedOrdering = keys
+				in := NewRowBuffer(types, rows, RowBufferArgs{})
+				retRows, meta, _ := runSorter(
+					t, &FlowCtx{tempStorage: tempEngine}, &spec, &tc.post, in, func(s *sorter) {
+						s.testingKnobMemLimit = tc.memLimit
+					},
+				)
+				if len(meta) != 0 {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				return retRows.String()
+			}
+			if expected, actual := sortRows(false), sortRows(true); expected != actual {
+				t.Errorf("expected:\n   %s\ngot:\n   %s", expected, actual)
+			}
+		})
+	}
+}
+
+// TestSorterNoColumns verifies that a sorter handles an input whose rows have
+// no columns.
+func TestSorterNoColumns(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{evalCtx: evalCtx}
+
+	const numRows = 10
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{}
+	}
+	post := PostProcessSpec{Limit: 3, Offset: 2}
+
+	testCases := []struct {
+		name        string
+		spec        SorterSpec
+		expStrategy sorterStrategyName
+	}{
+		{name: "NoOrdering", expStrategy: passThroughStrategyName},
+		{
+			// The rows are sorted on an expression but are output without
+			// columns.
+			name: "OrderingExpr",
+			spec: SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: encoding.Ascending},
+				}),
+				OrderingExprs: []Expression{{Expr: "1"}},
+			},
+			expStrategy: sortTopKStrategyName,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := NewRowBuffer(nil /* types */, rows, RowBufferArgs{})
+			retRows, meta, s := runSorter(t, &flowCtx, &tc.spec, &post, in)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if strategy := s.stats.strategy; strategy != tc.expStrategy {
+				t.Fatalf("expected the %s strategy, got %s", tc.expStrategy, strategy)
+			}
+			for _, row := range retRows {
+				if len(row) != 0 {
+					t.Fatalf("expected a row without columns, got %s", row)
+				}
+			}
+			if len(retRows) != int(post.Limit) {
+				t.Fatalf("expected %d rows, got %d", post.Limit, len(retRows))
+			}
+		})
+	}
+
+	// An ordering can't refer to a column of such an input.
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+		}),
+	}
+	in := NewRowBuffer(nil /* types */, rows, RowBufferArgs{})
+	if _, err := newSorter(
+		&flowCtx, &spec, in, &post, &RowBuffer{},
+	); !testutils.IsError(err, "invalid ordering column 0 \\(only 0 available\\)") {
+		t.Fatalf("expected invalid ordering column error, got %v", err)
+	}
+}
+
+// TestSorterSpillRequest verifies that the sorters that can fall back to disk
+// spill their rows when asked to through the sorterSpillRegistry.
+func TestSorterSpillRequest(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&distSQLUseTempStorage, true)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 4 * cancelCheckInterval
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	testCases := []struct {
+		name            string
+		limit           uint64
+		spillDisallowed bool
+	}{
+		{name: "SortAll"},
+		{name: "SortTopK", limit: 2 * cancelCheckInterval},
+		{name: "SpillDisallowed", spillDisallowed: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var registry sorterSpillRegistry
+			// asked is the number of sorters that were asked to spill.
+			asked := -1
+			read := 0
+			in := &nextHookRowSource{
+				RowSource: NewRowBuffer(types, rows, RowBufferArgs{}),
+				onNext: func() {
+					read++
+					if read == cancelCheckInterval+1 {
+						// The request comes from another goroutine.
+						done := make(chan int)
+						go func() { done <- registry.requestSpill() }()
+						asked = <-done
+					}
+				},
+			}
+			flowCtx := FlowCtx{tempStorage: tempEngine, sorterSpills: &registry}
+			spec := spec
+			spec.DiskSpillDisallowed = tc.spillDisallowed
+			retRows, meta, s := runSorter(t, &flowCtx, &spec, &PostProcessSpec{Limit: tc.limit}, in)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+
+			expAsked := 1
+			if tc.spillDisallowed {
+				expAsked = 0
+			}
+			if asked != expAsked {
+				t.Fatalf("expected %d sorters to be asked to spill, got %d", expAsked, asked)
+			}
+			if spilled := s.stats.spilledToDisk; spilled != !tc.spillDisallowed {
+				t.Fatalf("expected spilled to disk to be %t", !tc.spillDisallowed)
+			}
+			if n := registry.requestSpill(); n != 0 {
+				t.Fatalf("expected the sorter to be unregistered, %d sorters were asked to spill", n)
+			}
+
+			expRows := numRows
+			if tc.limit != 0 {
+				expRows = int(tc.limit)
+			}
+			if len(retRows) != expRows {
+				t.Fatalf("expected %d rows, got %d", expRows, len(retRows))
+			}
+			for i, row := range retRows {
+				if exp := fmt.Sprintf("[%d]", i+1); row.String() != exp {
+					t.Fatalf("expected row %s, got %s", exp, row)
+				}
+			}
+		})
+	}
+}
+
+func TestSorterStatsMetadata(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 10
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	testCases := []struct {
+		name      string
+		sendStats bool
+		limit     uint64
+		spill     bool
+	}{
+		{name: "NotSent"},
+		{name: "SortAll", sendStats: true},
+		{name: "SortTopK", sendStats: true, limit: 3},
+		{name: "Spill", sendStats: true, spill: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx, tempStorage: tempEngine, sendSorterStats: tc.sendStats}
+
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			out := &RowBuffer{}
+			s, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{Limit: tc.limit}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.spill {
+				s.testingKnobMemLimit = 1
+			}
+			s.Run(ctx, nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			numOut := 0
+			var stats *RemoteProducerMetadata_SorterStats
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					if meta.SorterStats == nil || stats != nil {
+						t.Fatalf("unexpected metadata: %v", meta)
+					}
+					stats = meta.SorterStats
+					continue
+				}
+				if row == nil {
+					break
+				}
+				if stats != nil {
+					t.Fatalf("sorter stats sent before row %s", row)
+				}
+				numOut++
+			}
+
+			if !tc.sendStats {
+				if stats != nil {
+					t.Fatalf("unexpected sorter stats: %v", stats)
+				}
+				if sorterStats := s.stats; sorterStats.rowSizes != (rowSizeHistogram{}) {
+					t.Fatalf("unexpected row sizes: %s", &sorterStats.rowSizes)
+				}
+				return
+			}
+			if stats == nil {
+				t.Fatal("no sorter stats were sent")
+			}
+			sorterStats := s.stats
+			exp := sorterStats.toMetadata()
+			if !reflect.DeepEqual(stats, exp) {
+				t.Fatalf("expected sorter stats %v, got %v", exp, stats)
+			}
+			var sizedRows int64
+			for _, c := range stats.RowSizeCounts {
+				sizedRows += c
+			}
+			if sizedRows != numRows {
+				t.Errorf("expected the sizes of %d rows, got %d", numRows, sizedRows)
+			}
+			if stats.InputRows != numRows {
+				t.Errorf("expected %d input rows, got %d", numRows, stats.InputRows)
+			}
+			if stats.OutputRows != int64(numOut) {
+				t.Errorf("expected %d output rows, got %d", numOut, stats.OutputRows)
+			}
+			if spilled := stats.SpilledBytes > 0; spilled != tc.spill {
+				t.Errorf("expected spilled to disk: %t, got %d bytes spilled", tc.spill, stats.SpilledBytes)
+			}
+		})
+	}
+}
+
+func TestSorterProgress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	defer func(interval time.Duration) { sorterProgressInterval = interval }(sorterProgressInterval)
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 2500
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+
+	testCases := []struct {
+		name         string
+		sendProgress bool
+		interval     time.Duration
+		estimate     int64
+		spill        bool
+		// expected are the progress reports, as phase, input rows, percentage
+		// of the estimate and output rows.
+		expected []string
+	}{
+		{name: "NotSent"},
+		// The sorter is done before it is due to report its progress.
+		{name: "Throttled", sendProgress: true, interval: time.Hour, estimate: 2048},
+		// Without an estimate, no percentage is reported.
+		{name: "NoEstimate", sendProgress: true, expected: []string{
+			"accumulating 1024 0% 0", "accumulating 2048 0% 0", "sorting 2500 0% 0",
+			"outputting 2500 0% 0", "outputting 2500 0% 1024", "outputting 2500 0% 2048",
+		}},
+		// The estimate is too low: the percentage only gets to 100 once the
+		// input is read entirely.
+		{name: "Estimate", sendProgress: true, estimate: 2048, expected: []string{
+			"accumulating 1024 50% 0", "accumulating 2048 99% 0", "sorting 2500 100% 0",
+			"outputting 2500 100% 0", "outputting 2500 100% 1024", "outputting 2500 100% 2048",
+		}},
+		{name: "Spill", sendProgress: true, estimate: 5000, spill: true, expected: []string{
+			"accumulating 1024 20% 0", "accumulating 2048 40% 0", "sorting 2500 100% 0",
+			"outputting 2500 100% 0", "outputting 2500 100% 1024", "outputting 2500 100% 2048",
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sorterProgressInterval = tc.interval
+			flowCtx := FlowCtx{tempStorage: tempEngine, sendSorterProgress: tc.sendProgress}
+			spec := SorterSpec{
+				OutputOrdering: convertToSpecOrdering(
+					sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+				EstimatedInputRows: tc.estimate,
+			}
+
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			retRows, meta, _ := runSorter(t, &flowCtx, &spec, &PostProcessSpec{}, in, func(s *sorter) {
+				if tc.spill {
+					s.testingKnobMemLimit = 1
+				}
+			})
+			var reports []string
+			for _, m := range meta {
+				p := m.SorterProgress
+				if p == nil {
+					t.Fatalf("unexpected metadata: %v", m)
+				}
+				if p.EstimatedInputRows != tc.estimate || p.SpilledToDisk != tc.spill {
+					t.Fatalf("unexpected progress: %v", p)
+				}
+				reports = append(reports, fmt.Sprintf(
+					"%s %d %d%% %d", p.Phase, p.InputRows, p.InputPercent, p.OutputRows,
+				))
+			}
+			if len(retRows) != numRows {
+				t.Fatalf("expected %d rows, got %d", numRows, len(retRows))
+			}
+			if fmt.Sprint(reports) != fmt.Sprint(tc.expected) {
+				t.Fatalf("expected progress reports %q, got %q", tc.expected, reports)
+			}
+		})
+	}
+}
+
+// TestSorterPartialResults verifies that a sorter that is given a time budget
+// stops reading its input once the budget runs out, outputs the rows read so
+// far in order, and flags its output as partial, after having drained its
+// input. The budget is made to run out after a given number of input rows by
+// moving the sorter's deadline.
+func TestSorterPartialResults(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	// The rows are ordered on the first column, and each chunk of 10 rows is in
+	// the reverse order of the second column.
+	const numRows = 100
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/10))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+	// sorted returns the first n rows, sorted.
+	sorted := func(n int) sqlbase.EncDatumRows {
+		var res sqlbase.EncDatumRows
+		for i := 0; i < n; i += 10 {
+			j := i + 9
+			if j >= n {
+				j = n - 1
+			}
+			for ; j >= i; j-- {
+				res = append(res, rows[j])
+			}
+		}
+		return res
+	}
+	const stopAfter = 35
+
+	testCases := []struct {
+		name     string
+		budget   time.Duration
+		matchLen uint32
+		limit    uint64
+		strategy sorterStrategyName
+		expected sqlbase.EncDatumRows
+	}{
+		{name: "NotOptedIn", strategy: sortAllStrategyName, expected: sorted(numRows)},
+		{name: "All", budget: time.Hour, strategy: sortAllStrategyName, expected: sorted(stopAfter)},
+		{name: "TopK", budget: time.Hour, limit: 5, strategy: sortTopKStrategyName,
+			expected: sorted(stopAfter)[:5]},
+		{name: "Chunks", budget: time.Hour, matchLen: 1, strategy: sortChunksStrategyName,
+			expected: sorted(stopAfter)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+			spec := SorterSpec{
+				OutputOrdering:           convertToSpecOrdering(ordering),
+				OrderingMatchLen:         tc.matchLen,
+				PartialResultsAfterNanos: tc.budget.Nanoseconds(),
+			}
+
+			var s *sorter
+			numNext := 0
+			in := NewRowBuffer(types, rows, RowBufferArgs{
+				OnNext: func(*RowBuffer) (sqlbase.EncDatumRow, ProducerMetadata) {
+					if numNext++; numNext == stopAfter {
+						// The budget runs out while the row is returned.
+						s.inputDeadline = time.Time{}
+					}
+					return nil, ProducerMetadata{}
+				},
+			})
+			// The metadata at the end of the input is forwarded even if the
+			// sorter stops reading rows before it.
+			inputMeta := ProducerMetadata{Ranges: []roachpb.RangeInfo{{}}}
+			in.Push(nil /* row */, inputMeta)
+			out := &RowBuffer{}
+			var err error
+			s, err = newSorter(&flowCtx, &spec, in, &PostProcessSpec{Limit: tc.limit}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Run(ctx, nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowBuffer not closed")
+			}
+			if s.stats.strategy != tc.strategy {
+				t.Fatalf("expected the %s strategy, got %s", tc.strategy, s.stats.strategy)
+			}
+
+			var retRows sqlbase.EncDatumRows
+			var partial *RemoteProducerMetadata_SorterPartialResult
+			numInputMeta := 0
+			for {
+				row, meta := out.Next()
+				if meta.SorterPartialResult != nil {
+					if partial != nil || len(retRows) != len(tc.expected) {
+						t.Fatalf("unexpected partial result after %d rows: %v", len(retRows), meta)
+					}
+					partial = meta.SorterPartialResult
+					continue
+				}
+				if len(meta.Ranges) > 0 {
+					numInputMeta++
+					continue
+				}
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				retRows = append(retRows, row)
+			}
+			if expStr, retStr := tc.expected.String(), retRows.String(); expStr != retStr {
+				t.Fatalf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+			}
+			if numInputMeta != 1 {
+				t.Fatalf("expected the input's metadata to be forwarded once, got %d", numInputMeta)
+			}
+			if tc.budget == 0 {
+				if partial != nil {
+					t.Fatalf("unexpected partial result: %v", partial)
+				}
+				return
+			}
+			if partial == nil || partial.InputRows != stopAfter {
+				t.Fatalf("expected a partial result after %d input rows, got %v", stopAfter, partial)
+			}
+			if in.ConsumerStatus != DrainRequested || !in.Done {
+				t.Fatalf("expected the input to be drained, got status %d", in.ConsumerStatus)
+			}
+		})
+	}
+}
+
+func TestRowSizeHistogram(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var h rowSizeHistogram
+	if counts := h.counts(); counts != nil {
+		t.Fatalf("expected no counts, got %v", counts)
+	}
+	for _, size := range []int64{0, 1, 2, 3, 4, 100, 127, 128, 1 << 40} {
+		h.add(size)
+	}
+	counts := h.counts()
+	if len(counts) != numRowSizeBuckets {
+		t.Fatalf("expected %d buckets, got %d", numRowSizeBuckets, len(counts))
+	}
+	exp := make([]int64, numRowSizeBuckets)
+	exp[0], exp[1], exp[2], exp[6], exp[7], exp[numRowSizeBuckets-1] = 2, 2, 1, 2, 1, 1
+	if !reflect.DeepEqual(counts, exp) {
+		t.Errorf("expected %v, got %v", exp, counts)
+	}
+	if expStr := "[0 B, 2 B): 2, [2 B, 4 B): 2, [4 B, 8 B): 1, [64 B, 128 B): 2, " +
+		"[128 B, 256 B): 1, [2.0 GiB, +inf): 1"; h.String() != expStr {
+		t.Errorf("expected %q, got %q", expStr, h.String())
+	}
+}
+
+// slowPushReceiver is a RowReceiver that takes delay to accept each row.
+type slowPushReceiver struct {
+	RowReceiver
+	delay time.Duration
+}
+
+func (r *slowPushReceiver) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
+	if row != nil {
+		time.Sleep(r.delay)
+	}
+	return r.RowReceiver.Push(row, meta)
+}
+
+// TestSorterOutputWaitTime verifies that the time spent pushing rows to a slow
+// consumer is reported in the stats, and only measured if they are sent.
+func TestSorterOutputWaitTime(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	const numRows = 10
+	const delay = time.Millisecond
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(numRows-i))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(
+			sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+
+	for _, sendStats := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SendStats=%t", sendStats), func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx, sendSorterStats: sendStats}
+
+			in := NewRowBuffer(types, rows, RowBufferArgs{})
+			buf := &RowBuffer{}
+			out := &slowPushReceiver{RowReceiver: buf, delay: delay}
+			s, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Run(ctx, nil)
+			if !buf.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			stats := s.stats
+			if !sendStats {
+				if stats.outputWaitTime != 0 {
+					t.Fatalf("expected no output wait time to be measured, got %s", stats.outputWaitTime)
+				}
+				return
+			}
+			if min := numRows * delay; stats.outputWaitTime < min {
+				t.Fatalf("expected an output wait time of at least %s, got %s", min, stats.outputWaitTime)
+			}
+			if stats.outputWaitTime > stats.sortTime {
+				t.Fatalf("expected the output wait time (%s) to be part of the sort time (%s)",
+					stats.outputWaitTime, stats.sortTime)
+			}
+			if meta := stats.toMetadata(); meta.OutputWaitNanos != stats.outputWaitTime.Nanoseconds() {
+				t.Fatalf("expected %d output wait nanos in the metadata, got %d",
+					stats.outputWaitTime.Nanoseconds(), meta.OutputWaitNanos)
+			}
+		})
+	}
+}
+
+// TestSorterFirstRowLatency verifies that a sorter measures the time to its
+// first output row, and records it in the DistSQL metrics: the
+// sortChunksStrategy outputs its first row before it reads the rest of its
+// input, while the sortAllStrategy only does once it has read all of it.
+func TestSorterFirstRowLatency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	// The rows are ordered on the first column, in chunks of 2 rows.
+	const numRows = 10
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/2))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(-i))),
+		}
+	}
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+
+	testCases := []struct {
+		name     string
+		rows     sqlbase.EncDatumRows
+		matchLen uint32
+		strategy sorterStrategyName
+		// before and after, if positive, are the calls to the input's Next that
+		// the first output row must come before (or after).
+		before, after int
+	}{
+		// The first chunk is output once the first row of the second one is read.
+		{name: "Chunks", rows: rows, matchLen: 1, strategy: sortChunksStrategyName, before: 4},
+		// The first row is output once the input is exhausted.
+		{name: "All", rows: rows, strategy: sortAllStrategyName, after: numRows + 1},
+		{name: "NoRows", strategy: sortAllStrategyName},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := MakeDistSQLMetrics(metric.TestSampleInterval)
+			flowCtx := FlowCtx{metrics: &metrics}
+			spec := SorterSpec{
+				OutputOrdering:   convertToSpecOrdering(ordering),
+				OrderingMatchLen: tc.matchLen,
+			}
+
+			// nextTimes are the times of the calls to the input's Next.
+			var nextTimes []time.Time
+			in := NewRowBuffer(types, tc.rows, RowBufferArgs{
+				OnNext: func(*RowBuffer) (sqlbase.EncDatumRow, ProducerMetadata) {
+					nextTimes = append(nextTimes, timeutil.Now())
+					return nil, ProducerMetadata{}
+				},
+			})
+			_, meta, s := runSorter(t, &flowCtx, &spec, &PostProcessSpec{}, in)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+
+			stats := s.stats
+			if stats.strategy != tc.strategy {
+				t.Fatalf("expected the %s strategy, got %s", tc.strategy, stats.strategy)
+			}
+			if meta := stats.toMetadata(); meta.FirstRowNanos != stats.firstRowLatency.Nanoseconds() {
+				t.Fatalf("expected %d first row nanos in the metadata, got %d",
+					stats.firstRowLatency.Nanoseconds(), meta.FirstRowNanos)
+			}
+			if len(tc.rows) == 0 {
+				if stats.firstRowLatency != 0 {
+					t.Fatalf("expected no first row latency, got %s", stats.firstRowLatency)
+				}
+				if n := metrics.SortFirstRowLatency.TotalCount(); n != 0 {
+					t.Fatalf("expected no first row latency to be recorded, got %d", n)
+				}
+				return
+			}
+			if stats.firstRowLatency <= 0 || stats.firstRowLatency > timeutil.Since(s.runStart) {
+				t.Fatalf("unexpected first row latency %s", stats.firstRowLatency)
+			}
+			firstRow := s.runStart.Add(stats.firstRowLatency)
+			if tc.before > 0 && firstRow.After(nextTimes[tc.before-1]) {
+				t.Fatalf("expected the first row before call %d to Next", tc.before)
+			}
+			if tc.after > 0 && firstRow.Before(nextTimes[tc.after-1]) {
+				t.Fatalf("expected the first row after call %d to Next", tc.after)
+			}
+			if n := metrics.SortFirstRowLatency.TotalCount(); n != 1 {
+				t.Fatalf("expected the first row latency to be recorded once, got %d", n)
+			}
+		})
+	}
+}
+
+// TestSorterOutputBatchSize verifies that a sorter that pushes its rows in
+// batches outputs them in order, before its stats, and that the
+// sortChunksStrategy doesn't hold back the rows of a chunk while it reads the
+// next one.
+func TestSorterOutputBatchSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	const batchSize = 7
+	defer settings.TestingSetInt(&sorterOutputBatchSize, batchSize)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	// The rows are ordered on the first column, in chunks of 10 rows that are
+	// in the reverse order of the second column.
+	const numRows = 100
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/10))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(-i))),
+		}
+	}
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+
+	ctx := context.Background()
+	for _, matchLen := range []uint32{0, 1} {
+		t.Run(fmt.Sprintf("MatchLen=%d", matchLen), func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx, sendSorterStats: true}
+
+			out := &RowBuffer{}
+			var numNext int
+			var outputOnSecondChunk int
+			in := NewRowBuffer(types, rows, RowBufferArgs{
+				OnNext: func(*RowBuffer) (sqlbase.EncDatumRow, ProducerMetadata) {
+					numNext++
+					if numNext == 12 {
+						// The second row of the second chunk is read once the first
+						// chunk is output.
+						out.mu.Lock()
+						outputOnSecondChunk = len(out.mu.records)
+						out.mu.Unlock()
+					}
+					return nil, ProducerMetadata{}
+				},
+			})
+			spec := SorterSpec{
+				OutputOrdering:   convertToSpecOrdering(ordering),
+				OrderingMatchLen: matchLen,
+			}
+			s, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.batchOutput == nil {
+				t.Fatal("expected the output to be batched")
+			}
+			s.Run(ctx, nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if matchLen > 0 && outputOnSecondChunk != 10 {
+				t.Fatalf("expected the first chunk to be output, got %d rows", outputOnSecondChunk)
+			}
+
+			var sorted sqlbase.EncDatumRows
+			var sawStats bool
+			for {
+				row, meta := out.Next()
+				if meta.Err != nil {
+					t.Fatal(meta.Err)
+				}
+				if meta.SorterStats != nil {
+					sawStats = true
+					continue
+				}
+				if row == nil {
+					break
+				}
+				if sawStats {
+					t.Fatalf("row %s pushed after the stats", row)
+				}
+				sorted = append(sorted, row)
+			}
+			if !sawStats {
+				t.Fatal("expected the sorter's stats")
+			}
+			var expected sqlbase.EncDatumRows
+			for i := 0; i < numRows; i += 10 {
+				for j := i + 9; j >= i; j-- {
+					expected = append(expected, rows[j])
+				}
+			}
+			if expStr, retStr := expected.String(), sorted.String(); expStr != retStr {
+				t.Fatalf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+			}
+		})
+	}
+}
+
+// TestSorterAggregation verifies the aggregation of the rows of an empty input;
+// the aggregation of other inputs is tested by TestSorter.
+func TestSorterAggregation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	zero := sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(0))
+	null := sqlbase.EncDatum{Datum: parser.DNull}
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+	})
+
+	testCases := []struct {
+		name     string
+		agg      AggregatorSpec
+		expected sqlbase.EncDatumRows
+	}{
+		{
+			// Without group columns, an empty input is aggregated to a single row.
+			name: "NoGroupCols",
+			agg: AggregatorSpec{
+				Aggregations: []AggregatorSpec_Aggregation{
+					{Func: AggregatorSpec_MAX, ColIdx: []uint32{1}},
+					{Func: AggregatorSpec_COUNT_ROWS},
+				},
+			},
+			expected: sqlbase.EncDatumRows{{null, zero}},
+		},
+		{
+			name: "GroupCols",
+			agg: AggregatorSpec{
+				GroupCols: []uint32{0},
+				Aggregations: []AggregatorSpec_Aggregation{
+					{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+					{Func: AggregatorSpec_COUNT_ROWS},
+				},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := SorterSpec{OutputOrdering: ordering, Aggregation: &tc.agg}
+			in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+			rows, meta, s := runSorter(t, &FlowCtx{}, &spec, &PostProcessSpec{}, in)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if strategy := s.stats.strategy; strategy != sortAllStrategyName {
+				t.Fatalf("expected the %s strategy, got %s", sortAllStrategyName, strategy)
+			}
+			if expStr, retStr := tc.expected.String(), rows.String(); expStr != retStr {
+				t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+			}
+		})
+	}
+}
+
+func TestSorterInvalidAggregation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{evalCtx: evalCtx}
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	})
+
+	testCases := []struct {
+		name   string
+		agg    AggregatorSpec
+		expErr string
+	}{
+		{
+			name:   "TooManyGroupCols",
+			agg:    AggregatorSpec{GroupCols: []uint32{0, 1, 0}},
+			expErr: "3 group columns but only 2 ordering columns",
+		},
+		{
+			name:   "GroupColNotOrdered",
+			agg:    AggregatorSpec{GroupCols: []uint32{1}},
+			expErr: "ordering column 0 is not a group column",
+		},
+		{
+			name:   "GroupColOutOfRange",
+			agg:    AggregatorSpec{GroupCols: []uint32{2}},
+			expErr: "group column 2 out of range",
+		},
+		{
+			name: "InvalidAggregation",
+			agg: AggregatorSpec{
+				GroupCols: []uint32{0},
+				Aggregations: []AggregatorSpec_Aggregation{
+					{Func: AggregatorSpec_MAX, ColIdx: []uint32{3}},
+				},
+			},
+			expErr: "ColIdx out of range",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := SorterSpec{OutputOrdering: ordering, Aggregation: &tc.agg}
+			in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+			_, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{})
+			if !testutils.IsError(err, tc.expErr) {
+				t.Fatalf("expected error %q, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+// TestSorterDistinct verifies the deduplication of the rows of an empty input;
+// the deduplication of other inputs is tested by TestSorter.
+func TestSorterDistinct(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+			{ColIdx: 1, Direction: encoding.Ascending},
+		}),
+		Distinct: true,
+	}
+	in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+	rows, meta, s := runSorter(t, &FlowCtx{}, &spec, &PostProcessSpec{}, in)
+	if len(meta) != 0 {
+		t.Fatalf("unexpected metadata: %v", meta)
+	}
+	if strategy := s.stats.strategy; strategy != sortAllStrategyName {
+		t.Fatalf("expected the %s strategy, got %s", sortAllStrategyName, strategy)
+	}
+	if len(rows) != 0 {
+		t.Fatalf("expected no rows, got %s", rows)
+	}
+}
+
+func TestSorterInvalidDistinct(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{evalCtx: evalCtx}
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	ordering := convertToSpecOrdering(sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+	})
+
+	testCases := []struct {
+		name   string
+		spec   SorterSpec
+		expErr string
+	}{
+		{
+			// All the input columns are distinct columns by default.
+			name:   "AllColsNotOrdered",
+			spec:   SorterSpec{OutputOrdering: ordering, Distinct: true},
+			expErr: "2 distinct columns but only 1 ordering columns",
+		},
+		{
+			name: "DistinctColNotOrdered",
+			spec: SorterSpec{
+				OutputOrdering: ordering, Distinct: true, DistinctColumns: []uint32{1},
+			},
+			expErr: "ordering column 0 is not a distinct column",
+		},
+		{
+			name: "DistinctColOutOfRange",
+			spec: SorterSpec{
+				OutputOrdering: ordering, Distinct: true, DistinctColumns: []uint32{2},
+			},
+			expErr: "distinct column 2 out of range",
+		},
+		{
+			name: "Aggregation",
+			spec: SorterSpec{
+				OutputOrdering:  ordering,
+				Distinct:        true,
+				DistinctColumns: []uint32{0},
+				Aggregation:     &AggregatorSpec{GroupCols: []uint32{0}},
+			},
+			expErr: "a sorter can't both aggregate and deduplicate its rows",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+			_, err := newSorter(&flowCtx, &tc.spec, in, &PostProcessSpec{}, &RowBuffer{})
+			if !testutils.IsError(err, tc.expErr) {
+				t.Fatalf("expected error %q, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestSorterReverseSortColumns(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	v := [4]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i)))
+	}
+	asc := encoding.Ascending
+	// The input is ordered on both columns.
+	input := sqlbase.EncDatumRows{
+		{v[1], v[1]},
+		{v[1], v[2]},
+		{v[2], v[1]},
+		{v[3], v[0]},
+		{v[3], v[3]},
+	}
+
+	testCases := []struct {
+		name        string
+		matchLen    uint32
+		post        PostProcessSpec
+		reverse     []uint32
+		expStrategy sorterStrategyName
+		expected    sqlbase.EncDatumRows
+	}{
+		{
+			name:        "NoOverride",
+			matchLen:    2,
+			expStrategy: passThroughStrategyName,
+			expected:    input,
+		},
+		{
+			name:        "SortAll",
+			reverse:     []uint32{1},
+			expStrategy: sortAllStrategyName,
+			expected: sqlbase.EncDatumRows{
+				{v[3], v[0]},
+				{v[3], v[3]},
+				{v[2], v[1]},
+				{v[1], v[1]},
+				{v[1], v[2]},
+			},
+		},
+		{
+			name:        "SortTopK",
+			post:        PostProcessSpec{Limit: 3},
+			reverse:     []uint32{1, 2},
+			expStrategy: sortTopKStrategyName,
+			expected: sqlbase.EncDatumRows{
+				{v[3], v[3]},
+				{v[3], v[0]},
+				{v[2], v[1]},
+			},
+		},
+		{
+			// Only the column after the match length is reversed, the input is
+			// still sorted in chunks.
+			name:        "SortChunks",
+			matchLen:    1,
+			reverse:     []uint32{2},
+			expStrategy: sortChunksStrategyName,
+			expected: sqlbase.EncDatumRows{
+				{v[1], v[2]},
+				{v[1], v[1]},
+				{v[2], v[1]},
+				{v[3], v[3]},
+				{v[3], v[0]},
+			},
+		},
+		{
+			// The input isn't ordered on the reversed column anymore.
+			name:        "ReversedMatchLen",
+			matchLen:    2,
+			reverse:     []uint32{2},
+			expStrategy: sortChunksStrategyName,
+			expected: sqlbase.EncDatumRows{
+				{v[1], v[2]},
+				{v[1], v[1]},
+				{v[2], v[1]},
+				{v[3], v[3]},
+				{v[3], v[0]},
+			},
+		},
+		{
+			// Positions beyond the ordering are ignored.
+			name:        "OutOfRange",
+			matchLen:    2,
+			reverse:     []uint32{3},
+			expStrategy: passThroughStrategyName,
+			expected:    input,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			evalCtx.ReverseSortColumns = tc.reverse
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+
+			spec := SorterSpec{
+				OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 0, Direction: asc},
+					{ColIdx: 1, Direction: asc},
+				}),
+				OrderingMatchLen: tc.matchLen,
+			}
+			effort := spec.sortEffort(&tc.post, tc.reverse)
+			if expEffort := strategyEfforts[tc.expStrategy]; effort != expEffort {
+				t.Fatalf("expected a sort effort of %d, got %d", expEffort, effort)
+			}
+			in := NewRowBuffer(types, input, RowBufferArgs{})
+			retRows, meta, s := runSorter(t, &flowCtx, &spec, &tc.post, in)
+			if len(meta) != 0 {
+				t.Fatalf("unexpected metadata: %v", meta)
+			}
+			if strategy := s.stats.strategy; strategy != tc.expStrategy {
+				t.Fatalf("expected the %s strategy, got %s", tc.expStrategy, strategy)
+			}
+			if expStr, retStr := tc.expected.String(), retRows.String(); expStr != retStr {
+				t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+			}
+		})
+	}
+}
+
+func TestParseWorkMem(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		value   string
+		bytes   int64
+		percent int64
+	}{
+		{"", defaultWorkMem, 0},
+		{"1024", 1024, 0},
+		{"0x100", 256, 0},
+		{"25%", 0, 25},
+		{"1%", 0, 1},
+		{"100%", 0, 100},
+		// Invalid values fall back to the default.
+		{"0%", defaultWorkMem, 0},
+		{"101%", defaultWorkMem, 0},
+		{"-5%", defaultWorkMem, 0},
+		{"x%", defaultWorkMem, 0},
+		{"64MB", defaultWorkMem, 0},
+	}
+	for _, tc := range testCases {
+		bytes, percent := parseWorkMem(tc.value)
+		if bytes != tc.bytes || percent != tc.percent {
+			t.Errorf("%q: expected (%d, %d), got (%d, %d)",
+				tc.value, tc.bytes, tc.percent, bytes, percent)
+		}
+	}
+}
+
+func TestWorkMemLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	m := mon.MakeMonitor("test", nil, nil, 1, math.MaxInt64)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	defer m.Stop(ctx)
+	unlimited := mon.MakeUnlimitedMonitor(ctx, "test-unlimited", nil, nil, math.MaxInt64)
+	defer unlimited.Stop(ctx)
+
+	testCases := []struct {
+		value    string
+		m        *mon.MemoryMonitor
+		expected int64
+	}{
+		{value: "123", m: &m, expected: 123},
+		{value: "25%", m: &m, expected: 250},
+		{value: "100%", m: &m, expected: 1000},
+		// A percentage of an unbounded monitor uses the default.
+		{value: "25%", m: &unlimited, expected: defaultWorkMem},
+	}
+	for _, tc := range testCases {
+		// The setting is read by every call, so that changes apply to the
+		// following sorts.
+		func() {
+			defer settings.TestingSetString(&sorterWorkMem, tc.value)()
+			if limit := workMemLimit(tc.m); limit != tc.expected {
+				t.Errorf("%q: expected limit %d, got %d", tc.value, tc.expected, limit)
+			}
+		}()
+	}
+
+	// The setting can't be set to values that can't be parsed.
+	for _, value := range []string{"", "0%", "101%", "x%", "64MB"} {
+		if err := sorterWorkMem.Validate(value); err == nil {
+			t.Errorf("%q: expected a validation error", value)
+		}
+	}
+	for _, value := range []string{"1024", "0x100", "1%", "100%"} {
+		if err := sorterWorkMem.Validate(value); err != nil {
+			t.Errorf("%q: unexpected validation error: %s", value, err)
+		}
+	}
+}
+
+func TestWorkMemDefault(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		env      string
+		expected string
+	}{
+		{"", "67108864"},
+		{"1024", "1024"},
+		{"0x100", "256"},
+		{"25%", "25%"},
+		// Invalid values fall back to the default.
+		{"101%", "67108864"},
+		{"64MB", "67108864"},
+	}
+	for _, tc := range testCases {
+		if value := workMemDefault(tc.env); value != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.env, tc.expected, value)
+		}
+	}
+}
+
 // BenchmarkSortAll times how long it takes to sort an input of varying length.
 func BenchmarkSortAll(b *testing.B) {
 	ctx := context.Background()
@@ -286,6 +5872,141 @@ func BenchmarkSortAll(b *testing.B) {
 	}
 }
 
+// BenchmarkSortWideRows compares sorting rows with many columns when the
+// post-processing stage doesn't do anything, in which case the sorter pushes
+// the rows to its output directly, to sorting them with a post-processing stage
+// that projects all the columns.
+func BenchmarkSortWideRows(b *testing.B) {
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{
+		evalCtx: evalCtx,
+	}
+
+	const numCols = 32
+	const inputSize = 1 << 12
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := make([]sqlbase.ColumnType, numCols)
+	outputCols := make([]uint32, numCols)
+	for i := range types {
+		types[i] = columnTypeInt
+		outputCols[i] = uint32(i)
+	}
+	rng := rand.New(rand.NewSource(int64(timeutil.Now().UnixNano())))
+	input := make(sqlbase.EncDatumRows, inputSize)
+	for i := range input {
+		input[i] = make(sqlbase.EncDatumRow, numCols)
+		for j := range input[i] {
+			input[i][j] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Int())))
+		}
+	}
+	rowSource := NewRepeatableRowSource(types, input)
+
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+	for _, tc := range []struct {
+		name string
+		post PostProcessSpec
+	}{
+		{name: "Direct"},
+		{name: "Projection", post: PostProcessSpec{Projection: true, OutputColumns: outputCols}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			s, err := newSorter(&flowCtx, &spec, rowSource, &tc.post, &RowDisposer{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Run(ctx, nil)
+				rowSource.Reset()
+			}
+		})
+	}
+}
+
+// BenchmarkSortNulls times the sort of rows whose ordering column is mostly
+// NULL with each of the strategies that compare rows.
+func BenchmarkSortNulls(b *testing.B) {
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{
+		evalCtx: evalCtx,
+	}
+
+	// The first column is a prefix of the ordering that changes every 1024
+	// rows, the second one is NULL in 90% of the rows.
+	const inputSize = 1 << 16
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	rng := rand.New(rand.NewSource(int64(timeutil.Now().UnixNano())))
+	for _, typ := range []sqlbase.ColumnType{columnTypeInt, columnTypeString} {
+		types := []sqlbase.ColumnType{columnTypeInt, typ}
+		input := make(sqlbase.EncDatumRows, inputSize)
+		for i := range input {
+			var d parser.Datum = parser.DNull
+			if rng.Intn(10) == 0 {
+				if typ.SemanticType == sqlbase.ColumnType_INT {
+					d = parser.NewDInt(parser.DInt(rng.Int()))
+				} else {
+					d = parser.NewDString(fmt.Sprint(rng.Int()))
+				}
+			}
+			input[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/1024))),
+				sqlbase.DatumToEncDatum(typ, d),
+			}
+		}
+		rowSource := NewRepeatableRowSource(types, input)
+
+		for _, tc := range []struct {
+			name string
+			spec SorterSpec
+			post PostProcessSpec
+		}{
+			{
+				name: "SortAll",
+				spec: SorterSpec{OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 1, Direction: encoding.Ascending},
+				})},
+			},
+			{
+				name: "SortTopK",
+				spec: SorterSpec{OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+					{ColIdx: 1, Direction: encoding.Descending},
+				})},
+				post: PostProcessSpec{Limit: 1 << 10},
+			},
+			{
+				name: "SortChunks",
+				spec: SorterSpec{
+					OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+						{ColIdx: 0, Direction: encoding.Ascending},
+						{ColIdx: 1, Direction: encoding.Ascending},
+					}),
+					OrderingMatchLen: 1,
+				},
+			},
+		} {
+			b.Run(fmt.Sprintf("%s/%s", typ.SemanticType, tc.name), func(b *testing.B) {
+				s, err := newSorter(&flowCtx, &tc.spec, rowSource, &tc.post, &RowDisposer{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					s.Run(ctx, nil)
+					rowSource.Reset()
+				}
+			})
+		}
+	}
+}
+
 // BenchmarkSortLimit times how long it takes to sort a fixed size input with
 // varying limits.
 func BenchmarkSortLimit(b *testing.B) {
@@ -333,3 +6054,159 @@ func BenchmarkSortLimit(b *testing.B) {
 		}
 	})
 }
+
+// contendedRowReceiver is a RowReceiver that only counts the rows pushed to
+// it, under a lock that is also taken in a loop by a background goroutine,
+// like the lock of a receiver that is shared with other producers.
+type contendedRowReceiver struct {
+	mu struct {
+		syncutil.Mutex
+		numRows int
+		// numLocks is the number of times the background goroutine took the
+		// lock.
+		numLocks int
+	}
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+var _ batchRowReceiver = &contendedRowReceiver{}
+
+func startContendedRowReceiver() *contendedRowReceiver {
+	r := &contendedRowReceiver{stopCh: make(chan struct{}), doneCh: make(chan struct{})}
+	go func() {
+		defer close(r.doneCh)
+		for {
+			select {
+			case <-r.stopCh:
+				return
+			default:
+			}
+			r.mu.Lock()
+			r.mu.numLocks++
+			r.mu.Unlock()
+		}
+	}()
+	return r
+}
+
+func (r *contendedRowReceiver) stop() {
+	close(r.stopCh)
+	<-r.doneCh
+}
+
+func (r *contendedRowReceiver) Push(row sqlbase.EncDatumRow, _ ProducerMetadata) ConsumerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if row != nil {
+		r.mu.numRows++
+	}
+	return NeedMoreRows
+}
+
+func (r *contendedRowReceiver) PushBatch(rows sqlbase.EncDatumRows) ConsumerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.numRows += len(rows)
+	return NeedMoreRows
+}
+
+func (r *contendedRowReceiver) ProducerDone() {}
+
+// BenchmarkSorterOutputBatchSize measures the throughput of an in-memory sort
+// whose output is contended, with and without batching its output rows (see
+// sorterOutputBatchSize).
+func BenchmarkSorterOutputBatchSize(b *testing.B) {
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{
+		evalCtx: evalCtx,
+	}
+
+	const inputSize = 1 << 12
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	rng := rand.New(rand.NewSource(int64(timeutil.Now().UnixNano())))
+	input := make(sqlbase.EncDatumRows, inputSize)
+	for i := range input {
+		input[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Int()))),
+		}
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}),
+	}
+	post := PostProcessSpec{}
+
+	for _, batchSize := range []int64{0, 16, 256} {
+		b.Run(fmt.Sprintf("BatchSize=%d", batchSize), func(b *testing.B) {
+			defer settings.TestingSetInt(&sorterOutputBatchSize, batchSize)()
+			out := startContendedRowReceiver()
+			defer out.stop()
+			rowSource := NewRepeatableRowSource(types, input)
+			s, err := newSorter(&flowCtx, &spec, rowSource, &post, out)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(inputSize * 8)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Run(ctx, nil)
+				rowSource.Reset()
+			}
+		})
+	}
+}
+
+// BenchmarkSorterLowCardinalityChunks compares sorting the chunks of an input
+// ordered on a prefix of the output ordering, whose other column has few
+// distinct values, with and without the hint that it does (see
+// SorterSpec.LowCardinalityChunkColumns).
+func BenchmarkSorterLowCardinalityChunks(b *testing.B) {
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{
+		evalCtx: evalCtx,
+	}
+
+	const inputSize = 1 << 16
+	const chunkSize = 1 << 10
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	rng := rand.New(rand.NewSource(int64(timeutil.Now().UnixNano())))
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+
+	for _, numValues := range []int{4, 16, 64} {
+		input := make(sqlbase.EncDatumRows, inputSize)
+		for i := range input {
+			input[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i/chunkSize))),
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Intn(numValues)))),
+			}
+		}
+		for _, lowCardinality := range []bool{false, true} {
+			b.Run(fmt.Sprintf("Values=%d/LowCardinality=%t", numValues, lowCardinality), func(b *testing.B) {
+				spec := SorterSpec{
+					OutputOrdering:             convertToSpecOrdering(ordering),
+					OrderingMatchLen:           1,
+					LowCardinalityChunkColumns: lowCardinality,
+				}
+				rowSource := NewRepeatableRowSource(types, input)
+				s, err := newSorter(&flowCtx, &spec, rowSource, &PostProcessSpec{}, &RowDisposer{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					s.Run(ctx, nil)
+					rowSource.Reset()
+				}
+			})
+		}
+	}
+}
@@ -17,11 +17,19 @@
 package distsqlrun
 
 import (
+	"container/heap"
+	"fmt"
+	"time"
+
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/pkg/errors"
 )
 
@@ -34,23 +42,46 @@ type sorterStrategy interface {
 	//
 	// It returns once either all the input has been exhausted or the consumer
 	// indicated that no more rows are needed. In any case, the caller is
-	// responsible for draining and closing the producer and the consumer.
+	// responsible for draining and closing the producer and the consumer, as
+	// well as for closing the memRowContainer the strategy was created with.
 	Execute(context.Context, *sorter) error
 }
 
+// cancelCheckInterval is the number of rows read by a strategy between checks
+// of whether it should stop accumulating rows in memory (e.g. because the
+// sorter was asked to spill). Note that the cancellation of the context is
+// checked before every row is read instead; see sorter.nextRow.
+const cancelCheckInterval = 1024
+
 // sortAllStrategy reads in all values into the wrapped rows and
 // uses sort.Sort to sort all values in-place. It has a worst-case time
 // complexity of O(n*log(n)) and a worst-case space complexity of O(n).
 //
+// If the sorter is stable, sort.Stable is used instead. Stability is preserved
+// if the strategy falls back to disk, since the diskRowContainer breaks ties
+// between rows by the order in which they were added.
+//
+// The strategy can also fall back to disk, if it is allowed to, when sorting
+// in memory is expected to take longer than the sql.distsql.sorter.spill_after
+// budget. Sorting the rows is assumed to take about as long as accumulating
+// them, so the rows are spilled once the accumulation has taken half of the
+// budget. This bounds the latency of large sorts at the cost of disk IO.
+//
+// Similarly, the rows are spilled if the sorter is asked to under memory
+// pressure while it accumulates them (see sorterSpillRegistry).
+//
+// Rows sorted in memory on numeric columns only are sorted on typed slices of
+// the values of these columns (see memRowContainer.sortColumnar).
+//
 // The strategy is intended to be used when all values need to be sorted.
 type sortAllStrategy struct {
-	rows           memRowContainer
+	rows           *memRowContainer
 	useTempStorage bool
 }
 
 var _ sorterStrategy = &sortAllStrategy{}
 
-func newSortAllStrategy(rows memRowContainer, useTempStorage bool) sorterStrategy {
+func newSortAllStrategy(rows *memRowContainer, useTempStorage bool) sorterStrategy {
 	return &sortAllStrategy{
 		rows:           rows,
 		useTempStorage: useTempStorage,
@@ -60,41 +91,150 @@ func newSortAllStrategy(rows memRowContainer, useTempStorage bool) sorterStrateg
 // Execute runs an in memory implementation of a sort. If this run fails with a
 // memory error, the strategy will fall back to use disk.
 func (ss *sortAllStrategy) Execute(ctx context.Context, s *sorter) error {
-	defer ss.rows.Close(ctx)
-	row, err := ss.executeImpl(ctx, s, &ss.rows)
-	// TODO(asubiotto): A memory error could also be returned if a limit other
-	// than the COCKROACH_WORK_MEM was reached. We should distinguish between
-	// these cases and log the event to facilitate debugging of queries that
-	// may be slow for this reason.
-	if pgErr, ok := err.(*pgerror.Error); !(ok && pgErr.Code == pgerror.CodeOutOfMemoryError) {
-		return err
+	var budget time.Duration
+	if ss.useTempStorage && s.tempStorage != nil && !s.diskSpillDisallowed {
+		budget = sorterSpillAfter.Get()
 	}
-	if !ss.useTempStorage {
-		return errors.Wrap(err, "external storage for large queries disabled")
+	row, err := ss.executeImpl(ctx, s, ss.rows, budget, true /* spillOnRequest */)
+	if err == nil {
+		return nil
 	}
-	if s.tempStorage == nil {
-		return errors.Wrap(err, "external storage not provided on this cockroach node")
+	if err == errSortTimeBudgetExceeded {
+		log.Eventf(ctx, "spilling to disk after accumulating rows for half of %s", budget)
+	} else if err == errSortSpillRequested {
+		log.Eventf(ctx, "spilling to disk on request")
+	} else if err := checkDiskFallback(
+		ctx, err, ss.useTempStorage, s, ss.rows.Len(), row,
+	); err != nil {
+		return err
 	}
-	log.VEventf(ctx, 2, "falling back to disk")
-	// The diskContainer will free the memory taken up by ss.rows as it is
-	// created from them.
-	diskContainer, err := makeDiskRowContainer(
-		ctx, ss.rows.types, ss.rows.ordering, ss.rows, s.tempStorage,
-	)
+	diskContainer, err := spillToDisk(ctx, s, ss.rows)
 	if err != nil {
 		return err
 	}
-	defer diskContainer.Close(ctx)
-	// Add the row that caused the memory container to run out of memory.
-	if err := diskContainer.AddRow(ctx, row); err != nil {
-		return err
+	defer closeDiskContainer(ctx, s, &diskContainer)
+	if row != nil {
+		// Add the row that caused the memory container to run out of memory.
+		if err := diskContainer.AddRow(ctx, row); err != nil {
+			return err
+		}
 	}
-	if _, err := ss.executeImpl(ctx, s, &diskContainer); err != nil {
+	if _, err := ss.executeImpl(
+		ctx, s, &diskContainer, 0 /* budget */, false, /* spillOnRequest */
+	); err != nil {
 		return err
 	}
 	return nil
 }
 
+// errSortTimeBudgetExceeded is returned by the in-memory execution of the
+// sortAllStrategy when it should fall back to disk because of the time spent
+// accumulating rows.
+var errSortTimeBudgetExceeded = errors.New("sort time budget exceeded")
+
+// errSortSpillRequested is returned by the in-memory executions of the
+// strategies that can fall back to disk when the sorter was asked to spill
+// (see sorter.spillRequested).
+var errSortSpillRequested = errors.New("sort spill requested")
+
+// checkDiskFallback is used by the strategies that can fall back to disk when
+// their in-memory execution fails with err. It returns nil if the strategy
+// should fall back to disk, which is the case if err is a memory budget error
+// and temporary storage can be used. Otherwise, the error that the strategy
+// should return is returned. numRows is the number of rows held in memory by
+// the strategy, and row the row that couldn't be added to them, if any.
+//
+// If not even the first row fit in memory, no memory limit the sorter could
+// have stopped short of would have helped: the row is sorted on disk if
+// possible, and otherwise the error says that the row is too large.
+//
+// TODO(asubiotto): A memory error could also be returned if a limit other
+// than the COCKROACH_WORK_MEM was reached. We should distinguish between
+// these cases and log the event to facilitate debugging of queries that
+// may be slow for this reason.
+func checkDiskFallback(
+	ctx context.Context,
+	err error,
+	useTempStorage bool,
+	s *sorter,
+	numRows int,
+	row sqlbase.EncDatumRow,
+) error {
+	if pgErr, ok := err.(*pgerror.Error); !(ok && pgErr.Code == pgerror.CodeOutOfMemoryError) {
+		return err
+	}
+	var fallbackErr error
+	if !useTempStorage {
+		fallbackErr = errors.Wrap(err, "external storage for large queries disabled")
+	} else if s.diskSpillDisallowed {
+		fallbackErr = newLimitError(
+			"sorter memory limit exceeded: %d rows buffered, limit is %d bytes; "+
+				"spilling to disk is disallowed", numRows, s.memMonLimit,
+		)
+	} else if s.tempStorage == nil {
+		fallbackErr = errors.Wrap(
+			err, "disk spill unavailable: external storage not provided on this cockroach node",
+		)
+	}
+	if numRows == 0 && row != nil {
+		if fallbackErr != nil {
+			return errors.Wrapf(
+				fallbackErr, "row too large for sort memory limit: row of %d bytes", row.Size(),
+			)
+		}
+		log.Eventf(ctx, "row of %d bytes too large for sort memory limit; sorting on disk", row.Size())
+	}
+	return fallbackErr
+}
+
+// spillToDisk creates a diskRowContainer on the sorter's temporary storage with
+// the rows from the given in-memory container. The diskRowContainer will free
+// the memory taken up by rows as it is created from them. The caller must Close
+// the returned container.
+func spillToDisk(ctx context.Context, s *sorter, rows *memRowContainer) (diskRowContainer, error) {
+	s.stats.spilledToDisk = true
+	// Record the spill in the sorter's span so that slow sorts can be
+	// attributed to it when looking at a trace.
+	log.Eventf(ctx, "spilled to disk after %d rows, %d bytes", rows.Len(), rows.MemUsage())
+	if s.flowCtx.sendSorterStats {
+		// The sizes of the rows tell whether a few wide rows filled up the
+		// memory budget, rather than many rows.
+		log.Eventf(ctx, "input row sizes: %s", &s.stats.rowSizes)
+	}
+	if m := s.flowCtx.metrics; m != nil {
+		m.SortSpillCount.Inc(1)
+	}
+	// The rows buffered by the disk container count towards the memory budget
+	// of the sort. If the batch doesn't fit, the rows are written in batches of
+	// the default size of the store instead.
+	batchSize := distSQLTempStorageWriteBatchSize.Get()
+	s.writeBatchAcc = rows.evalCtx.Mon.MakeBoundAccount()
+	if err := s.writeBatchAcc.Grow(ctx, batchSize); err != nil {
+		log.Eventf(ctx, "write batch of %s too large for sort memory limit; using default size",
+			humanizeutil.IBytes(batchSize))
+		batchSize = 0
+	}
+	d, err := makeDiskRowContainer(
+		ctx, rows.types, rows.ordering, *rows, s.tempStorage, distSQLTempStorageCompression.Get(),
+		diskRowEncoding(distSQLTempStorageEncoding.Get()),
+		diskColumnEncoding(distSQLTempStorageColumnEncoding.Get()),
+		int(batchSize), s.flowCtx.metrics,
+	)
+	if err != nil {
+		s.writeBatchAcc.Close(ctx)
+	}
+	return d, err
+}
+
+// closeDiskContainer closes a diskRowContainer created by spillToDisk, after
+// recording the bytes written to it in the sorter's stats, and releases the
+// memory reserved for its write batch.
+func closeDiskContainer(ctx context.Context, s *sorter, d *diskRowContainer) {
+	s.stats.spilledBytes += d.bytesWritten
+	d.Close(ctx)
+	s.writeBatchAcc.Close(ctx)
+}
+
 // The execution loop for the SortAll strategy:
 //  - loads all rows into memory. If the memory budget is not high enough, all
 //    rows are stored on disk.
@@ -104,42 +244,104 @@ func (ss *sortAllStrategy) Execute(ctx context.Context, s *sorter) error {
 //
 // If an error occurs while adding a row to the given container, the row is
 // returned in order to not lose it.
+//
+// Since reading the whole input can take a long time, no more rows are read
+// once the context is canceled (see sorter.nextRow). Additionally, every
+// cancelCheckInterval rows, if budget is set and the rows have been
+// accumulated for more than half of it, errSortTimeBudgetExceeded is returned,
+// and if spillOnRequest is set and the sorter was asked to spill,
+// errSortSpillRequested is returned; all the rows read so far are in r.
 func (ss *sortAllStrategy) executeImpl(
-	ctx context.Context, s *sorter, r sortableRowContainer,
+	ctx context.Context,
+	s *sorter,
+	r sortableRowContainer,
+	budget time.Duration,
+	spillOnRequest bool,
 ) (sqlbase.EncDatumRow, error) {
-	for {
-		row, err := s.input.NextRow()
+	start := timeutil.Now()
+	for n := 0; ; n++ {
+		if n%cancelCheckInterval == 0 {
+			if budget > 0 && n > 0 && timeutil.Since(start) > budget/2 {
+				return nil, errSortTimeBudgetExceeded
+			}
+			if spillOnRequest && n > 0 && s.spillRequested() {
+				return nil, errSortSpillRequested
+			}
+		}
+		row, err := s.nextRow(ctx)
 		if err != nil {
 			return nil, err
 		}
 		if row == nil {
 			break
 		}
+		// All the rows read so far are buffered.
+		if err := s.checkMaxRows(s.stats.inputRows); err != nil {
+			return nil, err
+		}
 		if err := r.AddRow(ctx, row); err != nil {
 			return row, err
 		}
 	}
-	r.Sort()
+	s.setPhase(sortPhaseSorting)
+	if rows, ok := r.(*memRowContainer); ok && s.fewRowsNeeded(rows.Len()) {
+		return nil, emitSmallestRows(ctx, s, rows)
+	}
+	if rows, ok := r.(*memRowContainer); !ok || !rows.sortColumnar(ctx) {
+		r.Sort()
+	}
+	return nil, emitSortedRows(ctx, s, r)
+}
+
+// emitSmallestRows outputs the rows of a container in sorted order without
+// sorting them all, until the output is satisfied (see sorter.outputSatisfied).
+// The rows are arranged in a min-heap, and the smallest one is taken out of it
+// for each row output. This costs O(Len()) to build the heap and O(log(Len()))
+// per row output, rather than O(Len()*log(Len())) to sort the rows, which is
+// cheaper when only a few of them are needed (see sorter.fewRowsNeeded). The
+// order of equal rows is unspecified.
+func emitSmallestRows(ctx context.Context, s *sorter, rows *memRowContainer) error {
+	rows.invertSorting = false
+	// The rows taken out of the heap are moved right past its end.
+	h := heapPrefix{memRowContainer: rows, n: rows.Len()}
+	heap.Init(&h)
+	s.setPhase(sortPhaseOutputting)
+	for h.n > 0 {
+		heap.Pop(&h)
+		consumerStatus, err := s.emitRow(ctx, rows.EncRow(h.n))
+		if err != nil || consumerStatus != NeedMoreRows {
+			return err
+		}
+	}
+	return nil
+}
 
-	i := r.NewIterator(ctx)
+// emitSortedRows outputs the rows of a sorted container, until the consumer
+// doesn't need more rows.
+func emitSortedRows(ctx context.Context, s *sorter, r sortableRowContainer) error {
+	s.setPhase(sortPhaseOutputting)
+	i, err := r.NewIterator(ctx)
+	if err != nil {
+		return err
+	}
 	defer i.Close()
 
 	for i.Rewind(); ; i.Next() {
 		if ok, err := i.Valid(); err != nil {
-			return nil, err
+			return err
 		} else if !ok {
 			break
 		}
 		row, err := i.Row()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		consumerStatus, err := s.out.emitRow(ctx, row)
+		consumerStatus, err := s.emitRow(ctx, row)
 		if err != nil || consumerStatus != NeedMoreRows {
-			return nil, err
+			return err
 		}
 	}
-	return nil, nil
+	return nil
 }
 
 // sortTopKStrategy creates a max-heap in its wrapped rows and keeps
@@ -149,7 +351,30 @@ func (ss *sortAllStrategy) executeImpl(
 // and the heap will be fixed. If not, the new value is dropped. When finished,
 // the max heap is converted to a min-heap effectively sorting the values
 // correctly in-place. It has a worst-case time complexity of O(n*log(k)) and a
-// worst-case space complexity of O(k).
+// worst-case space complexity of O(k). If the sorter has an offset, the rows
+// before it are never emitted: only the last k-offset rows are sorted, by
+// draining the max-heap, and the rest are discarded.
+//
+// If the k rows don't fit in memory and useTempStorage is set, the strategy
+// falls back to storing rows on disk. In that case, rows are only written to
+// disk if they can still be among the smallest k rows; see executeOnDisk.
+//
+// Rows that are wide compared to their ordering are kept narrow while they are
+// in memory; see narrowTopKRows.
+//
+// The strategy is also used when the input is ordered on a prefix of the
+// ordering if the spec prefers it (see SorterSpec.PreferTopK). In that case,
+// once k rows are buffered in memory, the input is only read until a row with
+// a greater prefix than the k-th row comes up: neither it nor the following
+// rows can be among the smallest k rows.
+//
+// Like the sortAllStrategy, the strategy falls back to disk if the sorter is
+// asked to spill under memory pressure while it reads its input.
+//
+// The heap doesn't preserve the input order of equal rows, so a stable sorter
+// appends a sequence number to every row and uses it as a final tie-breaker
+// (see sorter.seqNums). This makes both the in-memory and the disk-backed
+// executions stable.
 //
 // The strategy is intended to be used when exactly k values need to be sorted,
 // where k is known before sorting begins.
@@ -160,163 +385,807 @@ func (ss *sortAllStrategy) executeImpl(
 // For instance, the top k can be found in linear time, and then this can be
 // sorted in linearithmic time.
 //
-// TODO(asubiotto): Use diskRowContainer for these other strategies.
+// TODO(asubiotto): Use diskRowContainer for the sortChunksStrategy.
 type sortTopKStrategy struct {
-	rows memRowContainer
-	k    int64
+	rows           *memRowContainer
+	k              int64
+	useTempStorage bool
+	alloc          sqlbase.DatumAlloc
 }
 
 var _ sorterStrategy = &sortTopKStrategy{}
 
-func newSortTopKStrategy(rows memRowContainer, k int64) sorterStrategy {
+func newSortTopKStrategy(rows *memRowContainer, k int64, useTempStorage bool) sorterStrategy {
 	ss := &sortTopKStrategy{
-		rows: rows,
-		k:    k,
+		rows:           rows,
+		k:              k,
+		useTempStorage: useTempStorage,
 	}
 
 	return ss
 }
 
+// topKRowContainer is the container in which the sortTopKStrategy keeps the
+// rows that it buffers in memory. It is implemented by memRowContainer and
+// narrowTopKRows.
+type topKRowContainer interface {
+	Len() int
+	AddRow(ctx context.Context, row sqlbase.EncDatumRow) error
+	InitMaxHeap()
+	MaybeReplaceMax(ctx context.Context, row sqlbase.EncDatumRow) error
+	Sort()
+	SortLargest(n int)
+	PopFirst()
+	EncRow(idx int) sqlbase.EncDatumRow
+}
+
+var _ topKRowContainer = &memRowContainer{}
+var _ topKRowContainer = &narrowTopKRows{}
+
+// Execute runs an in memory implementation of the top k sort. If this run
+// fails with a memory error, the strategy will fall back to use disk.
+func (ss *sortTopKStrategy) Execute(ctx context.Context, s *sorter) error {
+	var rows topKRowContainer = ss.rows
+	narrow := makeNarrowTopKRows(ss.rows)
+	if narrow != nil {
+		defer narrow.Close(ctx)
+		rows = narrow
+	}
+	row, err := ss.executeInMemory(ctx, s, rows)
+	if err == nil {
+		return nil
+	}
+	if err == errSortSpillRequested {
+		log.Eventf(ctx, "spilling to disk on request")
+	} else if err := checkDiskFallback(
+		ctx, err, ss.useTempStorage, s, rows.Len(), row,
+	); err != nil {
+		return err
+	}
+	numRows := int64(rows.Len())
+	diskContainer, err := spillToDisk(ctx, s, ss.rows)
+	if err != nil {
+		return err
+	}
+	defer closeDiskContainer(ctx, s, &diskContainer)
+	if narrow != nil {
+		// The rows were kept narrow; they are moved to disk in full.
+		for i := 0; i < narrow.Len(); i++ {
+			if err := diskContainer.AddRow(ctx, narrow.EncRow(i)); err != nil {
+				return err
+			}
+		}
+		narrow.Close(ctx)
+	}
+	return ss.executeOnDisk(ctx, s, &diskContainer, numRows, row)
+}
+
 // The execution loop for the SortTopK strategy is similar to that of the
 // SortAll strategy; the difference is that we push rows into a max-heap of size
 // at most K, and only sort those.
-func (ss *sortTopKStrategy) Execute(ctx context.Context, s *sorter) error {
-	defer ss.rows.Close(ctx)
+//
+// If an error occurs while adding a row to the heap, the row is returned in
+// order to not lose it.
+func (ss *sortTopKStrategy) executeInMemory(
+	ctx context.Context, s *sorter, rows topKRowContainer,
+) (sqlbase.EncDatumRow, error) {
 	heapCreated := false
+	// lastAdded is the last row that was added to rows. Once k rows have been
+	// added, it is the k-th one.
+	var lastAdded sqlbase.EncDatumRow
 	for {
-		row, err := s.input.NextRow()
+		row, err := s.nextRow(ctx)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if row == nil {
 			break
 		}
+		if s.stats.inputRows%cancelCheckInterval == 0 && s.spillRequested() {
+			return row, errSortSpillRequested
+		}
 
-		if int64(ss.rows.Len()) < ss.k {
+		if int64(rows.Len()) < ss.k {
 			// Accumulate up to k values.
-			if err := ss.rows.AddRow(ctx, row); err != nil {
-				return err
+			if err := s.checkMaxRows(int64(rows.Len()) + 1); err != nil {
+				return nil, err
+			}
+			if err := rows.AddRow(ctx, row); err != nil {
+				return row, err
 			}
+			lastAdded = row
 		} else {
+			if s.matchLen > 0 {
+				// The input is ordered on the first matchLen ordering columns;
+				// if this row's prefix is greater than the k-th row's, all the
+				// rows that are left sort after the k rows already added.
+				cmp, err := row.Compare(
+					&ss.alloc, s.ordering[:s.matchLen], ss.rows.evalCtx, lastAdded,
+				)
+				if err != nil {
+					return nil, err
+				}
+				if cmp > 0 {
+					log.VEventf(ctx, 2, "top k rows found after reading %d rows", s.stats.inputRows)
+					break
+				}
+			}
 			if !heapCreated {
 				// Arrange the k values into a max-heap.
-				ss.rows.InitMaxHeap()
+				rows.InitMaxHeap()
 				heapCreated = true
 			}
 			// Replace the max value if the new row is smaller, maintaining the
 			// max-heap.
-			if err := ss.rows.MaybeReplaceMax(row); err != nil {
-				return err
+			if err := rows.MaybeReplaceMax(ctx, row); err != nil {
+				return row, err
 			}
 		}
 	}
 
-	ss.rows.Sort()
+	s.setPhase(sortPhaseSorting)
+	// The k rows include the ones that the procOutputHelper suppresses because
+	// of the offset. If possible, only the rows after the offset are sorted, by
+	// draining the max-heap, and the ones before it are discarded without being
+	// emitted.
+	if offset := int64(s.out.skipOffset()); offset > 0 {
+		if !heapCreated {
+			rows.InitMaxHeap()
+		}
+		numRows := int64(rows.Len())
+		if offset > numRows {
+			offset = numRows
+		}
+		rows.SortLargest(int(numRows - offset))
+		for i := int64(0); i < offset; i++ {
+			rows.PopFirst()
+		}
+	} else {
+		rows.Sort()
+	}
 
-	for ss.rows.Len() > 0 {
+	s.setPhase(sortPhaseOutputting)
+	for rows.Len() > 0 {
 		// Push the row to the output; stop if they don't need more rows.
-		consumerStatus, err := s.out.emitRow(ctx, ss.rows.EncRow(0))
+		consumerStatus, err := s.emitRow(ctx, rows.EncRow(0))
 		if err != nil || consumerStatus != NeedMoreRows {
-			return err
+			return nil, err
 		}
-		ss.rows.PopFirst()
+		rows.PopFirst()
 	}
-	return nil
+	return nil, nil
 }
 
-// If we're scanning an index with a prefix matching an ordering prefix, we only accumulate values
-// for equal fields in this prefix, sort the accumulated chunk and then output.
-type sortChunksStrategy struct {
-	rows  memRowContainer
-	alloc sqlbase.DatumAlloc
+// narrowTopKMinCols is the number of columns, besides the ordering columns,
+// from which the sortTopKStrategy keeps the rows it buffers in memory narrow.
+var narrowTopKMinCols = 4
+
+// narrowTopKRows is a topKRowContainer for rows that are wide compared to
+// their ordering. Only the ordering columns of each row, along with the index
+// of the row's other columns in a side store, go through the max-heap. The
+// other columns are stored value-encoded in the side store, which saves
+// decoding them for every row that replaces the maximum, keeps the swaps of
+// the heap cheap and takes less memory than their decoded datums. The rows are
+// only put back together by EncRow, when they are output.
+type narrowTopKRows struct {
+	// rows holds the ordering columns of each row, followed by the index of
+	// the row in values.
+	rows *memRowContainer
+	// types and ordering are those of the full rows.
+	types    []sqlbase.ColumnType
+	ordering sqlbase.ColumnOrdering
+	// valueIdxs are the indexes of the columns of the full rows that are not
+	// ordering columns.
+	valueIdxs []int
+	// values holds the encoded value columns of each row.
+	values [][]byte
+	// acc accounts for the memory used by values.
+	acc mon.BoundAccount
+
+	scratchNarrow sqlbase.EncDatumRow
+	scratchRow    sqlbase.EncDatumRow
+	scratchBuf    []byte
+	datumAlloc    sqlbase.DatumAlloc
 }
 
-var _ sorterStrategy = &sortChunksStrategy{}
+// makeNarrowTopKRows returns a narrowTopKRows for the rows of the given empty
+// container, which is not used. It returns nil if the rows are not wide enough
+// to be kept narrow. The returned container must be closed.
+func makeNarrowTopKRows(full *memRowContainer) *narrowTopKRows {
+	isOrderingCol := make([]bool, len(full.types))
+	for _, c := range full.ordering {
+		isOrderingCol[c.ColIdx] = true
+	}
+	var valueIdxs []int
+	for i := range full.types {
+		if !isOrderingCol[i] {
+			valueIdxs = append(valueIdxs, i)
+		}
+	}
+	if len(valueIdxs) < narrowTopKMinCols {
+		return nil
+	}
 
-func newSortChunksStrategy(rows memRowContainer) sorterStrategy {
-	return &sortChunksStrategy{
-		rows: rows,
+	// The narrow rows hold the ordering columns, in order, followed by the
+	// index of the value columns of the row.
+	types := make([]sqlbase.ColumnType, len(full.ordering)+1)
+	ordering := make(sqlbase.ColumnOrdering, len(full.ordering))
+	for i, c := range full.ordering {
+		types[i] = full.types[c.ColIdx]
+		ordering[i] = c
+		ordering[i].ColIdx = i
+	}
+	types[len(full.ordering)] = sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+
+	rows := getRowContainer(ordering, types, full.evalCtx)
+	rows.stable = full.stable
+	rows.comparators = makeComparators(ordering, types)
+	if full.keyCols > 0 {
+		rows.useKeys()
+	}
+	rows.comparisons = full.comparisons
+	return &narrowTopKRows{
+		rows:          rows,
+		types:         full.types,
+		ordering:      full.ordering,
+		valueIdxs:     valueIdxs,
+		acc:           full.evalCtx.Mon.MakeBoundAccount(),
+		scratchNarrow: make(sqlbase.EncDatumRow, len(types)),
+		scratchRow:    make(sqlbase.EncDatumRow, len(full.types)),
 	}
 }
 
-func (ss *sortChunksStrategy) Execute(ctx context.Context, s *sorter) error {
-	defer ss.rows.Close(ctx)
-	// pivoted is a helper function that determines if the given row shares the same values for the
-	// first s.matchLen ordering columns with the given pivot.
-	pivoted := func(row, pivot sqlbase.EncDatumRow) (bool, error) {
-		for _, ord := range s.ordering[:s.matchLen] {
-			cmp, err := row[ord.ColIdx].Compare(&ss.alloc, ss.rows.evalCtx, &pivot[ord.ColIdx])
-			if err != nil || cmp != 0 {
-				return false, err
-			}
+// idxCol is the column of the narrow rows that holds the index of their value
+// columns.
+func (n *narrowTopKRows) idxCol() int {
+	return len(n.ordering)
+}
+
+// narrowRow fills n.scratchNarrow with the ordering columns of the given row
+// and the given index.
+func (n *narrowTopKRows) narrowRow(row sqlbase.EncDatumRow, idx parser.Datum) sqlbase.EncDatumRow {
+	for i, c := range n.ordering {
+		n.scratchNarrow[i] = row[c.ColIdx]
+	}
+	n.scratchNarrow[n.idxCol()] = sqlbase.DatumToEncDatum(n.rows.types[n.idxCol()], idx)
+	return n.scratchNarrow
+}
+
+// encodeValues appends the encoding of the value columns of row to buf.
+func (n *narrowTopKRows) encodeValues(buf []byte, row sqlbase.EncDatumRow) ([]byte, error) {
+	for _, i := range n.valueIdxs {
+		var err error
+		buf, err = row[i].Encode(&n.datumAlloc, sqlbase.DatumEncoding_VALUE, buf)
+		if err != nil {
+			return nil, err
 		}
-		return true, nil
 	}
+	return buf, nil
+}
+
+// Len is part of the topKRowContainer interface.
+func (n *narrowTopKRows) Len() int {
+	return n.rows.Len()
+}
 
-	nextRow, err := s.input.NextRow()
-	if err != nil || nextRow == nil {
+// AddRow is part of the topKRowContainer interface.
+func (n *narrowTopKRows) AddRow(ctx context.Context, row sqlbase.EncDatumRow) error {
+	buf, err := n.encodeValues(nil, row)
+	if err != nil {
+		return err
+	}
+	if err := n.acc.Grow(ctx, int64(len(buf))); err != nil {
 		return err
 	}
+	idx := n.datumAlloc.NewDInt(parser.DInt(len(n.values)))
+	n.values = append(n.values, buf)
+	return n.rows.AddRow(ctx, n.narrowRow(row, idx))
+}
 
-	for {
-		pivot := nextRow
+// InitMaxHeap is part of the topKRowContainer interface.
+func (n *narrowTopKRows) InitMaxHeap() {
+	n.rows.InitMaxHeap()
+}
 
-		// We will accumulate rows to form a chunk such that they all share the same values
-		// for the first s.matchLen ordering columns.
-		for {
-			if log.V(3) {
-				log.Infof(ctx, "pushing row %s", nextRow)
-			}
-			if err := ss.rows.AddRow(ctx, nextRow); err != nil {
-				return err
-			}
+// MaybeReplaceMax is part of the topKRowContainer interface. The value columns
+// of the maximum row are overwritten with those of the given row.
+func (n *narrowTopKRows) MaybeReplaceMax(ctx context.Context, row sqlbase.EncDatumRow) error {
+	max := n.rows.At(0)
+	narrow := n.narrowRow(row, max[n.idxCol()])
+	cmp, err := n.rows.compareEncRow(narrow, 0 /* idx */)
+	if err != nil || cmp >= 0 {
+		return err
+	}
+	idx := int(*max[n.idxCol()].(*parser.DInt))
+	if n.scratchBuf, err = n.encodeValues(n.scratchBuf[:0], row); err != nil {
+		return err
+	}
+	// The container is left as is if the new values can't be accounted for, so
+	// that its rows can still be spilled to disk.
+	if err := n.acc.ResizeItem(
+		ctx, int64(len(n.values[idx])), int64(len(n.scratchBuf)),
+	); err != nil {
+		return err
+	}
+	n.values[idx] = append(n.values[idx][:0], n.scratchBuf...)
+	return n.rows.replaceMax(ctx, narrow)
+}
+
+// Sort is part of the topKRowContainer interface.
+func (n *narrowTopKRows) Sort() {
+	n.rows.Sort()
+}
+
+// SortLargest is part of the topKRowContainer interface.
+func (n *narrowTopKRows) SortLargest(k int) {
+	n.rows.SortLargest(k)
+}
+
+// PopFirst is part of the topKRowContainer interface.
+func (n *narrowTopKRows) PopFirst() {
+	n.rows.PopFirst()
+}
+
+// EncRow is part of the topKRowContainer interface. It puts the row at the
+// given index back together. The returned row is only valid until the next
+// call to EncRow.
+func (n *narrowTopKRows) EncRow(i int) sqlbase.EncDatumRow {
+	narrow := n.rows.EncRow(i)
+	for j, c := range n.ordering {
+		n.scratchRow[c.ColIdx] = narrow[j]
+	}
+	v := n.values[int(*narrow[n.idxCol()].Datum.(*parser.DInt))]
+	for _, j := range n.valueIdxs {
+		var err error
+		n.scratchRow[j], v, err = sqlbase.EncDatumFromBuffer(n.types[j], sqlbase.DatumEncoding_VALUE, v)
+		if err != nil {
+			// The values were encoded by encodeValues.
+			panic(fmt.Sprintf("unable to decode the values of row %d: %s", i, err))
+		}
+	}
+	return n.scratchRow
+}
+
+// Close releases the rows and their memory. It can be called more than once.
+func (n *narrowTopKRows) Close(ctx context.Context) {
+	if n.rows != nil {
+		putRowContainer(ctx, n.rows)
+		n.rows = nil
+		n.acc.Close(ctx)
+	}
+	n.values = nil
+}
 
-			nextRow, err = s.input.NextRow()
+// executeOnDisk continues the execution of the SortTopK strategy once the rows
+// have been spilled to the given diskRowContainer, which already contains
+// numRows rows. row is the row that could not be added in memory.
+//
+// Since rows can't be removed from the container, the strategy keeps track of
+// an upper bound instead: once k rows have been added, the k-th smallest row
+// on disk is read back and any subsequent row that isn't smaller than it is
+// dropped. The bound is refreshed every k added rows so that the number of
+// rows stored on disk stays proportional to k in practice. Once the input is
+// exhausted, the first k rows on disk are output.
+func (ss *sortTopKStrategy) executeOnDisk(
+	ctx context.Context,
+	s *sorter,
+	d *diskRowContainer,
+	numRows int64,
+	row sqlbase.EncDatumRow,
+) error {
+	var alloc sqlbase.DatumAlloc
+	// bound is the k-th smallest row stored on disk, or nil if fewer than k
+	// rows have been stored.
+	var bound parser.Datums
+	// added is the number of rows added since bound was last computed.
+	added := numRows
+	// stored is the number of rows stored on disk.
+	stored := numRows
+	for row != nil {
+		keep := true
+		if bound != nil {
+			if s.testingKnobCountComparisons {
+				s.stats.diskComparisons++
+			}
+			cmp, err := row.CompareToDatums(&alloc, ss.rows.ordering, ss.rows.evalCtx, bound)
 			if err != nil {
 				return err
 			}
-			if nextRow == nil {
-				break
+			keep = cmp < 0
+		}
+		if keep {
+			if err := s.checkMaxRows(stored + 1); err != nil {
+				return err
 			}
-
-			p, err := pivoted(nextRow, pivot)
-			if err != nil {
+			if err := d.AddRow(ctx, row); err != nil {
 				return err
 			}
-			if p {
-				continue
+			stored++
+			added++
+			if added >= ss.k {
+				var err error
+				if bound, err = ss.kthRow(ctx, d, &alloc); err != nil {
+					return err
+				}
+				added = 0
 			}
+		}
+		var err error
+		if row, err = s.nextRow(ctx); err != nil {
+			return err
+		}
+	}
 
-			// We verify if the nextRow here is infact 'greater' than pivot.
-			if cmp, err := nextRow.Compare(&ss.alloc, s.ordering, ss.rows.evalCtx, pivot); err != nil {
-				return err
-			} else if cmp < 0 {
-				return errors.Errorf("incorrectly ordered row %s before %s", pivot, nextRow)
-			}
+	s.setPhase(sortPhaseOutputting)
+	i, err := d.NewIterator(ctx)
+	if err != nil {
+		return err
+	}
+	defer i.Close()
+	emitted := int64(0)
+	for i.Rewind(); emitted < ss.k; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+		row, err := i.Row()
+		if err != nil {
+			return err
+		}
+		consumerStatus, err := s.emitRow(ctx, row)
+		if err != nil || consumerStatus != NeedMoreRows {
+			return err
+		}
+		emitted++
+	}
+	return nil
+}
+
+// kthRow returns the ordering columns of the k-th smallest row stored in the
+// given diskRowContainer, which must have at least k rows. The other columns
+// of the returned row are not set.
+func (ss *sortTopKStrategy) kthRow(
+	ctx context.Context, d *diskRowContainer, alloc *sqlbase.DatumAlloc,
+) (parser.Datums, error) {
+	i, err := d.NewIterator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer i.Close()
+	n := int64(1)
+	for i.Rewind(); ; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, errors.Errorf("fewer than %d rows stored on disk", ss.k)
+		}
+		if n == ss.k {
 			break
 		}
+		n++
+	}
+	row, err := i.Row()
+	if err != nil {
+		return nil, err
+	}
+	bound := make(parser.Datums, len(row))
+	for _, c := range ss.rows.ordering {
+		if err := row[c.ColIdx].EnsureDecoded(alloc); err != nil {
+			return nil, err
+		}
+		bound[c.ColIdx] = row[c.ColIdx].Datum
+	}
+	return bound, nil
+}
 
-		// Sort the rows that have been pushed onto the buffer.
-		ss.rows.Sort()
+// If we're scanning an index with a prefix matching an ordering prefix, we only accumulate values
+// for equal fields in this prefix, sort the accumulated chunk and then output.
+//
+// The rows of a chunk are pushed to the output as soon as the chunk is
+// complete, which is known once the first row of the next chunk is read; no
+// more input is read before they are all pushed, and neither the strategy nor
+// the procOutputHelper holds them back. Rows can't be output before their chunk
+// is complete, since any of its remaining rows could sort before them.
+//
+// The chunks are accumulated and sorted by a chunkSorter (see there for how
+// only the first k rows are kept when the sorter only needs to output them, in
+// which case the strategy stops consuming the input as soon as k rows have
+// been output).
+//
+// The input is only read ahead of the output if the sorter prefetches it (see
+// sorterPrefetch), in which case at most rowChannelBufSize rows are read while
+// the strategy is busy sorting or pushing rows: the prefetcher stops pulling
+// from the input while its buffer is full, and once the context is canceled.
+//
+// If the sorter is stable, chunks are sorted with sort.Stable. When k is
+// specified, the heap relies on the sequence numbers appended by the sorter
+// instead (see sorter.seqNums).
+//
+// Chunks that take up less than minChunkSize bytes are sorted together with the
+// following ones (see sorterMinChunkSize).
+//
+// If the spec hints that the ordering columns after the prefix are of low
+// cardinality (see SorterSpec.LowCardinalityChunkColumns), the chunks are
+// bucketed on the values of these columns instead of being sorted, when they
+// have few enough distinct values (see chunkSorter.lowCardinality).
+//
+// The rows suppressed by the offset of the sorter's post-processing stage are
+// discarded by the chunkSorter rather than emitted, if possible, so that the
+// chunks made only of such rows are not sorted (see chunkSorter.skip). This
+// is not possible with an aggregation or DISTINCT, for which the offset
+// applies to the rows they output rather than to the sorted rows.
+type sortChunksStrategy struct {
+	chunks chunkSorter
+}
+
+var _ sorterStrategy = &sortChunksStrategy{}
 
+func newSortChunksStrategy(
+	rows *memRowContainer,
+	ordering sqlbase.ColumnOrdering,
+	matchLen uint32,
+	k int64,
+	minChunkSize int64,
+	lowCardinality bool,
+) sorterStrategy {
+	return &sortChunksStrategy{
+		chunks: chunkSorter{
+			rows:           rows,
+			ordering:       ordering,
+			matchLen:       matchLen,
+			k:              k,
+			minChunkSize:   minChunkSize,
+			lowCardinality: lowCardinality,
+		},
+	}
+}
+
+func (ss *sortChunksStrategy) Execute(ctx context.Context, s *sorter) error {
+	ss.chunks.checkMaxRows = s.checkMaxRows
+	ss.chunks.skip = 0
+	if s.agg == nil && s.distinctOrdering == nil {
+		ss.chunks.skip = int64(s.out.skipOffset())
+	}
+	return ss.chunks.run(ctx, s, func(ctx context.Context, chunk *memRowContainer) (ConsumerStatus, error) {
+		s.stats.sortedChunks++
+		if s.phase != sortPhaseOutputting {
+			s.setPhase(sortPhaseOutputting)
+		}
 		// Stream out sorted rows in order to row receiver.
-		for ss.rows.Len() > 0 {
-			consumerStatus, err := s.out.emitRow(ctx, ss.rows.EncRow(0))
+		for chunk.Len() > 0 {
+			consumerStatus, err := s.emitRow(ctx, chunk.EncRow(0))
 			if err != nil || consumerStatus != NeedMoreRows {
-				// We don't need any more rows; clear out ss so to not hold on to that
-				// memory.
-				ss = &sortChunksStrategy{}
-				return err
+				return consumerStatus, err
 			}
-			ss.rows.PopFirst()
+			chunk.PopFirst()
 		}
-		ss.rows.Clear(ctx)
+		// Don't hold back the rows of the chunk while the next one is read.
+		return s.flushOutput(), nil
+	})
+}
 
-		if nextRow == nil {
-			// We've reached the end of the table.
-			break
+// sortRunsStrategy is used when the input consists of runs of rows that are
+// each already sorted (see SorterSpec.InputRunBoundaries). All the rows are
+// buffered, like with the sortAllStrategy, but they are then only merged: a heap
+// holds the next row of each run, and the smallest of them is output and
+// replaced with the following row of its run. It has a worst-case time
+// complexity of O(n*log(r)), for r runs, and a worst-case space complexity of
+// O(n).
+//
+// This generalizes the sortChunksStrategy, whose chunks can be thought of as
+// runs that don't overlap and are thus merged by outputting them one after
+// the other. Runs can overlap, so none of their rows can be output before the
+// whole input is read.
+//
+// Every row is compared to the previous row of its run as it is read, and an
+// error is returned if the run turns out not to be sorted. Rows that are equal
+// according to the ordering are merged in the order of their runs, so the
+// merge is stable.
+//
+// Like the sortAllStrategy, the strategy falls back to disk if the rows don't
+// fit in memory and useTempStorage is set, or if the sorter is asked to spill.
+// The rows on disk are kept sorted, so there is nothing left to merge then.
+type sortRunsStrategy struct {
+	rows           *memRowContainer
+	useTempStorage bool
+	alloc          sqlbase.DatumAlloc
+
+	// The fields below are maintained while the input is read, which carries
+	// on after falling back to disk.
+
+	// boundaries are the indexes of the input rows that start the runs that
+	// haven't been read yet.
+	boundaries []uint64
+	// runStarts are the indexes, in rows, of the first row of each run read so
+	// far.
+	runStarts []int
+	// numRows is the number of input rows read so far, and prevRow the last of
+	// them.
+	numRows uint64
+	prevRow sqlbase.EncDatumRow
+}
+
+var _ sorterStrategy = &sortRunsStrategy{}
+
+func newSortRunsStrategy(
+	rows *memRowContainer, boundaries []uint64, useTempStorage bool,
+) sorterStrategy {
+	return &sortRunsStrategy{
+		rows:           rows,
+		boundaries:     boundaries,
+		useTempStorage: useTempStorage,
+	}
+}
+
+// Execute reads the runs into memory and merges them. If the rows don't fit in
+// memory, the strategy will fall back to use disk.
+func (ss *sortRunsStrategy) Execute(ctx context.Context, s *sorter) error {
+	row, err := ss.readRuns(ctx, s, ss.rows, true /* spillOnRequest */)
+	if err == nil {
+		return ss.mergeRuns(ctx, s)
+	}
+	if err == errSortSpillRequested {
+		log.Eventf(ctx, "spilling to disk on request")
+	} else if err := checkDiskFallback(
+		ctx, err, ss.useTempStorage, s, ss.rows.Len(), row,
+	); err != nil {
+		return err
+	}
+	diskContainer, err := spillToDisk(ctx, s, ss.rows)
+	if err != nil {
+		return err
+	}
+	defer closeDiskContainer(ctx, s, &diskContainer)
+	if row != nil {
+		// Add the row that caused the memory container to run out of memory.
+		if err := diskContainer.AddRow(ctx, row); err != nil {
+			return err
+		}
+	}
+	if _, err := ss.readRuns(ctx, s, &diskContainer, false /* spillOnRequest */); err != nil {
+		return err
+	}
+	return emitSortedRows(ctx, s, &diskContainer)
+}
+
+// readRuns adds the rest of the input rows to r, keeping track of the runs. If
+// an error occurs while adding a row to r, the row is returned in order to not
+// lose it. If spillOnRequest is set and the sorter is asked to spill,
+// errSortSpillRequested is returned; all the rows read so far are in r.
+func (ss *sortRunsStrategy) readRuns(
+	ctx context.Context, s *sorter, r sortableRowContainer, spillOnRequest bool,
+) (sqlbase.EncDatumRow, error) {
+	for n := 0; ; n++ {
+		if spillOnRequest && n > 0 && n%cancelCheckInterval == 0 && s.spillRequested() {
+			return nil, errSortSpillRequested
+		}
+		row, err := s.nextRow(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			return nil, nil
+		}
+		if len(ss.boundaries) > 0 && ss.boundaries[0] == ss.numRows {
+			ss.boundaries = ss.boundaries[1:]
+			if ss.numRows > 0 {
+				ss.runStarts = append(ss.runStarts, int(ss.numRows))
+			}
+		} else if ss.prevRow != nil {
+			cmp, err := row.Compare(&ss.alloc, s.ordering, ss.rows.evalCtx, ss.prevRow)
+			if err != nil {
+				return nil, err
+			}
+			if cmp < 0 {
+				return nil, errors.Errorf(
+					"input run %d is not sorted: row %s is after %s", len(ss.runStarts), row, ss.prevRow,
+				)
+			}
+		}
+		ss.numRows++
+		ss.prevRow = row
+		// All the rows read so far are buffered.
+		if err := s.checkMaxRows(s.stats.inputRows); err != nil {
+			return nil, err
+		}
+		if err := r.AddRow(ctx, row); err != nil {
+			return row, err
+		}
+	}
+}
+
+// mergeRuns outputs the rows of the runs read into memory in sorted order, until
+// the consumer doesn't need more rows.
+func (ss *sortRunsStrategy) mergeRuns(ctx context.Context, s *sorter) error {
+	h := runHeap{rows: ss.rows, runs: make([]runCursor, 0, len(ss.runStarts)+1)}
+	start := 0
+	for _, end := range append(ss.runStarts, ss.rows.Len()) {
+		if end > start {
+			h.runs = append(h.runs, runCursor{next: start, end: end})
+		}
+		start = end
+	}
+	s.setPhase(sortPhaseMerging)
+	heap.Init(&h)
+	for h.Len() > 0 {
+		run := &h.runs[0]
+		consumerStatus, err := s.emitRow(ctx, ss.rows.EncRow(run.next))
+		if err != nil || consumerStatus != NeedMoreRows {
+			return err
+		}
+		if run.next++; run.next < run.end {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
 		}
 	}
+	return nil
+}
+
+// runCursor is the position of the next row of a run to be merged by the
+// sortRunsStrategy, in its rows. end is the index past the last row of the run.
+type runCursor struct {
+	next, end int
+}
+
+// runHeap is a min-heap of the runs that have rows left to be merged, ordered
+// on their next row.
+type runHeap struct {
+	rows *memRowContainer
+	runs []runCursor
+}
+
+var _ heap.Interface = &runHeap{}
 
+func (h *runHeap) Len() int { return len(h.runs) }
+
+func (h *runHeap) Less(i, j int) bool {
+	ri, rj := h.runs[i].next, h.runs[j].next
+	// The runs don't overlap in rows, so the run whose next row was read
+	// first is the earlier one, and its row comes first if they are equal.
+	if ri < rj {
+		return !h.rows.Less(rj, ri)
+	}
+	return h.rows.Less(ri, rj)
+}
+
+func (h *runHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(runCursor)) }
+
+func (h *runHeap) Pop() interface{} {
+	x := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return x
+}
+
+// passThroughStrategy is used when the input is already sorted according to
+// the full ordering (i.e. the ordering match length is the length of the
+// ordering). The rows are passed through to the sorter's post-processing stage
+// without being buffered. If k is specified, the strategy stops consuming the
+// input once k rows have been output.
+type passThroughStrategy struct {
+	k int64
+}
+
+var _ sorterStrategy = &passThroughStrategy{}
+
+func newPassThroughStrategy(k int64) sorterStrategy {
+	return &passThroughStrategy{k: k}
+}
+
+func (ss *passThroughStrategy) Execute(ctx context.Context, s *sorter) error {
+	s.setPhase(sortPhaseOutputting)
+	for emitted := int64(0); ss.k == 0 || emitted < ss.k; emitted++ {
+		row, err := s.nextRow(ctx)
+		if err != nil || row == nil {
+			return err
+		}
+		consumerStatus, err := s.emitRow(ctx, row)
+		if err != nil || consumerStatus != NeedMoreRows {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,173 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+)
+
+// sortingRowSource is a RowSource that sorts the rows of its input. It can be
+// used to plug a sorter into a pull-based consumer without setting up a flow.
+//
+// Nothing is read from the input until the first call to Next, which runs the
+// sorter (with the same strategy selection and memory monitoring as a sorter
+// processor) to completion. The sorted rows, as well as the metadata, are
+// buffered and then returned by Next; the memory taken up by the buffered rows
+// is accounted for by the flow's monitor and released as they are returned.
+//
+// The sortingRowSource is the RowReceiver to which its sorter pushes its
+// output; it is not meant to be used as a RowReceiver otherwise.
+type sortingRowSource struct {
+	ctx    context.Context
+	sorter *sorter
+	types  []sqlbase.ColumnType
+
+	// started is set once the sorter has run (or once the input has been closed
+	// without running the sorter).
+	started bool
+	// consumerStatus is returned to the sorter by Push.
+	consumerStatus ConsumerStatus
+	// records are the buffered rows and metadata, in the order in which they
+	// were pushed by the sorter.
+	records []BufferedRecord
+
+	// acc accounts for the rows in records.
+	acc       mon.BoundAccount
+	accClosed bool
+}
+
+var _ RowSource = &sortingRowSource{}
+var _ RowReceiver = &sortingRowSource{}
+
+// NewSortingRowSource returns a RowSource that sorts the rows of the given
+// input according to the spec and applies the post-processing spec to them.
+// The input is only read once the rows are pulled from the returned RowSource.
+func NewSortingRowSource(
+	ctx context.Context,
+	flowCtx *FlowCtx,
+	spec *SorterSpec,
+	input RowSource,
+	post *PostProcessSpec,
+) (RowSource, error) {
+	rs := &sortingRowSource{
+		ctx: ctx,
+		acc: flowCtx.evalCtx.Mon.MakeBoundAccount(),
+	}
+	s, err := newSorter(flowCtx, spec, input, post, rs)
+	if err != nil {
+		return nil, err
+	}
+	rs.sorter = s
+	rs.types = s.out.outputTypes
+	return rs, nil
+}
+
+// Push is part of the RowReceiver interface.
+func (rs *sortingRowSource) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) ConsumerStatus {
+	switch rs.consumerStatus {
+	case ConsumerClosed:
+		return rs.consumerStatus
+	case DrainRequested:
+		if meta.Empty() {
+			return rs.consumerStatus
+		}
+	}
+	if row != nil {
+		// The sorter reuses its rows, so they need to be copied.
+		row = append(sqlbase.EncDatumRow(nil), row...)
+		if err := rs.acc.Grow(rs.ctx, int64(row.Size())); err != nil {
+			// Return the error to the consumer and only accept metadata from now
+			// on.
+			rs.records = append(rs.records, BufferedRecord{Meta: ProducerMetadata{Err: err}})
+			rs.consumerStatus = DrainRequested
+			return rs.consumerStatus
+		}
+	}
+	rs.records = append(rs.records, BufferedRecord{Row: row, Meta: meta})
+	return rs.consumerStatus
+}
+
+// ProducerDone is part of the RowReceiver interface.
+func (rs *sortingRowSource) ProducerDone() {}
+
+// Types is part of the RowSource interface.
+func (rs *sortingRowSource) Types() []sqlbase.ColumnType {
+	return rs.types
+}
+
+// Next is part of the RowSource interface.
+func (rs *sortingRowSource) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	if !rs.started {
+		rs.started = true
+		rs.sorter.Run(rs.ctx, nil /* wg */)
+	}
+	if len(rs.records) == 0 {
+		rs.closeAcc()
+		return nil, ProducerMetadata{}
+	}
+	rec := rs.records[0]
+	rs.records[0] = BufferedRecord{}
+	rs.records = rs.records[1:]
+	if rec.Row != nil {
+		rs.acc.Shrink(rs.ctx, int64(rec.Row.Size()))
+	}
+	return rec.Row, rec.Meta
+}
+
+// ConsumerDone is part of the RowSource interface.
+func (rs *sortingRowSource) ConsumerDone() {
+	if rs.consumerStatus == ConsumerClosed {
+		return
+	}
+	rs.consumerStatus = DrainRequested
+	if !rs.started {
+		// The sorter will only forward the input's metadata once it's run.
+		return
+	}
+	// Discard the buffered rows but keep the metadata.
+	records := rs.records[:0]
+	for _, rec := range rs.records {
+		if rec.Row != nil {
+			rs.acc.Shrink(rs.ctx, int64(rec.Row.Size()))
+			continue
+		}
+		records = append(records, rec)
+	}
+	rs.records = records
+}
+
+// ConsumerClosed is part of the RowSource interface.
+func (rs *sortingRowSource) ConsumerClosed() {
+	if rs.consumerStatus == ConsumerClosed {
+		return
+	}
+	rs.consumerStatus = ConsumerClosed
+	if !rs.started {
+		rs.started = true
+		rs.sorter.rawInput.ConsumerClosed()
+	}
+	rs.records = nil
+	rs.closeAcc()
+}
+
+func (rs *sortingRowSource) closeAcc() {
+	if !rs.accClosed {
+		rs.acc.Close(rs.ctx)
+		rs.accClosed = true
+	}
+}
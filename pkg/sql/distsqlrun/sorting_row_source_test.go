@@ -0,0 +1,149 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestSortingRowSource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	v := [6]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i)))
+	}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	input := sqlbase.EncDatumRows{
+		{v[3], v[0]},
+		{v[1], v[1]},
+		{v[5], v[2]},
+		{v[0], v[3]},
+		{v[4], v[4]},
+		{v[2], v[5]},
+	}
+	spec := SorterSpec{
+		OutputOrdering: convertToSpecOrdering(sqlbase.ColumnOrdering{
+			{ColIdx: 0, Direction: encoding.Ascending},
+		}),
+	}
+
+	testCases := []struct {
+		name     string
+		post     PostProcessSpec
+		expected sqlbase.EncDatumRows
+	}{
+		{
+			name: "All",
+			expected: sqlbase.EncDatumRows{
+				{v[0], v[3]},
+				{v[1], v[1]},
+				{v[2], v[5]},
+				{v[3], v[0]},
+				{v[4], v[4]},
+				{v[5], v[2]},
+			},
+		},
+		{
+			name: "LimitProjection",
+			post: PostProcessSpec{
+				Limit: 3, Offset: 1, Projection: true, OutputColumns: []uint32{1},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[1]},
+				{v[5]},
+				{v[0]},
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			in := NewRowBuffer(types, input, RowBufferArgs{})
+			// The metadata of the input is forwarded.
+			in.Push(nil /* row */, ProducerMetadata{Ranges: []roachpb.RangeInfo{{}}})
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{evalCtx: evalCtx}
+
+			rs, err := NewSortingRowSource(ctx, &flowCtx, &spec, in, &c.post)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rs.Types()) != len(c.expected[0]) {
+				t.Fatalf("expected %d columns, got %d", len(c.expected[0]), len(rs.Types()))
+			}
+			if in.Done {
+				t.Fatal("input read before Next was called")
+			}
+
+			var rows sqlbase.EncDatumRows
+			numMeta := 0
+			for {
+				row, meta := rs.Next()
+				if !meta.Empty() {
+					if meta.Err != nil {
+						t.Fatal(meta.Err)
+					}
+					numMeta++
+					continue
+				}
+				if row == nil {
+					break
+				}
+				rows = append(rows, row)
+			}
+			if numMeta != 1 {
+				t.Errorf("expected 1 metadata record, got %d", numMeta)
+			}
+			if expStr, retStr := c.expected.String(), rows.String(); expStr != retStr {
+				t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s", expStr, retStr)
+			}
+			if n := evalCtx.Mon.GetCurrentAllocationForTesting(); n != 0 {
+				t.Errorf("expected all memory to be released, %d bytes still allocated", n)
+			}
+		})
+	}
+
+	t.Run("ConsumerClosed", func(t *testing.T) {
+		ctx := context.Background()
+		in := NewRowBuffer(types, input, RowBufferArgs{})
+		evalCtx := parser.MakeTestingEvalContext()
+		defer evalCtx.Stop(ctx)
+		flowCtx := FlowCtx{evalCtx: evalCtx}
+
+		rs, err := NewSortingRowSource(ctx, &flowCtx, &spec, in, &PostProcessSpec{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.ConsumerClosed()
+		if in.ConsumerStatus != ConsumerClosed {
+			t.Fatalf("expected the input to be closed, got status %d", in.ConsumerStatus)
+		}
+		if row, meta := rs.Next(); row != nil || !meta.Empty() {
+			t.Fatalf("expected no records after ConsumerClosed, got %s %+v", row, meta)
+		}
+	})
+}
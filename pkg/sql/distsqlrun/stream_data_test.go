@@ -19,6 +19,7 @@ package distsqlrun
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -143,3 +144,82 @@ func TestEmptyStreamEncodeDecode(t *testing.T) {
 		t.Errorf("received bogus row %v %v", row, meta)
 	}
 }
+
+func TestStreamEncodeDecodeSorterStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	var se StreamEncoder
+	var sd StreamDecoder
+	stats := RemoteProducerMetadata_SorterStats{
+		Strategy:        string(sortAllStrategyName),
+		InputRows:       10,
+		OutputRows:      5,
+		MaxAllocatedMem: 1 << 10,
+		SpilledBytes:    1 << 20,
+		OutputWaitNanos: 1e6,
+		RowSizeCounts:   []int64{0, 0, 0, 0, 0, 0, 3, 7},
+		FirstRowNanos:   2e6,
+		CountOverflow:   true,
+	}
+	se.AddMetadata(ProducerMetadata{SorterStats: &stats})
+	if err := sd.AddMessage(se.FormMessage(context.TODO())); err != nil {
+		t.Fatal(err)
+	}
+	row, meta, err := sd.GetRow(nil /* rowBuf */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row != nil || meta.SorterStats == nil {
+		t.Fatalf("expected sorter stats, got %v %v", row, meta)
+	}
+	if !reflect.DeepEqual(*meta.SorterStats, stats) {
+		t.Errorf("expected %v, got %v", stats, *meta.SorterStats)
+	}
+}
+
+func TestStreamEncodeDecodeSorterProgress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	var se StreamEncoder
+	var sd StreamDecoder
+	progress := RemoteProducerMetadata_SorterProgress{
+		Phase:              string(sortPhaseAccumulating),
+		InputRows:          1 << 10,
+		EstimatedInputRows: 1 << 12,
+		InputPercent:       25,
+		SpilledToDisk:      true,
+	}
+	se.AddMetadata(ProducerMetadata{SorterProgress: &progress})
+	if err := sd.AddMessage(se.FormMessage(context.TODO())); err != nil {
+		t.Fatal(err)
+	}
+	row, meta, err := sd.GetRow(nil /* rowBuf */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row != nil || meta.SorterProgress == nil {
+		t.Fatalf("expected sorter progress, got %v %v", row, meta)
+	}
+	if !reflect.DeepEqual(*meta.SorterProgress, progress) {
+		t.Errorf("expected %v, got %v", progress, *meta.SorterProgress)
+	}
+}
+
+func TestStreamEncodeDecodeSorterPartialResult(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	var se StreamEncoder
+	var sd StreamDecoder
+	partial := RemoteProducerMetadata_SorterPartialResult{InputRows: 1 << 10}
+	se.AddMetadata(ProducerMetadata{SorterPartialResult: &partial})
+	if err := sd.AddMessage(se.FormMessage(context.TODO())); err != nil {
+		t.Fatal(err)
+	}
+	row, meta, err := sd.GetRow(nil /* rowBuf */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row != nil || meta.SorterPartialResult == nil {
+		t.Fatalf("expected a sorter partial result, got %v %v", row, meta)
+	}
+	if !reflect.DeepEqual(*meta.SorterPartialResult, partial) {
+		t.Errorf("expected %v, got %v", partial, *meta.SorterPartialResult)
+	}
+}
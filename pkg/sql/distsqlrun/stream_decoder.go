@@ -110,6 +110,15 @@ func (sd *StreamDecoder) AddMessage(msg *ProducerMessage) error {
 			case *RemoteProducerMetadata_TraceData_:
 				meta.TraceData = v.TraceData.CollectedSpans
 
+			case *RemoteProducerMetadata_SorterStats_:
+				meta.SorterStats = v.SorterStats
+
+			case *RemoteProducerMetadata_SorterProgress_:
+				meta.SorterProgress = v.SorterProgress
+
+			case *RemoteProducerMetadata_SorterPartialResult_:
+				meta.SorterPartialResult = v.SorterPartialResult
+
 			case *RemoteProducerMetadata_Error:
 				meta.Err = v.Error.ErrorDetail()
 
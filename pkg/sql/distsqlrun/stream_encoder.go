@@ -88,6 +88,18 @@ func (se *StreamEncoder) AddMetadata(meta ProducerMetadata) {
 				CollectedSpans: meta.TraceData,
 			},
 		}
+	} else if meta.SorterStats != nil {
+		enc.Value = &RemoteProducerMetadata_SorterStats_{
+			SorterStats: meta.SorterStats,
+		}
+	} else if meta.SorterProgress != nil {
+		enc.Value = &RemoteProducerMetadata_SorterProgress_{
+			SorterProgress: meta.SorterProgress,
+		}
+	} else if meta.SorterPartialResult != nil {
+		enc.Value = &RemoteProducerMetadata_SorterPartialResult_{
+			SorterPartialResult: meta.SorterPartialResult,
+		}
 	} else {
 		enc.Value = &RemoteProducerMetadata_Error{
 			Error: NewError(meta.Err),
@@ -176,6 +176,10 @@ type Result struct {
 	// the result set of the result.
 	// TODO(nvanbenschoten): Can this be streamed from the planNode?
 	Rows *sqlbase.RowContainer
+	// PartialResults is set if the rows are only a best-effort result, because
+	// the query asked for the rows sorted within a time budget and it ran out
+	// (see distsqlrun.SorterSpec.PartialResultsAfterNanos).
+	PartialResults bool
 }
 
 // Close ensures that the resources claimed by the result are released.
@@ -1660,6 +1664,7 @@ func (e *Executor) execDistSQL(planner *planner, tree planNode, result *Result)
 	if recv.err != nil {
 		return recv.err
 	}
+	result.PartialResults = recv.partialResults
 	if result.Type == parser.RowsAffected {
 		result.RowsAffected = int(recv.numRows)
 	}
@@ -208,7 +208,8 @@ type MemoryMonitor struct {
 	// hit constraints on the owner monitor. This is useful to limit allocations
 	// when an owner monitor has a larger capacity than wanted but should still
 	// keep track of allocations made through this monitor. Note that child
-	// monitors are affected by this limit.
+	// monitors are affected by this limit. It can be changed with SetLimit,
+	// under mu, once the monitor is started.
 	limit int64
 
 	// pool specifies where to send requests to increase or decrease
@@ -546,6 +547,11 @@ func (b *BoundAccount) Grow(ctx context.Context, x int64) error {
 	return b.mon.GrowAccount(ctx, &b.MemoryAccount, x)
 }
 
+// Shrink is an accessor for b.mon.ShrinkAccount.
+func (b *BoundAccount) Shrink(ctx context.Context, delta int64) {
+	b.mon.ShrinkAccount(ctx, &b.MemoryAccount, delta)
+}
+
 // reserveMemory declares an allocation to this monitor. An error is
 // returned if the allocation is denied.
 func (mm *MemoryMonitor) reserveMemory(ctx context.Context, x int64) error {
@@ -670,6 +676,73 @@ func (mm *MemoryMonitor) adjustBudget(ctx context.Context) {
 	}
 }
 
+// Capacity returns the maximum number of bytes that can be allocated through
+// this monitor, taking into account its reserved budget, the capacity of its
+// pool and its own limit. The monitor must have been started.
+func (mm *MemoryMonitor) Capacity() int64 {
+	capacity := mm.reserved.curAllocated
+	if mm.pool != nil {
+		if poolCapacity := mm.pool.Capacity(); poolCapacity > math.MaxInt64-capacity {
+			capacity = math.MaxInt64
+		} else {
+			capacity += poolCapacity
+		}
+	}
+	mm.mu.Lock()
+	limit := mm.limit
+	mm.mu.Unlock()
+	if capacity > limit {
+		capacity = limit
+	}
+	return capacity
+}
+
+// Available returns the number of bytes that can currently be allocated
+// through this monitor: what remains of its own limit, bounded by its unused
+// budget and reserved bytes plus what is available in its pool. It is only an
+// estimate, since the pool's other clients can allocate concurrently.
+func (mm *MemoryMonitor) Available() int64 {
+	mm.mu.Lock()
+	available := mm.limit - mm.mu.curAllocated
+	unused := mm.mu.curBudget.curAllocated + mm.reserved.curAllocated - mm.mu.curAllocated
+	mm.mu.Unlock()
+	if mm.pool != nil {
+		if poolAvailable := mm.pool.Available(); poolAvailable > math.MaxInt64-unused {
+			unused = math.MaxInt64
+		} else {
+			unused += poolAvailable
+		}
+	}
+	if available > unused {
+		available = unused
+	}
+	if available < 0 {
+		available = 0
+	}
+	return available
+}
+
+// SetLimit changes the limit of the monitor (see MakeMonitorWithLimit); 0 or a
+// negative value removes it. Raising the limit doesn't reserve any memory from
+// the pool, whose own limits still apply. Lowering it below the current
+// allocations only denies the following ones.
+func (mm *MemoryMonitor) SetLimit(limit int64) {
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.limit = limit
+}
+
+// MaximumBytes returns the maximum number of bytes that were allocated by this
+// monitor at one time since it was started.
+func (mm *MemoryMonitor) MaximumBytes() int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.mu.maxAllocated
+}
+
 // GetCurrentAllocationForTesting returns the number of bytes that have
 // currently been allocated in the MemoryMonitor. Intended for use in testing.
 func (mm *MemoryMonitor) GetCurrentAllocationForTesting() int64 {
@@ -293,6 +293,9 @@ func TestMemoryMonitor(t *testing.T) {
 	if m.mu.maxAllocated != 100 {
 		t.Fatalf("incorrect max allocation: got %d, expected %d", m.mu.maxAllocated, 100)
 	}
+	if m.MaximumBytes() != 100 {
+		t.Fatalf("incorrect maximum bytes: got %d, expected %d", m.MaximumBytes(), 100)
+	}
 
 	m.releaseMemory(ctx, 10) // Should succeed without panic.
 	if m.mu.curAllocated != 0 {
@@ -302,13 +305,38 @@ func TestMemoryMonitor(t *testing.T) {
 	limitedMonitor := MakeMonitorWithLimit("testlimit", 10, nil, nil, 1, 1000)
 	limitedMonitor.Start(ctx, &m, BoundAccount{})
 
+	if c := m.Capacity(); c != 100 {
+		t.Fatalf("incorrect capacity: got %d, expected %d", c, 100)
+	}
+	if c := limitedMonitor.Capacity(); c != 10 {
+		t.Fatalf("incorrect limited capacity: got %d, expected %d", c, 10)
+	}
+
 	if err := limitedMonitor.reserveMemory(ctx, 10); err != nil {
 		t.Fatalf("limited monitor refused small allocation: %v", err)
 	}
 	if err := limitedMonitor.reserveMemory(ctx, 1); err == nil {
 		t.Fatal("limited monitor allowed allocation over limit")
 	}
-	limitedMonitor.releaseMemory(ctx, 10)
+	if a := limitedMonitor.Available(); a != 0 {
+		t.Fatalf("incorrect limited available bytes: got %d, expected %d", a, 0)
+	}
+
+	// Raising the limit allows more allocations, up to what the pool has left.
+	limitedMonitor.SetLimit(1000)
+	if a := limitedMonitor.Available(); a != 90 {
+		t.Fatalf("incorrect available bytes after raising the limit: got %d, expected %d", a, 90)
+	}
+	if err := limitedMonitor.reserveMemory(ctx, 90); err != nil {
+		t.Fatalf("limited monitor refused allocation under its raised limit: %v", err)
+	}
+	if err := limitedMonitor.reserveMemory(ctx, 1); err == nil {
+		t.Fatal("limited monitor allowed allocation over its pool's budget")
+	}
+	if a := m.Available(); a != 0 {
+		t.Fatalf("incorrect available bytes: got %d, expected %d", a, 0)
+	}
+	limitedMonitor.releaseMemory(ctx, 100)
 
 	limitedMonitor.Stop(ctx)
 	m.Stop(ctx)
@@ -1736,6 +1736,11 @@ type EvalContext struct {
 	// unqualified table name. Names in the search path are normalized already.
 	// This must not be modified (this is shared from the session).
 	SearchPath SearchPath
+	// ReverseSortColumns are the 1-based positions, in the output ordering of
+	// each distributed sorter, of the columns whose sort direction is reversed
+	// (see the reverse_sort_columns session variable). It is meant for
+	// debugging and is usually empty.
+	ReverseSortColumns []uint32
 	// Ctx represents the context in which the expression is evaluated. This will
 	// point to the Session's context container.
 	// NOTE: seems a bit lazy to hold a pointer to the session's context here,
@@ -207,6 +207,10 @@ type Session struct {
 	DistSQLMode DistSQLExecMode
 	// Location indicates the current time zone.
 	Location *time.Location
+	// ReverseSortColumns are the 1-based positions, in the output ordering of
+	// each distributed sorter, of the columns whose sort direction is reversed.
+	// It is only meant for debugging.
+	ReverseSortColumns []uint32
 	// SearchPath is a list of databases that will be searched for a table name
 	// before the database. Currently, this is used only for SELECTs.
 	// Names in the search path must have been normalized already.
@@ -627,6 +631,8 @@ func (s *Session) evalCtx() parser.EvalContext {
 		SearchPath: s.SearchPath,
 		Ctx:        s.Ctx,
 		Mon:        &s.TxnState.mon,
+
+		ReverseSortColumns: s.ReverseSortColumns,
 	}
 }
 
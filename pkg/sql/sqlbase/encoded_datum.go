@@ -19,6 +19,7 @@ package sqlbase
 import (
 	"bytes"
 	"fmt"
+	"unsafe"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
@@ -278,6 +279,31 @@ func (r EncDatumRow) String() string {
 	return b.String()
 }
 
+const (
+	sizeOfEncDatum    = unsafe.Sizeof(EncDatum{})
+	sizeOfEncDatumRow = unsafe.Sizeof(EncDatumRow{})
+)
+
+// Size returns a lower bound on the total size of the receiver in bytes,
+// including the memory taken up by its encoding and its decoded Datum.
+func (ed *EncDatum) Size() uintptr {
+	size := sizeOfEncDatum + uintptr(len(ed.encoded))
+	if ed.Datum != nil {
+		size += ed.Datum.Size()
+	}
+	return size
+}
+
+// Size returns a lower bound on the total size of the receiver in bytes,
+// including the memory taken up by its EncDatums.
+func (r EncDatumRow) Size() uintptr {
+	size := sizeOfEncDatumRow
+	for i := range r {
+		size += r[i].Size()
+	}
+	return size
+}
+
 // EncDatumRowToDatums converts a given EncDatumRow to a Datums.
 func EncDatumRowToDatums(datums parser.Datums, row EncDatumRow, da *DatumAlloc) error {
 	if len(row) != len(datums) {
@@ -313,6 +339,14 @@ func (r EncDatumRow) Compare(
 	a *DatumAlloc, ordering ColumnOrdering, evalCtx *parser.EvalContext, rhs EncDatumRow,
 ) (int, error) {
 	for _, c := range ordering {
+		if c.HasExplicitNullsOrder() {
+			if cmp, ok := c.CompareNulls(r[c.ColIdx].IsNull(), rhs[c.ColIdx].IsNull()); ok {
+				if cmp != 0 {
+					return cmp, nil
+				}
+				continue
+			}
+		}
 		cmp, err := r[c.ColIdx].Compare(a, evalCtx, &rhs[c.ColIdx])
 		if err != nil {
 			return 0, err
@@ -335,6 +369,14 @@ func (r EncDatumRow) CompareToDatums(
 		if err := r[c.ColIdx].EnsureDecoded(a); err != nil {
 			return 0, err
 		}
+		if cmp, ok := c.CompareNulls(
+			r[c.ColIdx].Datum == parser.DNull, rhs[c.ColIdx] == parser.DNull,
+		); ok {
+			if cmp != 0 {
+				return cmp, nil
+			}
+			continue
+		}
 		cmp := r[c.ColIdx].Datum.Compare(evalCtx, rhs[c.ColIdx])
 		if cmp != 0 {
 			if c.Direction == encoding.Descending {
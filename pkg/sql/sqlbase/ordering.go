@@ -21,11 +21,62 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 )
 
+// NullsOrder specifies where NULL values are placed in a column ordering.
+type NullsOrder int
+
+const (
+	// NullsDefault orders NULLs as smaller than any other value, i.e. first for
+	// an ascending ordering and last for a descending one.
+	NullsDefault NullsOrder = iota
+	// NullsFirst orders NULLs before any other value regardless of direction.
+	NullsFirst
+	// NullsLast orders NULLs after any other value regardless of direction.
+	NullsLast
+)
+
 // ColumnOrderInfo describes a column (as an index) and a desired order
 // direction.
 type ColumnOrderInfo struct {
 	ColIdx    int
 	Direction encoding.Direction
+	// NullsOrder specifies where NULLs are placed. The zero value keeps the
+	// default behavior where NULLs sort before any other value.
+	NullsOrder NullsOrder
+}
+
+// HasExplicitNullsOrder returns true if the NULL ordering of the column is
+// not implied by its direction (e.g. DESC NULLS FIRST).
+func (c ColumnOrderInfo) HasExplicitNullsOrder() bool {
+	switch c.NullsOrder {
+	case NullsFirst:
+		return c.Direction == encoding.Descending
+	case NullsLast:
+		return c.Direction == encoding.Ascending
+	}
+	return false
+}
+
+// CompareNulls compares two values of the column, given whether they are NULL,
+// when the column has an explicit NULL ordering (see HasExplicitNullsOrder)
+// and at least one of the values is NULL. In that case, the result of the
+// comparison (already taking the direction into account) is returned along
+// with true; otherwise the values should be compared normally and false is
+// returned.
+func (c ColumnOrderInfo) CompareNulls(lhsNull, rhsNull bool) (int, bool) {
+	if !(lhsNull || rhsNull) || !c.HasExplicitNullsOrder() {
+		return 0, false
+	}
+	if lhsNull && rhsNull {
+		return 0, true
+	}
+	cmp := -1
+	if rhsNull {
+		cmp = 1
+	}
+	if c.NullsOrder == NullsLast {
+		cmp = -cmp
+	}
+	return cmp, true
 }
 
 // ColumnOrdering is used to describe a desired column ordering. For example,
@@ -60,6 +111,12 @@ func CompareDatums(
 		// not sure this always holds as `CASE` expressions can return different
 		// types for a column for different rows. Investigate how other RDBMs
 		// handle this.
+		if cmp, ok := c.CompareNulls(lhs[c.ColIdx] == parser.DNull, rhs[c.ColIdx] == parser.DNull); ok {
+			if cmp != 0 {
+				return cmp
+			}
+			continue
+		}
 		if cmp := lhs[c.ColIdx].Compare(evalCtx, rhs[c.ColIdx]); cmp != 0 {
 			if c.Direction == encoding.Descending {
 				cmp = -cmp
@@ -63,6 +63,9 @@ type RowContainer struct {
 	// varSizedColumns indicates for which columns the datum size
 	// is variable.
 	varSizedColumns []int
+	// rowOverhead is the memory accounted for each row in addition to the
+	// size of its datums; see SetRowOverhead.
+	rowOverhead int64
 
 	// deletedRows is the number of rows that have been deleted from the front
 	// of the container. When this number reaches rowsPerChunk we delete that chunk
@@ -209,9 +212,20 @@ func (c *RowContainer) allocChunks(ctx context.Context, numChunks int) error {
 	return nil
 }
 
+// SetRowOverhead sets the memory, in bytes, accounted for each row in addition
+// to the size of its datums. It can be used to account for the memory that the
+// datums of a row use but which their sizes don't reflect (e.g. the rounding
+// up of their allocations). It must be called before any row is added.
+func (c *RowContainer) SetRowOverhead(rowOverhead int64) {
+	if c.numRows != 0 {
+		panic("row overhead set on a non-empty RowContainer")
+	}
+	c.rowOverhead = rowOverhead
+}
+
 // rowSize computes the size of a single row.
 func (c *RowContainer) rowSize(row parser.Datums) int64 {
-	rsz := c.fixedColsSize
+	rsz := c.fixedColsSize + c.rowOverhead
 	for _, i := range c.varSizedColumns {
 		rsz += int64(row[i].Size())
 	}
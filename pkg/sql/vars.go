@@ -16,7 +16,9 @@ package sql
 
 import (
 	"fmt"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -231,6 +233,51 @@ var varGen = map[string]sessionVar{
 		Get: func(session *Session) string { return fmt.Sprintf("%d", session.tables.leaseMgr.nodeID.Get()) },
 	},
 
+	`reverse_sort_columns`: {
+		// Only meant for debugging: reverses the sort direction of the columns
+		// at the given 1-based positions in the output ordering of each
+		// distributed sorter, without replanning.
+		Set: func(_ context.Context, session *Session, values []parser.TypedExpr) error {
+			evalCtx := session.evalCtx()
+			positions := make([]uint32, len(values))
+			for i, v := range values {
+				val, err := v.Eval(&evalCtx)
+				if err != nil {
+					return err
+				}
+				var pos int64
+				switch t := val.(type) {
+				case *parser.DInt:
+					pos = int64(*t)
+				case *parser.DString:
+					if pos, err = strconv.ParseInt(string(*t), 10, 64); err != nil {
+						return fmt.Errorf("set reverse_sort_columns: invalid position %s", t)
+					}
+				default:
+					return fmt.Errorf("set reverse_sort_columns: requires integer positions: %s is a %s",
+						v, val.ResolvedType())
+				}
+				if pos < 1 || pos > math.MaxUint32 {
+					return fmt.Errorf("set reverse_sort_columns: position %d out of range", pos)
+				}
+				positions[i] = uint32(pos)
+			}
+			session.ReverseSortColumns = positions
+			return nil
+		},
+		Get: func(session *Session) string {
+			positions := make([]string, len(session.ReverseSortColumns))
+			for i, pos := range session.ReverseSortColumns {
+				positions[i] = strconv.Itoa(int(pos))
+			}
+			return strings.Join(positions, ", ")
+		},
+		Reset: func(session *Session) error {
+			session.ReverseSortColumns = nil
+			return nil
+		},
+	},
+
 	`search_path`: {
 		Set: func(_ context.Context, session *Session, values []parser.TypedExpr) error {
 			// https://www.postgresql.org/docs/9.6/static/runtime-config-client.html